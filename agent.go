@@ -1,195 +1,407 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/charmbracelet/log"
-	"golang.org/x/net/html"
+	"net/mail"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"google.golang.org/api/gmail/v1"
 )
 
-var (
-	dailyTemplate   string
-	weeklyTemplate  string
-	summaryTemplate string
-	emailTemplate   string
-	userContext     string
-	openAIClient    *openai.Client
-)
+// Templates are the prompts, loaded from the templates directory, plus the user's own context
+type Templates struct {
+	Daily         string
+	Weekly        string
+	Topic         string
+	Rollup        string
+	Nudge         string
+	Summary       string
+	Email         string
+	EmailNotes    string
+	DigestEntries string
+	Ask           string
+	Recruiting    string
+	Bills         string
+	Travel        string
+	MailingLists  string
+	Person        string
+	Phishing      string
+	UserContext   string
+}
 
-func dailySummary(messages []*gmail.Message) (string, error) {
-	scratchpad := "# Daily Summary:\n\n"
+// files are the template files by name, pointing at the field each is loaded into
+func (t *Templates) files() map[string]*string {
+	return map[string]*string{
+		"daily_summary_prompt.tmpl":         &t.Daily,
+		"weekly_summary_prompt.tmpl":        &t.Weekly,
+		"scratchpad_to_summary_prompt.tmpl": &t.Summary,
+		"email_prompt.tmpl":                 &t.Email,
+		"email_notes_prompt.tmpl":           &t.EmailNotes,
+		"topic_summary_prompt.tmpl":         &t.Topic,
+		"rollup_summary_prompt.tmpl":        &t.Rollup,
+		"nudge_prompt.tmpl":                 &t.Nudge,
+		"digest_entries_prompt.tmpl":        &t.DigestEntries,
+		"ask_prompt.tmpl":                   &t.Ask,
+		"recruiting_prompt.tmpl":            &t.Recruiting,
+		"bills_prompt.tmpl":                 &t.Bills,
+		"travel_prompt.tmpl":                &t.Travel,
+		"mailing_lists_prompt.tmpl":         &t.MailingLists,
+		"person_prompt.tmpl":                &t.Person,
+		"phishing_prompt.tmpl":              &t.Phishing,
+	}
+}
 
-	for _, message := range messages {
-		from := extractHeader(message, "From")
-		to := extractHeader(message, "To")
-		subject := extractHeader(message, "Subject")
-		date := extractHeader(message, "Date")
-		body := extractBody(message)
+// loadTemplates reads the prompt templates, preferring the profile's own in dir over the shared ones
+func loadTemplates(dir string) (*Templates, error) {
+	var t Templates
+	var err error
 
-		systemPrompt := formatTemplate(dailyTemplate, scratchpad)
-		userPrompt := formatEmailTemplate(emailTemplate, from, to, subject, date, body)
-		updatedScratchpad, err := callOpenAI([]openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: systemPrompt,
-			},
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: userPrompt,
-			},
-		})
-		if err != nil {
-			return "", err
+	for name, field := range t.files() {
+		if *field, err = loadTemplate(dir, name); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", name, err)
+		}
+		// parsed here only to catch mistakes at startup, they're parsed again in the user's timezone when rendered
+		if _, err := parsePrompt(name, *field, time.Local); err != nil {
+			return nil, fmt.Errorf("invalid template %s: %w", name, err)
 		}
-		scratchpad = updatedScratchpad
 	}
 
-	log.Debug("Email data collection complete:", "scratchpad", scratchpad)
+	t.UserContext, err = loadUserContext(dir)
+	if err != nil {
+		return nil, fmt.Errorf("loading user context: %w", err)
+	}
 
-	return convertScratchpadToHTML(scratchpad)
+	return &t, nil
 }
 
-func weeklySummary(messages []*gmail.Message) (string, error) {
-	scratchpad := "# Weekly Summary\n\n"
-
-	for _, message := range messages {
-		from := extractHeader(message, "From")
-		to := extractHeader(message, "To")
-		subject := extractHeader(message, "Subject")
-		date := extractHeader(message, "Date")
-		body := extractBody(message)
+// openAISummarizer builds digests from notes on each email, one chat completion per email, folded into a scratchpad
+// by the digest's own prompt
+type openAISummarizer struct {
+	client *openai.Client
+	// templates are swapped whole when a prompt is rolled back
+	templates      *atomic.Pointer[Templates]
+	state          *stateStore
+	clock          Clock
+	extractEntries bool
+	gmailAccount   int // gmailAccount is the /u/ index of the account in Gmail links
+	imageDetail    openai.ImageURLDetail
+	locale         string // locale writes the dates of the digests the bot adds itself
+	// categories are the user's own, the model picks its own when there are none
+	categories []CategoryConfig
+	// racer is the second provider for the final summary, nil unless racing is configured
+	racer *racer
+	// redis holds the summary cache when the replicas share it, nil keeps it in the state
+	redis *redisClient
+}
 
-		systemPrompt := formatTemplate(weeklyTemplate, scratchpad)
-		userPrompt := formatEmailTemplate(emailTemplate, from, to, subject, date, body)
-		updatedScratchpad, err := callOpenAI([]openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: systemPrompt,
-			},
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: userPrompt,
-			},
-		})
-		if err != nil {
-			return "", err
-		}
-		scratchpad = updatedScratchpad
+func (s *openAISummarizer) Summarize(ctx context.Context, kind string, messages []*gmail.Message) (*Digest, error) {
+	switch kind {
+	case "daily":
+		return s.summarize(ctx, kind, "# Daily Summary:\n\n", s.templates.Load().Daily, nil, messages)
+	case "mini":
+		// a mini digest is a daily digest of a few hours
+		return s.summarize(ctx, kind, "# Summary So Far:\n\n", s.templates.Load().Daily, nil, messages)
+	case "weekly":
+		return s.summarize(ctx, kind, "# Weekly Summary\n\n", s.templates.Load().Weekly, nil, messages)
+	default:
+		return nil, fmt.Errorf("unknown digest kind %q", kind)
 	}
+}
 
-	log.Debug("Email data collection complete:", "scratchpad", scratchpad)
-
-	return convertScratchpadToHTML(scratchpad)
+func (s *openAISummarizer) SummarizeTopic(ctx context.Context, topic string, messages []*gmail.Message) (*Digest, error) {
+	return s.summarize(ctx, "topic", "# Digest: "+topic+"\n\n", s.templates.Load().Topic, map[string]any{"topic": topic}, messages)
 }
 
-func convertScratchpadToHTML(scratchpad string) (string, error) {
-	prompt := strings.ReplaceAll(summaryTemplate, "{{scratchpad}}", scratchpad)
-	prompt = strings.ReplaceAll(prompt, "{{context}}", userContext)
-	return callOpenAI([]openai.ChatCompletionMessage{
+// SummarizeRollup writes a rollup from the period's digests in a single call, there are no emails to fold in
+func (s *openAISummarizer) SummarizeRollup(ctx context.Context, rollup *Rollup) (*Digest, error) {
+	var sb strings.Builder
+	for _, digest := range rollup.Digests {
+		fmt.Fprintf(&sb, "## %s digest, %s (%d emails)\n%s\n\n", digest.Kind, digest.GeneratedAt.Format("Mon 2 Jan 2006"), digest.EmailCount, digest.Summary)
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().Rollup, map[string]any{
+		"digests": sb.String(),
+		"stats":   rollup.Stats(),
+		"kind":    rollup.Kind,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := s.callOpenAI(ctx, []openai.ChatCompletionMessage{
 		{
 			Role:    openai.ChatMessageRoleSystem,
 			Content: prompt,
 		},
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.clock.Now()
+	id, ok := digestIDFromContext(ctx)
+	if !ok {
+		profile, _ := ctx.Value(profileKey{}).(string)
+		id = oneOffDigestID(profile, rollup.Kind, now)
+	}
+	return &Digest{
+		ID:          id,
+		Kind:        rollup.Kind,
+		GeneratedAt: now,
+		EmailCount:  rollup.EmailCount,
+		Summary:     summary,
+		Categories:  rollup.Categories,
+		Prompts:     s.templates.Load().hashes("rollup_summary_prompt.tmpl"),
+	}, nil
 }
 
-func extractHeader(message *gmail.Message, headerName string) string {
-	for _, header := range message.Payload.Headers {
-		if header.Name == headerName {
-			return header.Value
-		}
+func (s *openAISummarizer) DraftNudge(ctx context.Context, reply AwaitingReply) (string, error) {
+	waiting := pluralize(int(s.clock.Now().Sub(reply.SentAt).Hours()/24), "day")
+	systemPrompt, err := s.renderPrompt(s.templates.Load().Nudge, map[string]any{"waiting": waiting})
+	if err != nil {
+		return "", err
 	}
-	return ""
+	userPrompt, err := s.renderPrompt(s.templates.Load().Email, map[string]any{
+		"from":    "the user",
+		"to":      reply.To,
+		"subject": reply.Subject,
+		"date":    reply.SentAt.In(s.clock.Now().Location()).Format("Mon, 2 Jan 2006 15:04 MST"),
+		"time":    reply.SentAt,
+		"body":    reply.Snippet,
+		"headers": map[string]string{"To": reply.To, "Subject": reply.Subject},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return s.callOpenAI(ctx, []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: systemPrompt,
+		},
+		{
+			Role:    openai.ChatMessageRoleUser,
+			Content: userPrompt,
+		},
+	})
 }
 
-func extractBody(message *gmail.Message) string {
-	var body string
+// summarize writes notes on each email on its own, then has the digest template fold them all into the scratchpad in
+// one call, and renders the result. the notes don't depend on the digest or on the emails around them, so they're what
+// the summary cache keeps. vars are extra values for the digest template, like the topic
+func (s *openAISummarizer) summarize(ctx context.Context, kind, scratchpad, template string, vars map[string]any, messages []*gmail.Message) (*Digest, error) {
+	logger := log.FromContext(ctx)
+	prompts := emailPromptsFromContext(ctx)
+	images := emailImagesFromContext(ctx)
+	known := knownThreadsFromContext(ctx)
+	templates := s.templates.Load()
 
-	// Attempt to extract text from all parts of the email
-	for _, part := range message.Payload.Parts {
-		// Handle text/plain parts
-		if part.MimeType == "text/plain" && part.Body.Data != "" {
-			bodyBytes, err := base64.URLEncoding.DecodeString(part.Body.Data)
-			if err != nil {
-				log.Error("Error decoding text/plain part", "error", err)
-				continue
-			}
-			body += string(bodyBytes) + "\n"
+	notesPrompt, err := s.renderPrompt(templates.EmailNotes, map[string]any{})
+	if err != nil {
+		return nil, err
+	}
+
+	var unsummarized []*gmail.Message
+	var notes strings.Builder
+	// fresh are the notes written by this digest, cached together once they're all in
+	fresh := make(map[string]string)
+	for i, message := range messages {
+		reportProgress(ctx, ProgressEvent{Kind: kind, Stage: "summarizing", Done: i, Total: len(messages)})
+		logger.Debug("Summarizing email", "message_id", message.Id)
+
+		body := extractBody(message)
+		override := prompts[message.Id]
+		if override.condensed && len(body) > condensedBodyLength {
+			body = strings.ToValidUTF8(body[:condensedBodyLength], "") + "…"
+		}
+
+		emailTemplate := templates.Email
+		if override.template != "" {
+			emailTemplate = override.template
+		}
+		userPrompt, err := s.renderPrompt(emailTemplate, emailPromptData(message, body, s.clock.Now().Location()))
+		if err != nil {
+			return nil, err
+		}
+		if override.instructions != "" {
+			userPrompt += "\n\n# Instructions For This Email\n" + override.instructions
+		}
+		if memory, ok := known[message.ThreadId]; ok {
+			userPrompt += "\n\n" + knownThreadPrompt(memory, s.clock.Now().Location())
+		}
+		if examples := s.state.examplesFor(message, override.examples); len(examples) > 0 && !override.condensed {
+			userPrompt += "\n\n" + examplesPrompt(examples)
+		}
+		if override.condensed {
+			userPrompt += "\n\n# Budget\n" + condensedInstructions
+		}
+		userMessage := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: userPrompt}
+		if emailImages := images[message.Id]; len(emailImages) > 0 {
+			userMessage = imageMessage(userPrompt+"\n\nThe email's images are attached, read them as part of its body.", emailImages, s.imageDetail)
+		}
+		req := openai.ChatCompletionRequest{
+			Model: openai.GPT4o,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: notesPrompt,
+				},
+				userMessage,
+			},
 		}
 
-		// Handle text/html parts
-		if part.MimeType == "text/html" && part.Body.Data != "" {
-			bodyBytes, err := base64.URLEncoding.DecodeString(part.Body.Data)
+		key := summaryCacheKey(message.Id, req)
+		emailNotes, ok := s.cachedSummary(ctx, key)
+		if ok {
+			logger.Debug("Reusing the cached notes on the email", "message_id", message.Id)
+		} else {
+			emailNotes, err = s.createChatCompletion(ctx, req)
 			if err != nil {
-				log.Error("Error decoding text/html part", "error", err)
-				continue
+				if i == 0 || ctx.Err() != nil {
+					s.cacheSummaries(ctx, fresh)
+					return nil, err
+				}
+				// the emails read so far are still worth sending, the rest go in a follow-up
+				logger.Error("Unable to summarize the email, finishing the digest without the rest", "message_id", message.Id, "summarized", i, "left", len(messages)-i, "error", err)
+				unsummarized = messages[i:]
+				break
 			}
-
-			// Convert HTML to plain text
-			htmlText := string(bodyBytes)
-			body += htmlToText(htmlText) + "\n"
+			fresh[key] = emailNotes
+		}
+		if strings.TrimSpace(emailNotes) == "[NOTHING]" {
+			continue
 		}
+		fmt.Fprintf(&notes, "## %s, from %s\n%s\n\n", extractHeader(message, "Subject"), extractHeader(message, "From"), strings.TrimSpace(emailNotes))
 	}
+	// written before the notes are folded, so a digest that fails from here on doesn't pay for them again
+	s.cacheSummaries(ctx, fresh)
 
-	if body == "" && message.Payload.Body.Data != "" {
-		// Fallback to directly reading the body if it's present (e.g., for simple emails)
-		bodyBytes, err := base64.URLEncoding.DecodeString(message.Payload.Body.Data)
+	if notes.Len() > 0 {
+		data := map[string]any{"scratchpad": scratchpad}
+		for name, value := range vars {
+			data[name] = value
+		}
+		systemPrompt, err := s.renderPrompt(template, data)
 		if err != nil {
-			log.Error("Error decoding body", "error", err)
-			return ""
+			return nil, err
+		}
+		if scratchpad, err = s.callOpenAI(ctx, []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: systemPrompt,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "# Notes On The Emails\n\n" + notes.String(),
+			},
+		}); err != nil {
+			return nil, err
 		}
-		body = string(bodyBytes)
 	}
 
-	log.Debug("Extracted email body", "body", body)
-	return body
-}
+	logger.Debug("Email data collection complete:", "scratchpad", scratchpad)
 
-// htmlToText strips HTML tags and returns the plain text
-func htmlToText(htmlContent string) string {
-	doc, err := html.Parse(strings.NewReader(htmlContent))
+	digest, err := s.buildDigest(ctx, kind, scratchpad, messages[:len(messages)-len(unsummarized)])
 	if err != nil {
-		log.Error("Error parsing HTML", "error", err)
-		return ""
+		return nil, err
 	}
-	return renderNode(doc)
+	digest.Unsummarized = unsummarized
+	return digest, nil
 }
 
-func renderNode(n *html.Node) string {
-	if n.Type == html.TextNode {
-		return n.Data
+func (s *openAISummarizer) convertScratchpadToHTML(ctx context.Context, scratchpad string) (string, error) {
+	prompt, err := s.renderPrompt(s.templates.Load().Summary, map[string]any{"scratchpad": scratchpad})
+	if err != nil {
+		return "", err
+	}
+	if style, ok := digestStyles[digestStyleFromContext(ctx)]; ok {
+		prompt += "\n\n# Style\n" + style
 	}
-	if n.Type != html.ElementNode {
-		return ""
+	if skipped := roundupFromContext(ctx); len(skipped) > 0 {
+		prompt += "\n\n# Roundup\n" + roundupInstructions(localeOf(s.locale), skipped)
+	}
+	if len(knownThreadsFromContext(ctx)) > 0 {
+		prompt += "\n\n# What Changed\n" + whatChangedInstructions
 	}
 
-	var sb strings.Builder
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		sb.WriteString(renderNode(c))
+	// the one call the user waits on with nothing to show, so it's the one worth racing
+	return s.raceChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: openai.GPT4o,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: prompt,
+			},
+		},
+	})
+}
+
+func (s *openAISummarizer) callOpenAI(ctx context.Context, messages []openai.ChatCompletionMessage) (string, error) {
+	return s.createChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:    openai.GPT4o,
+		Messages: messages,
+	})
+}
+
+// callOpenAIJSON is callOpenAI with the response constrained to a JSON object
+func (s *openAISummarizer) callOpenAIJSON(ctx context.Context, messages []openai.ChatCompletionMessage) (string, error) {
+	return s.createChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:    openai.GPT4o,
+		Messages: messages,
+		ResponseFormat: &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+		},
+	})
+}
+
+func (s *openAISummarizer) createChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (string, error) {
+	resp, err := s.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("ChatCompletion error: %v", err)
 	}
+	recordUsage(resp.Usage)
+	if len(resp.Choices) == 0 {
+		return "", errors.New("ChatCompletion returned no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
 
-	// Preserve some basic block elements like paragraphs with line breaks
-	if n.Data == "p" || n.Data == "br" {
-		sb.WriteString("\n")
+func extractHeader(message *gmail.Message, headerName string) string {
+	for _, header := range message.Payload.Headers {
+		if header.Name == headerName {
+			return header.Value
+		}
 	}
+	return ""
+}
 
-	return sb.String()
+// extractHeaderFold is extractHeader for the headers senders spell differently, like List-Id and List-ID
+func extractHeaderFold(message *gmail.Message, headerName string) string {
+	for _, header := range message.Payload.Headers {
+		if strings.EqualFold(header.Name, headerName) {
+			return header.Value
+		}
+	}
+	return ""
 }
 
-func formatTemplate(template, scratchpad string) string {
-	prompt := strings.ReplaceAll(template, "{{scratchpad}}", scratchpad)
-	prompt = strings.ReplaceAll(prompt, "{{context}}", userContext)
-	return prompt
+// localDate rewrites an email's Date header in the configured timezone, so the model doesn't put mail on the wrong day
+func localDate(header string, location *time.Location) string {
+	t, err := mail.ParseDate(header)
+	if err != nil {
+		return header
+	}
+	return t.In(location).Format("Mon, 2 Jan 2006 15:04 MST")
 }
 
-func formatEmailTemplate(template, from, to, subject, date, body string) string {
-	prompt := strings.ReplaceAll(template, "{{from}}", from)
-	prompt = strings.ReplaceAll(prompt, "{{to}}", to)
-	prompt = strings.ReplaceAll(prompt, "{{subject}}", subject)
-	prompt = strings.ReplaceAll(prompt, "{{date}}", date)
-	prompt = strings.ReplaceAll(prompt, "{{body}}", body)
-	return prompt
+// extractBody is the text of an email, see readBody. what couldn't be read is listed in the digest by
+// bodyProblemSection
+func extractBody(message *gmail.Message) string {
+	return readBody(message).text
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// anomalyBaselineDays is how far back the usual volume is worked out from
+	anomalyBaselineDays = 28
+	// minAnomalyBaselineDays is how many days of history there have to be before anything is called unusual
+	minAnomalyBaselineDays = 7
+	// defaultAnomalySensitivity is how many standard deviations over the usual a flood is when the config doesn't say
+	defaultAnomalySensitivity = 4
+	// defaultAnomalyMinEmails is the fewest emails a flood can be when the config doesn't say
+	defaultAnomalyMinEmails = 10
+	// silenceMinDaily and silenceMinDays make a sender busy enough for its silence to be news: at least this many
+	// emails on an average day, and some on nearly every day
+	silenceMinDaily = 3
+	silenceMinDays  = 0.9
+)
+
+type VolumeAlertsConfig struct {
+	// ChannelID is where the alerts go, the daily channel by default
+	ChannelID string `json:"channel_id"`
+	// Sensitivity is how many standard deviations over a sender's usual day a flood is
+	Sensitivity float64 `json:"sensitivity"`
+	// MinEmails is the fewest emails from one sender, or in one category, that can be a flood
+	MinEmails int `json:"min_emails"`
+	// Ignore are the senders whose volume is nobody's business, by name or address
+	Ignore []string `json:"ignore"`
+	// SMS texts the alerts too, when twilio is set up
+	SMS bool `json:"sms"`
+}
+
+// volumeAnomaly is a sender or category that's far off its usual volume today
+type volumeAnomaly struct {
+	// kind is "flood" or "silence"
+	kind string
+	// of is "sender" or "category"
+	of    string
+	name  string
+	count int
+	usual float64
+}
+
+// key identifies the anomaly for the day, so it's only alerted about once
+func (v volumeAnomaly) key(date string) string {
+	return strings.Join([]string{date, v.kind, v.of, v.name}, ":")
+}
+
+func (v volumeAnomaly) String() string {
+	name := v.name
+	if v.of == "category" {
+		name = "emails in " + v.name
+	}
+	if v.kind == "silence" {
+		return fmt.Sprintf("🔇 **%s**: nothing today, usually about %.0f a day. whatever sends them may be down.", name, v.usual)
+	}
+	return fmt.Sprintf("📈 **%s**: %d today, usually about %.0f a day. a flood like this can mean an outage or a compromised account.", name, v.count, v.usual)
+}
+
+// volumeBaseline is the mean and standard deviation of daily counts, and the share of days with any
+type volumeBaseline struct {
+	mean, stddev, active float64
+}
+
+// volumeBaselines works out the usual day of each key from the days before today. a key missing from a day counts as
+// zero that day
+func volumeBaselines(days []VolumeDay, counts func(VolumeDay) map[string]int) map[string]volumeBaseline {
+	keys := make(map[string]bool)
+	for _, day := range days {
+		for key := range counts(day) {
+			keys[key] = true
+		}
+	}
+	baselines := make(map[string]volumeBaseline, len(keys))
+	n := float64(len(days))
+	for key := range keys {
+		var sum, sumSquares, active float64
+		for _, day := range days {
+			count := float64(counts(day)[key])
+			sum += count
+			sumSquares += count * count
+			if count > 0 {
+				active++
+			}
+		}
+		mean := sum / n
+		baselines[key] = volumeBaseline{
+			mean:   mean,
+			stddev: math.Sqrt(max(sumSquares/n-mean*mean, 0)),
+			active: active / n,
+		}
+	}
+	return baselines
+}
+
+// detectVolumeAnomalies compares today's counts with their baselines. silences are only looked for at the end of the
+// day, a sender that hasn't sent anything by noon may yet
+func detectVolumeAnomalies(of string, today map[string]int, baselines map[string]volumeBaseline, config VolumeAlertsConfig, endOfDay bool) []volumeAnomaly {
+	sensitivity := config.Sensitivity
+	if sensitivity <= 0 {
+		sensitivity = defaultAnomalySensitivity
+	}
+	minEmails := config.MinEmails
+	if minEmails <= 0 {
+		minEmails = defaultAnomalyMinEmails
+	}
+
+	var anomalies []volumeAnomaly
+	for _, name := range sortedKeys(today) {
+		count, usual := today[name], baselines[name]
+		// three times the usual at least, so a sender that never varies isn't a flood at one email over
+		threshold := max(float64(minEmails), usual.mean+sensitivity*usual.stddev, 3*usual.mean)
+		if float64(count) >= threshold {
+			anomalies = append(anomalies, volumeAnomaly{kind: "flood", of: of, name: name, count: count, usual: usual.mean})
+		}
+	}
+	if endOfDay {
+		for _, name := range sortedKeys(baselines) {
+			usual := baselines[name]
+			if today[name] == 0 && usual.mean >= silenceMinDaily && usual.active >= silenceMinDays {
+				anomalies = append(anomalies, volumeAnomaly{kind: "silence", of: of, name: name, usual: usual.mean})
+			}
+		}
+	}
+	return anomalies
+}
+
+// checkVolumeAnomalies alerts about the senders and categories far off their usual volume today, once each. it runs
+// after a digest records its emails, endOfDay after the daily one. days without a digest aren't in the history, so
+// they don't count as quiet ones
+func (a *App) checkVolumeAnomalies(ctx context.Context, endOfDay bool) {
+	config := a.Config.VolumeAlerts
+	if config == nil {
+		return
+	}
+	logger := log.FromContext(ctx)
+	date := a.Clock.Now().Format(time.DateOnly)
+
+	var today *VolumeDay
+	var history []VolumeDay
+	var alerted map[string]time.Time
+	a.state.read(func(s *State) {
+		account := s.account()
+		for _, day := range account.Volume {
+			switch {
+			case day.Date == date:
+				today = &VolumeDay{Date: day.Date, Senders: maps.Clone(day.Senders), Categories: maps.Clone(day.Categories)}
+			case day.Date < date:
+				history = append(history, day)
+			}
+		}
+		alerted = maps.Clone(account.VolumeAlerted)
+	})
+	if today == nil || len(history) < minAnomalyBaselineDays {
+		return
+	}
+	history = history[max(len(history)-anomalyBaselineDays, 0):]
+
+	ignored := func(name string) bool {
+		return slices.ContainsFunc(config.Ignore, func(ignore string) bool { return strings.EqualFold(ignore, name) })
+	}
+	senders := make(map[string]int)
+	for name, n := range today.Senders {
+		if !ignored(name) {
+			senders[name] = n
+		}
+	}
+	senderBaselines := volumeBaselines(history, func(day VolumeDay) map[string]int { return day.Senders })
+	for name := range senderBaselines {
+		if ignored(name) {
+			delete(senderBaselines, name)
+		}
+	}
+	anomalies := detectVolumeAnomalies("sender", senders, senderBaselines, *config, endOfDay)
+	// categories are only known when digest entries are extracted, there's no telling a silent one from that
+	anomalies = append(anomalies, detectVolumeAnomalies("category", today.Categories,
+		volumeBaselines(history, func(day VolumeDay) map[string]int { return day.Categories }), *config, false)...)
+
+	channelID := config.ChannelID
+	if channelID == "" {
+		channelID = a.dailyChannel()
+	}
+	var sent []string
+	for _, anomaly := range anomalies {
+		key := anomaly.key(date)
+		if _, ok := alerted[key]; ok {
+			continue
+		}
+		if err := a.sendToDiscord(channelID, anomaly.String()); err != nil {
+			logger.Error("Unable to send volume alert", "name", anomaly.name, "error", err)
+			continue
+		}
+		if config.SMS {
+			a.sendSMSAlert(strings.ReplaceAll(anomaly.String(), "**", ""))
+		}
+		logger.Info("Volume alert sent", "kind", anomaly.kind, "of", anomaly.of, "name", anomaly.name, "count", anomaly.count, "usual", anomaly.usual)
+		sent = append(sent, key)
+	}
+	if len(sent) == 0 {
+		return
+	}
+
+	now := a.Clock.Now()
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		if account.VolumeAlerted == nil {
+			account.VolumeAlerted = make(map[string]time.Time)
+		}
+		// a day's alerts only need remembering for the day
+		for key, at := range account.VolumeAlerted {
+			if now.Sub(at) > 48*time.Hour {
+				delete(account.VolumeAlerted, key)
+			}
+		}
+		for _, key := range sent {
+			account.VolumeAlerted[key] = now
+		}
+	}); err != nil {
+		logger.Error("Unable to record the volume alerts sent", "error", err)
+	}
+}
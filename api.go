@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"scheduler"
+)
+
+type APIConfig struct {
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+var startTime = time.Now()
+
+// the API server's limits, so a slow or idle client can't hold a connection open. there's no write timeout, since
+// summarize-now answers once the digest is written
+const (
+	apiReadHeaderTimeout = 10 * time.Second
+	apiReadTimeout       = 30 * time.Second
+	apiIdleTimeout       = 2 * time.Minute
+	// apiShutdownTimeout is how long the requests in flight get to finish once the scheduler stops
+	apiShutdownTimeout = 30 * time.Second
+)
+
+// servers are the API servers still shutting down, for the daemon to wait on before it exits
+var servers sync.WaitGroup
+
+func startAPIServer(a *App, config APIConfig, s *scheduler.Scheduler) {
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, a, config, s)
+	if err := registerDashboard(mux); err != nil {
+		log.Error("Dashboard unavailable", "error", err)
+	}
+	srv := &http.Server{
+		Addr:              config.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		ReadTimeout:       apiReadTimeout,
+		IdleTimeout:       apiIdleTimeout,
+	}
+
+	log.Info("API server listening", "addr", config.Listen)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("API server stopped", "error", err)
+		}
+	}()
+
+	// the API queues tasks on the scheduler, so it goes down with it
+	servers.Add(1)
+	go func() {
+		defer servers.Done()
+		<-s.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error("API server didn't shut down cleanly", "addr", config.Listen, "error", err)
+		}
+	}()
+}
+
+func registerAPIRoutes(mux *http.ServeMux, a *App, config APIConfig, s *scheduler.Scheduler) {
+	auth := func(h http.HandlerFunc) http.Handler {
+		return requireToken(config.Token, h)
+	}
+
+	mux.Handle("GET /api/digests", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleListDigests(w, r, a)
+	}))
+	mux.Handle("GET /api/digest/latest", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleLatestDigest(w, r, a)
+	}))
+	mux.Handle("GET /api/digest/{id}", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleGetDigest(w, r, a)
+	}))
+	mux.Handle("POST /api/summarize-now", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleSummarizeNow(w, r, a, s)
+	}))
+	mux.Handle("GET /api/status", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleStatus(w, r, a)
+	}))
+	mux.Handle("GET /api/archive/verify", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleVerifyArchive(w, r, a)
+	}))
+	mux.Handle("GET /api/travel.ics", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleTravelICS(w, r, a)
+	}))
+	mux.Handle("GET /api/tasks", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleListTasks(w, r, a, s)
+	}))
+	mux.Handle("POST /api/tasks/{id}/run", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleRunTask(w, r, a, s)
+	}))
+	mux.Handle("POST /api/tasks/{id}/reschedule", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleRescheduleTask(w, r, a, s)
+	}))
+	mux.Handle("GET /api/errors", auth(func(w http.ResponseWriter, r *http.Request) {
+		handleListErrors(w, r, a)
+	}))
+}
+
+// requireToken rejects requests that don't carry "Authorization: Bearer <token>"
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing API token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleListDigests(w http.ResponseWriter, r *http.Request, a *App) {
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	digests := a.state.recentDigests(r.URL.Query().Get("kind"), limit)
+	if digests == nil {
+		digests = []*Digest{}
+	}
+	writeJSON(w, http.StatusOK, digests)
+}
+
+func handleLatestDigest(w http.ResponseWriter, r *http.Request, a *App) {
+	digests := a.state.recentDigests(r.URL.Query().Get("kind"), 1)
+	if len(digests) == 0 {
+		writeJSONError(w, http.StatusNotFound, "no digests yet")
+		return
+	}
+	writeDigest(w, r, digests[0])
+}
+
+func handleGetDigest(w http.ResponseWriter, r *http.Request, a *App) {
+	digest := a.state.findDigest(r.PathValue("id"))
+	if digest == nil {
+		writeJSONError(w, http.StatusNotFound, "digest not found")
+		return
+	}
+	writeDigest(w, r, digest)
+}
+
+// digestContentTypes are the content types of the digest formats the API serves, by format
+var digestContentTypes = map[string]string{
+	"markdown": "text/markdown; charset=utf-8",
+	"discord":  "text/markdown; charset=utf-8",
+	"html":     "text/html; charset=utf-8",
+	"text":     "text/plain; charset=utf-8",
+}
+
+// writeDigest responds with the digest as JSON, or rendered in the format of the format query parameter
+func writeDigest(w http.ResponseWriter, r *http.Request, digest *Digest) {
+	format := r.URL.Query().Get("format")
+	if format == "" || format == "json" {
+		writeJSON(w, http.StatusOK, digest)
+		return
+	}
+
+	rendered, err := renderDigest(digest, format)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", digestContentTypes[format])
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, rendered); err != nil {
+		log.Error("Failed to write API response", "error", err)
+	}
+}
+
+func handleVerifyArchive(w http.ResponseWriter, r *http.Request, a *App) {
+	writeJSON(w, http.StatusOK, a.state.verifyArchive(nil))
+}
+
+func handleTravelICS(w http.ResponseWriter, r *http.Request, a *App) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="trips.ics"`)
+	if err := a.writeTravelICS(w); err != nil {
+		log.Error("Unable to write the travel calendar", "error", err)
+	}
+}
+
+func handleSummarizeNow(w http.ResponseWriter, r *http.Request, a *App, s *scheduler.Scheduler) {
+	var id uint64
+	var err error
+	switch kind := r.URL.Query().Get("kind"); kind {
+	case "", "daily":
+		id, err = s.Add(createTask(a.taskName("Daily summary (API)"), a.summarizeNow("daily")).Once().GlobalBlocking())
+	case "weekly":
+		id, err = s.Add(createTask(a.taskName("Weekly summary (API)"), a.summarizeNow("weekly")).Once().GlobalBlocking())
+	default:
+		writeJSONError(w, http.StatusBadRequest, "kind must be daily or weekly")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]any{"task_id": id})
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request, a *App) {
+	status := map[string]any{
+		"uptime_seconds": int(time.Since(startTime).Seconds()),
+		"notifiers":      len(a.Notifiers),
+		"usage":          currentUsage(),
+	}
+	a.state.read(func(s *State) {
+		account := s.account()
+		status["last_fetch"] = account.LastFetch
+		status["weekly_queue_size"] = len(account.WeeklyQueue)
+		status["oauth_token_exists"] = account.Token != nil
+		status["archived_digests"] = len(s.Digests)
+	})
+	writeJSON(w, http.StatusOK, status)
+}
+
+// apiTask is a scheduled task as the API lists it
+type apiTask struct {
+	scheduledTask
+	// NextRun is when the scheduler runs the task next, missing when it won't again
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+// handleListTasks lists the profile's scheduled tasks, the other profiles' tasks are their own API's
+func handleListTasks(w http.ResponseWriter, r *http.Request, a *App, s *scheduler.Scheduler) {
+	tasks := []apiTask{}
+	for _, task := range a.tasks() {
+		listed := apiTask{scheduledTask: task}
+		if next, ok := s.NextRun(task.ID); ok {
+			listed.NextRun = &next
+		}
+		tasks = append(tasks, listed)
+	}
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// requestedTask is the profile's scheduled task the request's path names, or false once it has responded with why
+// there isn't one
+func requestedTask(w http.ResponseWriter, r *http.Request, a *App) (scheduledTask, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid task id")
+		return scheduledTask{}, false
+	}
+	for _, task := range a.tasks() {
+		if task.ID == id {
+			return task, true
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "task not found")
+	return scheduledTask{}, false
+}
+
+// handleRunTask runs one of the profile's scheduled tasks right now, without touching its regular schedule
+func handleRunTask(w http.ResponseWriter, r *http.Request, a *App, s *scheduler.Scheduler) {
+	task, ok := requestedTask(w, r, a)
+	if !ok {
+		return
+	}
+	runID, err := s.Add(createTask(task.Name+" (API)", task.fn).Once().GlobalBlocking())
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"task_id": runID})
+}
+
+// handleRescheduleTask moves the next run of one of the profile's scheduled tasks to the at query parameter, an RFC
+// 3339 time. the runs after it keep to the task's schedule
+func handleRescheduleTask(w http.ResponseWriter, r *http.Request, a *App, s *scheduler.Scheduler) {
+	task, ok := requestedTask(w, r, a)
+	if !ok {
+		return
+	}
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "at must be an RFC 3339 time")
+		return
+	}
+	if _, ok := s.NextRun(task.ID); !ok {
+		writeJSONError(w, http.StatusConflict, "the task has no run left to move")
+		return
+	}
+	if err := s.Reschedule(task.ID, at); err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"task_id": task.ID, "next_run": at})
+}
+
+func handleListErrors(w http.ResponseWriter, r *http.Request, a *App) {
+	writeJSON(w, http.StatusOK, a.taskErrors())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Failed to encode API response", "error", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+	"scheduler"
+)
+
+// EmailSource provides the emails to summarize
+type EmailSource interface {
+	Fetch(ctx context.Context, after time.Time) ([]*gmail.Message, error)
+	// Search is Fetch limited to the emails matching a Gmail search query
+	Search(ctx context.Context, query string, after time.Time) ([]*gmail.Message, error)
+	// Preview counts the emails matching a Gmail search query, listing the newest few without their content
+	Preview(ctx context.Context, query string, size int) (*QueryPreview, error)
+	// Message fetches one email by its Gmail message id
+	Message(ctx context.Context, id string) (*gmail.Message, error)
+	// AwaitingReplies lists the threads the user has sent mail to since after, and which have had no reply since
+	AwaitingReplies(ctx context.Context, after time.Time) ([]AwaitingReply, error)
+	// Labels maps label ids to their names
+	Labels(ctx context.Context) (map[string]string, error)
+	// Attachment downloads the content of an attachment or inline image that the fetched message only references
+	Attachment(ctx context.Context, messageID, attachmentID string) ([]byte, error)
+	// Send sends a raw RFC 5322 email in the thread, as the user. it needs gmail_access.send
+	Send(ctx context.Context, raw []byte, threadID string) error
+	// InboxCount counts the conversations in the inbox, and the unread ones
+	InboxCount(ctx context.Context) (InboxCount, error)
+	// Modify adds and removes labels on many emails in one call. it needs gmail_access.label or archive
+	Modify(ctx context.Context, request *gmail.BatchModifyMessagesRequest) error
+}
+
+// Summarizer turns a batch of emails into a digest of the given kind, "daily" or "weekly"
+type Summarizer interface {
+	Summarize(ctx context.Context, kind string, messages []*gmail.Message) (*Digest, error)
+	// SummarizeTopic writes a one-off digest focused on a topic
+	SummarizeTopic(ctx context.Context, topic string, messages []*gmail.Message) (*Digest, error)
+	// SummarizeRollup writes a monthly or quarterly rollup from archived digests
+	SummarizeRollup(ctx context.Context, rollup *Rollup) (*Digest, error)
+	// DraftNudge writes a follow-up for a thread that hasn't been answered
+	DraftNudge(ctx context.Context, reply AwaitingReply) (string, error)
+	// Answer answers a question about the user's email from the emails found for it, following on from the
+	// conversation so far
+	Answer(ctx context.Context, question string, history []AskTurn, emails []*IndexedEmail) (string, error)
+	// ExtractRecruiting reads where the user's job applications stand from the emails about them
+	ExtractRecruiting(ctx context.Context, messages []*gmail.Message, known []RecruitingThread) ([]RecruitingUpdate, error)
+	// ExtractBills finds the bills, renewals and trials with a deadline in the emails
+	ExtractBills(ctx context.Context, messages []*gmail.Message) ([]Bill, error)
+	// ExtractTravel finds the flight, train, stay and rental bookings in the emails
+	ExtractTravel(ctx context.Context, messages []*gmail.Message) ([]TravelSegment, error)
+	// SummarizeMailingLists names the main topics of each list's messages, by list name
+	SummarizeMailingLists(ctx context.Context, lists map[string][]*gmail.Message) (map[string]string, error)
+	// SummarizeContact writes the recent history with a contact: the latest threads, open items and how their tone has
+	// changed
+	SummarizeContact(ctx context.Context, history *ContactHistory) (string, error)
+	// AssessPhishing weighs up whether an email is phishing, with what the checks that don't need the model found
+	AssessPhishing(ctx context.Context, message *gmail.Message, findings []phishingFinding) (*PhishingAssessment, error)
+}
+
+// Clock tells the time. the pipeline never calls time.Now directly, so tests can pin it
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real time, in the configured timezone
+type systemClock struct {
+	location *time.Location
+}
+
+func (c systemClock) Now() time.Time {
+	return time.Now().In(c.location)
+}
+
+// App is everything the bot runs on. the digest pipeline only talks to its parts through the interfaces above, so
+// tests can assemble an App out of fakes instead of Gmail, OpenAI and Discord
+type App struct {
+	Config     *Config
+	Discord    *discordgo.Session
+	Emails     EmailSource
+	Summarizer Summarizer
+	Notifiers  []Notifier
+	Clock      Clock
+	Rules      []*rule
+
+	// Location is the configured timezone, used for the schedule, day boundaries and rendered timestamps
+	Location *time.Location
+
+	// Profile is the name of the profile the App runs, "" when the config has no profiles
+	Profile string
+	// profiles are the Apps of every profile running in the process, in order, this one included
+	profiles []*App
+
+	// state is the profile's state, and index its email index
+	state *stateStore
+	index *emailIndex
+	// askCache is the recent /ask answers
+	askCache *askCache
+
+	openAI *openai.Client
+
+	// httpClient carries the proxy and timeout settings, for the OpenAI and Gmail clients
+	httpClient *http.Client
+
+	// scheduler runs the recurring tasks, nil until the daemon has started
+	scheduler *scheduler.Scheduler
+
+	// templates are the prompts the summarizer uses, shared with it so /prompts rollback takes effect straight away
+	templates *atomic.Pointer[Templates]
+
+	// embedder embeds emails for the index and dedupe, nil when embeddings aren't configured
+	embedder Embedder
+
+	// ocr reads the images of image-only emails, nil when OCR isn't configured
+	ocr OCRProvider
+
+	// llmQueue orders the LLM requests by priority, nil until the agent is set up
+	llmQueue *llmQueue
+
+	// smsAlerts is the SMS channel for urgent alerts, nil when Twilio isn't configured
+	smsAlerts *smsNotifier
+
+	// contentFilter cleans up the digests for shared channels, nil when it isn't configured
+	contentFilter *contentFilter
+
+	// discordChannels are where the digests go, swapped whole when /config or a config reload changes them
+	discordChannels *atomic.Pointer[DiscordChannels]
+	// configuredChannels are the channels as the config last had them, for a reload to tell which it changed
+	configuredChannels DiscordChannels
+
+	// redis coordinates the replicas, nil when it isn't configured
+	redis *redisClient
+	// outbox holds the digests Discord wouldn't take, in the state or in Redis
+	outbox outboxStore
+	// reauthorizing is set while a new Gmail consent is being waited for in the background
+	reauthorizing *atomic.Bool
+}
+
+// newApp assembles the App of a profile, "" when the config has no profiles, and loads its state
+func newApp(config *Config, profile string) (_ *App, err error) {
+	location := time.Local
+	if config.Timezone != "" {
+		location, err = time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+	if _, err := lookupLocale(config.Locale); err != nil {
+		return nil, err
+	}
+
+	// the replicas coordinating through Redis have to share their state too, or each would fetch, queue and deliver
+	// from its own copy
+	if config.Redis != nil && (config.Storage == nil || config.Storage.Backend != "postgres") {
+		return nil, fmt.Errorf("redis needs the postgres storage backend, so the replicas share their state")
+	}
+
+	state, err := loadState(profile, config.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("loading state: %w", err)
+	}
+	// the store is the App's from here, unless the rest of the config doesn't hold up
+	defer func() {
+		if err != nil {
+			state.store.Close()
+		}
+	}()
+
+	if config.ArchiveSigning != nil {
+		if state.signingKey, err = loadSigningKey(signingKeyPath(config.ArchiveSigning, state.dir)); err != nil {
+			return nil, err
+		}
+	}
+
+	rules, err := compileRules(config.Rules, state.dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+	if err := validateCategories(config.Categories); err != nil {
+		return nil, fmt.Errorf("invalid categories: %w", err)
+	}
+	if config.Approval != nil {
+		if err := config.Approval.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	httpClient, err := newHTTPClient(config.HTTPProxy, config.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.DiscordFormat {
+	case "", "markdown", "embeds":
+	default:
+		return nil, fmt.Errorf("discord_format must be markdown or embeds, got %q", config.DiscordFormat)
+	}
+
+	var redis *redisClient
+	if config.Redis != nil {
+		if redis, err = newRedisClient(config.Redis, profile); err != nil {
+			return nil, err
+		}
+	}
+
+	channels := &atomic.Pointer[DiscordChannels]{}
+	channels.Store(currentChannels(config, state))
+
+	return &App{
+		Config:   config,
+		Clock:    systemClock{location: location},
+		Location: location,
+		Rules:    rules,
+		Profile:  profile,
+
+		state:      state,
+		index:      &emailIndex{file: state.path(indexFile)},
+		askCache:   &askCache{},
+		httpClient: httpClient,
+		redis:      redis,
+		outbox:     newOutboxStore(state, redis),
+
+		discordChannels:    channels,
+		configuredChannels: configChannels(config),
+		reauthorizing:      &atomic.Bool{},
+	}, nil
+}
+
+// setupAgent wires up the production Gmail source, OpenAI summarizer and notifiers
+func (a *App) setupAgent() error {
+	templates, err := loadTemplates(a.state.dir)
+	if err != nil {
+		return err
+	}
+
+	openAIConfig := openai.DefaultConfig(a.Config.OpenAIKey)
+	if a.Config.OpenAIBaseURL != "" {
+		openAIConfig.BaseURL = a.Config.OpenAIBaseURL
+	}
+	openAIConfig.OrgID = a.Config.OpenAIOrgID
+
+	// the limits are the process', shared with the other profiles sending to the same provider with the same key. the
+	// queue comes first, so the requests that wait on the limiter are the most urgent ones
+	limits := llmLimitsFor(openAIConfig.BaseURL, a.Config.OpenAIKey, a.Config)
+	a.llmQueue = limits.queue
+	llmClient := withLLMQueue(withRateLimit(a.httpClient, limits.limiter), a.llmQueue)
+	openAIConfig.HTTPClient = withFixtures(llmClient)
+	a.openAI = openai.NewClientWithConfig(openAIConfig)
+
+	a.setupNotifiers()
+
+	if config := a.Config.ContentFilter; config != nil {
+		if config.Mode != "" && config.Mode != "soften" && config.Mode != "redact" {
+			return fmt.Errorf("unknown content_filter mode %q, must be soften or redact", config.Mode)
+		}
+		a.contentFilter = newContentFilter(*config)
+	}
+
+	if a.Config.OCR != nil {
+		if a.ocr, err = newOCRProvider(a.openAI, *a.Config.OCR); err != nil {
+			return fmt.Errorf("setting up OCR: %w", err)
+		}
+	}
+
+	if a.Config.Embeddings != nil {
+		if a.embedder, err = newEmbedder(*a.Config.Embeddings, a.openAI, a.httpClient); err != nil {
+			return fmt.Errorf("setting up embeddings: %w", err)
+		}
+	}
+
+	a.Emails = &gmailSource{app: a}
+	a.templates = &atomic.Pointer[Templates]{}
+	a.templates.Store(templates)
+	if err := a.state.recordPromptVersions(templates, a.Clock.Now()); err != nil {
+		log.Error("Unable to record the prompt versions", "error", err)
+	}
+
+	summarizer := &openAISummarizer{
+		client:    a.openAI,
+		templates: a.templates,
+		state:     a.state,
+		clock:     a.Clock,
+		// structured entries cost an extra call, so only extract them when something will consume them
+		extractEntries: len(a.Notifiers) > 0 || a.Config.Rollups != nil || a.Config.WhatChanged != nil || len(a.Config.Categories) > 0,
+		gmailAccount:   a.Config.GmailAccount,
+		locale:         a.Config.Locale,
+		categories:     a.Config.Categories,
+		redis:          a.redis,
+	}
+	if a.Config.Vision != nil {
+		summarizer.imageDetail = openai.ImageURLDetail(a.Config.Vision.Detail)
+	}
+	if a.Config.Race != nil {
+		if summarizer.racer, err = newRacer(*a.Config.Race, a.Config.OpenAIKey, llmClient); err != nil {
+			return fmt.Errorf("setting up provider racing: %w", err)
+		}
+	}
+	a.Summarizer = summarizer
+	return nil
+}
+
+func (a *App) setupDiscord() error {
+	var err error
+
+	// Initialize Discord session
+	a.Discord, err = discordgo.New("Bot " + a.Config.DiscordToken)
+	if err != nil {
+		return fmt.Errorf("error creating Discord session: %w", err)
+	}
+
+	// Open WebSocket connection to Discord
+	err = a.Discord.Open()
+	if err != nil {
+		return fmt.Errorf("error opening Discord connection: %w", err)
+	}
+
+	log.Info("Discord session initialized")
+	return nil
+}
+
+// gmailSource fetches from the authorized Gmail account, going through re-authorization if the token was revoked
+type gmailSource struct {
+	app *App
+}
+
+func (g *gmailSource) Fetch(ctx context.Context, after time.Time) ([]*gmail.Message, error) {
+	return g.Search(ctx, g.app.Config.FetchQuery, after)
+}
+
+func (g *gmailSource) Search(ctx context.Context, query string, after time.Time) ([]*gmail.Message, error) {
+	query = strings.TrimSpace(fmt.Sprintf("%s after:%d", query, after.Unix()))
+
+	var messages []*gmail.Message
+	err := g.call(func(client *http.Client) (err error) {
+		messages, err = fetchEmails(ctx, client, query)
+		return err
+	})
+	return messages, err
+}
+
+func (g *gmailSource) Preview(ctx context.Context, query string, size int) (*QueryPreview, error) {
+	var preview *QueryPreview
+	err := g.call(func(client *http.Client) (err error) {
+		preview, err = fetchQueryPreview(ctx, client, query, size)
+		return err
+	})
+	return preview, err
+}
+
+func (g *gmailSource) Message(ctx context.Context, id string) (*gmail.Message, error) {
+	var message *gmail.Message
+	err := g.call(func(client *http.Client) (err error) {
+		message, err = fetchMessage(ctx, client, id)
+		return err
+	})
+	return message, err
+}
+
+func (g *gmailSource) AwaitingReplies(ctx context.Context, after time.Time) ([]AwaitingReply, error) {
+	var replies []AwaitingReply
+	err := g.call(func(client *http.Client) (err error) {
+		replies, err = fetchAwaitingReplies(ctx, client, after)
+		return err
+	})
+	return replies, err
+}
+
+func (g *gmailSource) Labels(ctx context.Context) (map[string]string, error) {
+	var labels map[string]string
+	err := g.call(func(client *http.Client) (err error) {
+		labels, err = fetchLabels(ctx, client)
+		return err
+	})
+	return labels, err
+}
+
+func (g *gmailSource) Attachment(ctx context.Context, messageID, attachmentID string) ([]byte, error) {
+	var data []byte
+	err := g.call(func(client *http.Client) (err error) {
+		data, err = fetchAttachment(ctx, client, messageID, attachmentID)
+		return err
+	})
+	return data, err
+}
+
+func (g *gmailSource) Send(ctx context.Context, raw []byte, threadID string) error {
+	return g.call(func(client *http.Client) error {
+		return sendEmail(ctx, client, raw, threadID)
+	})
+}
+
+func (g *gmailSource) InboxCount(ctx context.Context) (InboxCount, error) {
+	var count InboxCount
+	err := g.call(func(client *http.Client) (err error) {
+		count, err = fetchInboxCount(ctx, client)
+		return err
+	})
+	return count, err
+}
+
+func (g *gmailSource) Modify(ctx context.Context, request *gmail.BatchModifyMessagesRequest) error {
+	return g.call(func(client *http.Client) error {
+		return batchModifyEmails(ctx, client, request)
+	})
+}
+
+// call runs fn with an authorized client. when the refresh token is rejected it asks for a new consent, and fails until
+// it's given
+func (g *gmailSource) call(fn func(client *http.Client) error) error {
+	oauthClient, err := g.app.createOAuthClient()
+	if err != nil {
+		return fmt.Errorf("creating OAuth client: %w", err)
+	}
+
+	err = fn(oauthClient)
+	if isInvalidGrant(err) {
+		g.app.reauthorize("the refresh token was rejected while reading Gmail")
+		return errReauthorizing
+	}
+	return err
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+	"scheduler"
+)
+
+// approvalButtonPrefix starts the custom id of the buttons under a digest waiting for approval, followed by the
+// digest's id and the answer
+const approvalButtonPrefix = "approval:"
+
+// defaultApprovalTimeout is how long a digest waits for approval when the config doesn't say
+const defaultApprovalTimeout = 12 * time.Hour
+
+type ApprovalConfig struct {
+	// ChannelID is where the digests wait for approval, with a preview of each
+	ChannelID string `json:"channel_id"`
+	// Kinds are the digests that need approval, daily and weekly by default
+	Kinds []string `json:"kinds"`
+	// TimeoutHours is how long a digest waits before OnTimeout happens to it
+	TimeoutHours float64 `json:"timeout_hours"`
+	// OnTimeout is publish, the default, or discard
+	OnTimeout string `json:"on_timeout"`
+}
+
+// PendingApproval is a digest held back until someone approves it, or its deadline passes
+type PendingApproval struct {
+	Digest    *Digest                     `json:"digest"`
+	ChannelID string                      `json:"channel_id"`
+	Reference *discordgo.MessageReference `json:"reference,omitempty"`
+	HeldAt    time.Time                   `json:"held_at"`
+	Deadline  time.Time                   `json:"deadline"`
+	// PromptChannelID and PromptMessageID are the message with the buttons, empty if it couldn't be sent
+	PromptChannelID string `json:"prompt_channel_id,omitempty"`
+	PromptMessageID string `json:"prompt_message_id,omitempty"`
+	// Extras are what follows the digest once it's published, its emails without their bodies
+	Extras DigestExtras `json:"extras"`
+}
+
+// validate checks the channel is set and the timeout makes sense
+func (c *ApprovalConfig) validate() error {
+	if c.ChannelID == "" {
+		return fmt.Errorf("approval needs a channel_id")
+	}
+	if c.TimeoutHours < 0 {
+		return fmt.Errorf("approval timeout_hours can't be negative")
+	}
+	switch c.OnTimeout {
+	case "", "publish", "discard":
+	default:
+		return fmt.Errorf("approval on_timeout must be publish or discard, got %q", c.OnTimeout)
+	}
+	return nil
+}
+
+func (c *ApprovalConfig) timeout() time.Duration {
+	if c.TimeoutHours == 0 {
+		return defaultApprovalTimeout
+	}
+	return time.Duration(c.TimeoutHours * float64(time.Hour))
+}
+
+// needsApproval is whether a digest of kind waits for approval before it goes out
+func (a *App) needsApproval(kind string) bool {
+	config := a.Config.Approval
+	if config == nil {
+		return false
+	}
+	if len(config.Kinds) == 0 {
+		return kind == "daily" || kind == "weekly"
+	}
+	return slices.Contains(config.Kinds, kind)
+}
+
+// holdForApproval keeps the digest back, posts a preview of it with approve and discard buttons to the approval
+// channel, and schedules what happens when nobody answers. the digest is saved before anything is posted, so a preview
+// Discord won't take still times out like any other
+func (a *App) holdForApproval(ctx context.Context, channelID string, digest *Digest, reference *discordgo.MessageReference, extras DigestExtras) error {
+	logger := log.FromContext(ctx)
+	config := a.Config.Approval
+	now := a.Clock.Now()
+	pending := PendingApproval{
+		Digest:    digest,
+		ChannelID: channelID,
+		Reference: reference,
+		HeldAt:    now,
+		Deadline:  now.Add(config.timeout()),
+		Extras:    DigestExtras{Emails: withoutBodies(extras.Emails), VolumeStats: extras.VolumeStats},
+	}
+	if err := a.savePendingApproval(pending); err != nil {
+		return fmt.Errorf("holding the digest for approval: %w", err)
+	}
+	logger.Info("Digest is waiting for approval", "kind", digest.Kind, "digest_id", digest.ID, "deadline", pending.Deadline)
+	a.scheduleApprovalTimeout(digest.ID, pending.Deadline)
+
+	if _, err := a.postDigest(config.ChannelID, digest, nil); err != nil {
+		logger.Error("Unable to post the digest's preview for approval", "digest_id", digest.ID, "error", err)
+		return nil
+	}
+	outcome := "publishes"
+	if config.OnTimeout == "discard" {
+		outcome = "is discarded"
+	}
+	prompt, err := a.Discord.ChannelMessageSendComplex(config.ChannelID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("This %s digest for <#%s> is waiting for approval. It %s on its own <t:%d:R> if nobody answers.",
+			digest.Kind, channelID, outcome, pending.Deadline.Unix()),
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "Publish", Style: discordgo.SuccessButton, CustomID: approvalButtonPrefix + digest.ID + ":publish"},
+			discordgo.Button{Label: "Discard", Style: discordgo.DangerButton, CustomID: approvalButtonPrefix + digest.ID + ":discard"},
+		}}},
+	})
+	if err != nil {
+		logger.Error("Unable to ask for approval", "digest_id", digest.ID, "error", err)
+		return nil
+	}
+	pending.PromptChannelID, pending.PromptMessageID = prompt.ChannelID, prompt.ID
+	if err := a.savePendingApproval(pending); err != nil {
+		logger.Error("Unable to remember the approval message", "digest_id", digest.ID, "error", err)
+	}
+	return nil
+}
+
+// withoutBodies keeps what the menus and buttons under a digest need of its emails, their ids, labels and headers, so
+// the bodies of a held digest's emails don't sit in the state
+func withoutBodies(messages []*gmail.Message) []*gmail.Message {
+	trimmed := make([]*gmail.Message, 0, len(messages))
+	for _, message := range messages {
+		kept := &gmail.Message{Id: message.Id, ThreadId: message.ThreadId, LabelIds: message.LabelIds}
+		if message.Payload != nil {
+			kept.Payload = &gmail.MessagePart{Headers: message.Payload.Headers}
+		}
+		trimmed = append(trimmed, kept)
+	}
+	return trimmed
+}
+
+// savePendingApproval saves pending, in place of the digest's earlier one if it has one
+func (a *App) savePendingApproval(pending PendingApproval) error {
+	return a.state.update(func(s *State) {
+		account := s.account()
+		account.Approvals = slices.DeleteFunc(account.Approvals, func(p PendingApproval) bool {
+			return p.Digest.ID == pending.Digest.ID
+		})
+		account.Approvals = append(account.Approvals, pending)
+	})
+}
+
+// scheduleApprovalTimeout has the scheduler settle the digest at its deadline, if it's still waiting then
+func (a *App) scheduleApprovalTimeout(digestID string, deadline time.Time) {
+	if a.scheduler == nil {
+		// outside the daemon, the next start schedules it
+		return
+	}
+	if err := a.addApprovalTimeout(a.scheduler, digestID, deadline); err != nil {
+		log.Error("Unable to schedule the approval timeout", "digest_id", digestID, "error", err)
+	}
+}
+
+func (a *App) addApprovalTimeout(s *scheduler.Scheduler, digestID string, deadline time.Time) error {
+	name := a.taskName("Approval timeout " + digestID)
+	_, err := s.Add(a.createResumeTask(name, digestID, func(ctx context.Context) error {
+		return a.expireApproval(ctx, digestID)
+	}).AtTime(deadline))
+	return err
+}
+
+// resumeApprovals schedules the timeouts of the digests that were waiting for approval when the bot stopped. those
+// whose deadline passed in the meantime are settled straight away
+func (a *App) resumeApprovals(s *scheduler.Scheduler) error {
+	var pending []PendingApproval
+	a.state.read(func(st *State) {
+		pending = slices.Clone(st.account().Approvals)
+	})
+	for _, p := range pending {
+		if err := a.addApprovalTimeout(s, p.Digest.ID, p.Deadline); err != nil {
+			return fmt.Errorf("scheduling the approval timeout of %s: %w", p.Digest.ID, err)
+		}
+	}
+	return nil
+}
+
+// expireApproval settles a digest nobody answered for, by publishing or discarding it as the config says
+func (a *App) expireApproval(ctx context.Context, digestID string) error {
+	config := a.Config.Approval
+	publish := config == nil || config.OnTimeout != "discard"
+	pending, ok, err := a.settleApproval(ctx, digestID, publish)
+	if err != nil || !ok {
+		return err
+	}
+
+	note := "\n*Nobody answered in time, so it was published.*"
+	if !publish {
+		note = "\n*Nobody answered in time, so it was discarded.*"
+	}
+	if pending.PromptMessageID == "" {
+		return nil
+	}
+	message, err := a.Discord.ChannelMessage(pending.PromptChannelID, pending.PromptMessageID)
+	if err != nil {
+		log.FromContext(ctx).Error("Unable to read the approval message", "error", err)
+		return nil
+	}
+	content := message.Content + note
+	if _, err := a.Discord.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		Channel: pending.PromptChannelID, ID: pending.PromptMessageID, Content: &content, Components: &[]discordgo.MessageComponent{},
+	}); err != nil {
+		log.FromContext(ctx).Error("Unable to update the approval message", "error", err)
+	}
+	return nil
+}
+
+// settleApproval takes the digest off the pending list and publishes it, or drops it. ok is false when it wasn't
+// waiting any more, answered already or settled by another replica. a dropped digest counts as delivered, so its period
+// isn't summarized again
+func (a *App) settleApproval(ctx context.Context, digestID string, publish bool) (pending PendingApproval, ok bool, err error) {
+	logger := log.FromContext(ctx)
+	now := a.Clock.Now()
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		ok = false
+		for i, p := range account.Approvals {
+			if p.Digest.ID == digestID {
+				pending, ok = p, true
+				account.Approvals = slices.Delete(account.Approvals, i, i+1)
+				break
+			}
+		}
+		if ok && !publish {
+			if account.Delivered == nil {
+				account.Delivered = make(map[string]time.Time)
+			}
+			account.Delivered[digestID] = now
+		}
+	}); err != nil {
+		return pending, false, fmt.Errorf("taking the digest off the approval list: %w", err)
+	}
+	if !ok {
+		return pending, false, nil
+	}
+
+	digest := pending.Digest
+	if !publish {
+		// the digest stays in the archive, its emails aren't summarized again
+		logger.Info("Digest discarded", "kind", digest.Kind, "digest_id", digest.ID)
+		return pending, true, nil
+	}
+	posted, err := a.deliverOrQueue(ctx, pending.ChannelID, digest, pending.Reference)
+	if err != nil {
+		return pending, true, fmt.Errorf("publishing the approved digest: %w", err)
+	}
+	logger.Info("Digest published", "kind", digest.Kind, "digest_id", digest.ID, "waited", a.Clock.Now().Sub(pending.HeldAt).Round(time.Second))
+	if posted != nil {
+		a.afterPosting(ctx, pending.ChannelID, digest, posted, pending.Extras)
+	}
+	return pending, true, nil
+}
+
+// handleApprovalButton publishes or discards a digest waiting for approval, and takes the buttons off
+func (a *App) handleApprovalButton(i *discordgo.InteractionCreate, id string) {
+	ctx := withTaskRun(context.Background(), "approval")
+	logger := log.FromContext(ctx)
+	digestID, answer, _ := strings.Cut(id, ":")
+
+	// publishing can take longer than Discord waits for an answer
+	if err := a.Discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	}); err != nil {
+		logger.Error("Failed to acknowledge approval button", "error", err)
+		return
+	}
+
+	content := i.Message.Content
+	components := []discordgo.MessageComponent{}
+	_, ok, err := a.settleApproval(ctx, digestID, answer == "publish")
+	switch {
+	case err != nil:
+		logger.Error("Failed to settle the digest", "digest_id", digestID, "error", err)
+		recordTaskError(a.taskName("approval"), err)
+		content += "\n*Sorry, that failed: " + err.Error() + "*"
+	case !ok:
+		content += "\n*This digest isn't waiting for approval any more.*"
+	case answer == "publish":
+		content += fmt.Sprintf("\n*Published, %s approved it.*", interactionUserMention(i))
+	default:
+		content += fmt.Sprintf("\n*Discarded by %s.*", interactionUserMention(i))
+	}
+	if _, err := a.Discord.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content, Components: &components}); err != nil {
+		logger.Error("Failed to update the approval message", "error", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// maxArchivedDigests bounds how many digests are kept around for the API and rollups. it covers two quarters of
+	// daily and weekly digests, so a quarterly rollup can compare against the one before
+	maxArchivedDigests = 400
+	// deliveredRetention is how long a digest id is remembered as sent, longer than the quarter the longest digest
+	// covers
+	deliveredRetention = 120 * 24 * time.Hour
+)
+
+// archiveDigest records a delivered digest, dropping the oldest ones past maxArchivedDigests
+func (st *stateStore) archiveDigest(digest *Digest) {
+	if err := st.update(func(s *State) {
+		var previous *Digest
+		if len(s.Digests) > 0 {
+			previous = s.Digests[len(s.Digests)-1]
+		}
+		st.sealDigest(digest, previous)
+		s.Digests = append(s.Digests, digest)
+		if len(s.Digests) > maxArchivedDigests {
+			s.Digests = s.Digests[len(s.Digests)-maxArchivedDigests:]
+		}
+	}); err != nil {
+		log.Error("Unable to save digest archive", "error", err)
+	}
+}
+
+// recentDigests returns up to limit digests of the given kind, newest first. an empty kind matches everything
+func (st *stateStore) recentDigests(kind string, limit int) []*Digest {
+	var digests []*Digest
+	st.read(func(s *State) {
+		for i := len(s.Digests) - 1; i >= 0 && len(digests) < limit; i-- {
+			if kind == "" || s.Digests[i].Kind == kind {
+				digests = append(digests, s.Digests[i])
+			}
+		}
+	})
+	return digests
+}
+
+func (st *stateStore) findDigest(id string) *Digest {
+	var found *Digest
+	st.read(func(s *State) {
+		for _, digest := range s.Digests {
+			if digest.ID == id {
+				found = digest
+			}
+		}
+	})
+	return found
+}
+
+// markDelivered records that a digest went out, so its period is never posted again
+func (st *stateStore) markDelivered(id string, now time.Time) error {
+	return st.update(func(s *State) {
+		account := s.account()
+		if account.Delivered == nil {
+			account.Delivered = make(map[string]time.Time)
+		}
+		account.Delivered[id] = now
+		for id, at := range account.Delivered {
+			if now.Sub(at) > deliveredRetention {
+				delete(account.Delivered, id)
+			}
+		}
+	})
+}
+
+// delivered is whether the digest with this id went out
+func (st *stateStore) delivered(id string) bool {
+	var delivered bool
+	st.read(func(s *State) {
+		_, delivered = s.account().Delivered[id]
+	})
+	return delivered
+}
+
+// alreadySent is whether the digest with this id was delivered or discarded, or is waiting for approval or in the
+// outbox. a run for the same period then has nothing to do: the emails that came in since wait for the next digest
+func (a *App) alreadySent(ctx context.Context, id string) bool {
+	var held bool
+	a.state.read(func(s *State) {
+		_, held = s.account().Delivered[id]
+		held = held || slices.ContainsFunc(s.account().Approvals, func(p PendingApproval) bool { return p.Digest.ID == id })
+	})
+	if held {
+		return true
+	}
+	queued, err := a.outbox.list(ctx)
+	if err != nil {
+		// sending the digest again is better than not at all
+		log.FromContext(ctx).Warn("Unable to read the outbox", "error", err)
+		return false
+	}
+	return slices.ContainsFunc(queued, func(entry OutboxEntry) bool { return entry.Digest.ID == id })
+}
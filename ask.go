@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// askEmails is how many emails an answer is written from
+	askEmails = 6
+	// askEmailTokens is how much of each email the model gets
+	askEmailTokens = 400
+	// defaultMemoryTurns and defaultMemoryMinutes are how much of a conversation /ask remembers when the config
+	// doesn't say
+	defaultMemoryTurns   = 5
+	defaultMemoryMinutes = 30
+)
+
+// citationPattern matches the [n] references to the emails in an answer
+var citationPattern = regexp.MustCompile(`\[(\d+)\]`)
+
+type AskConfig struct {
+	// MemoryTurns is how many earlier questions and answers of a channel a follow-up is read with, -1 for none
+	MemoryTurns int `json:"memory_turns"`
+	// MemoryMinutes is how long a conversation is remembered after its last question
+	MemoryMinutes int `json:"memory_minutes"`
+	// CacheMinutes is how long an answer is given again to the same question, -1 to always ask the model
+	CacheMinutes int `json:"cache_minutes"`
+}
+
+// AskTurn is a question asked with /ask, its answer, and the emails the answer came from
+type AskTurn struct {
+	Question   string    `json:"question"`
+	Answer     string    `json:"answer"`
+	MessageIDs []string  `json:"message_ids"`
+	At         time.Time `json:"at"`
+}
+
+type channelKey struct{}
+
+// withChannel records the Discord channel a command came from
+func withChannel(ctx context.Context, channelID string) context.Context {
+	return context.WithValue(ctx, channelKey{}, channelID)
+}
+
+func channelFromContext(ctx context.Context) string {
+	channelID, _ := ctx.Value(channelKey{}).(string)
+	return channelID
+}
+
+func (a *App) askMemory() (turns int, ttl time.Duration) {
+	turns, minutes := defaultMemoryTurns, defaultMemoryMinutes
+	if config := a.Config.Ask; config != nil {
+		if config.MemoryTurns != 0 {
+			turns = max(config.MemoryTurns, 0)
+		}
+		if config.MemoryMinutes > 0 {
+			minutes = config.MemoryMinutes
+		}
+	}
+	return turns, time.Duration(minutes) * time.Minute
+}
+
+// conversation is the channel's recent turns, none once it's been quiet for longer than the memory lasts
+func (a *App) conversation(channelID string) []AskTurn {
+	turns, ttl := a.askMemory()
+	if turns == 0 || channelID == "" {
+		return nil
+	}
+	var history []AskTurn
+	a.state.read(func(s *State) {
+		history = append(history, s.account().Conversations[channelID]...)
+	})
+	if len(history) == 0 || a.Clock.Now().Sub(history[len(history)-1].At) > ttl {
+		return nil
+	}
+	if len(history) > turns {
+		history = history[len(history)-turns:]
+	}
+	return history
+}
+
+// remember adds a turn to the channel's conversation, or starts it over with the turn when forget is set
+func (a *App) remember(channelID string, turn AskTurn, forget bool) error {
+	turns, _ := a.askMemory()
+	if turns == 0 || channelID == "" {
+		return nil
+	}
+	return a.state.update(func(s *State) {
+		account := s.account()
+		if account.Conversations == nil {
+			account.Conversations = make(map[string][]AskTurn)
+		}
+		history := account.Conversations[channelID]
+		if forget {
+			history = nil
+		}
+		history = append(history, turn)
+		if len(history) > turns {
+			history = history[len(history)-turns:]
+		}
+		account.Conversations[channelID] = history
+	})
+}
+
+// askCommand is /ask: a question answered from the indexed emails. follow-ups in the same channel are read with the
+// conversation so far, so "and what did she say about the deposit?" knows who she is
+func askCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	if a.embedder == nil {
+		return "Questions are answered from the email index, set up `embeddings` in the config to build it.", nil
+	}
+	question := strings.TrimSpace(options["question"])
+	if question == "" {
+		return "", fmt.Errorf("ask what?")
+	}
+	channelID := channelFromContext(ctx)
+	forget := options["memory"] == "forget"
+
+	var history []AskTurn
+	if !forget {
+		history = a.conversation(channelID)
+	}
+
+	// a follow-up is answered with the conversation it's in, so only questions asked on their own are cached
+	ttl := a.askCacheTTL()
+	key := askCacheKey(question, a.index.currentVersion())
+	if len(history) == 0 && ttl > 0 {
+		if cached, ok := a.askCache.get(key, a.Clock.Now(), ttl); ok {
+			log.FromContext(ctx).Debug("Answering from the cache", "asked_at", cached.turn.At)
+			turn := cached.turn
+			turn.Question, turn.At = question, a.Clock.Now()
+			if err := a.remember(channelID, turn, forget); err != nil {
+				log.FromContext(ctx).Error("Unable to remember the conversation", "error", err)
+			}
+			return cached.reply, nil
+		}
+	}
+
+	// a follow-up on its own often doesn't say what it's about, so the search gets the earlier questions too
+	query := question
+	for i := len(history) - 1; i >= 0 && i >= len(history)-2; i-- {
+		query = history[i].Question + "\n" + query
+	}
+	results, err := a.searchIndex(ctx, query, askEmails)
+	if err != nil {
+		return "", err
+	}
+	emails := a.askContextEmails(results, history)
+	if len(emails) == 0 {
+		return "There's nothing in the email index to answer from yet.", nil
+	}
+
+	answer, err := a.Summarizer.Answer(ctx, question, history, emails)
+	if err != nil {
+		return "", fmt.Errorf("answering: %w", err)
+	}
+
+	var cited []*IndexedEmail
+	var ids []string
+	for _, n := range citations(answer, len(emails)) {
+		cited = append(cited, emails[n-1])
+	}
+	for _, email := range emails {
+		ids = append(ids, email.MessageID)
+	}
+	turn := AskTurn{Question: question, Answer: answer, MessageIDs: ids, At: a.Clock.Now()}
+	if err := a.remember(channelID, turn, forget); err != nil {
+		log.FromContext(ctx).Error("Unable to remember the conversation", "error", err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(answer)
+	if len(cited) > 0 {
+		sb.WriteString("\n\n")
+		for i, email := range cited {
+			if i > 0 {
+				sb.WriteString(" · ")
+			}
+			label := email.Subject
+			if url := gmailThreadURL(a.Config.GmailAccount, email.ThreadID); url != "" {
+				label = fmt.Sprintf("[%s](<%s>)", email.Subject, url)
+			}
+			sb.WriteString(label)
+		}
+	}
+	if len(history) == 0 && ttl > 0 {
+		a.askCache.put(key, cachedAnswer{reply: sb.String(), turn: turn}, ttl)
+	}
+	return sb.String(), nil
+}
+
+// askContextEmails are the emails found for the question, then the ones earlier answers in the conversation were
+// written from, so a follow-up can still see them when the search doesn't find them again
+func (a *App) askContextEmails(results []searchResult, history []AskTurn) []*IndexedEmail {
+	seen := make(map[string]bool)
+	var emails []*IndexedEmail
+	for _, result := range results {
+		seen[result.email.MessageID] = true
+		emails = append(emails, result.email)
+	}
+
+	earlier := make(map[string]bool)
+	for _, turn := range history {
+		for _, id := range turn.MessageIDs {
+			earlier[id] = !seen[id]
+		}
+	}
+	a.index.mu.Lock()
+	defer a.index.mu.Unlock()
+	for _, email := range a.index.Emails {
+		if earlier[email.MessageID] && len(emails) < 2*askEmails {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// citations are the email numbers an answer cites, in order, each once
+func citations(answer string, count int) []int {
+	seen := make(map[int]bool)
+	var numbers []int
+	for _, match := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil || n < 1 || n > count || seen[n] {
+			continue
+		}
+		seen[n] = true
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+func (s *openAISummarizer) Answer(ctx context.Context, question string, history []AskTurn, emails []*IndexedEmail) (string, error) {
+	location := s.clock.Now().Location()
+	var sb strings.Builder
+	for i, email := range emails {
+		fmt.Fprintf(&sb, "## [%d] %s\n- **From:** %s\n", i+1, email.Subject, email.From)
+		if !email.Date.IsZero() {
+			fmt.Fprintf(&sb, "- **Date:** %s\n", email.Date.In(location).Format("Mon, 2 Jan 2006 15:04 MST"))
+		}
+		fmt.Fprintf(&sb, "\n%s\n\n", truncateTokens(askEmailTokens, email.Text))
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().Ask, map[string]any{"emails": sb.String()})
+	if err != nil {
+		return "", err
+	}
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: prompt}}
+	for _, turn := range history {
+		messages = append(messages,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: turn.Question},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: turn.Answer},
+		)
+	}
+	messages = append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: question})
+	return s.callOpenAI(ctx, messages)
+}
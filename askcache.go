@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultAskCacheMinutes is how long an answer is reused when the config doesn't say
+const defaultAskCacheMinutes = 10
+
+// askFillerWords don't change what a question asks, so "what's the deposit?" and "What is the deposit" are the same
+// question
+var askFillerWords = map[string]bool{
+	"a": true, "an": true, "the": true, "is": true, "are": true, "was": true, "s": true, "do": true, "does": true,
+	"did": true, "please": true, "can": true, "could": true, "you": true, "tell": true, "me": true, "about": true,
+	"of": true, "any": true, "there": true, "i": true, "my": true,
+}
+
+// cachedAnswer is an /ask reply, kept for when the question comes again
+type cachedAnswer struct {
+	reply string
+	turn  AskTurn
+}
+
+// askCache keeps the recent /ask answers of a profile in memory, so the same question asked again in a busy channel
+// is answered without searching the index and asking the model again. the index version is part of the key: once new
+// emails are indexed the answer could be different, so it's asked again
+type askCache struct {
+	mu      sync.Mutex
+	answers map[string]cachedAnswer
+}
+
+// askCacheKey is the question's words, lowercased and in their order, without the filler words, at the index version.
+// rephrasing that only adds or drops those words asks the same question, but "did alice pay bob" isn't "did bob pay
+// alice"
+func askCacheKey(question string, indexVersion int) string {
+	var words []string
+	for _, word := range searchTerms(question) {
+		if !askFillerWords[word] {
+			words = append(words, word)
+		}
+	}
+	return strconv.Itoa(indexVersion) + ":" + strings.Join(words, " ")
+}
+
+// get is the answer cached for key, if it isn't older than ttl
+func (c *askCache) get(key string, now time.Time, ttl time.Duration) (cachedAnswer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.answers[key]
+	if !ok || now.Sub(cached.turn.At) > ttl {
+		return cachedAnswer{}, false
+	}
+	return cached, true
+}
+
+// put caches the answer for key, and drops the answers older than ttl
+func (c *askCache) put(key string, answer cachedAnswer, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answers == nil {
+		c.answers = make(map[string]cachedAnswer)
+	}
+	for k, cached := range c.answers {
+		if answer.turn.At.Sub(cached.turn.At) > ttl {
+			delete(c.answers, k)
+		}
+	}
+	c.answers[key] = answer
+}
+
+// askCacheTTL is how long answers are reused, 0 when they aren't
+func (a *App) askCacheTTL() time.Duration {
+	minutes := defaultAskCacheMinutes
+	if config := a.Config.Ask; config != nil && config.CacheMinutes != 0 {
+		minutes = max(config.CacheMinutes, 0)
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// currentVersion counts the changes to the index since the process started
+func (ix *emailIndex) currentVersion() int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.version
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// executableExtensions run code when opened on Windows or macOS, or install something
+var executableExtensions = map[string]bool{
+	".exe": true, ".scr": true, ".com": true, ".pif": true, ".bat": true, ".cmd": true, ".msi": true, ".msp": true,
+	".dll": true, ".cpl": true, ".hta": true, ".js": true, ".jse": true, ".vbs": true, ".vbe": true, ".wsf": true,
+	".wsh": true, ".ps1": true, ".psm1": true, ".jar": true, ".lnk": true, ".reg": true, ".app": true, ".pkg": true,
+	".dmg": true, ".iso": true, ".img": true, ".vhd": true, ".apk": true, ".sh": true, ".command": true,
+}
+
+// macroExtensions are office formats that can carry macros
+var macroExtensions = map[string]bool{
+	".docm": true, ".dotm": true, ".xlsm": true, ".xltm": true, ".xlsb": true, ".xlam": true, ".xla": true,
+	".pptm": true, ".potm": true, ".ppam": true, ".ppsm": true, ".sldm": true,
+}
+
+// decoyExtensions are what a double extension pretends to be, e.g. invoice.pdf.exe
+var decoyExtensions = map[string]bool{
+	".pdf": true, ".doc": true, ".docx": true, ".xls": true, ".xlsx": true, ".ppt": true, ".pptx": true, ".txt": true,
+	".rtf": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".mp3": true, ".mp4": true, ".zip": true,
+	".csv": true, ".html": true,
+}
+
+// AttachmentWarning is a risky attachment and why it's risky
+type AttachmentWarning struct {
+	Filename string `json:"filename"`
+	Reason   string `json:"reason"`
+}
+
+// attachmentWarnings flags the attachments of message that run code when opened
+func attachmentWarnings(message *gmail.Message) []AttachmentWarning {
+	if message.Payload == nil {
+		return nil
+	}
+
+	var warnings []AttachmentWarning
+	var walk func(part *gmail.MessagePart)
+	walk = func(part *gmail.MessagePart) {
+		if reason := attachmentRisk(part.Filename); reason != "" {
+			warnings = append(warnings, AttachmentWarning{Filename: part.Filename, Reason: reason})
+		}
+		for _, child := range part.Parts {
+			walk(child)
+		}
+	}
+	walk(message.Payload)
+	return warnings
+}
+
+// attachmentRisk says what's wrong with an attachment's name, or returns "" if nothing is
+func attachmentRisk(filename string) string {
+	// trailing dots and spaces are dropped by Windows, and are a common way to hide the real extension
+	name := strings.ToLower(strings.TrimRight(filename, ". "))
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return ""
+	}
+
+	inner := strings.TrimSpace(filepath.Ext(strings.TrimSuffix(name, ext)))
+	switch {
+	case executableExtensions[ext] && decoyExtensions[inner]:
+		return "executable disguised with a double extension"
+	case executableExtensions[ext]:
+		return "executable"
+	case macroExtensions[ext]:
+		return "office document with macros"
+	}
+	return ""
+}
+
+// attachmentSection is the digest's warning section, empty when no email has a risky attachment
+func attachmentSection(messages []*gmail.Message) *DigestSection {
+	section := &DigestSection{
+		Key:   "attachments",
+		Title: "⚠️ Dangerous attachments",
+		Intro: "Don't open these unless you were expecting them:",
+	}
+	for _, message := range messages {
+		for _, warning := range attachmentWarnings(message) {
+			section.Lines = append(section.Lines, fmt.Sprintf("⚠️ **%s**, %q: `%s` (%s)",
+				senderName(extractHeader(message, "From")), extractHeader(message, "Subject"), warning.Filename, warning.Reason))
+		}
+	}
+	return section
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// bounceSenders are the local parts of the addresses delivery failures come from
+var bounceSenders = []string{"mailer-daemon", "postmaster", "mail-daemon"}
+
+// bounceSubjects start the subject of a delivery failure, lowercased
+var bounceSubjects = []string{
+	"undeliverable", "undelivered mail", "delivery status notification (failure)", "delivery status notification (delay)",
+	"mail delivery failed", "mail delivery failure", "failure notice", "returned mail", "delivery failure",
+	"message not delivered", "nicht zustellbar", "non remis",
+}
+
+// autoReplySubjects start the subject of an automatic reply, lowercased, for the mail servers that don't say so in the
+// headers
+var autoReplySubjects = []string{
+	"automatic reply", "auto reply", "autoreply", "auto-reply", "auto:", "out of office:", "ooo:", "abwesenheitsnotiz",
+	"automatische antwort", "réponse automatique", "respuesta automática",
+}
+
+// outOfOfficeWords in the subject of an automatic reply make it an out of office one, lowercased
+var outOfOfficeWords = []string{
+	"out of office", "out of the office", "ooo", "away", "vacation", "holiday", "leave", "absence", "absent", "abwesen",
+	"urlaub", "congé", "vacaciones",
+}
+
+// maxAutoReplyText is how much of an automatic reply is read for whether it's an out of office one
+const maxAutoReplyText = 500
+
+var (
+	finalRecipientPattern = regexp.MustCompile(`(?i)(?:final|original)-recipient:\s*rfc822;\s*<?([^\s<>]+@[^\s<>]+?)>?\s`)
+	emailAddressPattern   = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+)
+
+// autoReplyKind says whether an email was sent by a machine on someone's behalf rather than written to the user:
+// "bounce" for a delivery failure, "out_of_office" for an away message, "auto_reply" for another automatic reply, or
+// "" for everything else. newsletters and notifications are written to the user, so they aren't auto replies
+func autoReplyKind(message *gmail.Message) string {
+	if message.Payload == nil {
+		return ""
+	}
+	from := senderAddress(extractHeader(message, "From"))
+	local, _, _ := strings.Cut(from, "@")
+	subject := strings.ToLower(strings.TrimSpace(extractHeader(message, "Subject")))
+
+	if extractHeader(message, "X-Failed-Recipients") != "" ||
+		strings.Contains(strings.ToLower(message.Payload.MimeType+extractHeader(message, "Content-Type")), "report-type=delivery-status") {
+		return "bounce"
+	}
+	for _, sender := range bounceSenders {
+		if local == sender {
+			return "bounce"
+		}
+	}
+	for _, prefix := range bounceSubjects {
+		if strings.HasPrefix(subject, prefix) {
+			return "bounce"
+		}
+	}
+
+	// RFC 3834 marks replies sent by a program; "auto-generated" is a notification, which the user does want to read
+	automatic := strings.HasPrefix(strings.ToLower(extractHeader(message, "Auto-Submitted")), "auto-replied") ||
+		extractHeader(message, "X-Autoreply") != "" || extractHeader(message, "X-Autorespond") != "" ||
+		strings.EqualFold(extractHeader(message, "Precedence"), "auto_reply")
+	for _, prefix := range autoReplySubjects {
+		if strings.HasPrefix(subject, prefix) {
+			automatic = true
+		}
+	}
+	if !automatic {
+		return ""
+	}
+	// "Automatic reply: <the user's subject>" only says it's an away message in the text
+	text := subject + " " + strings.ToLower(extractBody(message))
+	text = text[:min(len(text), maxAutoReplyText)]
+	for _, word := range outOfOfficeWords {
+		if strings.Contains(text, word) {
+			return "out_of_office"
+		}
+	}
+	return "auto_reply"
+}
+
+// bouncedRecipient is who the bounced email was for, from the failure's headers or its text. "" when it doesn't say
+func bouncedRecipient(message *gmail.Message) string {
+	if failed := extractHeader(message, "X-Failed-Recipients"); failed != "" {
+		return strings.TrimSpace(strings.Split(failed, ",")[0])
+	}
+	body := extractBody(message)
+	if match := finalRecipientPattern.FindStringSubmatch(body + "\n"); match != nil {
+		return match[1]
+	}
+	from := senderAddress(extractHeader(message, "From"))
+	for _, address := range emailAddressPattern.FindAllString(body, -1) {
+		if !strings.EqualFold(address, from) {
+			return address
+		}
+	}
+	return ""
+}
+
+// splitAutoReplies takes the bounces and automatic replies out of the emails, so the model never reads them
+func splitAutoReplies(messages []*gmail.Message) (written, bounces, autoReplies []*gmail.Message) {
+	for _, message := range messages {
+		switch autoReplyKind(message) {
+		case "bounce":
+			bounces = append(bounces, message)
+		case "out_of_office", "auto_reply":
+			autoReplies = append(autoReplies, message)
+		default:
+			written = append(written, message)
+		}
+	}
+	return written, bounces, autoReplies
+}
+
+// bounceSection lists the emails of the user's that didn't arrive, which they'll want to resend. Gmail keeps a bounce in
+// the thread of the email that bounced, so the link opens both
+func bounceSection(bounces []*gmail.Message, account int) *DigestSection {
+	section := &DigestSection{
+		Key:   "bounces",
+		Title: "↩️ Bounced",
+		Intro: "These didn't arrive, check the address and send them again:",
+	}
+	for _, message := range bounces {
+		line := "An email of yours bounced"
+		if recipient := bouncedRecipient(message); recipient != "" {
+			line = fmt.Sprintf("Your email to **%s** bounced", recipient)
+		}
+		if message.ThreadId != "" {
+			line += fmt.Sprintf(" ([open](<%s>))", gmailThreadURL(account, message.ThreadId))
+		}
+		section.Lines = append(section.Lines, line)
+	}
+	return section
+}
+
+// autoReplySection names who replied automatically, in one line
+func autoReplySection(autoReplies []*gmail.Message) *DigestSection {
+	section := &DigestSection{Key: "auto_replies", Title: "🏖️ Automatic replies", Inline: true}
+	for _, message := range autoReplies {
+		name := senderName(extractHeader(message, "From"))
+		if autoReplyKind(message) == "out_of_office" {
+			name += " (out of office)"
+		}
+		section.Lines = append(section.Lines, name)
+	}
+	return section
+}
+
+// listedOnlyDigest is the digest when every email is one that's listed rather than summarized, like bounces, automatic
+// replies, code notifications and mailing lists. it's made without the model, the caller adds the lists
+func (a *App) listedOnlyDigest(ctx context.Context, kind string) *Digest {
+	now := a.Clock.Now()
+	id, ok := digestIDFromContext(ctx)
+	if !ok {
+		id = oneOffDigestID(a.Profile, kind, now)
+	}
+	return &Digest{
+		ID:          id,
+		Kind:        kind,
+		GeneratedAt: now,
+		Summary:     "Nothing came in that needed summarizing, it's all listed below.",
+		Categories:  make(map[string]int),
+	}
+}
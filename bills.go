@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// defaultBillDaysBefore is how many days before a deadline its reminder goes out when the config doesn't say
+	defaultBillDaysBefore = 3
+	// defaultBillReminderTime is when the reminders are posted when the config doesn't say
+	defaultBillReminderTime = "09:00"
+)
+
+// billPattern picks out the emails worth asking the model about, lowercased
+var billPattern = regexp.MustCompile(`invoice|bill\b|billing|statement|payment due|due date|amount due|renew|subscription|auto-pay|autopay|direct debit|trial (?:ends|expires|is ending)|expir|membership|premium`)
+
+// billKinds are what a deadline can be, and the emoji of each kind's reminder
+var billKinds = map[string]string{
+	"bill":    "🧾",
+	"renewal": "🔁",
+	"trial":   "⏳",
+}
+
+type BillsConfig struct {
+	// DaysBefore is how many days before a deadline its reminder is posted
+	DaysBefore int `json:"days_before"`
+	// Time is when the reminders are posted each day, as 15:04
+	Time string `json:"time"`
+	// ChannelID is where the reminders go, the daily channel by default
+	ChannelID string `json:"channel_id"`
+}
+
+// Bill is a deadline found in an email: a bill to pay, a subscription renewal or the end of a free trial
+type Bill struct {
+	MessageID string `json:"message_id"`
+	ThreadID  string `json:"thread_id"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Amount    string `json:"amount"`
+	// Due is the deadline, as 2006-01-02
+	Due       string `json:"due"`
+	Automatic bool   `json:"automatic"`
+	// Reminded is when the reminder went out, zero until it has
+	Reminded time.Time `json:"reminded"`
+}
+
+// key tells deadlines apart: another email about the same bill, like a second notice, doesn't make a second reminder
+func (b *Bill) key() string {
+	return strings.ToLower(strings.TrimSpace(b.Name)) + "|" + b.Due
+}
+
+// ExtractBills asks the model for the deadlines in the emails
+func (s *openAISummarizer) ExtractBills(ctx context.Context, messages []*gmail.Message) ([]Bill, error) {
+	location := s.clock.Now().Location()
+
+	var emails strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&emails, "## id: %s\n- **From:** %s\n- **Subject:** %s\n- **Date:** %s\n\n%s\n\n",
+			message.Id,
+			extractHeader(message, "From"),
+			extractHeader(message, "Subject"),
+			localDate(extractHeader(message, "Date"), location),
+			truncateTokens(500, stripQuotes(extractBody(message))),
+		)
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().Bills, map[string]any{
+		"emails": emails.String(),
+		"today":  s.clock.Now().Format("Monday 2 January 2006"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.callOpenAIJSON(ctx, []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: prompt,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Bills []Bill `json:"bills"`
+	}
+	if err := json.Unmarshal([]byte(resp), &parsed); err != nil {
+		return nil, fmt.Errorf("unable to parse bills: %v", err)
+	}
+	return parsed.Bills, nil
+}
+
+// trackBills stores the deadlines in the emails for their reminders. it's best effort, the emails are in the digest
+// either way
+func (a *App) trackBills(ctx context.Context, messages []*gmail.Message) {
+	if a.Config.Bills == nil || len(messages) == 0 {
+		return
+	}
+	logger := log.FromContext(ctx)
+
+	var candidates []*gmail.Message
+	for _, message := range messages {
+		if billPattern.MatchString(strings.ToLower(extractHeader(message, "Subject") + " " + message.Snippet)) {
+			candidates = append(candidates, message)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	found, err := a.Summarizer.ExtractBills(ctx, candidates)
+	if err != nil {
+		logger.Error("Unable to look for bills", "error", err)
+		return
+	}
+	byID := make(map[string]*gmail.Message, len(candidates))
+	for _, message := range candidates {
+		byID[message.Id] = message
+	}
+
+	today := a.Clock.Now().Format(time.DateOnly)
+	added := 0
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		added = 0
+		for _, bill := range found {
+			message, ok := byID[bill.MessageID]
+			_, known := billKinds[bill.Kind]
+			if !ok || !known || bill.Name == "" {
+				continue
+			}
+			if _, err := time.Parse(time.DateOnly, bill.Due); err != nil || bill.Due < today {
+				continue
+			}
+			bill.ThreadID = message.ThreadId
+			bill.Reminded = time.Time{}
+			if slices.ContainsFunc(account.Bills, func(b Bill) bool { return b.key() == bill.key() }) {
+				continue
+			}
+			account.Bills = append(account.Bills, bill)
+			added++
+		}
+	}); err != nil {
+		logger.Error("Unable to save the bills", "error", err)
+		return
+	}
+	if added > 0 {
+		logger.Info("Bills found", "added", added)
+	}
+}
+
+// sendBillReminders posts a reminder for every deadline that's close enough, once, and forgets the ones that passed
+func (a *App) sendBillReminders(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	config := a.Config.Bills
+	now := a.Clock.Now()
+	today := now.Format(time.DateOnly)
+	daysBefore := defaultBillDaysBefore
+	if config.DaysBefore > 0 {
+		daysBefore = config.DaysBefore
+	}
+	horizon := now.AddDate(0, 0, daysBefore).Format(time.DateOnly)
+	channelID := config.ChannelID
+	if channelID == "" {
+		channelID = a.dailyChannel()
+	}
+
+	var due []Bill
+	a.state.read(func(s *State) {
+		for _, bill := range s.account().Bills {
+			if bill.Reminded.IsZero() && bill.Due >= today && bill.Due <= horizon {
+				due = append(due, bill)
+			}
+		}
+	})
+	slices.SortFunc(due, func(a, b Bill) int { return strings.Compare(a.Due, b.Due) })
+
+	var reminded []string
+	for _, bill := range due {
+		if err := a.sendToDiscord(channelID, a.billReminder(bill, now)); err != nil {
+			// it's tried again tomorrow, while it's still due
+			logger.Error("Unable to send bill reminder", "name", bill.Name, "due", bill.Due, "error", err)
+			continue
+		}
+		reminded = append(reminded, bill.key())
+	}
+
+	return a.state.update(func(s *State) {
+		account := s.account()
+		for i := range account.Bills {
+			if slices.Contains(reminded, account.Bills[i].key()) {
+				account.Bills[i].Reminded = now
+			}
+		}
+		account.Bills = slices.DeleteFunc(account.Bills, func(b Bill) bool { return b.Due < today })
+	})
+}
+
+// billReminder is the reminder of a deadline, e.g. "🧾 **Electricity** is due in 3 days (Fri 14 Mar), €82.10"
+func (a *App) billReminder(bill Bill, now time.Time) string {
+	due, _ := time.ParseInLocation(time.DateOnly, bill.Due, a.Location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, a.Location)
+	// rounded, a day with a clock change isn't 24 hours
+	days := int(math.Round(due.Sub(today).Hours() / 24))
+
+	when := fmt.Sprintf("in %s (%s)", pluralize(days, "day"), a.locale().shortDate(due))
+	switch days {
+	case 0:
+		when = "today"
+	case 1:
+		when = "tomorrow"
+	}
+	what := "is due"
+	switch bill.Kind {
+	case "renewal":
+		what = "renews"
+	case "trial":
+		what = "free trial ends"
+	}
+
+	line := fmt.Sprintf("%s **%s** %s %s", billKinds[bill.Kind], bill.Name, what, when)
+	if bill.Amount != "" {
+		line += ", " + a.locale().money(bill.Amount)
+	}
+	if bill.Automatic {
+		line += ". It's paid automatically, just check that's still what you want"
+	}
+	if bill.ThreadID != "" {
+		line += fmt.Sprintf(" ([email](<%s>))", gmailThreadURL(a.Config.GmailAccount, bill.ThreadID))
+	}
+	return line
+}
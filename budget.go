@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+// the token estimates behind projectDigestCost. they're rough on purpose, they only have to tell a digest that fits the
+// budget from one that doesn't
+const (
+	// promptOverheadTokens is the digest template, the user's context and the email template, sent with every email
+	promptOverheadTokens = 1200
+	// notesTokensPerEmail is what the running notes grow by for an email read in full. the notes are sent and rewritten
+	// with every email, which is what makes big digests expensive
+	notesTokensPerEmail = 120
+	// condensedNotesTokens is the same for a condensed email, a line at most
+	condensedNotesTokens = 30
+	// condensedBodyLength is how many characters of a condensed email the model gets to see
+	condensedBodyLength = 600
+)
+
+// condensedInstructions are given to the model for the emails condensed to stay within the budget
+const condensedInstructions = "The digest is over its cost budget, so this email is condensed: mention it in a single short line at most."
+
+// defaultCondenseCategories are the Gmail inbox tabs condensed first, least important first
+var defaultCondenseCategories = []string{"promotions", "social", "forums", "updates"}
+
+type BudgetConfig struct {
+	MaxCost  float64  `json:"max_cost"`
+	Condense []string `json:"condense"`
+	VIPs     []string `json:"vips"`
+	// ConfirmAbove is the projected cost in dollars above which a scheduled digest asks in Discord before it's written
+	ConfirmAbove float64 `json:"confirm_above"`
+	// ConfirmWait is how long it waits for the answer, 20m when unset
+	ConfirmWait string `json:"confirm_wait"`
+}
+
+// detailLevel is how much of the digest an email gets
+type detailLevel int
+
+const (
+	detailFull detailLevel = iota
+	detailOneLine
+	detailCountOnly
+)
+
+// budgetPlan is what was condensed to bring a digest within the budget
+type budgetPlan struct {
+	budget    float64
+	projected float64 // projected is the cost of the digest in full
+	final     float64
+	// categories are the condensed categories in the order they were condensed, with the emails at each level
+	categories []string
+	oneLine    map[string][]*gmail.Message
+	countOnly  map[string][]*gmail.Message
+}
+
+type urgentEmailsKey struct{}
+
+// withUrgentEmails marks the emails, by message id, that a rule escalated. the budget never condenses them
+func withUrgentEmails(ctx context.Context, escalated []escalation) context.Context {
+	urgent := make(map[string]bool, len(escalated))
+	for _, e := range escalated {
+		urgent[e.message.Id] = true
+	}
+	return context.WithValue(ctx, urgentEmailsKey{}, urgent)
+}
+
+func urgentEmailsFromContext(ctx context.Context) map[string]bool {
+	urgent, _ := ctx.Value(urgentEmailsKey{}).(map[string]bool)
+	return urgent
+}
+
+// summarizeWithinBudget is Summarizer.Summarize, after condensing the least important categories if the digest is
+// projected to cost more than the budget. what was condensed is listed in a section of the digest
+func (a *App) summarizeWithinBudget(ctx context.Context, kind string, messages []*gmail.Message) (*Digest, error) {
+	// bounces and automatic replies say nothing worth summarizing, they're listed instead. code notifications are
+	// condensed by repository and mailing lists by list
+	all := messages
+	messages, bounces, autoReplies := splitAutoReplies(messages)
+	messages, code := splitCodeNotifications(messages)
+	messages, lists, leftOut := a.splitMailingLists(messages)
+
+	var digest *Digest
+	if len(messages) == 0 {
+		digest = a.listedOnlyDigest(ctx, kind)
+	} else {
+		var plan *budgetPlan
+		var summarized []*gmail.Message
+		ctx, summarized, plan = a.planBudget(ctx, messages)
+		ctx = a.withVisionImages(ctx, summarized)
+		ctx = a.withKnownThreads(ctx, kind, summarized)
+
+		var err error
+		digest, err = a.Summarizer.Summarize(ctx, kind, summarized)
+		if err != nil {
+			return nil, err
+		}
+		if plan != nil {
+			digest.EmailCount = len(messages) - len(digest.Unsummarized)
+			digest.addSection(plan.section())
+		}
+		digest.addSection(unsummarizedSection(digest.Unsummarized))
+		a.rememberThreads(ctx, kind, digest, summarized[:len(summarized)-len(digest.Unsummarized)])
+	}
+
+	digest.EmailCount += len(bounces) + len(autoReplies) + len(code)
+	for _, listed := range lists {
+		digest.EmailCount += len(listed)
+	}
+	for _, count := range leftOut {
+		digest.EmailCount += count
+	}
+	digest.addSection(a.mailingListSection(ctx, lists, leftOut))
+	digest.addSection(a.privacySection(all))
+	// the emails left for a follow-up digest are recorded with it
+	digest.MessageIDs = messageIDs(slices.DeleteFunc(slices.Clone(all), func(m *gmail.Message) bool {
+		return slices.Contains(digest.Unsummarized, m)
+	}))
+	digest.addSection(codeNotificationSection(code, a.Config.GmailAccount))
+	digest.addSection(bounceSection(bounces, a.Config.GmailAccount))
+	digest.addSection(autoReplySection(autoReplies))
+	digest.addSection(bodyProblemSection(all, a.Config.GmailAccount))
+	return digest, nil
+}
+
+// planBudget decides how much detail each email gets. categories are condensed to one line each, in the configured
+// order, until the projection fits the budget, then left out and only counted. VIPs, escalated emails and categories
+// that aren't listed always get the full treatment, so a digest can still end up over the budget
+func (a *App) planBudget(ctx context.Context, messages []*gmail.Message) (context.Context, []*gmail.Message, *budgetPlan) {
+	config := a.Config.Budget
+	if config == nil || config.MaxCost <= 0 {
+		return ctx, messages, nil
+	}
+
+	levels := make(map[string]detailLevel, len(messages))
+	projected := projectDigestCost(messages, levels)
+	if projected <= config.MaxCost {
+		return ctx, messages, nil
+	}
+
+	order := config.Condense
+	if len(order) == 0 {
+		order = defaultCondenseCategories
+	}
+	urgent := urgentEmailsFromContext(ctx)
+	byCategory := make(map[string][]*gmail.Message)
+	for _, message := range messages {
+		if urgent[message.Id] || isVIP(message, config.VIPs) {
+			continue
+		}
+		category := gmailCategory(message)
+		byCategory[category] = append(byCategory[category], message)
+	}
+
+	plan := &budgetPlan{
+		budget:    config.MaxCost,
+		projected: projected,
+		final:     projected,
+		oneLine:   make(map[string][]*gmail.Message),
+		countOnly: make(map[string][]*gmail.Message),
+	}
+	for _, level := range []detailLevel{detailOneLine, detailCountOnly} {
+		for _, category := range order {
+			condensing := byCategory[strings.ToLower(category)]
+			if plan.final <= config.MaxCost || len(condensing) == 0 {
+				continue
+			}
+			if level == detailCountOnly && countedCount(levels)+len(condensing) == len(messages) {
+				// leaving everything out isn't a digest anymore
+				continue
+			}
+			for _, message := range condensing {
+				levels[message.Id] = level
+			}
+			plan.final = projectDigestCost(messages, levels)
+			plan.condense(strings.ToLower(category), level, condensing)
+		}
+	}
+	if len(plan.categories) == 0 {
+		log.FromContext(ctx).Warn("Digest is over budget, but nothing in it can be condensed", "projected", projected, "budget", config.MaxCost)
+		return ctx, messages, nil
+	}
+
+	prompts := make(map[string]emailPrompt)
+	for id, prompt := range emailPromptsFromContext(ctx) {
+		prompts[id] = prompt
+	}
+	var summarized []*gmail.Message
+	for _, message := range messages {
+		switch levels[message.Id] {
+		case detailCountOnly:
+			continue
+		case detailOneLine:
+			prompt := prompts[message.Id]
+			prompt.condensed = true
+			prompts[message.Id] = prompt
+		}
+		summarized = append(summarized, message)
+	}
+
+	log.FromContext(ctx).Warn("Digest is over budget, condensed it", "projected", projected, "budget", config.MaxCost, "final", plan.final, "categories", strings.Join(plan.categories, ","))
+	return withEmailPrompts(ctx, prompts), summarized, plan
+}
+
+// condense records that category went down to level. a category condensed to one line and then left out is only
+// reported as left out
+func (p *budgetPlan) condense(category string, level detailLevel, messages []*gmail.Message) {
+	if level == detailOneLine {
+		p.categories = append(p.categories, category)
+		p.oneLine[category] = messages
+		return
+	}
+	if _, ok := p.oneLine[category]; !ok {
+		p.categories = append(p.categories, category)
+	}
+	delete(p.oneLine, category)
+	p.countOnly[category] = messages
+}
+
+// section says what was condensed, for the end of the digest
+func (p *budgetPlan) section() *DigestSection {
+	section := &DigestSection{
+		Key:   "condensed",
+		Title: fmt.Sprintf("✂️ Condensed to stay within the $%.2f budget", p.budget),
+		Intro: fmt.Sprintf("*projected $%.2f in full, $%.2f condensed*", p.projected, p.final),
+	}
+	for _, category := range p.categories {
+		if messages, ok := p.oneLine[category]; ok {
+			section.Lines = append(section.Lines, fmt.Sprintf("**%s:** %s, a line each at most", category, pluralize(len(messages), "email")))
+			continue
+		}
+		messages := p.countOnly[category]
+		section.Lines = append(section.Lines, fmt.Sprintf("**%s:** %s left out, from %s", category, pluralize(len(messages), "email"), topSenders(messages, 3)))
+	}
+	return section
+}
+
+// projectDigestCost estimates what summarizing the emails will cost at the given detail levels, from their length
+func projectDigestCost(messages []*gmail.Message, levels map[string]detailLevel) float64 {
+	var promptTokens, completionTokens, notes int
+	for _, message := range messages {
+		bodyLength := len(extractBody(message))
+		switch levels[message.Id] {
+		case detailCountOnly:
+			continue
+		case detailOneLine:
+			bodyLength = min(bodyLength, condensedBodyLength)
+			notes += condensedNotesTokens
+		default:
+			notes += notesTokensPerEmail
+		}
+		// about four characters to a token
+		promptTokens += promptOverheadTokens + notes + bodyLength/4
+		completionTokens += notes
+	}
+	// turning the notes into the summary
+	promptTokens += promptOverheadTokens + notes
+	completionTokens += notes
+
+	return float64(promptTokens)/1e6*promptCostPerMillion + float64(completionTokens)/1e6*completionCostPerMillion
+}
+
+func countedCount(levels map[string]detailLevel) int {
+	n := 0
+	for _, level := range levels {
+		if level == detailCountOnly {
+			n++
+		}
+	}
+	return n
+}
+
+// gmailCategory is the inbox tab of an email, "primary" when Gmail didn't put it in another one
+func gmailCategory(message *gmail.Message) string {
+	for _, id := range message.LabelIds {
+		if category, ok := strings.CutPrefix(id, "CATEGORY_"); ok && category != "PERSONAL" {
+			return strings.ToLower(category)
+		}
+	}
+	return "primary"
+}
+
+// isVIP reports whether the sender is one of vips, each an email address or a whole domain like "@example.com"
+func isVIP(message *gmail.Message, vips []string) bool {
+	address := senderAddress(extractHeader(message, "From"))
+	for _, vip := range vips {
+		vip = strings.ToLower(strings.TrimSpace(vip))
+		if address == vip || (strings.HasPrefix(vip, "@") && strings.HasSuffix(address, vip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// topSenders names the most frequent senders of the emails, e.g. "LinkedIn, Facebook and 4 others"
+func topSenders(messages []*gmail.Message, n int) string {
+	counts := make(map[string]int)
+	var names []string
+	for _, message := range messages {
+		name := senderName(extractHeader(message, "From"))
+		if counts[name] == 0 {
+			names = append(names, name)
+		}
+		counts[name]++
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return counts[names[i]] > counts[names[j]]
+	})
+	if len(names) <= n {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %s", strings.Join(names[:n], ", "), pluralize(len(names)-n, "other"))
+}
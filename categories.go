@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// defaultCategoryInstruction is what the entries prompt says about categories when the user hasn't defined their own
+const defaultCategoryInstruction = "a short lowercase category such as `work`, `finance`, `personal`, `newsletter`, `notification`."
+
+// otherCategory is where the emails fitting none of the user's categories go
+const otherCategory = "other"
+
+// CategoryConfig is a category of the user's own. once any are defined, the digest entries only use those
+type CategoryConfig struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Senders and Subjects are examples of the emails that belong in it, to show the model rather than to match
+	Senders  []string `json:"senders"`
+	Subjects []string `json:"subjects"`
+	// ChannelID gets a post with the category's emails after each daily digest, none when empty
+	ChannelID string `json:"channel_id"`
+	// Detail is how much that post says about each email: full (the default), brief or count
+	Detail string `json:"detail"`
+}
+
+// validateCategories checks that the categories have names, each its own, and a detail level there is
+func validateCategories(categories []CategoryConfig) error {
+	seen := make(map[string]bool, len(categories))
+	for i, category := range categories {
+		name := strings.ToLower(strings.TrimSpace(category.Name))
+		if name == "" {
+			return fmt.Errorf("category %d has no name", i+1)
+		}
+		if seen[name] {
+			return fmt.Errorf("category %q is defined twice", category.Name)
+		}
+		seen[name] = true
+		switch category.Detail {
+		case "", "full", "brief", "count":
+		default:
+			return fmt.Errorf("%s: detail must be full, brief or count, got %q", category.Name, category.Detail)
+		}
+	}
+	return nil
+}
+
+// categoryInstruction tells the model which categories it can put the entries in, with what each is for and examples
+// of what's in it
+func categoryInstruction(categories []CategoryConfig) string {
+	if len(categories) == 0 {
+		return defaultCategoryInstruction
+	}
+	var sb strings.Builder
+	sb.WriteString("exactly one of the user's categories below, written as it is here. Use `" + otherCategory + "` when none of them fits.")
+	for _, category := range categories {
+		sb.WriteString("\n    - `" + category.Name + "`")
+		if category.Description != "" {
+			sb.WriteString(": " + category.Description)
+		}
+		var examples []string
+		if len(category.Senders) > 0 {
+			examples = append(examples, "from "+strings.Join(category.Senders, ", "))
+		}
+		if len(category.Subjects) > 0 {
+			examples = append(examples, "subjects like \""+strings.Join(category.Subjects, "\", \"")+"\"")
+		}
+		if len(examples) > 0 {
+			sb.WriteString(" (e.g. " + strings.Join(examples, "; ") + ")")
+		}
+	}
+	return sb.String()
+}
+
+// normalizeCategories holds the model to the user's categories: a name in another case becomes the one configured, a
+// name that isn't one of them becomes other
+func normalizeCategories(entries []DigestEntry, categories []CategoryConfig) {
+	if len(categories) == 0 {
+		return
+	}
+	for i, entry := range entries {
+		entries[i].Category = otherCategory
+		for _, category := range categories {
+			if strings.EqualFold(strings.TrimSpace(entry.Category), category.Name) {
+				entries[i].Category = category.Name
+				break
+			}
+		}
+	}
+}
+
+// routeCategories posts the emails of each category with a channel to that channel, at the category's detail level
+func (a *App) routeCategories(digest *Digest) {
+	for _, category := range a.Config.Categories {
+		if category.ChannelID == "" {
+			continue
+		}
+		var entries []DigestEntry
+		for _, entry := range digest.Entries {
+			if entry.Category == category.Name {
+				entries = append(entries, entry)
+			}
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if err := a.sendToDiscord(category.ChannelID, formatCategoryPost(category, entries)); err != nil {
+			log.Error("Unable to send category post", "category", category.Name, "error", err)
+		}
+	}
+}
+
+// formatCategoryPost lists a category's emails: with their summaries and action items at full detail, a line with the
+// subject and sender each when brief, and only how many there were for count
+func formatCategoryPost(category CategoryConfig, entries []DigestEntry) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "📁 **%s**: %s in today's digest", category.Name, pluralize(len(entries), "email"))
+	if category.Detail == "count" {
+		return sb.String()
+	}
+	for _, entry := range entries {
+		subject := entry.Subject
+		if subject == "" {
+			subject = "(no subject)"
+		}
+		if entry.URL != "" {
+			subject = fmt.Sprintf("[%s](<%s>)", strings.NewReplacer("[", "(", "]", ")").Replace(subject), entry.URL)
+		}
+		fmt.Fprintf(&sb, "\n- %s · %s", subject, senderName(entry.From))
+		if category.Detail == "brief" {
+			continue
+		}
+		if entry.Summary != "" {
+			sb.WriteString(": " + entry.Summary)
+		}
+		for _, item := range entry.ActionItems {
+			sb.WriteString("\n  - ☐ " + item.Description)
+			if item.Due != "" {
+				sb.WriteString(" (due " + item.Due + ")")
+			}
+		}
+	}
+	return sb.String()
+}
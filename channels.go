@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+)
+
+// DiscordChannels are the channels of a profile that can be changed while the bot runs, by config key
+type DiscordChannels struct {
+	Daily      string `json:"daily_summary_channel_id"`
+	Weekly     string `json:"weekly_summary_channel_id"`
+	OAuthDebug string `json:"oauth_debug_channel_id"`
+}
+
+// channelKeys are the config keys of DiscordChannels, in the order /config shows them
+var channelKeys = []string{"daily_summary_channel_id", "weekly_summary_channel_id", "oauth_debug_channel_id"}
+
+// field is the channel of a config key
+func (c *DiscordChannels) field(key string) *string {
+	switch key {
+	case "daily_summary_channel_id":
+		return &c.Daily
+	case "weekly_summary_channel_id":
+		return &c.Weekly
+	case "oauth_debug_channel_id":
+		return &c.OAuthDebug
+	}
+	return nil
+}
+
+func configChannels(config *Config) DiscordChannels {
+	return DiscordChannels{
+		Daily:      config.DailySummaryChannelID,
+		Weekly:     config.WeeklySummaryChannelID,
+		OAuthDebug: config.OAuthDebugChannelID,
+	}
+}
+
+// currentChannels are the config's channels with the ones /config set changed on top
+func currentChannels(config *Config, state *stateStore) *DiscordChannels {
+	channels := configChannels(config)
+	state.read(func(s *State) {
+		for key, id := range s.Channels {
+			if field := channels.field(key); field != nil {
+				*field = id
+			}
+		}
+	})
+	return &channels
+}
+
+func (a *App) dailyChannel() string {
+	return a.discordChannels.Load().Daily
+}
+
+func (a *App) weeklyChannel() string {
+	return a.discordChannels.Load().Weekly
+}
+
+func (a *App) oauthChannel() string {
+	return a.discordChannels.Load().OAuthDebug
+}
+
+// checkChannel makes sure the bot can see and post in a channel before anything is sent there
+func (a *App) checkChannel(id string) error {
+	if a.Discord == nil || a.Discord.State == nil || a.Discord.State.User == nil {
+		return errors.New("not connected to Discord")
+	}
+	permissions, err := a.Discord.UserChannelPermissions(a.Discord.State.User.ID, id)
+	if err != nil {
+		return fmt.Errorf("looking up channel %s: %w", id, err)
+	}
+	const needed = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages
+	if permissions&needed != needed {
+		return fmt.Errorf("the bot can't post in <#%s>, give it the View Channel and Send Messages permissions there", id)
+	}
+	return nil
+}
+
+// setChannel points a config key at another channel, from the next message on. the Discord session stays up, only
+// where the messages go changes
+func (a *App) setChannel(key, id string) error {
+	if a.discordChannels.Load().field(key) == nil {
+		return fmt.Errorf("%q isn't a channel, use one of %s", key, strings.Join(channelKeys, ", "))
+	}
+	if id != "" {
+		if err := a.checkChannel(id); err != nil {
+			return err
+		}
+	}
+	channels := *a.discordChannels.Load()
+	*channels.field(key) = id
+	a.discordChannels.Store(&channels)
+	return nil
+}
+
+// configCommand is /config: shows the channels, or moves one of them to another channel until the config changes it
+func configCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	if options["action"] != "set" {
+		channels := a.discordChannels.Load()
+		var sb strings.Builder
+		for _, key := range channelKeys {
+			fmt.Fprintf(&sb, "**%s**: ", key)
+			if id := *channels.field(key); id != "" {
+				fmt.Fprintf(&sb, "<#%s>\n", id)
+			} else {
+				sb.WriteString("not set\n")
+			}
+		}
+		return sb.String(), nil
+	}
+
+	key, id := options["key"], options["channel"]
+	if key == "" || id == "" {
+		return "", errors.New("set needs a key and a channel")
+	}
+	if err := a.setChannel(key, id); err != nil {
+		return "", err
+	}
+	if err := a.state.update(func(s *State) {
+		if s.Channels == nil {
+			s.Channels = make(map[string]string)
+		}
+		s.Channels[key] = id
+	}); err != nil {
+		return "", fmt.Errorf("saving the channel: %w", err)
+	}
+	log.FromContext(ctx).Info("Channel changed", "key", key, "channel_id", id)
+	return fmt.Sprintf("**%s** is now <#%s>.", key, id), nil
+}
+
+// reloadConfig reads the config again, set by runCLI to load it the way it was loaded at startup
+var reloadConfig func() (*Config, error)
+
+// watchConfigReloads applies the channels of the config again each time the process gets SIGHUP. only the channels
+// change; the rest of the config still needs a restart
+func watchConfigReloads(apps []*App) {
+	if reloadConfig == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Info("Reloading the config's channels")
+			config, err := reloadConfig()
+			if err != nil {
+				log.Error("Unable to reload the config", "error", err)
+				continue
+			}
+			for _, a := range apps {
+				profile := config
+				if a.Profile != "" {
+					if profile, err = profileConfig(config, a.Profile); err != nil {
+						log.Error("Unable to reload the config", "profile", a.Profile, "error", err)
+						continue
+					}
+				}
+				a.reloadChannels(profile)
+			}
+		}
+	}()
+}
+
+// reloadChannels moves the channels the config changed since it was last read. a channel changed in the config wins
+// over an earlier /config set of it
+func (a *App) reloadChannels(config *Config) {
+	logger := log.With("profile", a.Profile)
+	previous, next := a.configuredChannels, configChannels(config)
+	var changed []string
+	for _, key := range channelKeys {
+		id := *next.field(key)
+		if id == *previous.field(key) {
+			continue
+		}
+		if err := a.setChannel(key, id); err != nil {
+			logger.Error("Keeping the channel", "key", key, "error", err)
+			*next.field(key) = *previous.field(key)
+			continue
+		}
+		logger.Info("Channel changed", "key", key, "channel_id", id)
+		changed = append(changed, key)
+	}
+	a.configuredChannels = next
+	if len(changed) == 0 {
+		return
+	}
+	if err := a.state.update(func(s *State) {
+		for _, key := range changed {
+			delete(s.Channels, key)
+		}
+	}); err != nil {
+		logger.Error("Unable to save the channels", "error", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type MattermostConfig struct {
+	WebhookURL string `json:"webhook_url"`
+	Channel    string `json:"channel"`
+	Username   string `json:"username"`
+}
+
+type TeamsConfig struct {
+	WebhookURL string `json:"webhook_url"`
+}
+
+// mattermostNotifier posts the rendered digest through a Mattermost incoming webhook
+type mattermostNotifier struct {
+	config MattermostConfig
+	client *http.Client
+}
+
+func newMattermostNotifier(config MattermostConfig) *mattermostNotifier {
+	return &mattermostNotifier{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (m *mattermostNotifier) Name() string {
+	return "mattermost"
+}
+
+func (m *mattermostNotifier) Notify(digest *Digest) error {
+	body, err := json.Marshal(struct {
+		Text     string `json:"text"`
+		Channel  string `json:"channel,omitempty"`
+		Username string `json:"username,omitempty"`
+	}{
+		Text:     renderMarkdown(digest),
+		Channel:  m.config.Channel,
+		Username: m.config.Username,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding mattermost message: %w", err)
+	}
+
+	return postJSON(m.client, m.config.WebhookURL, body, nil)
+}
+
+// teamsNotifier posts the rendered digest as a MessageCard through a Teams incoming webhook
+type teamsNotifier struct {
+	config TeamsConfig
+	client *http.Client
+}
+
+func newTeamsNotifier(config TeamsConfig) *teamsNotifier {
+	return &teamsNotifier{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (t *teamsNotifier) Name() string {
+	return "teams"
+}
+
+func (t *teamsNotifier) Notify(digest *Digest) error {
+	title := fmt.Sprintf("Email summary (%s)", digest.Kind)
+
+	body, err := json.Marshal(map[string]any{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    title,
+		"title":      title,
+		"text":       renderMarkdown(digest),
+		"themeColor": "5865F2",
+	})
+	if err != nil {
+		return fmt.Errorf("encoding teams card: %w", err)
+	}
+
+	return postJSON(t.client, t.config.WebhookURL, body, nil)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(a *App, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "run the scheduler daemon (default)", runCommand},
+		{"auth", "authorize gmail access from the terminal", authCommand},
+		{"summarize", "summarize recent emails once", summarizeCommand},
+		{"tui", "run the daemon with a terminal dashboard", tuiCommand},
+		{"test-discord", "send a test message to discord", testDiscordCommand},
+		{"export", "export archived digests", exportCommand},
+		{"travel", "export upcoming trips as an iCalendar file", travelCommand},
+		{"verify", "check the digest archive hasn't been tampered with", verifyCommand},
+		{"purge", "delete the embeddings, or everything stored for an account", purgeCommand},
+	}
+}
+
+// runCLI parses the global config flags, then dispatches to a subcommand, running the daemon when none is given
+func runCLI(args []string) error {
+	global := flag.NewFlagSet("reads_ur_emails", flag.ContinueOnError)
+	global.Usage = printUsage
+	configPath := global.String("config", envOr("REU_CONFIG", configFile), "path to the config file (env REU_CONFIG)")
+	profile := global.String("profile", envOr("REU_PROFILE", ""), "only run this profile of the config (env REU_PROFILE)")
+	configFlags(global)
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	args = global.Args()
+
+	name := "run"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		printUsage()
+		return nil
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		log.Info("Loading configuration...")
+		config, err := loadConfig(*configPath)
+		if err != nil {
+			return fmt.Errorf("loading configuration: %w", err)
+		}
+		if err := applyConfigOverrides(config, global); err != nil {
+			return fmt.Errorf("loading configuration: %w", err)
+		}
+		if err := setupLogging(config); err != nil {
+			return fmt.Errorf("setting up logging: %w", err)
+		}
+		if err := setupFixtures(config); err != nil {
+			return fmt.Errorf("setting up fixtures: %w", err)
+		}
+		if err := setupEncryption(config); err != nil {
+			return fmt.Errorf("setting up encryption: %w", err)
+		}
+		reloadConfig = func() (*Config, error) {
+			config, err := loadConfig(*configPath)
+			if err != nil {
+				return nil, err
+			}
+			return config, applyConfigOverrides(config, global)
+		}
+
+		apps, err := newProfileApps(config, *profile)
+		if err != nil {
+			return fmt.Errorf("loading configuration: %w", err)
+		}
+		// the daemon runs every profile, the one-off commands are about a single mailbox
+		if len(apps) > 1 && name != "run" && name != "tui" {
+			return fmt.Errorf("%s works on one profile, pick it with --profile (one of %s)", name, strings.Join(profileNames(config), ", "))
+		}
+
+		err = cmd.run(apps[0], args)
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	printUsage()
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: reads_ur_emails [config flags] <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "run 'reads_ur_emails <command> -h' for the flags of a command")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "config flags:")
+	fs := flag.NewFlagSet("reads_ur_emails", flag.ContinueOnError)
+	fs.String("config", configFile, "path to the config file (env REU_CONFIG)")
+	fs.String("profile", "", "only run this profile of the config (env REU_PROFILE)")
+	configFlags(fs)
+	fs.SetOutput(os.Stderr)
+	fs.PrintDefaults()
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func runCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return runDaemon(a.profiles)
+}
+
+func authCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("auth", flag.ContinueOnError)
+	force := fs.Bool("force", false, "discard the saved token and authorize again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *force {
+		if err := a.state.update(func(s *State) {
+			s.account().Token = nil
+		}); err != nil {
+			return fmt.Errorf("removing saved token: %w", err)
+		}
+	}
+
+	if _, err := a.createOAuthClient(); err != nil {
+		return err
+	}
+	fmt.Println("Gmail access is authorized.")
+	return nil
+}
+
+func summarizeCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("summarize", flag.ContinueOnError)
+	since := fs.Duration("since", 24*time.Hour, "summarize emails received in this window")
+	kind := fs.String("kind", "daily", "prompt style to use: daily or weekly")
+	stdout := fs.Bool("stdout", false, "print the summary instead of sending it to discord")
+	format := fs.String("format", "markdown", "with --stdout, how to print the summary: "+strings.Join(digestFormats(), ", "))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var channelID string
+	switch *kind {
+	case "daily":
+		channelID = a.dailyChannel()
+	case "weekly":
+		channelID = a.weeklyChannel()
+	default:
+		return fmt.Errorf("kind must be daily or weekly, got %q", *kind)
+	}
+
+	if err := a.setupAgent(); err != nil {
+		return fmt.Errorf("initializing application: %w", err)
+	}
+
+	if !*stdout {
+		if err := a.setupDiscord(); err != nil {
+			return fmt.Errorf("initializing Discord: %w", err)
+		}
+		defer a.Discord.Close()
+	}
+
+	ctx := a.startDigest(context.Background(), oneOffDigestID(a.Profile, *kind, a.Clock.Now()))
+	messages, err := a.Emails.Fetch(ctx, a.Clock.Now().Add(-*since))
+	if err != nil {
+		return fmt.Errorf("fetching emails: %w", err)
+	}
+
+	if len(messages) == 0 {
+		fmt.Fprintln(os.Stderr, "No messages in that window.")
+		return nil
+	}
+	a.recognizeImageOnlyEmails(ctx, messages)
+
+	digest, err := a.summarizeWithinBudget(ctx, *kind, messages)
+	if err != nil {
+		return fmt.Errorf("generating summary: %w", err)
+	}
+
+	if *stdout {
+		rendered, err := renderDigest(digest, *format)
+		if err != nil {
+			return err
+		}
+		fmt.Println(rendered)
+		return nil
+	}
+	_, err = a.postDigest(channelID, digest, nil)
+	return err
+}
+
+func testDiscordCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("test-discord", flag.ContinueOnError)
+	channelID := fs.String("channel", a.dailyChannel(), "channel to send the test message to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := a.setupDiscord(); err != nil {
+		return fmt.Errorf("initializing Discord: %w", err)
+	}
+	defer a.Discord.Close()
+
+	if err := a.sendToDiscord(*channelID, "reads_ur_emails test message: this channel is reachable."); err != nil {
+		return err
+	}
+	fmt.Println("Test message sent.")
+	return nil
+}
+
+func exportCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "md", "output format: md or json")
+	kind := fs.String("kind", "", "only export digests of this kind (daily or weekly)")
+	limit := fs.Int("limit", maxArchivedDigests, "maximum number of digests to export")
+	out := fs.String("out", "", "write to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	digests := a.state.recentDigests(*kind, *limit)
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("creating export file: %w", err)
+		}
+		defer closeFile(f, "export file")
+		w = f
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(digests)
+	case "md":
+		for _, digest := range digests {
+			fmt.Fprintf(w, "# %s summary, %s\n\n%s\n\n", digest.Kind, digest.GeneratedAt.Format("Mon 2 Jan 2006 15:04"), renderMarkdown(digest))
+		}
+		return nil
+	default:
+		return fmt.Errorf("format must be md or json, got %q", *format)
+	}
+}
+
+func travelCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("travel", flag.ContinueOnError)
+	out := fs.String("out", "", "write to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("creating calendar file: %w", err)
+		}
+		defer closeFile(f, "calendar file")
+		w = f
+	}
+	return a.writeTravelICS(w)
+}
+
+func verifyCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	publicKey := fs.String("public-key", "", "check the signatures with this base64 ed25519 public key instead of the profile's own key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var key ed25519.PublicKey
+	if *publicKey != "" {
+		decoded, err := base64.StdEncoding.DecodeString(*publicKey)
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			return fmt.Errorf("--public-key must be a base64 ed25519 public key")
+		}
+		key = decoded
+	}
+
+	check := a.state.verifyArchive(key)
+	fmt.Printf("Checked %d digests, %d of them signed.\n", check.Checked, check.Signed)
+	if check.Unsealed > 0 {
+		fmt.Printf("%d older digests were archived before hashing and can't be checked.\n", check.Unsealed)
+	}
+	if check.Signed > 0 && check.PublicKey == "" {
+		fmt.Println("The signatures weren't checked, there's no key to check them with.")
+	}
+	if check.PublicKey != "" {
+		fmt.Println("Public key:", check.PublicKey)
+	}
+	for _, problem := range check.Problems {
+		fmt.Println("- " + problem)
+	}
+	if len(check.Problems) > 0 {
+		return fmt.Errorf("the archive failed %s", pluralize(len(check.Problems), "check"))
+	}
+	fmt.Println("The archive is intact.")
+	return nil
+}
+
+func purgeCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	account := fs.String("account", "", "delete everything stored for this account: the profile's name, or default without profiles")
+	embeddings := fs.Bool("embeddings", false, "only delete the email index and its embeddings")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	name := a.Profile
+	if name == "" {
+		name = defaultAccount
+	}
+	switch {
+	case *account != "" && *account != name:
+		return fmt.Errorf("--account %q isn't the profile this runs on (%s), pick it with --profile", *account, name)
+	case *account != "":
+		if err := a.index.purge(); err != nil {
+			return err
+		}
+		if err := a.state.purge(); err != nil {
+			return fmt.Errorf("deleting the state: %w", err)
+		}
+		fmt.Printf("Deleted everything stored for %s. Authorize Gmail again to start over.\n", name)
+		return nil
+	case *embeddings:
+		if err := a.index.purge(); err != nil {
+			return err
+		}
+		fmt.Println("Deleted the email index and its embeddings, it fills up again as emails come in.")
+		return nil
+	default:
+		return fmt.Errorf("say what to delete, with --account or --embeddings")
+	}
+}
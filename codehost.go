@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxCodeItems is how many pull requests, issues or runs a repository's line names for each kind before "and N more"
+const maxCodeItems = 5
+
+// codeItemKinds are what a notification can ask of the user, in the order a repository's line lists them
+var codeItemKinds = []struct{ kind, label string }{
+	{"review", "👀 review requested"},
+	{"mention", "💬 mentioned"},
+	{"assigned", "📌 assigned"},
+	{"ci_failed", "❌ CI failed"},
+}
+
+var (
+	githubRepoSubjectPattern = regexp.MustCompile(`^\[([^\]\s]+/[^\]\s]+)\]\s*`)
+	githubURLPattern         = regexp.MustCompile(`https://github\.com/[^\s<>()"]+`)
+	gitlabURLPattern         = regexp.MustCompile(`https?://[^\s<>()"]+/-/[^\s<>()"]+`)
+)
+
+// codeNotification is what a GitHub or GitLab notification email is about
+type codeNotification struct {
+	repo string
+	// kind is one of codeItemKinds, or "" for the rest: comments, pushes, passing builds
+	kind  string
+	title string
+	url   string
+}
+
+// codeNotificationOf reads a GitHub or GitLab notification from its headers, nil for every other email
+func codeNotificationOf(message *gmail.Message) *codeNotification {
+	if message.Payload == nil {
+		return nil
+	}
+	subject := strings.TrimSpace(extractHeader(message, "Subject"))
+	for _, prefix := range []string{"Re: ", "RE: ", "Fwd: "} {
+		subject = strings.TrimPrefix(subject, prefix)
+	}
+	body := extractBody(message)
+
+	if path := extractHeaderFold(message, "X-GitLab-Project-Path"); path != "" {
+		n := &codeNotification{repo: path, title: subject}
+		// "Group / Project | Title (!12)"
+		if _, title, ok := strings.Cut(subject, " | "); ok {
+			n.title = title
+		}
+		switch extractHeaderFold(message, "X-GitLab-NotificationReason") {
+		case "review_requested":
+			n.kind = "review"
+		case "mentioned", "directly_addressed":
+			n.kind = "mention"
+		case "assigned":
+			n.kind = "assigned"
+		}
+		if strings.EqualFold(extractHeaderFold(message, "X-GitLab-Pipeline-Status"), "failed") {
+			n.kind = "ci_failed"
+		}
+		n.url = gitlabURLPattern.FindString(body)
+		return n
+	}
+
+	reason := extractHeaderFold(message, "X-GitHub-Reason")
+	listID := extractHeaderFold(message, "List-ID")
+	if !strings.HasSuffix(senderAddress(extractHeader(message, "From")), "@github.com") ||
+		(reason == "" && !strings.Contains(listID, ".github.com")) {
+		return nil
+	}
+	// List-ID: owner/repo <repo.owner.github.com>
+	repo, _, _ := strings.Cut(listID, " <")
+	repo = strings.TrimSpace(repo)
+	if match := githubRepoSubjectPattern.FindStringSubmatch(subject); match != nil {
+		if repo == "" || !strings.Contains(repo, "/") {
+			repo = match[1]
+		}
+		subject = subject[len(match[0]):]
+	}
+	if repo == "" {
+		repo = "GitHub"
+	}
+	n := &codeNotification{repo: repo, title: subject}
+	switch reason {
+	case "review_requested":
+		n.kind = "review"
+	case "mention", "team_mention":
+		n.kind = "mention"
+	case "assign":
+		n.kind = "assigned"
+	case "ci_activity":
+		if strings.Contains(strings.ToLower(subject), "fail") {
+			n.kind = "ci_failed"
+		}
+	}
+	if url := githubURLPattern.FindString(body); url != "" {
+		n.url, _, _ = strings.Cut(url, "#")
+	}
+	return n
+}
+
+// splitCodeNotifications takes the GitHub and GitLab notifications out of the emails. dozens of them read alike, so
+// they're condensed by repository instead of summarized
+func splitCodeNotifications(messages []*gmail.Message) (rest, code []*gmail.Message) {
+	for _, message := range messages {
+		if codeNotificationOf(message) != nil {
+			code = append(code, message)
+		} else {
+			rest = append(rest, message)
+		}
+	}
+	return rest, code
+}
+
+// codeRepo is a repository's notifications, one item per pull request, issue or run
+type codeRepo struct {
+	name          string
+	items         []codeNotification
+	notifications int
+}
+
+// actionable is how many of the repository's items ask something of the user
+func (r *codeRepo) actionable() int {
+	n := 0
+	for _, item := range r.items {
+		if item.kind != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// codeNotificationSection condenses the notifications into a line per repository: what needs a review, where the user
+// was mentioned or assigned, which builds failed, and how many other updates there were
+func codeNotificationSection(code []*gmail.Message, account int) *DigestSection {
+	section := &DigestSection{Key: "code", Title: "🐙 Code notifications"}
+	if len(code) == 0 {
+		return section
+	}
+
+	var repos []*codeRepo
+	for _, message := range code {
+		n := codeNotificationOf(message)
+		if n.url == "" && message.ThreadId != "" {
+			n.url = gmailThreadURL(account, message.ThreadId)
+		}
+		i := slices.IndexFunc(repos, func(r *codeRepo) bool { return r.name == n.repo })
+		if i < 0 {
+			repos = append(repos, &codeRepo{name: n.repo})
+			i = len(repos) - 1
+		}
+		repo := repos[i]
+		repo.notifications++
+		// the notifications about one pull request are one item, as whatever asks the most of the user
+		j := slices.IndexFunc(repo.items, func(item codeNotification) bool { return item.title == n.title })
+		switch {
+		case j < 0:
+			repo.items = append(repo.items, *n)
+		case n.kind != "" && (repo.items[j].kind == "" || codeKindRank(n.kind) < codeKindRank(repo.items[j].kind)):
+			repo.items[j].kind = n.kind
+		}
+	}
+	slices.SortStableFunc(repos, func(x, y *codeRepo) int {
+		if x.actionable() != y.actionable() {
+			return y.actionable() - x.actionable()
+		}
+		return y.notifications - x.notifications
+	})
+
+	linkText := strings.NewReplacer("[", "(", "]", ")")
+	for _, repo := range repos {
+		var parts []string
+		for _, k := range codeItemKinds {
+			var links []string
+			for _, item := range repo.items {
+				if item.kind != k.kind {
+					continue
+				}
+				if item.url != "" {
+					links = append(links, fmt.Sprintf("[%s](<%s>)", linkText.Replace(item.title), item.url))
+				} else {
+					links = append(links, item.title)
+				}
+			}
+			if len(links) > maxCodeItems {
+				links = append(links[:maxCodeItems], fmt.Sprintf("and %d more", len(links)-maxCodeItems))
+			}
+			if len(links) > 0 {
+				parts = append(parts, k.label+": "+strings.Join(links, ", "))
+			}
+		}
+		if other := len(repo.items) - repo.actionable(); other > 0 {
+			parts = append(parts, fmt.Sprintf("updates on %s", pluralize(other, "other thread")))
+		}
+		section.Lines = append(section.Lines, fmt.Sprintf("**%s** (%s): %s", repo.name, pluralize(repo.notifications, "notification"), strings.Join(parts, " · ")))
+	}
+	return section
+}
+
+// codeKindRank orders the kinds as codeItemKinds does
+func codeKindRank(kind string) int {
+	return slices.IndexFunc(codeItemKinds, func(k struct{ kind, label string }) bool { return k.kind == kind })
+}
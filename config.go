@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// configFlags registers one string flag per Config field on fs. the flag name is the env var name without the
+// REU_ prefix, lowercased and dashed, so REU_DAILY_TIME becomes --daily-time
+func configFlags(fs *flag.FlagSet) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		env := t.Field(i).Tag.Get("env")
+		if env == "" {
+			continue
+		}
+
+		usage := fmt.Sprintf("overrides %q in the config file (env %s)", jsonName(t.Field(i)), env)
+		if t.Field(i).Type.Kind() != reflect.String {
+			usage += ", as json"
+		}
+		fs.String(flagName(env), "", usage)
+	}
+}
+
+// applyConfigOverrides layers the environment, then any flags that were set on fs, on top of the config file
+func applyConfigOverrides(config *Config, fs *flag.FlagSet) error {
+	if err := overrideConfig(config, "environment", os.LookupEnv); err != nil {
+		return err
+	}
+
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	return overrideConfig(config, "flags", func(env string) (string, bool) {
+		v, ok := set[flagName(env)]
+		return v, ok
+	})
+}
+
+func overrideConfig(config *Config, source string, lookup func(env string) (string, bool)) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		env := t.Field(i).Tag.Get("env")
+		if env == "" {
+			continue
+		}
+
+		raw, ok := lookup(env)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(raw)
+		} else if err := json.Unmarshal([]byte(raw), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("parsing %s from %s: %w", env, source, err)
+		}
+		log.Info("Config overridden", "field", jsonName(t.Field(i)), "source", source)
+	}
+
+	return nil
+}
+
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(env, "REU_")), "_", "-")
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return name
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+)
+
+// profanity are the words the content filter always catches, as the stem of each. a word that starts with one is
+// caught too, like "fucking" or "shitty"
+var profanity = []string{
+	"fuck", "motherfuck", "shit", "bullshit", "bitch", "asshole", "arsehole", "bastard", "cunt", "dickhead", "wanker",
+	"bollocks", "piss", "crap", "damn", "slut", "whore", "twat",
+}
+
+// redacted replaces what the filter takes out
+const redacted = "[redacted]"
+
+var (
+	// linkPattern matches the URLs in a digest's Markdown, which are left alone: the gmail links have account numbers in
+	// them and mean nothing to a reader anyway
+	linkPattern = regexp.MustCompile(`\(<[^>]*>\)|<https?://[^>]*>|https?://\S+`)
+	// phoneNumberPattern matches phone, card and account numbers. only the matches with enough digits are taken out,
+	// so dates, times and amounts aren't
+	phoneNumberPattern = regexp.MustCompile(`\+?\d[\d ().\-]{6,}\d`)
+	isoDatePattern     = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+	ibanPattern        = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){3,7}(?: ?[A-Z0-9]{1,3})?\b`)
+)
+
+// minRedactedDigits is how many digits a number needs before the filter takes it for a phone or card number
+const minRedactedDigits = 9
+
+type ContentFilterConfig struct {
+	// Mode is "soften", which keeps the first letter of a swear word and stars out the rest, or "redact", which
+	// replaces it whole
+	Mode string `json:"mode"`
+	// Words are more words to catch, on top of the built-in ones
+	Words []string `json:"words"`
+	// Personal also takes out email addresses, phone numbers, card numbers and IBANs
+	Personal bool `json:"personal"`
+	// Channels are the Discord channels to filter. when empty every server channel is filtered, and direct messages
+	// never are
+	Channels []string `json:"channels"`
+	// Notifiers are the notifiers to filter for, by name, like "mattermost" or "teams"
+	Notifiers []string `json:"notifiers"`
+}
+
+// contentFilter softens or takes out what shouldn't be read out in a shared channel
+type contentFilter struct {
+	mode     string
+	words    *regexp.Regexp
+	personal bool
+}
+
+func newContentFilter(config ContentFilterConfig) *contentFilter {
+	stems := slices.Clone(profanity)
+	for _, word := range config.Words {
+		if word = strings.TrimSpace(word); word != "" {
+			stems = append(stems, regexp.QuoteMeta(strings.ToLower(word)))
+		}
+	}
+	return &contentFilter{
+		mode:     config.Mode,
+		words:    regexp.MustCompile(`(?i)\b(?:` + strings.Join(stems, "|") + `)[a-z]*`),
+		personal: config.Personal,
+	}
+}
+
+// text filters a piece of Markdown, leaving its links alone
+func (f *contentFilter) text(s string) string {
+	var sb strings.Builder
+	last := 0
+	for _, link := range linkPattern.FindAllStringIndex(s, -1) {
+		sb.WriteString(f.plain(s[last:link[0]]))
+		sb.WriteString(s[link[0]:link[1]])
+		last = link[1]
+	}
+	sb.WriteString(f.plain(s[last:]))
+	return sb.String()
+}
+
+// plain filters text without links in it
+func (f *contentFilter) plain(s string) string {
+	s = f.words.ReplaceAllStringFunc(s, func(word string) string {
+		if f.mode == "redact" {
+			return redacted
+		}
+		first, size := utf8.DecodeRuneInString(word)
+		return string(first) + strings.Repeat("*", utf8.RuneCountInString(word[size:]))
+	})
+	if !f.personal {
+		return s
+	}
+	s = emailAddressPattern.ReplaceAllString(s, redacted)
+	s = ibanPattern.ReplaceAllString(s, redacted)
+	return phoneNumberPattern.ReplaceAllStringFunc(s, func(number string) string {
+		digits := 0
+		for _, r := range number {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		if digits < minRedactedDigits || isoDatePattern.MatchString(number) {
+			return number
+		}
+		return redacted
+	})
+}
+
+// digest returns a filtered copy of the digest. the original, which is archived and served by the API, isn't touched
+func (f *contentFilter) digest(d *Digest) *Digest {
+	filtered := *d
+	filtered.Title = f.text(d.Title)
+	filtered.Summary = f.text(d.Summary)
+
+	filtered.Sections = make([]DigestSection, len(d.Sections))
+	for i, section := range d.Sections {
+		section.Intro = f.text(section.Intro)
+		section.Lines = slices.Clone(section.Lines)
+		for j, line := range section.Lines {
+			section.Lines[j] = f.text(line)
+		}
+		filtered.Sections[i] = section
+	}
+
+	filtered.Entries = make([]DigestEntry, len(d.Entries))
+	for i, entry := range d.Entries {
+		entry.From = f.text(entry.From)
+		entry.Subject = f.text(entry.Subject)
+		entry.Summary = f.text(entry.Summary)
+		entry.ActionItems = slices.Clone(entry.ActionItems)
+		for j := range entry.ActionItems {
+			entry.ActionItems[j].Description = f.text(entry.ActionItems[j].Description)
+		}
+		filtered.Entries[i] = entry
+	}
+
+	filtered.WaitingOn = make([]AwaitingReply, len(d.WaitingOn))
+	for i, reply := range d.WaitingOn {
+		reply.To = f.text(reply.To)
+		reply.Subject = f.text(reply.Subject)
+		reply.Snippet = f.text(reply.Snippet)
+		filtered.WaitingOn[i] = reply
+	}
+	return &filtered
+}
+
+// filterForChannel is the digest as it should be posted in a Discord channel: filtered in a shared one, as it is in
+// a direct message or when there's no filter
+func (a *App) filterForChannel(channelID string, digest *Digest) *Digest {
+	if a.contentFilter == nil {
+		return digest
+	}
+	if channels := a.Config.ContentFilter.Channels; len(channels) > 0 {
+		if slices.Contains(channels, channelID) {
+			return a.contentFilter.digest(digest)
+		}
+		return digest
+	}
+
+	channel, err := a.Discord.State.Channel(channelID)
+	if err != nil {
+		if channel, err = a.Discord.Channel(channelID); err != nil {
+			// better filtered in a DM than not in a server
+			log.Error("Unable to look up Discord channel, filtering the digest", "channel_id", channelID, "error", err)
+			return a.contentFilter.digest(digest)
+		}
+	}
+	if channel.Type == discordgo.ChannelTypeDM {
+		return digest
+	}
+	return a.contentFilter.digest(digest)
+}
+
+// filterForNotifier is the digest as it should go to a notifier, filtered for the ones the config names
+func (a *App) filterForNotifier(n Notifier, digest *Digest) *Digest {
+	if a.contentFilter == nil || !slices.Contains(a.Config.ContentFilter.Notifiers, n.Name()) {
+		return digest
+	}
+	return a.contentFilter.digest(digest)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encrypted files are "REU1" || salt || nonce || AES-256-GCM ciphertext
+var encryptedMagic = []byte("REU1")
+
+const (
+	saltSize = 16
+	keySize  = 32
+)
+
+// encryptionPassphrase protects sensitive state files at rest. empty means they are stored in plaintext
+var encryptionPassphrase []byte
+
+// setupEncryption resolves the passphrase, either directly from config or from the output of a command such as
+// `secret-tool lookup service reads_ur_emails` or `security find-generic-password -w -s reads_ur_emails`,
+// which lets the OS keyring hold it
+func setupEncryption(config *Config) error {
+	switch {
+	case config.EncryptionPassphrase != "":
+		encryptionPassphrase = []byte(config.EncryptionPassphrase)
+	case config.EncryptionPassphraseCommand != "":
+		out, err := exec.Command("sh", "-c", config.EncryptionPassphraseCommand).Output()
+		if err != nil {
+			return fmt.Errorf("running encryption passphrase command: %w", err)
+		}
+		encryptionPassphrase = bytes.TrimRight(out, "\r\n")
+		if len(encryptionPassphrase) == 0 {
+			return errors.New("encryption passphrase command returned nothing")
+		}
+	default:
+		log.Warn("No encryption passphrase configured, the OAuth token and digest archive are stored in plaintext")
+		return nil
+	}
+
+	log.Info("State encryption enabled")
+	return nil
+}
+
+// readStateFile reads a file that may have been written by writeStateFile, decrypting it if needed.
+// plaintext files are still accepted so that turning encryption on doesn't need a migration step
+func readStateFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openState(path, data)
+}
+
+// writeStateFile writes data to path, encrypted when a passphrase is configured
+func writeStateFile(path string, data []byte) error {
+	data, err := sealState(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// sealState encrypts data when a passphrase is configured, for a state file or a storage backend's record
+func sealState(data []byte) ([]byte, error) {
+	sealer, err := processSealer()
+	if err != nil {
+		return nil, err
+	}
+	return sealer.seal(data)
+}
+
+// openState reverses sealState and stateSealer.seal. name says where data came from in the errors
+func openState(name string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return data, nil
+	}
+	if len(encryptionPassphrase) == 0 {
+		return nil, fmt.Errorf("%s is encrypted but no encryption passphrase is configured", name)
+	}
+
+	return decrypt(data[len(encryptedMagic):])
+}
+
+// stateSealer encrypts records with one key, derived from the passphrase and its salt once rather than per record.
+// scrypt takes a good part of a second by design, which a store with hundreds of records can't pay for each of them.
+// every record still gets its own nonce, and carries the salt, so openState reads it like any other
+type stateSealer struct {
+	salt []byte
+	// gcm is nil when there's no passphrase, and records are stored in plaintext
+	gcm cipher.AEAD
+}
+
+// newStateSealer derives the key for salt, a new random one when it's nil
+func newStateSealer(salt []byte) (*stateSealer, error) {
+	if len(encryptionPassphrase) == 0 {
+		return &stateSealer{}, nil
+	}
+	if salt == nil {
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("generating salt: %w", err)
+		}
+	}
+	gcm, err := cachedGCM(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &stateSealer{salt: salt, gcm: gcm}, nil
+}
+
+// processSealer seals the records of the process that have no salt of their own to keep: the state files and the
+// records of the split stores and Redis. it's made on first use, after setupEncryption
+var processSealer = sync.OnceValues(func() (*stateSealer, error) {
+	return newStateSealer(nil)
+})
+
+// seal encrypts data, if there's a passphrase
+func (s *stateSealer) seal(data []byte) ([]byte, error) {
+	if s.gcm == nil {
+		return data, nil
+	}
+	nonce := make([]byte, s.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	out := append(append(append([]byte{}, encryptedMagic...), s.salt...), nonce...)
+	return s.gcm.Seal(out, nonce, data, nil), nil
+}
+
+func decrypt(data []byte) ([]byte, error) {
+	if len(data) < saltSize {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	salt, data := data[:saltSize], data[saltSize:]
+
+	gcm, err := cachedGCM(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting (wrong passphrase?): %w", err)
+	}
+	return plaintext, nil
+}
+
+// derivedKeys are the keys derived so far, by salt, so the records sealed with one salt only run scrypt once between
+// them. records only come with a few salts, one per process or store, and the map is emptied if it ever grows past
+// maxDerivedKeys
+var derivedKeys = struct {
+	sync.Mutex
+	gcms map[string]cipher.AEAD
+}{gcms: make(map[string]cipher.AEAD)}
+
+const maxDerivedKeys = 64
+
+// cachedGCM is newGCM, derived once per salt
+func cachedGCM(salt []byte) (cipher.AEAD, error) {
+	derivedKeys.Lock()
+	defer derivedKeys.Unlock()
+	if gcm, ok := derivedKeys.gcms[string(salt)]; ok {
+		return gcm, nil
+	}
+	gcm, err := newGCM(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(derivedKeys.gcms) >= maxDerivedKeys {
+		clear(derivedKeys.gcms)
+	}
+	derivedKeys.gcms[string(salt)] = gcm
+	return gcm, nil
+}
+
+func newGCM(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(encryptionPassphrase, salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// registerDashboard serves the web UI. the page itself is public, it asks for the API token and
+// uses it for every call to the REST API
+func registerDashboard(mux *http.ServeMux) error {
+	page, err := loadFile("web/dashboard.html")
+	if err != nil {
+		return fmt.Errorf("loading dashboard: %w", err)
+	}
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(page))
+	})
+	return nil
+}
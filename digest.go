@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+	"scheduler"
+)
+
+// Digest is the structured form of a summary. nothing in it is formatted for a particular destination, the renderers
+// in render.go turn it into a Discord message, embeds, an HTML email, plain text or JSON
+type Digest struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Title replaces the usual "Daily summary" title, e.g. for a weekend roundup
+	Title       string    `json:"title,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// Locale is how the digest's dates are written, the default locale when empty
+	Locale     string `json:"locale,omitempty"`
+	EmailCount int    `json:"email_count"`
+	// Summary is the model's summary, in Markdown
+	Summary string `json:"summary"`
+	// Sections are what the bot adds after the summary, in order
+	Sections   []DigestSection `json:"sections,omitempty"`
+	Categories map[string]int  `json:"categories"`
+	Entries    []DigestEntry   `json:"entries"`
+	Usage      TokenUsage      `json:"usage"`
+
+	// Prompts are the template files the digest was written with, and the hash of the version of each
+	Prompts map[string]string `json:"prompts,omitempty"`
+
+	// WaitingOn are the sent threads still without a reply, when follow-ups are enabled
+	WaitingOn []AwaitingReply `json:"waiting_on,omitempty"`
+
+	// MessageIDs are the emails the digest reports on. with Hash, the hash of the digest chained onto the one archived
+	// before it, and Signature, the hash signed with the archive's key, they make the archive a record of what came in
+	// and what was said about it
+	MessageIDs []string `json:"message_ids,omitempty"`
+	PrevHash   string   `json:"prev_hash,omitempty"`
+	Hash       string   `json:"hash,omitempty"`
+	Signature  string   `json:"signature,omitempty"`
+
+	// Unsummarized are the emails the model failed on partway through, left for a follow-up digest
+	Unsummarized []*gmail.Message `json:"-"`
+}
+
+// DigestSection is a part of a digest written by the bot rather than the model, like the attachment warnings or the
+// links to Gmail, so it can't be summarized away. Lines are Markdown, one list item each, or parts of a single line for
+// an inline section
+type DigestSection struct {
+	Key    string   `json:"key"`
+	Title  string   `json:"title"`
+	Intro  string   `json:"intro,omitempty"`
+	Lines  []string `json:"lines"`
+	Inline bool     `json:"inline,omitempty"`
+}
+
+// addSection appends section, unless it's nil or has nothing in it
+func (d *Digest) addSection(section *DigestSection) {
+	if section == nil || len(section.Lines) == 0 {
+		return
+	}
+	d.Sections = append(d.Sections, *section)
+}
+
+// section is the digest's section with the key, nil if it has none
+func (d *Digest) section(key string) *DigestSection {
+	for i := range d.Sections {
+		if d.Sections[i].Key == key {
+			return &d.Sections[i]
+		}
+	}
+	return nil
+}
+
+// periodDigestID names a scheduled digest after the profile and the period it covers, e.g. "daily-2026-01-05" or
+// "alice-weekly-2026-W02". a retry, restart or catch-up run of the same period gets the same id, which is how it can
+// tell the digest already went out
+func (a *App) periodDigestID(kind string, now time.Time) string {
+	var period string
+	switch kind {
+	case "daily":
+		period = now.Format(time.DateOnly)
+	case "mini":
+		period = now.Format("2006-01-02-1504")
+	case "weekly":
+		year, week := now.ISOWeek()
+		period = fmt.Sprintf("%d-W%02d", year, week)
+	case "monthly":
+		period = now.Format("2006-01")
+	case "quarterly":
+		period = fmt.Sprintf("%d-Q%d", now.Year(), (int(now.Month())+2)/3)
+	default:
+		return oneOffDigestID(a.Profile, kind, now)
+	}
+	if a.Profile != "" {
+		return fmt.Sprintf("%s-%s-%s", a.Profile, kind, period)
+	}
+	return kind + "-" + period
+}
+
+// periodTime is the time a scheduled run's period is worked out from: when the schedule had it due, so a run that
+// starts late, past the end of its period, still covers that period rather than taking the next one's id. the clock
+// when the run wasn't scheduled, like the retry of a panicked job
+func (a *App) periodTime(ctx context.Context) time.Time {
+	if at, ok := scheduler.ScheduledAt(ctx); ok {
+		return at.In(a.Clock.Now().Location())
+	}
+	return a.Clock.Now()
+}
+
+// oneOffDigestID names a digest made on demand, like /digest, /regenerate or summarize-now, after the profile, when
+// it was made and a random suffix, e.g. "alice-topic-20260105-093012-1f3a9c2e". it's never one that went out already,
+// even when two are asked for in the same second, so a digest asked for by hand always runs
+func oneOffDigestID(profile, kind string, now time.Time) string {
+	id := fmt.Sprintf("%s-%s-%s", kind, now.Format("20060102-150405"), newRunID())
+	if profile != "" {
+		return profile + "-" + id
+	}
+	return id
+}
+
+// DigestEntry is a single summarized email
+type DigestEntry struct {
+	MessageID   string       `json:"message_id"`
+	From        string       `json:"from"`
+	Subject     string       `json:"subject"`
+	Category    string       `json:"category"`
+	Summary     string       `json:"summary"`
+	Urgency     string       `json:"urgency"`
+	ActionItems []ActionItem `json:"action_items"`
+
+	// URL opens the email in Gmail
+	URL string `json:"url"`
+
+	AttachmentWarnings []AttachmentWarning `json:"attachment_warnings,omitempty"`
+}
+
+// ActionItem is something the user needs to do, with an optional deadline
+type ActionItem struct {
+	Description string `json:"description"`
+	Due         string `json:"due,omitempty"`
+}
+
+func (s *openAISummarizer) buildDigest(ctx context.Context, kind, scratchpad string, messages []*gmail.Message) (*Digest, error) {
+	summary, err := s.convertScratchpadToHTML(ctx, scratchpad)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.clock.Now()
+	id, ok := digestIDFromContext(ctx)
+	if !ok {
+		profile, _ := ctx.Value(profileKey{}).(string)
+		id = oneOffDigestID(profile, kind, now)
+	}
+	digest := &Digest{
+		ID:          id,
+		Kind:        kind,
+		GeneratedAt: now,
+		Locale:      s.locale,
+		EmailCount:  len(messages),
+		Summary:     summary,
+		Categories:  make(map[string]int),
+	}
+	if skipped := roundupFromContext(ctx); len(skipped) > 0 {
+		digest.Title = roundupTitle(localeOf(s.locale), skipped)
+	}
+	// flagged here rather than by the model, so a risky attachment can't be summarized away
+	digest.addSection(attachmentSection(messages))
+	digest.addSection(emailLinksSection(messages, s.gmailAccount))
+
+	files := []string{"email_prompt.tmpl", "email_notes_prompt.tmpl", "scratchpad_to_summary_prompt.tmpl"}
+	if file, ok := digestPromptFiles[kind]; ok {
+		files = append(files, file)
+	}
+	if s.extractEntries {
+		files = append(files, "digest_entries_prompt.tmpl")
+	}
+	digest.Prompts = s.templates.Load().hashes(files...)
+
+	if !s.extractEntries {
+		return digest, nil
+	}
+
+	entries, err := s.extractDigestEntries(ctx, scratchpad, messages)
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to extract digest entries", "error", err)
+		return digest, nil
+	}
+
+	normalizeCategories(entries, s.categories)
+	digest.Entries = entries
+	for _, entry := range entries {
+		digest.Categories[entry.Category]++
+	}
+
+	return digest, nil
+}
+
+func (s *openAISummarizer) extractDigestEntries(ctx context.Context, scratchpad string, messages []*gmail.Message) ([]DigestEntry, error) {
+	byID := make(map[string]*gmail.Message, len(messages))
+
+	var sb strings.Builder
+	for _, message := range messages {
+		byID[message.Id] = message
+		sb.WriteString(fmt.Sprintf("- id: %s | from: %s | subject: %s | date: %s\n",
+			message.Id,
+			extractHeader(message, "From"),
+			extractHeader(message, "Subject"),
+			localDate(extractHeader(message, "Date"), s.clock.Now().Location()),
+		))
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().DigestEntries, map[string]any{
+		"scratchpad": scratchpad,
+		"emails":     sb.String(),
+		"categories": categoryInstruction(s.categories),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.callOpenAIJSON(ctx, []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: prompt,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Entries []DigestEntry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(resp), &parsed); err != nil {
+		return nil, fmt.Errorf("unable to parse digest entries: %v", err)
+	}
+
+	// Trust the headers over whatever the model echoed back
+	for i, entry := range parsed.Entries {
+		if message, ok := byID[entry.MessageID]; ok {
+			parsed.Entries[i].From = extractHeader(message, "From")
+			parsed.Entries[i].Subject = extractHeader(message, "Subject")
+			parsed.Entries[i].AttachmentWarnings = attachmentWarnings(message)
+			parsed.Entries[i].URL = gmailThreadURL(s.gmailAccount, message.ThreadId)
+		}
+	}
+
+	return parsed.Entries, nil
+}
+
+// gmailThreadURL opens a thread in Gmail. account is the index of the account among those signed in to the browser,
+// the N in mail.google.com/mail/u/N
+func gmailThreadURL(account int, threadID string) string {
+	if threadID == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://mail.google.com/mail/u/%d/#inbox/%s", account, threadID)
+}
+
+// maxLinkLabelLength keeps the email links to about a line each
+const maxLinkLabelLength = 60
+
+// emailLinksSection links every summarized thread, so any of them opens in Gmail in one click
+func emailLinksSection(messages []*gmail.Message, account int) *DigestSection {
+	section := &DigestSection{Key: "links", Title: "📬 Open in Gmail"}
+	seen := make(map[string]bool)
+	for _, message := range messages {
+		if message.ThreadId == "" || seen[message.ThreadId] {
+			continue
+		}
+		seen[message.ThreadId] = true
+
+		label := extractHeader(message, "Subject")
+		if label == "" {
+			label = "(no subject)"
+		}
+		if runes := []rune(label); len(runes) > maxLinkLabelLength {
+			label = string(runes[:maxLinkLabelLength-1]) + "…"
+		}
+		// brackets would end the link text early, and <> around the url stops Discord from embedding a preview
+		label = strings.NewReplacer("[", "(", "]", ")").Replace(label)
+		section.Lines = append(section.Lines, fmt.Sprintf("[%s](<%s>) · %s", label, gmailThreadURL(account, message.ThreadId), senderName(extractHeader(message, "From"))))
+	}
+	return section
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+)
+
+// slashCommand is a Discord application command. run gets the options by name and returns the reply
+type slashCommand struct {
+	command *discordgo.ApplicationCommand
+	run     func(ctx context.Context, a *App, options map[string]string) (string, error)
+}
+
+var slashCommands []slashCommand
+
+// manageServer limits a command to the members who can manage the server, unless the server's settings say otherwise
+var manageServer int64 = discordgo.PermissionManageServer
+
+// componentHandlers answer button presses and menu picks, by custom id prefix. they get the rest of the custom id
+var componentHandlers = map[string]func(a *App, i *discordgo.InteractionCreate, id string){
+	nudgeButtonPrefix:        (*App).handleNudgeButton,
+	feedbackMenuPrefix:       (*App).handleFeedbackMenu,
+	costButtonPrefix:         (*App).handleCostButton,
+	archiveNewslettersPrefix: (*App).handleArchiveNewsletters,
+	approvalButtonPrefix:     (*App).handleApprovalButton,
+}
+
+func init() {
+	slashCommands = []slashCommand{
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "digest",
+				Description: "Summarize recent emails about a topic",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "topic",
+						Description: `What to summarize, e.g. "job applications". Gmail search syntax works too`,
+						Required:    true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "since",
+						Description: "How far back to look, e.g. 30d, 2w or 12h (default 7d)",
+					},
+				},
+			},
+			run: topicDigestCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "unmute",
+				Description: "Let a muted sender back into your digests",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "sender",
+						Description: "The sender's email address",
+						Required:    true,
+					},
+				},
+			},
+			run: unmuteCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "regenerate",
+				Description: "Rewrite the latest digest from the same emails",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "kind",
+						Description: "Which digest (default daily)",
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "daily", Value: "daily"},
+							{Name: "weekly", Value: "weekly"},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "style",
+						Description: "How to write it this time",
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "brief", Value: "brief"},
+							{Name: "detailed", Value: "detailed"},
+							{Name: "bullets", Value: "bullets"},
+						},
+					},
+				},
+			},
+			run: regenerateCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "status",
+				Description: "Show when each scheduled task runs next and last ran",
+			},
+			run: statusCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "prompts",
+				Description: "List, compare or roll back versions of the prompt templates",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "action",
+						Description: "What to do (default list)",
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "list", Value: "list"},
+							{Name: "diff", Value: "diff"},
+							{Name: "rollback", Value: "rollback"},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "template",
+						Description: "The template file, e.g. daily_summary_prompt",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "version",
+						Description: "The version's hash, or its first few characters",
+					},
+				},
+			},
+			run: promptsCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "examples",
+				Description: "List, remove or recategorize the example summaries the model is shown",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "action",
+						Description: "What to do (default list)",
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "list", Value: "list"},
+							{Name: "remove", Value: "remove"},
+							{Name: "move", Value: "move"},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "category",
+						Description: "The category to list, or to move the example to",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "id",
+						Description: "The example's id, from /examples list",
+					},
+				},
+			},
+			run: examplesCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "search",
+				Description: "Search the indexed emails by meaning and by keyword",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "query",
+						Description: `What to look for, e.g. "flight to Berlin"`,
+						Required:    true,
+					},
+				},
+			},
+			run: searchCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "ask",
+				Description: "Ask a question about your email, follow-up questions keep the conversation going",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "question",
+						Description: `e.g. "when is the apartment viewing?"`,
+						Required:    true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "memory",
+						Description: "Start a new conversation instead of following on",
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "forget", Value: "forget"},
+						},
+					},
+				},
+			},
+			run: askCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "person",
+				Description: "Summarize your recent history with a contact: the latest threads, open items and their tone",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "contact",
+						Description: "Their email address, e.g. alice@example.com",
+						Required:    true,
+					},
+				},
+			},
+			run: personCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:                     "config",
+				Description:              "Show the digest channels, or move one to another channel",
+				DefaultMemberPermissions: &manageServer,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "action",
+						Description: "What to do (default show)",
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "show", Value: "show"},
+							{Name: "set", Value: "set"},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "key",
+						Description: "The channel to move",
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "daily_summary_channel_id", Value: "daily_summary_channel_id"},
+							{Name: "weekly_summary_channel_id", Value: "weekly_summary_channel_id"},
+							{Name: "oauth_debug_channel_id", Value: "oauth_debug_channel_id"},
+						},
+					},
+					{
+						Type:         discordgo.ApplicationCommandOptionChannel,
+						Name:         "channel",
+						Description:  "The channel it moves to",
+						ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+					},
+				},
+			},
+			run: configCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "query",
+				Description: "Try a Gmail search query before using it as the fetch_query",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "action",
+						Description: "What to do",
+						Required:    true,
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "test", Value: "test"},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "query",
+						Description: `The query, as in Gmail's search box, e.g. "from:boss is:unread"`,
+						Required:    true,
+					},
+				},
+			},
+			run: queryCommand,
+		},
+		{
+			command: &discordgo.ApplicationCommand{
+				Name:        "check",
+				Description: "Check a suspicious email for phishing: its sender, authentication, links and wording",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "email",
+						Description: `A Gmail message id or link, a Message-ID, or a search like "from:paypal subject:suspended"`,
+						Required:    true,
+					},
+				},
+			},
+			run: checkCommand,
+		},
+	}
+}
+
+// registerSlashCommands publishes the slash commands and starts answering them
+func (a *App) registerSlashCommands() error {
+	commands := make([]*discordgo.ApplicationCommand, 0, len(slashCommands))
+	for _, c := range slashCommands {
+		commands = append(commands, c.command)
+	}
+	if _, err := a.Discord.ApplicationCommandBulkOverwrite(a.Discord.State.User.ID, "", commands); err != nil {
+		return fmt.Errorf("registering slash commands: %w", err)
+	}
+	a.answerInteractions()
+
+	log.Info("Slash commands registered", "count", len(commands))
+	return nil
+}
+
+// answerInteractions handles the slash commands and buttons meant for this profile
+func (a *App) answerInteractions() {
+	a.Discord.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if !a.handles(i.ChannelID) {
+			return
+		}
+		if i.Type == discordgo.InteractionMessageComponent {
+			for prefix, handle := range componentHandlers {
+				if id, ok := strings.CutPrefix(i.MessageComponentData().CustomID, prefix); ok {
+					go handle(a, i, id)
+					return
+				}
+			}
+			return
+		}
+		if i.Type != discordgo.InteractionApplicationCommand {
+			return
+		}
+		data := i.ApplicationCommandData()
+		for _, c := range slashCommands {
+			if c.command.Name == data.Name {
+				go a.handleSlashCommand(c, i)
+				return
+			}
+		}
+	})
+}
+
+// handleSlashCommand acknowledges the command straight away, since Discord only waits three seconds for that, and
+// edits the real answer in once it's ready
+func (a *App) handleSlashCommand(c slashCommand, i *discordgo.InteractionCreate) {
+	ctx := withTaskRun(context.Background(), "/"+c.command.Name)
+	ctx = withChannel(ctx, i.ChannelID)
+	ctx = withLLMPriority(ctx, llmPriorityInteractive)
+	logger := log.FromContext(ctx)
+
+	if err := a.Discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	}); err != nil {
+		logger.Error("Failed to acknowledge slash command", "error", err)
+		return
+	}
+
+	options := make(map[string]string)
+	for _, option := range i.ApplicationCommandData().Options {
+		// a channel option's value is the channel's id
+		options[option.Name] = fmt.Sprint(option.Value)
+	}
+
+	reply, err := c.run(ctx, a, options)
+	if err != nil {
+		logger.Error("Slash command failed", "error", err)
+		recordTaskError(a.taskName("/"+c.command.Name), err)
+		reply = "Sorry, that failed: " + err.Error()
+	}
+
+	chunks := splitMessage(reply, maxDiscordMessageLength)
+	if len(chunks) == 0 {
+		chunks = []string{"Done."}
+	}
+	if _, err := a.Discord.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &chunks[0]}); err != nil {
+		logger.Error("Failed to send slash command reply", "error", err)
+		return
+	}
+	for _, chunk := range chunks[1:] {
+		if _, err := a.Discord.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{Content: chunk}); err != nil {
+			logger.Error("Failed to send slash command reply", "error", err)
+			return
+		}
+	}
+}
+
+// topicDigestCommand is /digest: a one-off digest of the emails matching a topic, outside the daily/weekly cadence
+func topicDigestCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	topic := strings.TrimSpace(options["topic"])
+	since := 7 * 24 * time.Hour
+	if s, ok := options["since"]; ok {
+		var err error
+		if since, err = parseSince(s); err != nil {
+			return "", err
+		}
+	}
+
+	now := a.Clock.Now()
+	ctx = a.startDigest(ctx, oneOffDigestID(a.Profile, "topic", now))
+	messages, err := a.Emails.Search(ctx, topic, now.Add(-since))
+	if err != nil {
+		return "", fmt.Errorf("searching emails: %w", err)
+	}
+	if len(messages) == 0 {
+		return fmt.Sprintf("No emails about %q in that window.", topic), nil
+	}
+	a.recognizeImageOnlyEmails(ctx, messages)
+
+	usageBefore := currentUsage()
+	ctx = a.withVisionImages(ctx, messages)
+	digest, err := a.Summarizer.SummarizeTopic(ctx, topic, messages)
+	if err != nil {
+		return "", fmt.Errorf("generating topic digest: %w", err)
+	}
+	digest.Usage = currentUsage().Sub(usageBefore)
+	digest.MessageIDs = messageIDs(messages)
+	a.state.archiveDigest(digest)
+
+	return renderDiscord(digest), nil
+}
+
+// parseSince reads a lookback window. on top of time.ParseDuration it takes days and weeks, like 30d or 2w
+func parseSince(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count <= 0 {
+				return 0, fmt.Errorf("invalid window %q", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid window %q, try something like 30d, 2w or 12h", s)
+	}
+	return d, nil
+}
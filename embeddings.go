@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// embeddingBatchSize is how many texts go to the provider in one request
+const embeddingBatchSize = 64
+
+type EmbeddingConfig struct {
+	// Provider is "openai" (the default), "ollama", or "tei" for a local text-embeddings-inference server, which runs
+	// ONNX models on the CPU
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	BaseURL  string `json:"base_url"`
+	// IndexDays is how long emails stay in the index, default a year
+	IndexDays int `json:"index_days"`
+	// DedupThreshold is the similarity above which an email is dropped from a digest as a duplicate of an earlier one
+	// in it, 0 to keep duplicates
+	DedupThreshold float64 `json:"dedup_threshold"`
+}
+
+// Embedder turns texts into vectors, for the email index and for spotting duplicates
+type Embedder interface {
+	// Name identifies the provider and model. vectors from different ones can't be compared
+	Name() string
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+func newEmbedder(config EmbeddingConfig, client *openai.Client, httpClient *http.Client) (Embedder, error) {
+	switch config.Provider {
+	case "", "openai":
+		model := openai.EmbeddingModel(config.Model)
+		if model == "" {
+			model = openai.SmallEmbedding3
+		}
+		return &openAIEmbedder{client: client, model: model}, nil
+	case "ollama":
+		e := &ollamaEmbedder{client: httpClient, baseURL: "http://localhost:11434", model: "nomic-embed-text"}
+		if config.BaseURL != "" {
+			e.baseURL = strings.TrimSuffix(config.BaseURL, "/")
+		}
+		if config.Model != "" {
+			e.model = config.Model
+		}
+		return e, nil
+	case "tei":
+		e := &teiEmbedder{client: httpClient, baseURL: "http://localhost:8080", model: config.Model}
+		if config.BaseURL != "" {
+			e.baseURL = strings.TrimSuffix(config.BaseURL, "/")
+		}
+		return e, nil
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q, expected openai, ollama or tei", config.Provider)
+	}
+}
+
+// embedAll embeds texts in batches the provider accepts
+func embedAll(ctx context.Context, e Embedder, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		batch := texts[start:min(start+embeddingBatchSize, len(texts))]
+		embedded, err := e.Embed(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		if len(embedded) != len(batch) {
+			return nil, fmt.Errorf("%s returned %d embeddings for %d texts", e.Name(), len(embedded), len(batch))
+		}
+		vectors = append(vectors, embedded...)
+	}
+	return vectors, nil
+}
+
+type openAIEmbedder struct {
+	client *openai.Client
+	model  openai.EmbeddingModel
+}
+
+func (e *openAIEmbedder) Name() string {
+	return "openai/" + string(e.model)
+}
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	resp, err := e.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{Input: texts, Model: e.model})
+	if err != nil {
+		return nil, fmt.Errorf("creating embeddings: %w", err)
+	}
+	vectors := make([][]float32, len(texts))
+	for _, d := range resp.Data {
+		if d.Index >= 0 && d.Index < len(vectors) {
+			vectors[d.Index] = d.Embedding
+		}
+	}
+	return vectors, nil
+}
+
+// ollamaEmbedder uses a local Ollama server, e.g. with nomic-embed-text pulled
+type ollamaEmbedder struct {
+	client  *http.Client
+	baseURL string
+	model   string
+}
+
+func (e *ollamaEmbedder) Name() string {
+	return "ollama/" + e.model
+}
+
+func (e *ollamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var resp struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := embedRequest(ctx, e.client, e.baseURL+"/api/embed", map[string]any{"model": e.model, "input": texts}, &resp); err != nil {
+		return nil, fmt.Errorf("ollama embeddings: %w", err)
+	}
+	return resp.Embeddings, nil
+}
+
+// teiEmbedder uses a local Hugging Face text-embeddings-inference server. the model is whatever the server was started
+// with, model only tells the vectors of one apart from another's
+type teiEmbedder struct {
+	client  *http.Client
+	baseURL string
+	model   string
+}
+
+func (e *teiEmbedder) Name() string {
+	if e.model == "" {
+		return "tei/" + e.baseURL
+	}
+	return "tei/" + e.model
+}
+
+func (e *teiEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var vectors [][]float32
+	if err := embedRequest(ctx, e.client, e.baseURL+"/embed", map[string]any{"inputs": texts, "truncate": true}, &vectors); err != nil {
+		return nil, fmt.Errorf("tei embeddings: %w", err)
+	}
+	return vectors, nil
+}
+
+// embedRequest posts body as JSON and decodes the JSON answer into out
+func embedRequest(ctx context.Context, client *http.Client, url string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
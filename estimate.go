@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+// costButtonPrefix starts the custom id of the buttons of a cost confirmation, followed by its id and the answer
+const costButtonPrefix = "cost:"
+
+// defaultConfirmWait is how long a digest over budget.confirm_above waits for an answer when the config doesn't say.
+// the wait counts towards the task's maxTaskRuntime
+const defaultConfirmWait = 20 * time.Minute
+
+// costConfirmations are the digests waiting for a yes or no, by confirmation id
+var costConfirmations = struct {
+	sync.Mutex
+	pending map[string]chan bool
+}{pending: make(map[string]chan bool)}
+
+// confirmWait is how long to wait for the answer to a cost confirmation
+func (c *BudgetConfig) confirmWait() (time.Duration, error) {
+	if c.ConfirmWait == "" {
+		return defaultConfirmWait, nil
+	}
+	wait, err := time.ParseDuration(c.ConfirmWait)
+	if err != nil {
+		return 0, fmt.Errorf("invalid budget confirm_wait: %w", err)
+	}
+	if wait <= 0 || wait >= maxTaskRuntime {
+		return 0, fmt.Errorf("invalid budget confirm_wait %s, it has to be under %s", wait, maxTaskRuntime)
+	}
+	return wait, nil
+}
+
+// estimateDigestCost is what summarizing the emails is projected to cost, once the budget has condensed what it would
+func (a *App) estimateDigestCost(ctx context.Context, messages []*gmail.Message) float64 {
+	if _, _, plan := a.planBudget(ctx, messages); plan != nil {
+		return plan.final
+	}
+	return projectDigestCost(messages, nil)
+}
+
+// confirmDigestCost asks in channelID whether to go ahead with a digest projected to cost more than
+// budget.confirm_above, and waits for the answer. nobody answering in time is a no: the emails wait for the next digest
+func (a *App) confirmDigestCost(ctx context.Context, kind, channelID string, messages []*gmail.Message) (bool, error) {
+	config := a.Config.Budget
+	if config == nil || config.ConfirmAbove <= 0 {
+		return true, nil
+	}
+	logger := log.FromContext(ctx)
+	estimate := a.estimateDigestCost(ctx, messages)
+	if estimate <= config.ConfirmAbove {
+		return true, nil
+	}
+	if a.Discord == nil {
+		logger.Warn("Digest is over the confirmation threshold, but there's no Discord to ask", "estimate", estimate)
+		return true, nil
+	}
+	wait, err := config.confirmWait()
+	if err != nil {
+		return false, err
+	}
+
+	id := strconv.FormatInt(a.Clock.Now().UnixNano(), 36)
+	answer := make(chan bool, 1)
+	costConfirmations.Lock()
+	costConfirmations.pending[id] = answer
+	costConfirmations.Unlock()
+	defer func() {
+		costConfirmations.Lock()
+		delete(costConfirmations.pending, id)
+		costConfirmations.Unlock()
+	}()
+
+	question, err := a.Discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("This %s digest will cost ~$%.2f across %s — proceed?", kind, estimate, pluralize(len(messages), "email")),
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "Proceed", Style: discordgo.PrimaryButton, CustomID: costButtonPrefix + id + ":yes"},
+			discordgo.Button{Label: "Skip", Style: discordgo.SecondaryButton, CustomID: costButtonPrefix + id + ":no"},
+		}}},
+	})
+	if err != nil {
+		return false, fmt.Errorf("asking whether to go ahead with the digest: %w", err)
+	}
+	logger.Info("Waiting for the digest's cost to be confirmed", "estimate", estimate, "threshold", config.ConfirmAbove)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case ok := <-answer:
+		logger.Info("Digest cost answered", "proceed", ok)
+		return ok, nil
+	case <-timer.C:
+		content := fmt.Sprintf("This %s digest would have cost ~$%.2f across %s. Nobody answered within %s, so it was skipped and the emails wait for the next one.",
+			kind, estimate, pluralize(len(messages), "email"), wait)
+		if _, err := a.Discord.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			Channel: channelID, ID: question.ID, Content: &content, Components: &[]discordgo.MessageComponent{},
+		}); err != nil {
+			logger.Error("Unable to update the cost confirmation", "error", err)
+		}
+		logger.Warn("Digest cost wasn't confirmed in time, skipping the digest")
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// handleCostButton passes the answer to the digest waiting for it, and takes the buttons off the question
+func (a *App) handleCostButton(i *discordgo.InteractionCreate, id string) {
+	logger := log.FromContext(withTaskRun(context.Background(), "cost confirmation"))
+	id, answer, _ := strings.Cut(id, ":")
+
+	costConfirmations.Lock()
+	waiting, ok := costConfirmations.pending[id]
+	if ok {
+		delete(costConfirmations.pending, id)
+	}
+	costConfirmations.Unlock()
+
+	response := &discordgo.InteractionResponse{Type: discordgo.InteractionResponseUpdateMessage, Data: &discordgo.InteractionResponseData{
+		Content:    i.Message.Content,
+		Components: []discordgo.MessageComponent{},
+	}}
+	switch {
+	case !ok:
+		response.Data.Content += "\n*No digest is waiting for this answer any more.*"
+	case answer == "yes":
+		response.Data.Content += fmt.Sprintf("\n*Going ahead, %s said so.*", interactionUserMention(i))
+	default:
+		response.Data.Content += fmt.Sprintf("\n*Skipped by %s, the emails wait for the next digest.*", interactionUserMention(i))
+	}
+	if ok {
+		waiting <- answer == "yes"
+	}
+	if err := a.Discord.InteractionRespond(i.Interaction, response); err != nil {
+		logger.Error("Failed to answer the cost confirmation", "error", err)
+	}
+}
+
+// interactionUserMention mentions whoever used a button, in a server or in a DM
+func interactionUserMention(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.Mention()
+	}
+	if i.User != nil {
+		return i.User.Mention()
+	}
+	return "someone"
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// maxExamplesPerCategory bounds the library, the oldest example of a category goes first
+	maxExamplesPerCategory = 10
+	// maxExamplesPerEmail is how many examples the model is shown with an email
+	maxExamplesPerEmail = 2
+	// exampleBodyTokens is how much of an example's email is kept, enough to recognize the kind of email
+	exampleBodyTokens = 300
+)
+
+// FewShotExample is an email and the summary the user liked for it, shown to the model with emails of the same kind so
+// recurring ones like CI alerts or bank notices are summarized the same way every time
+type FewShotExample struct {
+	MessageID string    `json:"message_id"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	Summary   string    `json:"summary"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// seedExamples adds the entries of a digest from the senders the user rated 👍 to the example library, filed under the
+// category the model gave them. the email itself is only still around for the latest digest of each kind, older ones
+// are kept with their subject alone
+func seedExamples(s *State, digestID string, senders []string, now time.Time) int {
+	var digest *Digest
+	for _, d := range s.Digests {
+		if d.ID == digestID {
+			digest = d
+		}
+	}
+	if digest == nil {
+		return 0
+	}
+
+	account := s.account()
+	emails := make(map[string]*gmail.Message)
+	for _, messages := range account.LastDigestEmails {
+		for _, message := range messages {
+			emails[message.Id] = message
+		}
+	}
+	liked := make(map[string]bool, len(senders))
+	for _, sender := range senders {
+		liked[sender] = true
+	}
+
+	if account.Examples == nil {
+		account.Examples = make(map[string][]FewShotExample)
+	}
+	added := 0
+	for _, entry := range digest.Entries {
+		if !liked[senderAddress(entry.From)] || entry.Summary == "" || findExample(account.Examples, entry.MessageID) != "" {
+			continue
+		}
+		example := FewShotExample{
+			MessageID: entry.MessageID,
+			From:      entry.From,
+			Subject:   entry.Subject,
+			Summary:   entry.Summary,
+			AddedAt:   now,
+		}
+		if message, ok := emails[entry.MessageID]; ok {
+			example.Body = truncateTokens(exampleBodyTokens, stripQuotes(extractBody(message)))
+		}
+		category := strings.ToLower(entry.Category)
+		if category == "" {
+			category = "other"
+		}
+		examples := append(account.Examples[category], example)
+		if len(examples) > maxExamplesPerCategory {
+			examples = examples[len(examples)-maxExamplesPerCategory:]
+		}
+		account.Examples[category] = examples
+		added++
+	}
+	return added
+}
+
+// findExample is the category an example is filed under, empty when it isn't in the library
+func findExample(library map[string][]FewShotExample, messageID string) string {
+	for category, examples := range library {
+		for _, example := range examples {
+			if example.MessageID == messageID {
+				return category
+			}
+		}
+	}
+	return ""
+}
+
+// examplesFor picks the examples to show the model with an email: the given category's, when a rule names one,
+// otherwise the ones from the same sender, then the same domain
+func (st *stateStore) examplesFor(message *gmail.Message, category string) []FewShotExample {
+	var picked []FewShotExample
+	st.read(func(s *State) {
+		library := s.account().Examples
+		if category != "" {
+			examples := library[strings.ToLower(category)]
+			// the newest are the closest to how the user wants things now
+			for i := len(examples) - 1; i >= 0 && len(picked) < maxExamplesPerEmail; i-- {
+				picked = append(picked, examples[i])
+			}
+			return
+		}
+
+		address := senderAddress(extractHeader(message, "From"))
+		_, domain, _ := strings.Cut(address, "@")
+		var sameSender, sameDomain []FewShotExample
+		for _, examples := range library {
+			for _, example := range examples {
+				if example.MessageID == message.Id {
+					continue
+				}
+				exampleAddress := senderAddress(example.From)
+				switch {
+				case exampleAddress == address:
+					sameSender = append(sameSender, example)
+				case domain != "" && strings.HasSuffix(exampleAddress, "@"+domain):
+					sameDomain = append(sameDomain, example)
+				}
+			}
+		}
+		for _, examples := range [][]FewShotExample{sameSender, sameDomain} {
+			sort.Slice(examples, func(i, j int) bool { return examples[i].AddedAt.After(examples[j].AddedAt) })
+			for _, example := range examples {
+				if len(picked) < maxExamplesPerEmail {
+					picked = append(picked, example)
+				}
+			}
+		}
+	})
+	return picked
+}
+
+// examplesPrompt shows the model the examples, to add to an email's prompt
+func examplesPrompt(examples []FewShotExample) string {
+	var sb strings.Builder
+	sb.WriteString("# Examples\nThe user liked how these similar emails were summarized before. Summarize this one the same way, with the same kind of detail.\n")
+	for i, example := range examples {
+		fmt.Fprintf(&sb, "\n## Example %d\n- **From:** %s\n- **Subject:** %s\n", i+1, example.From, example.Subject)
+		if example.Body != "" {
+			fmt.Fprintf(&sb, "\n%s\n", example.Body)
+		}
+		fmt.Fprintf(&sb, "\n**Summary:** %s\n", example.Summary)
+	}
+	return sb.String()
+}
+
+// examplesCommand is /examples: the few-shot example library, to look through, prune and reorganize
+func examplesCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	switch options["action"] {
+	case "", "list":
+		return a.state.listExamples(options["category"]), nil
+	case "remove", "move":
+	default:
+		return "", fmt.Errorf("unknown action %q, expected list, remove or move", options["action"])
+	}
+
+	id := strings.TrimSpace(options["id"])
+	if id == "" {
+		return "", fmt.Errorf("which example? /examples list shows their ids")
+	}
+	to := strings.ToLower(strings.TrimSpace(options["category"]))
+	if options["action"] == "move" && to == "" {
+		return "", fmt.Errorf("move it to which category?")
+	}
+
+	var from string
+	if err := a.state.update(func(s *State) {
+		library := s.account().Examples
+		if from = findExample(library, id); from == "" {
+			return
+		}
+		var example FewShotExample
+		kept := library[from][:0]
+		for _, e := range library[from] {
+			if e.MessageID == id {
+				example = e
+				continue
+			}
+			kept = append(kept, e)
+		}
+		library[from] = kept
+		if len(kept) == 0 {
+			delete(library, from)
+		}
+		if options["action"] == "move" {
+			library[to] = append(library[to], example)
+		}
+	}); err != nil {
+		return "", fmt.Errorf("saving the example library: %w", err)
+	}
+	if from == "" {
+		return fmt.Sprintf("There's no example %s.", id), nil
+	}
+
+	log.FromContext(ctx).Info("Example library changed", "action", options["action"], "id", id, "from", from, "to", to)
+	if options["action"] == "move" {
+		return fmt.Sprintf("Moved example %s from %s to %s.", id, from, to), nil
+	}
+	return fmt.Sprintf("Removed example %s from %s.", id, from), nil
+}
+
+// listExamples is the categories of the library, or the examples of one category
+func (st *stateStore) listExamples(category string) string {
+	var sb strings.Builder
+	st.read(func(s *State) {
+		library := s.account().Examples
+		if category == "" {
+			categories := make([]string, 0, len(library))
+			for c := range library {
+				categories = append(categories, c)
+			}
+			sort.Strings(categories)
+			for _, c := range categories {
+				fmt.Fprintf(&sb, "**%s**: %s\n", c, pluralize(len(library[c]), "example"))
+			}
+			return
+		}
+		for _, example := range library[strings.ToLower(category)] {
+			fmt.Fprintf(&sb, "- `%s` **%s** — %s\n  %s\n", example.MessageID, senderName(example.From), example.Subject, example.Summary)
+		}
+	})
+	if sb.Len() == 0 {
+		if category != "" {
+			return fmt.Sprintf("No examples in %s.", category)
+		}
+		return "No examples yet. Rate senders 👍 under a digest to add their emails."
+	}
+	return sb.String()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// FixturesConfig records the Gmail and OpenAI responses of a run to Dir, or plays them back from there instead of
+// calling either API
+type FixturesConfig struct {
+	Mode string `json:"mode"`
+	Dir  string `json:"dir"`
+}
+
+// fixture is one recorded response
+type fixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// fixtureRecorder numbers the requests made to each endpoint, so the n-th call to an endpoint replays the n-th
+// recorded response. requests aren't matched on their query or body: those contain timestamps and prompts, which
+// change between runs, and changing prompts is exactly what replaying is for
+type fixtureRecorder struct {
+	mode   string
+	dir    string
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var fixtures *fixtureRecorder
+
+func setupFixtures(config *Config) error {
+	if config.Fixtures == nil {
+		return nil
+	}
+
+	switch config.Fixtures.Mode {
+	case "record", "replay":
+	default:
+		return fmt.Errorf("fixtures mode must be record or replay, got %q", config.Fixtures.Mode)
+	}
+
+	dir := config.Fixtures.Dir
+	if dir == "" {
+		dir = "fixtures"
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating fixtures directory: %w", err)
+	}
+
+	fixtures = &fixtureRecorder{mode: config.Fixtures.Mode, dir: dir, counts: make(map[string]int)}
+	log.Warn("Fixtures enabled", "mode", fixtures.mode, "dir", dir)
+	return nil
+}
+
+// replayingFixtures reports whether API calls are served from fixtures, in which case there is nothing to authorize
+func replayingFixtures() bool {
+	return fixtures != nil && fixtures.mode == "replay"
+}
+
+// withFixtures wraps client so its requests are recorded or replayed, if fixtures are enabled
+func withFixtures(client *http.Client) *http.Client {
+	if fixtures == nil {
+		return client
+	}
+
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	wrapped := *client
+	wrapped.Transport = &fixtureTransport{recorder: fixtures, next: next}
+	return &wrapped
+}
+
+type fixtureTransport struct {
+	recorder *fixtureRecorder
+	next     http.RoundTripper
+}
+
+func (t *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := t.recorder.nextPath(req)
+
+	if t.recorder.mode == "replay" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("no fixture for %s %s: %w", req.Method, req.URL.Path, err)
+		}
+		var f fixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("parsing fixture %s: %w", path, err)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+			StatusCode:    f.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        f.Header,
+			Body:          io.NopCloser(strings.NewReader(f.Body)),
+			ContentLength: int64(len(f.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading response to record: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	// only the content type is kept, the rest of the headers can carry cookies and request ids
+	header := http.Header{}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	data, err := json.MarshalIndent(fixture{
+		Method: req.Method,
+		URL:    req.URL.Redacted(),
+		Status: resp.StatusCode,
+		Header: header,
+		Body:   string(body),
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding fixture: %w", err)
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		log.Error("Unable to record fixture", "file", path, "error", err)
+	}
+	return resp, nil
+}
+
+// nextPath returns the fixture file for the next call to req's endpoint
+func (r *fixtureRecorder) nextPath(req *http.Request) string {
+	endpoint := strings.ToLower(req.Method) + "_" + req.URL.Host + req.URL.Path
+	endpoint = strings.Map(func(c rune) rune {
+		if c == '/' || c == '.' || c == ':' {
+			return '_'
+		}
+		return c
+	}, endpoint)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[endpoint]++
+	return filepath.Join(r.dir, fmt.Sprintf("%s_%03d.json", endpoint, r.counts[endpoint]))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// FollowUpsConfig enables the "Waiting on" section: threads where the user sent the last email and nobody has
+// answered for AfterDays. sent mail older than LookbackDays is assumed to be dead
+type FollowUpsConfig struct {
+	AfterDays    int `json:"after_days"`
+	LookbackDays int `json:"lookback_days"`
+}
+
+// AwaitingReply is a thread where the user's email is still the latest one
+type AwaitingReply struct {
+	ThreadID  string    `json:"thread_id"`
+	MessageID string    `json:"message_id"`
+	To        string    `json:"to"`
+	Subject   string    `json:"subject"`
+	Snippet   string    `json:"snippet"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// nudgeButtonPrefix starts the custom id of the nudge buttons, followed by the thread id
+const nudgeButtonPrefix = "nudge:"
+
+// maxNudgeButtons is Discord's limit of 5 rows of 5 buttons per message
+const maxNudgeButtons = 25
+
+// fetchAwaitingReplies finds the threads with sent mail after the given time whose latest message is the user's own
+func fetchAwaitingReplies(ctx context.Context, client *http.Client, after time.Time) ([]AwaitingReply, error) {
+	logger := log.FromContext(ctx)
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Gmail client: %v", err)
+	}
+
+	r, err := srv.Users.Threads.List("me").Q(fmt.Sprintf("in:sent after:%d", after.Unix())).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve sent threads: %w", err)
+	}
+
+	var replies []AwaitingReply
+	for _, t := range r.Threads {
+		thread, err := srv.Users.Threads.Get("me", t.Id).Format("metadata").MetadataHeaders("To", "Subject").Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve thread: %w", err)
+		}
+		if len(thread.Messages) == 0 {
+			continue
+		}
+
+		last := thread.Messages[len(thread.Messages)-1]
+		if !hasLabel(last, "SENT") {
+			continue
+		}
+		replies = append(replies, AwaitingReply{
+			ThreadID:  thread.Id,
+			MessageID: last.Id,
+			To:        extractHeader(last, "To"),
+			Subject:   extractHeader(last, "Subject"),
+			Snippet:   last.Snippet,
+			SentAt:    time.UnixMilli(last.InternalDate),
+		})
+	}
+
+	logger.Info("Threads awaiting a reply", "count", len(replies), "sent_threads", len(r.Threads))
+	return replies, nil
+}
+
+func hasLabel(message *gmail.Message, label string) bool {
+	for _, id := range message.LabelIds {
+		if id == label {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFollowUps returns the threads that have been waiting longer than configured, oldest first, and remembers them
+// for the nudge buttons
+func (a *App) checkFollowUps(ctx context.Context) ([]AwaitingReply, error) {
+	afterDays, lookbackDays := a.Config.FollowUps.AfterDays, a.Config.FollowUps.LookbackDays
+	if afterDays <= 0 {
+		afterDays = 3
+	}
+	if lookbackDays <= 0 {
+		lookbackDays = 30
+	}
+
+	now := a.Clock.Now()
+	replies, err := a.Emails.AwaitingReplies(ctx, now.AddDate(0, 0, -lookbackDays))
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := now.AddDate(0, 0, -afterDays)
+	var waiting []AwaitingReply
+	for _, reply := range replies {
+		if reply.SentAt.Before(cutoff) {
+			waiting = append(waiting, reply)
+		}
+	}
+	// oldest first, they're the most overdue
+	for i, j := 0, len(waiting)-1; i < j; i, j = i+1, j-1 {
+		waiting[i], waiting[j] = waiting[j], waiting[i]
+	}
+
+	if err := a.state.update(func(s *State) {
+		s.account().AwaitingReplies = waiting
+	}); err != nil {
+		return nil, fmt.Errorf("saving awaiting replies: %w", err)
+	}
+	return waiting, nil
+}
+
+// formatWaitingOn renders the "Waiting on" section, one line per thread
+func formatWaitingOn(replies []AwaitingReply, now time.Time) string {
+	var sb strings.Builder
+	sb.WriteString("## Waiting on\n")
+	for _, reply := range replies {
+		days := int(now.Sub(reply.SentAt).Hours() / 24)
+		fmt.Fprintf(&sb, "- **%s**, re: %s (%s)\n", senderName(reply.To), reply.Subject, pluralize(days, "day"))
+	}
+	return sb.String()
+}
+
+func pluralize(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return strconv.Itoa(n) + " " + unit + "s"
+}
+
+// sendWaitingOn posts the section with a nudge button per thread
+func (a *App) sendWaitingOn(channelID string, replies []AwaitingReply) error {
+	var rows []discordgo.MessageComponent
+	var row discordgo.ActionsRow
+	for i, reply := range replies {
+		if i == maxNudgeButtons {
+			break
+		}
+		label := "Nudge " + senderName(reply.To)
+		if len(label) > 80 {
+			label = label[:80]
+		}
+		row.Components = append(row.Components, discordgo.Button{
+			Label:    label,
+			Style:    discordgo.SecondaryButton,
+			CustomID: nudgeButtonPrefix + reply.ThreadID,
+		})
+		if len(row.Components) == 5 {
+			rows = append(rows, row)
+			row = discordgo.ActionsRow{}
+		}
+	}
+	if len(row.Components) > 0 {
+		rows = append(rows, row)
+	}
+
+	content := formatWaitingOn(replies, a.Clock.Now())
+	if len(content) > maxDiscordMessageLength {
+		content = content[:maxDiscordMessageLength]
+	}
+	if _, err := a.Discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:    content,
+		Components: rows,
+	}); err != nil {
+		return fmt.Errorf("sending waiting on section: %w", err)
+	}
+	return nil
+}
+
+// handleNudgeButton drafts a polite follow-up for the thread and shows it only to whoever pressed the button. the bot
+// only has read access to Gmail, so the draft is for copying into the thread, linked below it
+func (a *App) handleNudgeButton(i *discordgo.InteractionCreate, threadID string) {
+	ctx := withLLMPriority(withTaskRun(context.Background(), "nudge"), llmPriorityInteractive)
+	logger := log.FromContext(ctx)
+
+	if err := a.Discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	}); err != nil {
+		logger.Error("Failed to acknowledge nudge button", "error", err)
+		return
+	}
+
+	var reply *AwaitingReply
+	a.state.read(func(s *State) {
+		for _, r := range s.account().AwaitingReplies {
+			if r.ThreadID == threadID {
+				reply = &r
+				break
+			}
+		}
+	})
+
+	var content string
+	if reply == nil {
+		content = "That thread isn't waiting on a reply any more."
+	} else if draft, err := a.Summarizer.DraftNudge(ctx, *reply); err != nil {
+		logger.Error("Failed to draft nudge", "error", err)
+		recordTaskError(a.taskName("nudge"), err)
+		content = "Sorry, that failed: " + err.Error()
+	} else {
+		content = fmt.Sprintf("%s\n\n%s", draft, gmailThreadURL(a.Config.GmailAccount, reply.ThreadID))
+	}
+
+	if len(content) > maxDiscordMessageLength {
+		content = content[:maxDiscordMessageLength]
+	}
+	if _, err := a.Discord.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content}); err != nil {
+		logger.Error("Failed to send nudge draft", "error", err)
+	}
+}
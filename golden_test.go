@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// update rewrites the golden files with the current output: go test -run Golden -update
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// goldenLocation is the timezone the golden files are rendered in, so they don't depend on the machine's
+var goldenLocation = time.FixedZone("CET", 60*60)
+
+// TestPromptTemplatesGolden renders every template in templates/ with the fixtures. the email templates are rendered
+// once for each email in testdata/emails, the others once with testdata/prompt_vars.json
+func TestPromptTemplatesGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("templates", "*.tmpl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no templates found")
+	}
+	var vars map[string]any
+	readJSON(t, filepath.Join("testdata", "prompt_vars.json"), &vars)
+	emails := fixtureEmails(t)
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		text, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) {
+			if !isEmailTemplate(string(text)) {
+				checkGolden(t, filepath.Join("prompts", strings.TrimSuffix(name, ".tmpl")+".txt"), renderFixturePrompt(t, string(text), maps.Clone(vars)))
+				return
+			}
+			for _, message := range emails {
+				data := emailPromptData(message, extractBody(message), goldenLocation)
+				checkGolden(t, filepath.Join("prompts", strings.TrimSuffix(name, ".tmpl"), message.Id+".txt"), renderFixturePrompt(t, string(text), data))
+			}
+		})
+	}
+}
+
+// TestTemplatesCovered makes sure every template the summarizer loads is in templates/, and so has golden files
+func TestTemplatesCovered(t *testing.T) {
+	for name := range (&Templates{}).files() {
+		if _, err := os.Stat(filepath.Join("templates", name)); err != nil {
+			t.Errorf("%s has no golden files: %v", name, err)
+		}
+	}
+}
+
+// TestDigestRenderersGolden renders every digest in testdata/digests in every format, Discord embeds included
+func TestDigestRenderersGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "digests", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		var digest Digest
+		readJSON(t, file, &digest)
+		t.Run(name, func(t *testing.T) {
+			for _, format := range digestFormats() {
+				rendered, err := renderDigest(&digest, format)
+				if err != nil {
+					t.Fatalf("rendering %s: %v", format, err)
+				}
+				checkGolden(t, filepath.Join("digests", name+"."+format), rendered)
+			}
+			embeds, err := json.MarshalIndent(groupEmbeds(renderEmbeds(&digest)), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, filepath.Join("digests", name+".embeds.json"), string(embeds))
+		})
+	}
+}
+
+// isEmailTemplate is whether a template reads one email, like email_prompt.tmpl and the rule templates
+func isEmailTemplate(text string) bool {
+	return strings.Contains(text, "{{body}}") || strings.Contains(text, ".body")
+}
+
+func renderFixturePrompt(t *testing.T, text string, data map[string]any) string {
+	t.Helper()
+	rendered, err := renderPromptText(text, data, "", goldenLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rendered
+}
+
+// checkGolden compares got with the golden file at testdata/golden/name, or rewrites it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run the tests with -update to create it", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from its golden file, run the tests with -update and review the diff\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+func readJSON(t *testing.T, path string, v any) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+// fixtureEmails are the emails in testdata/emails, as Gmail's API would return them, by file name
+func fixtureEmails(t *testing.T) []*gmail.Message {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "emails", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []*gmail.Message
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := gmailMessage(strings.TrimSuffix(filepath.Base(file), ".eml"), raw)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// gmailMessage parses a MIME email into the form the Gmail API returns it in: headers decoded, a part for each MIME
+// part and every body base64url encoded, without its transfer encoding
+func gmailMessage(id string, raw []byte) (*gmail.Message, error) {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := gmailPart(textproto.MIMEHeader(parsed.Header), parsed.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Gmail keeps the email's own order and spelling of its headers, which textproto doesn't
+	payload.Headers = rawHeaders(raw)
+	message := &gmail.Message{Id: id, ThreadId: "thread-" + id, Payload: payload}
+	if date, err := parsed.Header.Date(); err == nil {
+		message.InternalDate = date.UnixMilli()
+	}
+	return message, nil
+}
+
+// rawHeaders are the top-level headers of an email as written, unfolded and decoded
+func rawHeaders(raw []byte) []*gmail.MessagePartHeader {
+	decoder := new(mime.WordDecoder)
+	var headers []*gmail.MessagePartHeader
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		headers = append(headers, &gmail.MessagePartHeader{Name: name, Value: strings.TrimSpace(value)})
+	}
+	for _, header := range headers {
+		if decoded, err := decoder.DecodeHeader(header.Value); err == nil {
+			header.Value = decoded
+		}
+	}
+	return headers
+}
+
+func gmailPart(header textproto.MIMEHeader, body io.Reader) (*gmail.MessagePart, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	part := &gmail.MessagePart{MimeType: mediaType, Body: &gmail.MessagePartBody{}}
+	if _, disposition, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Filename = disposition["filename"]
+	}
+	decoder := new(mime.WordDecoder)
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			if decoded, err := decoder.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			part.Headers = append(part.Headers, &gmail.MessagePartHeader{Name: name, Value: value})
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			child, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			childPart, err := gmailPart(child.Header, child)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, childPart)
+		}
+		return part, nil
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	part.Body.Data = base64.URLEncoding.EncodeToString(data)
+	part.Body.Size = int64(len(data))
+	return part, nil
+}
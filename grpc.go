@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"scheduler"
+
+	pb "email/proto"
+)
+
+type GRPCConfig struct {
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+// jsonCodec lets clients without the generated stubs call the service with JSON, with the content subtype "json". the
+// generated types are marshalled as they are, so their json tags, the json names in the .proto, are the wire format
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+// codecs have to be registered before any server starts
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type grpcServer struct {
+	pb.UnimplementedReadsUrEmailsServer
+	app *App
+	s   *scheduler.Scheduler
+}
+
+func startGRPCServer(a *App, config GRPCConfig, s *scheduler.Scheduler) error {
+	lis, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := checkGRPCToken(ctx, config.Token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := checkGRPCToken(ss.Context(), config.Token); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	pb.RegisterReadsUrEmailsServer(srv, &grpcServer{app: a, s: s})
+
+	log.Info("gRPC server listening", "addr", config.Listen)
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Error("gRPC server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// checkGRPCToken expects the same "authorization: Bearer <token>" scheme as the REST API, as request metadata
+func checkGRPCToken(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if token != "" && subtle.ConstantTimeCompare([]byte(v), []byte("Bearer "+token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing API token")
+}
+
+func (g *grpcServer) ListTasks(ctx context.Context, req *pb.ListTasksRequest) (*pb.ListTasksResponse, error) {
+	resp := &pb.ListTasksResponse{}
+	for _, task := range g.app.tasks() {
+		resp.Tasks = append(resp.Tasks, &pb.Task{Name: task.Name, Id: task.ID, Profile: task.Profile})
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) ListDigests(ctx context.Context, req *pb.ListDigestsRequest) (*pb.ListDigestsResponse, error) {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = 20
+	}
+	resp := &pb.ListDigestsResponse{}
+	for _, digest := range g.app.state.recentDigests(req.Kind, limit) {
+		resp.Digests = append(resp.Digests, digestMessage(digest))
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) GetDigest(ctx context.Context, req *pb.GetDigestRequest) (*pb.Digest, error) {
+	if req.Id != "" {
+		if digest := g.app.state.findDigest(req.Id); digest != nil {
+			return digestMessage(digest), nil
+		}
+		return nil, status.Error(codes.NotFound, "digest not found")
+	}
+
+	digests := g.app.state.recentDigests(req.Kind, 1)
+	if len(digests) == 0 {
+		return nil, status.Error(codes.NotFound, "no digests yet")
+	}
+	return digestMessage(digests[0]), nil
+}
+
+// digestMessage is the digest as the .proto has it
+func digestMessage(digest *Digest) *pb.Digest {
+	message := &pb.Digest{
+		Id:          digest.ID,
+		Kind:        digest.Kind,
+		Title:       digest.Title,
+		GeneratedAt: digest.GeneratedAt.Format(time.RFC3339),
+		EmailCount:  int64(digest.EmailCount),
+		Summary:     digest.Summary,
+		Categories:  make(map[string]int64, len(digest.Categories)),
+		Usage: &pb.TokenUsage{
+			PromptTokens:     int64(digest.Usage.PromptTokens),
+			CompletionTokens: int64(digest.Usage.CompletionTokens),
+			CostUsd:          digest.Usage.CostUSD,
+		},
+		MessageIds: digest.MessageIDs,
+		Hash:       digest.Hash,
+		Signature:  digest.Signature,
+	}
+	for category, count := range digest.Categories {
+		message.Categories[category] = int64(count)
+	}
+	for _, entry := range digest.Entries {
+		summary := &pb.EmailSummary{
+			MessageId: entry.MessageID,
+			From:      entry.From,
+			Subject:   entry.Subject,
+			Category:  entry.Category,
+			Summary:   entry.Summary,
+			Urgency:   entry.Urgency,
+			Url:       entry.URL,
+		}
+		for _, item := range entry.ActionItems {
+			summary.ActionItems = append(summary.ActionItems, &pb.ActionItem{Description: item.Description, Due: item.Due})
+		}
+		message.Entries = append(message.Entries, summary)
+	}
+	return message
+}
+
+func (g *grpcServer) Summarize(req *pb.SummarizeRequest, stream grpc.ServerStreamingServer[pb.ProgressEvent]) error {
+	var fn func(ctx context.Context) error
+	switch req.Kind {
+	case "", "daily":
+		req.Kind = "daily"
+		fn = g.app.summarizeNow("daily")
+	case "weekly":
+		fn = g.app.summarizeNow("weekly")
+	default:
+		return status.Error(codes.InvalidArgument, "kind must be daily or weekly")
+	}
+
+	// subscribe before queueing the run so no events are missed
+	events := subscribeProgress()
+	defer unsubscribeProgress(events)
+
+	// the run's id is picked here, so its events can be told apart from those of the other runs and profiles
+	name := g.app.taskName("Summary (gRPC)")
+	run := newRunID()
+	// finished is how the run ended, so the stream ends with it even when the run didn't report its last stage, like
+	// when it panicked or was stopped at its max runtime
+	finished := make(chan error, 1)
+	task := scheduler.NewTaskWithContext(func(ctx context.Context) (err error) {
+		defer func() {
+			result := err
+			r := recover()
+			if r != nil {
+				result = fmt.Errorf("panic: %v", r)
+			}
+			// the retries after a panic have no one waiting on them
+			select {
+			case finished <- result:
+			default:
+			}
+			if r != nil {
+				panic(r)
+			}
+		}()
+		return fn(withTaskRunID(ctx, name, run))
+	}).Named(name).MaxRuntime(maxTaskRuntime)
+	if _, err := g.s.Add(task.Once().GlobalBlocking()); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	// send streams the run's events, and says whether it was the last
+	send := func(event ProgressEvent) (bool, error) {
+		if event.Run != run || event.Profile != g.app.Profile {
+			return false, nil
+		}
+		err := stream.Send(&pb.ProgressEvent{
+			Kind:    event.Kind,
+			Stage:   event.Stage,
+			Done:    int64(event.Done),
+			Total:   int64(event.Total),
+			Error:   event.Error,
+			Run:     event.Run,
+			Profile: event.Profile,
+		})
+		return event.Finished(), err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case event := <-events:
+			if last, err := send(event); last || err != nil {
+				return err
+			}
+		case err := <-finished:
+			// the run's last events can still be waiting behind its end
+			for len(events) > 0 {
+				if last, err := send(<-events); last || err != nil {
+					return err
+				}
+			}
+			last := ProgressEvent{Kind: req.Kind, Stage: "done", Run: run, Profile: g.app.Profile}
+			if err != nil {
+				last.Stage, last.Error = "failed", err.Error()
+			}
+			_, err = send(last)
+			return err
+		}
+	}
+}
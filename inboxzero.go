@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	// maxInboxCounts bounds the inbox counts kept, a few fetches a day for a month or two
+	maxInboxCounts = 200
+	// defaultStaleDays is how old a conversation has to be to be suggested for archiving when the config doesn't say
+	defaultStaleDays = 30
+	// maxMuteSuggestions is how many senders the weekly summary suggests muting
+	maxMuteSuggestions = 5
+	// minMuteSuggestionEmails is the fewest emails in a week a sender needs to be worth muting
+	minMuteSuggestionEmails = 3
+)
+
+// sparkBlocks draw the trend of the inbox, lowest to highest
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+type InboxZeroConfig struct {
+	// StaleDays is how old the conversations suggested for archiving are
+	StaleDays int `json:"stale_days"`
+}
+
+// InboxCount is the size of the inbox at a fetch, in conversations like Gmail shows it
+type InboxCount struct {
+	At     time.Time `json:"at"`
+	Total  int       `json:"total"`
+	Unread int       `json:"unread"`
+}
+
+func fetchInboxCount(ctx context.Context, client *http.Client) (InboxCount, error) {
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return InboxCount{}, fmt.Errorf("unable to retrieve Gmail client: %v", err)
+	}
+
+	label, err := srv.Users.Labels.Get("me", "INBOX").Context(ctx).Do()
+	if err != nil {
+		return InboxCount{}, fmt.Errorf("unable to retrieve inbox label: %w", err)
+	}
+	return InboxCount{Total: int(label.ThreadsTotal), Unread: int(label.ThreadsUnread)}, nil
+}
+
+// recordInboxCount remembers how big the inbox is as a digest fetches, for the weekly inbox zero report. it's only a
+// report, so failing to count doesn't stop the digest
+func (a *App) recordInboxCount(ctx context.Context) {
+	if a.Config.InboxZero == nil {
+		return
+	}
+	logger := log.FromContext(ctx)
+	count, err := a.Emails.InboxCount(ctx)
+	if err != nil {
+		logger.Warn("Unable to count the inbox", "error", err)
+		return
+	}
+	count.At = a.Clock.Now()
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		account.InboxCounts = append(account.InboxCounts, count)
+		if len(account.InboxCounts) > maxInboxCounts {
+			account.InboxCounts = account.InboxCounts[len(account.InboxCounts)-maxInboxCounts:]
+		}
+	}); err != nil {
+		logger.Error("Unable to record the inbox count", "error", err)
+	}
+}
+
+// inboxZeroSection is how the inbox went this week, and what would clear it: the senders of the week's queue worth
+// muting and the conversations old enough to archive
+func (a *App) inboxZeroSection(ctx context.Context, queue []*gmail.Message) *DigestSection {
+	config := a.Config.InboxZero
+	if config == nil {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+	now := a.Clock.Now()
+
+	var counts []InboxCount
+	var reputations map[string]SenderReputation
+	a.state.read(func(s *State) {
+		counts = slices.Clone(s.account().InboxCounts)
+		reputations = make(map[string]SenderReputation, len(s.Senders))
+		for address, reputation := range s.Senders {
+			reputations[address] = *reputation
+		}
+	})
+
+	section := &DigestSection{Key: "inbox_zero", Title: "📥 Inbox zero"}
+	if line := inboxTrendLine(counts, now, a.Location); line != "" {
+		section.Lines = append(section.Lines, line)
+	}
+	if senders := muteSuggestions(queue, reputations); len(senders) > 0 {
+		section.Lines = append(section.Lines, "🔇 Most bulk mail, worth muting or unsubscribing from: "+strings.Join(senders, ", "))
+	}
+
+	staleDays := config.StaleDays
+	if staleDays <= 0 {
+		staleDays = defaultStaleDays
+	}
+	query := fmt.Sprintf("in:inbox older_than:%dd", staleDays)
+	if stale, err := a.Emails.Preview(ctx, query, 1); err != nil {
+		logger.Warn("Unable to look for stale conversations", "error", err)
+	} else if stale.Count > 0 {
+		count := pluralize(stale.Count, "email")
+		if stale.More {
+			count = "over " + count
+		}
+		line := fmt.Sprintf("🗄️ [%s](<%s>) in the inbox are over %d days old, archived they'd still be in All Mail",
+			count, gmailSearchURL(a.Config.GmailAccount, query), staleDays)
+		if len(stale.Newest) > 0 {
+			line += fmt.Sprintf(", the newest is \"%s\" from %s", extractHeader(stale.Newest[0], "Subject"), senderName(extractHeader(stale.Newest[0], "From")))
+		}
+		section.Lines = append(section.Lines, line)
+	}
+	return section
+}
+
+// inboxTrendLine compares the inbox now with a week ago, with a sparkline of each day's last count in between, e.g.
+// "412 conversations in the inbox, 96 fewer than a week ago, 38 unread (-51) ▇▆▆▄▃▂▂"
+func inboxTrendLine(counts []InboxCount, now time.Time, location *time.Location) string {
+	weekAgo := now.AddDate(0, 0, -7)
+	var week []InboxCount
+	var before *InboxCount
+	for i, count := range counts {
+		if count.At.After(weekAgo) {
+			week = append(week, count)
+		} else {
+			before = &counts[i]
+		}
+	}
+	if len(week) == 0 {
+		return ""
+	}
+	latest := week[len(week)-1]
+	// the last count from before the week is where it started, the first of the week when there's none
+	start := week[0]
+	if before != nil {
+		start = *before
+	}
+
+	line := pluralize(latest.Total, "conversation") + " in the inbox"
+	switch change := latest.Total - start.Total; {
+	case change < 0:
+		line += fmt.Sprintf(", %d fewer than a week ago", -change)
+	case change > 0:
+		line += fmt.Sprintf(", %d more than a week ago", change)
+	default:
+		line += ", as many as a week ago"
+	}
+	line += fmt.Sprintf(", %d unread (%+d)", latest.Unread, latest.Unread-start.Unread)
+
+	// the last count of each day, so a day with more digests doesn't take up more of the line
+	var daily []int
+	var lastDay string
+	for _, count := range week {
+		day := count.At.In(location).Format(time.DateOnly)
+		if day == lastDay {
+			daily[len(daily)-1] = count.Total
+			continue
+		}
+		daily = append(daily, count.Total)
+		lastDay = day
+	}
+	if len(daily) > 1 {
+		line += " " + sparkline(daily)
+	}
+	return line
+}
+
+// sparkline draws values as a line of blocks, scaled between the lowest and the highest
+func sparkline(values []int) string {
+	low, high := slices.Min(values), slices.Max(values)
+	var sb strings.Builder
+	for _, value := range values {
+		block := len(sparkBlocks) / 2
+		if high > low {
+			block = (value - low) * (len(sparkBlocks) - 1) / (high - low)
+		}
+		sb.WriteRune(sparkBlocks[block])
+	}
+	return sb.String()
+}
+
+// muteSuggestions are the senders who sent the most bulk mail this week, newsletters and notifications in the
+// promotions, social or forums tabs or with an unsubscribe link, leaving out those the user muted or rated up
+func muteSuggestions(queue []*gmail.Message, reputations map[string]SenderReputation) []string {
+	counts := make(map[string]int)
+	names := make(map[string]string)
+	for _, message := range queue {
+		if !slices.Contains(defaultTrivialCategories, gmailCategory(message)) && extractHeader(message, "List-Unsubscribe") == "" {
+			continue
+		}
+		from := extractHeader(message, "From")
+		address := senderAddress(from)
+		if reputation, ok := reputations[address]; ok && (reputation.Muted || reputation.Up > 0) {
+			continue
+		}
+		counts[address]++
+		names[address] = senderName(from)
+	}
+
+	addresses := slices.DeleteFunc(sortedKeys(counts), func(address string) bool { return counts[address] < minMuteSuggestionEmails })
+	slices.SortStableFunc(addresses, func(a, b string) int { return counts[b] - counts[a] })
+	var suggestions []string
+	for _, address := range addresses[:min(len(addresses), maxMuteSuggestions)] {
+		suggestions = append(suggestions, fmt.Sprintf("**%s** (%d this week)", names[address], counts[address]))
+	}
+	return suggestions
+}
+
+// gmailSearchURL opens a Gmail search, in the account at the /u/ index
+func gmailSearchURL(account int, query string) string {
+	return fmt.Sprintf("https://mail.google.com/mail/u/%d/#search/%s", account, url.QueryEscape(query))
+}
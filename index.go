@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// indexFile holds the email index, apart from the state file since it's much bigger and only needed for search
+	indexFile = "email_index.json"
+	// defaultIndexDays is how long emails stay in the index when the config doesn't say
+	defaultIndexDays = 365
+	// indexTextTokens is how much of an email is embedded and kept for keyword search
+	indexTextTokens = 1000
+)
+
+// IndexedEmail is an email in the index, with what's needed to find it again and link to it
+type IndexedEmail struct {
+	MessageID string    `json:"message_id"`
+	ThreadID  string    `json:"thread_id"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	Date      time.Time `json:"date"`
+	Text      string    `json:"text"`
+	Vector    vector    `json:"vector"`
+}
+
+// vector is stored as base64 little endian float32s, a third the size of a JSON array of numbers
+type vector []float32
+
+func (v vector) MarshalJSON() ([]byte, error) {
+	data := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(f))
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(data))
+}
+
+func (v *vector) UnmarshalJSON(b []byte) error {
+	var encoded string
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	*v = make(vector, len(data)/4)
+	for i := range *v {
+		(*v)[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return nil
+}
+
+// emailIndex is every email the bot read in the last IndexDays, embedded by one Embedder. switching to another
+// embedder starts the index over, since their vectors can't be compared
+type emailIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	// file is where the index is kept, in the profile's directory
+	file string
+	// version goes up each time the index changes, for the /ask cache
+	version int
+	Model   string          `json:"model"`
+	Emails  []*IndexedEmail `json:"emails"`
+}
+
+// loadLocked reads the index file the first time it's needed
+func (ix *emailIndex) loadLocked() error {
+	if ix.loaded {
+		return nil
+	}
+	data, err := readStateFile(ix.file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s: %w", ix.file, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, ix); err != nil {
+			return fmt.Errorf("parsing %s: %w", ix.file, err)
+		}
+	}
+	ix.loaded = true
+	return nil
+}
+
+func (ix *emailIndex) saveLocked() error {
+	ix.version++
+	data, err := json.Marshal(ix)
+	if err != nil {
+		return fmt.Errorf("encoding the email index: %w", err)
+	}
+	return writeStateFile(ix.file, data)
+}
+
+// indexEmails embeds the emails the index doesn't have yet and adds them, dropping the ones older than the index
+// keeps. it returns the vector of every email, for dedupe
+func (a *App) indexEmails(ctx context.Context, messages []*gmail.Message) (map[string][]float32, error) {
+	a.index.mu.Lock()
+	defer a.index.mu.Unlock()
+	if err := a.index.loadLocked(); err != nil {
+		return nil, err
+	}
+
+	model := a.embedder.Name()
+	if a.index.Model != model {
+		if len(a.index.Emails) > 0 {
+			log.FromContext(ctx).Warn("Embedding model changed, starting the email index over", "from", a.index.Model, "to", model)
+		}
+		a.index.Model = model
+		a.index.Emails = nil
+	}
+
+	vectors := make(map[string][]float32, len(messages))
+	for _, email := range a.index.Emails {
+		vectors[email.MessageID] = email.Vector
+	}
+
+	var added []*IndexedEmail
+	var texts []string
+	for _, message := range messages {
+		if _, ok := vectors[message.Id]; ok {
+			continue
+		}
+		email := indexedEmail(message)
+		added = append(added, email)
+		texts = append(texts, fmt.Sprintf("From: %s\nSubject: %s\n\n%s", email.From, email.Subject, email.Text))
+	}
+	if len(added) > 0 {
+		embedded, err := embedAll(ctx, a.embedder, texts)
+		if err != nil {
+			return nil, err
+		}
+		for i, email := range added {
+			email.Vector = embedded[i]
+			vectors[email.MessageID] = email.Vector
+		}
+	}
+
+	days := defaultIndexDays
+	if a.Config.Embeddings.IndexDays > 0 {
+		days = a.Config.Embeddings.IndexDays
+	}
+	cutoff := a.Clock.Now().AddDate(0, 0, -days)
+	kept := a.index.Emails[:0]
+	for _, email := range append(a.index.Emails, added...) {
+		if email.Date.IsZero() || email.Date.After(cutoff) {
+			kept = append(kept, email)
+		}
+	}
+	a.index.Emails = kept
+
+	if err := a.index.saveLocked(); err != nil {
+		return nil, err
+	}
+	log.FromContext(ctx).Debug("Emails indexed", "added", len(added), "total", len(a.index.Emails), "model", model)
+	return vectors, nil
+}
+
+func indexedEmail(message *gmail.Message) *IndexedEmail {
+	date, _ := mail.ParseDate(extractHeader(message, "Date"))
+	return &IndexedEmail{
+		MessageID: message.Id,
+		ThreadID:  message.ThreadId,
+		From:      extractHeader(message, "From"),
+		Subject:   extractHeader(message, "Subject"),
+		Date:      date,
+		Text:      truncateTokens(indexTextTokens, stripQuotes(extractBody(message))),
+	}
+}
+
+// dedupe drops the emails that are near copies of an earlier one in the same batch, like a newsletter sent to two of
+// the user's addresses or an alert repeated by every system it passed through
+func (a *App) dedupe(ctx context.Context, messages []*gmail.Message, vectors map[string][]float32) []*gmail.Message {
+	threshold := a.Config.Embeddings.DedupThreshold
+	if threshold <= 0 {
+		return messages
+	}
+
+	var kept []*gmail.Message
+	for _, message := range messages {
+		v, ok := vectors[message.Id]
+		duplicate := false
+		for _, earlier := range kept {
+			if ok && cosineSimilarity(v, vectors[earlier.Id]) >= threshold {
+				log.FromContext(ctx).Info("Dropping a duplicate email", "message_id", message.Id, "duplicate_of", earlier.Id, "subject", extractHeader(message, "Subject"))
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, message)
+		}
+	}
+	return kept
+}
+
+// indexAndDedupe indexes a fetched batch and drops its duplicates. the index is a nice-to-have, so when the embedding
+// provider is down the digest goes out with the duplicates rather than not at all
+func (a *App) indexAndDedupe(ctx context.Context, messages []*gmail.Message) []*gmail.Message {
+	if a.embedder == nil {
+		return messages
+	}
+	vectors, err := a.indexEmails(ctx, messages)
+	if err != nil {
+		log.FromContext(ctx).Error("Unable to index emails", "error", err)
+		return messages
+	}
+	return a.dedupe(ctx, messages, vectors)
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// defaultLLMConcurrency is how many LLM requests are sent at once when llm_queue doesn't say
+const defaultLLMConcurrency = 4
+
+// llmPriority is how soon an LLM request should go out when the queue is full. higher goes first
+type llmPriority int
+
+const (
+	// llmPriorityBatch is the scheduled digests and everything else that runs on its own
+	llmPriorityBatch llmPriority = iota
+	// llmPriorityInteractive is the slash commands and buttons, someone is waiting on them
+	llmPriorityInteractive
+	// llmPriorityUrgent is the alerts that go out as soon as an email comes in
+	llmPriorityUrgent
+)
+
+var llmPriorityNames = map[llmPriority]string{
+	llmPriorityBatch:       "batch",
+	llmPriorityInteractive: "interactive",
+	llmPriorityUrgent:      "urgent",
+}
+
+type llmPriorityKey struct{}
+
+// withLLMPriority marks the LLM requests made with ctx as priority
+func withLLMPriority(ctx context.Context, priority llmPriority) context.Context {
+	return context.WithValue(ctx, llmPriorityKey{}, priority)
+}
+
+func llmPriorityFromContext(ctx context.Context) llmPriority {
+	priority, _ := ctx.Value(llmPriorityKey{}).(llmPriority)
+	return priority
+}
+
+type LLMQueueConfig struct {
+	MaxConcurrent int `json:"max_concurrent"`
+}
+
+// llmQueue lets a few LLM requests out at a time, the most urgent first and in the order they came otherwise, so a
+// question asked in Discord doesn't wait behind every summary of a digest. when the provider pushes back with a 429 or
+// a 503 the queue lets out half as many at once, and works its way back up one at a time as requests go through
+type llmQueue struct {
+	maxConcurrent int
+
+	mu      sync.Mutex
+	limit   int
+	running int
+	// passed counts the requests that went through since the limit last moved
+	passed  int
+	waiting []*llmWaiter
+	seq     int
+}
+
+type llmWaiter struct {
+	priority llmPriority
+	seq      int
+	ready    chan struct{}
+}
+
+func newLLMQueue(config LLMQueueConfig) *llmQueue {
+	maxConcurrent := config.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultLLMConcurrency
+	}
+	return &llmQueue{maxConcurrent: maxConcurrent, limit: maxConcurrent}
+}
+
+// acquire blocks until a request of priority can go out. done must be called once it's back, saying whether the
+// provider pushed back
+func (q *llmQueue) acquire(ctx context.Context, priority llmPriority) (done func(throttled bool), err error) {
+	q.mu.Lock()
+	q.seq++
+	w := &llmWaiter{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, w)
+	q.dispatch()
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if i := slices.Index(q.waiting, w); i >= 0 {
+			q.waiting = slices.Delete(q.waiting, i, i+1)
+			return nil, ctx.Err()
+		}
+		// it was let out as ctx ended, so its place goes to the next one
+		q.running--
+		q.dispatch()
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func(throttled bool) {
+		once.Do(func() { q.release(throttled) })
+	}, nil
+}
+
+// release frees the place of a request, and moves the limit
+func (q *llmQueue) release(throttled bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	switch {
+	case throttled:
+		if q.limit > 1 {
+			q.limit /= 2
+			log.Warn("LLM provider is pushing back, sending fewer requests at once", "concurrency", q.limit)
+		}
+		q.passed = 0
+	case q.limit < q.maxConcurrent:
+		q.passed++
+		if q.passed >= q.limit {
+			q.limit++
+			q.passed = 0
+		}
+	}
+	q.dispatch()
+}
+
+// dispatch lets out the most urgent waiting requests while there's room. q.mu must be held
+func (q *llmQueue) dispatch() {
+	for q.running < q.limit && len(q.waiting) > 0 {
+		next := 0
+		for i, w := range q.waiting {
+			if w.priority > q.waiting[next].priority {
+				next = i
+			}
+		}
+		w := q.waiting[next]
+		q.waiting = slices.Delete(q.waiting, next, next+1)
+		q.running++
+		close(w.ready)
+	}
+}
+
+// stats are the requests out and waiting by priority, for /status
+func (q *llmQueue) stats() (running, limit int, waiting map[string]int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting = make(map[string]int)
+	for _, w := range q.waiting {
+		waiting[llmPriorityNames[w.priority]]++
+	}
+	return q.running, q.limit, waiting
+}
+
+// queuedTransport puts every request through the queue before it goes out
+type queuedTransport struct {
+	queue *llmQueue
+	next  http.RoundTripper
+}
+
+// withLLMQueue is client with its requests going through queue
+func withLLMQueue(client *http.Client, queue *llmQueue) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	queued := *client
+	queued.Transport = &queuedTransport{queue: queue, next: next}
+	return &queued
+}
+
+func (t *queuedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done, err := t.queue.acquire(req.Context(), llmPriorityFromContext(req.Context()))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	done(err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable))
+	return resp, err
+}
+
+// llmLimits are the rate limiter and queue of a provider and key. the profiles using the same ones share them, since
+// the provider counts their requests together
+type llmLimits struct {
+	limiter *rateLimiter
+	queue   *llmQueue
+}
+
+var sharedLLMLimits = struct {
+	sync.Mutex
+	limits map[string]*llmLimits
+}{limits: make(map[string]*llmLimits)}
+
+// llmLimitsFor are the process' limits for the provider at baseURL with key, made from config by the first profile
+// that asks. a later profile with other limits for the same provider and key gets the first one's
+func llmLimitsFor(baseURL, key string, config *Config) *llmLimits {
+	sharedLLMLimits.Lock()
+	defer sharedLLMLimits.Unlock()
+	id := baseURL + "\x00" + key
+	if limits, ok := sharedLLMLimits.limits[id]; ok {
+		return limits
+	}
+	limits := &llmLimits{}
+	if config.LLMRateLimit != nil {
+		limits.limiter = newRateLimiter(*config.LLMRateLimit)
+	}
+	var queueConfig LLMQueueConfig
+	if config.LLMQueue != nil {
+		queueConfig = *config.LLMQueue
+	}
+	limits.queue = newLLMQueue(queueConfig)
+	sharedLLMLimits.limits[id] = limits
+	return limits
+}
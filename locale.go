@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// locale is how dates, weekdays and amounts are written in a language. the digests' own words stay the model's
+type locale struct {
+	weekdays      [7]string
+	shortWeekdays [7]string
+	months        [12]string
+	shortMonths   [12]string
+	// the date patterns, like "{wd} {d} {mon}": {weekday}, {wd}, {d}, {dd}, {month}, {mon}, {mm} and {yyyy} are replaced
+	// with the date's. the short one is for headings and lists, the long one for prose and the full one has the year
+	shortPattern string
+	longPattern  string
+	fullPattern  string
+	// decimal and group separate the cents and the thousands of an amount
+	decimal string
+	group   string
+	// symbolAfter writes the currency after the amount, "82,10 €", rather than before it, "€82.10"
+	symbolAfter bool
+}
+
+// defaultLocale is the locale when the config doesn't set one, the digests' dates as they always were
+const defaultLocale = "en"
+
+var locales = map[string]*locale{
+	"en": {
+		weekdays:      [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		shortWeekdays: [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+		months:        [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		shortMonths:   [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		shortPattern:  "{wd} {d} {mon}",
+		longPattern:   "{weekday} {d} {month}",
+		fullPattern:   "{wd} {d} {mon} {yyyy}",
+		decimal:       ".",
+		group:         ",",
+	},
+	"en-us": {
+		weekdays:      [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		shortWeekdays: [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+		months:        [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		shortMonths:   [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		shortPattern:  "{wd} {mon} {d}",
+		longPattern:   "{weekday}, {month} {d}",
+		fullPattern:   "{wd} {mon} {d}, {yyyy}",
+		decimal:       ".",
+		group:         ",",
+	},
+	"de": {
+		weekdays:      [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		shortWeekdays: [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+		months:        [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		shortMonths:   [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		shortPattern:  "{wd} {dd}.{mm}.",
+		longPattern:   "{weekday}, {d}. {month}",
+		fullPattern:   "{wd} {dd}.{mm}.{yyyy}",
+		decimal:       ",",
+		group:         ".",
+		symbolAfter:   true,
+	},
+	"fr": {
+		weekdays:      [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		shortWeekdays: [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+		months:        [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		shortMonths:   [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		shortPattern:  "{wd} {d} {mon}",
+		longPattern:   "{weekday} {d} {month}",
+		fullPattern:   "{wd} {d} {mon} {yyyy}",
+		decimal:       ",",
+		group:         " ",
+		symbolAfter:   true,
+	},
+	"es": {
+		weekdays:      [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		shortWeekdays: [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+		months:        [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		shortMonths:   [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		shortPattern:  "{wd} {d} {mon}",
+		longPattern:   "{weekday} {d} de {month}",
+		fullPattern:   "{wd} {d} {mon} {yyyy}",
+		decimal:       ",",
+		group:         ".",
+		symbolAfter:   true,
+	},
+	"it": {
+		weekdays:      [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		shortWeekdays: [7]string{"dom", "lun", "mar", "mer", "gio", "ven", "sab"},
+		months:        [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		shortMonths:   [12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		shortPattern:  "{wd} {d} {mon}",
+		longPattern:   "{weekday} {d} {month}",
+		fullPattern:   "{wd} {d} {mon} {yyyy}",
+		decimal:       ",",
+		group:         ".",
+		symbolAfter:   true,
+	},
+	"nl": {
+		weekdays:      [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		shortWeekdays: [7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+		months:        [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		shortMonths:   [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		shortPattern:  "{wd} {d} {mon}",
+		longPattern:   "{weekday} {d} {month}",
+		fullPattern:   "{wd} {d} {mon} {yyyy}",
+		decimal:       ",",
+		group:         ".",
+	},
+	"pt": {
+		weekdays:      [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		shortWeekdays: [7]string{"dom", "seg", "ter", "qua", "qui", "sex", "sáb"},
+		months:        [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		shortMonths:   [12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+		shortPattern:  "{wd}, {d} {mon}",
+		longPattern:   "{weekday}, {d} de {month}",
+		fullPattern:   "{wd}, {d} {mon} {yyyy}",
+		decimal:       ",",
+		group:         ".",
+		symbolAfter:   true,
+	},
+}
+
+// lookupLocale is the locale called name, like "de" or "en-US", falling back from a region to its language
+func lookupLocale(name string) (*locale, error) {
+	if name == "" {
+		name = defaultLocale
+	}
+	name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	if l, ok := locales[name]; ok {
+		return l, nil
+	}
+	language, _, _ := strings.Cut(name, "-")
+	if l, ok := locales[language]; ok {
+		return l, nil
+	}
+	return nil, fmt.Errorf("unknown locale %q, use one of %s", name, strings.Join(sortedKeys(locales), ", "))
+}
+
+// localeOf is the locale called name, or the default one for a name that isn't known, like that of a digest archived
+// by a build with more locales
+func localeOf(name string) *locale {
+	l, err := lookupLocale(name)
+	if err != nil {
+		return locales[defaultLocale]
+	}
+	return l
+}
+
+func (l *locale) format(pattern string, t time.Time) string {
+	return strings.NewReplacer(
+		"{weekday}", l.weekdays[t.Weekday()],
+		"{wd}", l.shortWeekdays[t.Weekday()],
+		"{dd}", fmt.Sprintf("%02d", t.Day()),
+		"{d}", fmt.Sprint(t.Day()),
+		"{month}", l.months[t.Month()-1],
+		"{mon}", l.shortMonths[t.Month()-1],
+		"{mm}", fmt.Sprintf("%02d", int(t.Month())),
+		"{yyyy}", fmt.Sprint(t.Year()),
+	).Replace(pattern)
+}
+
+// shortDate is e.g. "Tue 4 Mar", "Tue Mar 4" or "Di 04.03."
+func (l *locale) shortDate(t time.Time) string {
+	return l.format(l.shortPattern, t)
+}
+
+// longDate is e.g. "Tuesday 4 March"
+func (l *locale) longDate(t time.Time) string {
+	return l.format(l.longPattern, t)
+}
+
+// fullDate is e.g. "Tue 4 Mar 2026"
+func (l *locale) fullDate(t time.Time) string {
+	return l.format(l.fullPattern, t)
+}
+
+// amountPattern finds an amount of money written the English way: a symbol or ISO code, then the number, or the other
+// way round, e.g. "€82.10", "USD 1,200" or "82.10 EUR"
+var amountPattern = regexp.MustCompile(`^(?:([€$£¥]|[A-Z]{3})\s?([0-9][0-9,]*(?:\.[0-9]{1,2})?)|([0-9][0-9,]*(?:\.[0-9]{1,2})?)\s?([€$£¥]|[A-Z]{3}))$`)
+
+// money writes an amount the locale's way, e.g. "€1,082.10" as "1.082,10 €" in German. anything that isn't a single
+// amount written the English way is left as it is
+func (l *locale) money(amount string) string {
+	match := amountPattern.FindStringSubmatch(strings.TrimSpace(amount))
+	if match == nil {
+		return amount
+	}
+	symbol, number := match[1], match[2]
+	if symbol == "" {
+		symbol, number = match[4], match[3]
+	}
+	whole, cents, _ := strings.Cut(strings.ReplaceAll(number, ",", ""), ".")
+	var grouped strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteString(l.group)
+		}
+		grouped.WriteRune(digit)
+	}
+	number = grouped.String()
+	if cents != "" {
+		number += l.decimal + cents
+	}
+	if l.symbolAfter {
+		return number + " " + symbol
+	}
+	// an ISO code is spaced from the number, a symbol isn't
+	if utf8.RuneCountInString(symbol) == 3 {
+		return symbol + " " + number
+	}
+	return symbol + number
+}
+
+// localizedWeekday is the weekday a name means in any of the locales, full or short, e.g. "Montag", "mer." or "vie"
+func localizedWeekday(name string) (time.Weekday, bool) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	for _, l := range locales {
+		for day := range 7 {
+			if name == strings.ToLower(l.weekdays[day]) || name == strings.TrimSuffix(strings.ToLower(l.shortWeekdays[day]), ".") {
+				return time.Weekday(day), true
+			}
+		}
+	}
+	return time.Sunday, false
+}
+
+// locale is the locale of the profile's digests
+func (a *App) locale() *locale {
+	return localeOf(a.Config.Locale)
+}
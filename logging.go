@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+)
+
+type digestIDKey struct{}
+
+type runIDKey struct{}
+
+type profileKey struct{}
+
+// setupLogging switches the log output format. "text" is the default, "json" and "logfmt" suit log aggregators
+func setupLogging(config *Config) error {
+	switch config.LogFormat {
+	case "", "text":
+		log.SetFormatter(log.TextFormatter)
+	case "json":
+		log.SetFormatter(log.JSONFormatter)
+	case "logfmt":
+		log.SetFormatter(log.LogfmtFormatter)
+	default:
+		return fmt.Errorf("log_format must be text, json or logfmt, got %q", config.LogFormat)
+	}
+	return nil
+}
+
+// withTaskRun returns a context whose logger tags every line with the task name and a fresh run id
+func withTaskRun(ctx context.Context, name string) context.Context {
+	return withTaskRunID(ctx, name, newRunID())
+}
+
+// withTaskRunID is withTaskRun with a run id picked beforehand, for a caller that follows the run's progress
+func withTaskRunID(ctx context.Context, name, id string) context.Context {
+	ctx = context.WithValue(ctx, runIDKey{}, id)
+	return log.WithContext(ctx, log.FromContext(ctx).With("task", name, "run_id", id))
+}
+
+func newRunID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startDigest records the id of the digest this run will produce, and the profile it's for, so the lines logged and the
+// progress reported while fetching and summarizing can already carry them
+func (a *App) startDigest(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, digestIDKey{}, id)
+	ctx = context.WithValue(ctx, profileKey{}, a.Profile)
+	return log.WithContext(ctx, log.FromContext(ctx).With("digest_id", id))
+}
+
+func digestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(digestIDKey{}).(string)
+	return id, ok
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// defaultMaxSkipDays is how many days in a row a quiet daily digest can be held back when the config doesn't say
+	defaultMaxSkipDays = 2
+)
+
+// defaultTrivialCategories are the Gmail inbox tabs that don't count towards min_emails
+var defaultTrivialCategories = []string{"promotions", "social", "forums"}
+
+// trivialNames say what the emails of a trivial category are, for the one-liner
+var trivialNames = map[string]string{
+	"promotions": "newsletter",
+	"social":     "social notification",
+	"forums":     "forum post",
+	"updates":    "update",
+}
+
+type LowVolumeConfig struct {
+	// MinEmails is how many emails outside the trivial categories a day needs for a full daily digest
+	MinEmails int `json:"min_emails"`
+	// Mode is "merge" (the default) to hold a quiet day's emails back for the next digest, or "one_liner" to post a
+	// line saying what came in instead
+	Mode string `json:"mode"`
+	// Trivial are the Gmail inbox tabs that don't count, default promotions, social and forums
+	Trivial []string `json:"trivial"`
+	// MaxSkipDays is how many days in a row merge holds the digest back before sending it anyway
+	MaxSkipDays int `json:"max_skip_days"`
+}
+
+// lowVolumeAction is what to do with a day's digest: "" to send it as usual, "merge" to hold the emails back for the
+// next one, or "one_liner" to post a line instead. deferredSince is when the emails held back so far were first held
+func (a *App) lowVolumeAction(ctx context.Context, messages []*gmail.Message, deferredSince time.Time) string {
+	config := a.Config.LowVolume
+	if config == nil || config.MinEmails <= 0 || len(messages) == 0 {
+		return ""
+	}
+	important := len(messages) - len(trivialEmails(messages, config.Trivial))
+	if important >= config.MinEmails {
+		return ""
+	}
+	logger := log.FromContext(ctx)
+
+	if config.Mode == "one_liner" {
+		logger.Info("Quiet day, sending a one-liner instead of a digest", "emails", len(messages), "important", important)
+		return "one_liner"
+	}
+	maxSkipDays := defaultMaxSkipDays
+	if config.MaxSkipDays > 0 {
+		maxSkipDays = config.MaxSkipDays
+	}
+	// an hour of slack, so a digest that ran a little early still counts as a day later
+	if !deferredSince.IsZero() && a.Clock.Now().Sub(deferredSince) >= time.Duration(maxSkipDays)*24*time.Hour-time.Hour {
+		logger.Info("Quiet day, but the digest was held back long enough", "emails", len(messages), "since", deferredSince)
+		return ""
+	}
+	logger.Info("Quiet day, holding the emails back for the next digest", "emails", len(messages), "important", important)
+	return "merge"
+}
+
+// trivialEmails are the emails in the trivial categories, by category
+func trivialEmails(messages []*gmail.Message, categories []string) map[string][]*gmail.Message {
+	if len(categories) == 0 {
+		categories = defaultTrivialCategories
+	}
+	trivial := make(map[string]bool, len(categories))
+	for _, category := range categories {
+		trivial[strings.ToLower(category)] = true
+	}
+	byCategory := make(map[string][]*gmail.Message)
+	for _, message := range messages {
+		if category := gmailCategory(message); trivial[category] {
+			byCategory[category] = append(byCategory[category], message)
+		}
+	}
+	return byCategory
+}
+
+// quietDayLine is the one-liner for a quiet day, e.g. "Nothing important today (3 newsletters, 1 forum post)"
+func quietDayLine(messages []*gmail.Message, categories []string) string {
+	byCategory := trivialEmails(messages, categories)
+	var parts []string
+	counted := 0
+	for _, category := range append(append([]string{}, defaultTrivialCategories...), "updates") {
+		if emails, ok := byCategory[category]; ok {
+			parts = append(parts, pluralize(len(emails), trivialNames[category]))
+			counted += len(emails)
+			delete(byCategory, category)
+		}
+	}
+	for _, emails := range byCategory {
+		counted += len(emails)
+		parts = append(parts, pluralize(len(emails), "email"))
+	}
+	if other := len(messages) - counted; other > 0 {
+		parts = append(parts, fmt.Sprintf("%d other", other))
+	}
+	return fmt.Sprintf("📭 Nothing important today (%s).", strings.Join(parts, ", "))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxListThreads is how many of a list's busiest threads its line links to
+const maxListThreads = 3
+
+// listSubjectPrefix matches the "Re: [list] " in front of a list message's subject
+var listSubjectPrefix = regexp.MustCompile(`^(?i:(?:re|aw|fwd?|sv)\s*:\s*|\[[^\]]*\]\s*)+`)
+
+type MailingListsConfig struct {
+	// Include, when set, are the only lists that make it into the digests. the others are counted and left out
+	Include []string `json:"include"`
+	// Exclude are lists that are counted and left out of the digests
+	Exclude []string `json:"exclude"`
+}
+
+// mailingList reads which discussion list an email came through, from its List-Id, as the list's name and its id, e.g.
+// "golang-nuts" and "golang-nuts.googlegroups.com". newsletters carry a List-Id too but take no posts, so only lists
+// with a List-Post address count
+func mailingList(message *gmail.Message) (name, id string) {
+	if message.Payload == nil {
+		return "", ""
+	}
+	listID := strings.TrimSpace(extractHeaderFold(message, "List-Id"))
+	post := strings.TrimSpace(extractHeaderFold(message, "List-Post"))
+	if listID == "" || post == "" || strings.EqualFold(post, "NO") {
+		return "", ""
+	}
+	// "Go Nuts <golang-nuts.googlegroups.com>" or just "<golang-nuts.googlegroups.com>"
+	name, id = listID, listID
+	if start, end := strings.LastIndex(listID, "<"), strings.LastIndex(listID, ">"); start >= 0 && end > start {
+		id = listID[start+1 : end]
+		name = strings.Trim(strings.TrimSpace(listID[:start]), `"`)
+	}
+	if name == "" {
+		name, _, _ = strings.Cut(id, ".")
+	}
+	return name, strings.ToLower(id)
+}
+
+// listMatches is whether a list is one of the configured ones, by name or id
+func listMatches(patterns []string, name, id string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return strings.EqualFold(pattern, name) || strings.EqualFold(pattern, id)
+	})
+}
+
+// splitMailingLists takes the mailing list messages out of the emails, grouped by list name. the lists the config
+// leaves out are only counted
+func (a *App) splitMailingLists(messages []*gmail.Message) (rest []*gmail.Message, lists map[string][]*gmail.Message, leftOut map[string]int) {
+	config := a.Config.MailingLists
+	if config == nil {
+		return messages, nil, nil
+	}
+	lists = make(map[string][]*gmail.Message)
+	leftOut = make(map[string]int)
+	for _, message := range messages {
+		name, id := mailingList(message)
+		switch {
+		case name == "":
+			rest = append(rest, message)
+		case listMatches(config.Exclude, name, id) || (len(config.Include) > 0 && !listMatches(config.Include, name, id)):
+			leftOut[name]++
+		default:
+			lists[name] = append(lists[name], message)
+		}
+	}
+	return rest, lists, leftOut
+}
+
+// listThread is one discussion on a list
+type listThread struct {
+	subject  string
+	threadID string
+	messages int
+}
+
+// listThreads groups a list's messages by thread, busiest first
+func listThreads(messages []*gmail.Message) []listThread {
+	var threads []listThread
+	for _, message := range messages {
+		i := slices.IndexFunc(threads, func(t listThread) bool { return t.threadID == message.ThreadId })
+		if i < 0 {
+			subject := listSubjectPrefix.ReplaceAllString(strings.TrimSpace(extractHeader(message, "Subject")), "")
+			threads = append(threads, listThread{subject: subject, threadID: message.ThreadId})
+			i = len(threads) - 1
+		}
+		threads[i].messages++
+	}
+	slices.SortStableFunc(threads, func(x, y listThread) int { return y.messages - x.messages })
+	return threads
+}
+
+// SummarizeMailingLists asks the model for the main topics of each list's new messages, in one call for all of them
+func (s *openAISummarizer) SummarizeMailingLists(ctx context.Context, lists map[string][]*gmail.Message) (map[string]string, error) {
+	var emails strings.Builder
+	for _, name := range sortedKeys(lists) {
+		fmt.Fprintf(&emails, "## %s\n\n", name)
+		byThread := make(map[string][]*gmail.Message)
+		for _, message := range lists[name] {
+			byThread[message.ThreadId] = append(byThread[message.ThreadId], message)
+		}
+		for _, thread := range listThreads(lists[name]) {
+			fmt.Fprintf(&emails, "### %s (%s)\n", thread.subject, pluralize(thread.messages, "message"))
+			for _, message := range byThread[thread.threadID] {
+				fmt.Fprintf(&emails, "- **%s:** %s\n", senderName(extractHeader(message, "From")),
+					strings.Join(strings.Fields(truncateTokens(150, stripQuotes(extractBody(message)))), " "))
+			}
+			emails.WriteString("\n")
+		}
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().MailingLists, map[string]any{"emails": emails.String()})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.callOpenAIJSON(ctx, []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: prompt,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Lists map[string]string `json:"lists"`
+	}
+	if err := json.Unmarshal([]byte(resp), &parsed); err != nil {
+		return nil, fmt.Errorf("unable to parse mailing list topics: %v", err)
+	}
+	return parsed.Lists, nil
+}
+
+// mailingListSection gives each list a line: how much was posted, the main topics and links to the busiest threads.
+// without the topics, when the model fails, the threads still say what was discussed
+func (a *App) mailingListSection(ctx context.Context, lists map[string][]*gmail.Message, leftOut map[string]int) *DigestSection {
+	section := &DigestSection{Key: "mailing_lists", Title: "📮 Mailing lists"}
+	if len(lists) > 0 {
+		topics, err := a.Summarizer.SummarizeMailingLists(ctx, lists)
+		if err != nil {
+			log.FromContext(ctx).Error("Unable to summarize the mailing lists", "error", err)
+		}
+		linkText := strings.NewReplacer("[", "(", "]", ")")
+		for _, name := range sortedKeys(lists) {
+			threads := listThreads(lists[name])
+			line := fmt.Sprintf("**%s**: %s in %s.", name, pluralize(len(lists[name]), "message"), pluralize(len(threads), "thread"))
+			if topic := strings.TrimSpace(topics[name]); topic != "" {
+				line += " " + topic
+			}
+			var links []string
+			for _, thread := range threads[:min(len(threads), maxListThreads)] {
+				links = append(links, fmt.Sprintf("[%s](<%s>) (%d)", linkText.Replace(thread.subject), gmailThreadURL(a.Config.GmailAccount, thread.threadID), thread.messages))
+			}
+			section.Lines = append(section.Lines, line+" Busiest: "+strings.Join(links, ", "))
+		}
+	}
+	if len(leftOut) > 0 {
+		var counts []string
+		for _, name := range sortedKeys(leftOut) {
+			counts = append(counts, fmt.Sprintf("%s (%d)", name, leftOut[name]))
+		}
+		section.Lines = append(section.Lines, "Left out: "+strings.Join(counts, ", "))
+	}
+	return section
+}
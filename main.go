@@ -5,238 +5,785 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"slices"
+	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/charmbracelet/log"
-	"github.com/sashabaranov/go-openai"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 	"scheduler"
 )
 
 const (
-	tokenFile       = "token.json"
 	credentialsFile = "credentials.json"
 	configFile      = "config.json"
-	lastFetchFile   = "last_fetch.json"
-)
+	// stateFile is the state of the file backend, and of every profile before the sqlite one, imported on first start
+	stateFile = "state.json"
 
-var (
-	config             *Config
-	weeklySummaryQueue []*gmail.Message
+	// state files from before state.json, imported on first start
+	legacyTokenFile         = "token.json"
+	legacyLastFetchFile     = "last_fetch.json"
+	legacyDigestArchiveFile = "digests.json"
 )
 
-var discordSession *discordgo.Session
+// scheduledTask records a recurring task that was added to the scheduler at startup
+type scheduledTask struct {
+	Name string `json:"name"`
+	ID   uint64 `json:"id"`
+	// Profile is the profile the task is for, "" without profiles
+	Profile string `json:"profile,omitempty"`
+
+	fn func(ctx context.Context) error
+}
+
+var scheduledTasks []scheduledTask
+
+// gmailTasks is the scheduler group of the tasks that use the Gmail token, so they never refresh or use it at the
+// same time. Discord-only tasks run alongside them
+const gmailTasks = "gmail"
+
+// maxTaskRuntime is how long a task may run before its context is cancelled, so a hung Gmail or OpenAI call gives up
+// instead of holding up the tasks waiting on it forever
+const maxTaskRuntime = 30 * time.Minute
 
 func main() {
 	log.SetLevel(log.DebugLevel)
 
-	log.Info("Loading configuration...")
-	var err error
-	config, err = loadConfig()
-	if err != nil {
-		log.Fatal("Failed to load configuration", "error", err)
+	if err := runCLI(os.Args[1:]); err != nil {
+		log.Fatal("Command failed", "error", err)
 	}
+}
 
-	log.Info("Initializing components...")
-	if err := setupAgent(config); err != nil {
-		log.Fatal("Failed to initialize application", "error", err)
+// runDaemon is the long-running mode: it schedules the digests of every profile and serves the optional API servers
+// until the process is interrupted or terminated
+func runDaemon(apps []*App) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s, err := startDaemon(apps)
+	if err != nil {
+		return err
 	}
 
-	s := setupScheduler(config)
+	log.Info("Application is running, awaiting tasks...")
+	<-ctx.Done()
+	log.Info("Shutting down")
+	s.Stop()
+	servers.Wait()
+	return nil
+}
+
+// startDaemon initializes every profile and starts the scheduler, returning once it is running. the profiles share
+// the scheduler, and a Discord session when they use the same bot
+func startDaemon(apps []*App) (*scheduler.Scheduler, error) {
+	s := scheduler.New().SetLogger(slog.New(log.Default())).OnEvent(recordSchedulerEvent)
+	sessions := make(map[string]*discordgo.Session)
+	for _, a := range apps {
+		log.Info("Initializing components...", "profile", a.Profile)
+		if err := a.setupAgent(); err != nil {
+			return nil, fmt.Errorf("initializing application: %w", err)
+		}
+
+		if session, ok := sessions[a.Config.DiscordToken]; ok {
+			a.Discord = session
+			a.answerInteractions()
+		} else {
+			if err := a.setupDiscord(); err != nil {
+				return nil, fmt.Errorf("initializing Discord: %w", err)
+			}
+			sessions[a.Config.DiscordToken] = a.Discord
+			if err := a.registerSlashCommands(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := a.setupScheduler(s); err != nil {
+			return nil, fmt.Errorf("setting up scheduler: %w", err)
+		}
+		a.scheduler = s
+	}
 	log.Info("Scheduler initialized and running...")
 	go s.Run(context.Background())
+	watchConfigReloads(apps)
 
-	log.Info("Initial OAuth client generation")
-	_ = createOAuthClient()
+	// newProfileApps made sure every profile has its own addresses
+	for _, a := range apps {
+		if a.Config.API != nil {
+			startAPIServer(a, *a.Config.API, s)
+		}
 
-	log.Info("Application is running, awaiting tasks...")
-	defer func(discordSession *discordgo.Session) {
-		err := discordSession.Close()
-		if err != nil {
-			log.Error("failed to close discord session", "error", err)
+		if a.Config.Metrics != nil {
+			startMetricsServer(a, *a.Config.Metrics)
 		}
-	}(discordSession)
-	select {}
+
+		if a.Config.GRPC != nil {
+			if err := startGRPCServer(a, *a.Config.GRPC, s); err != nil {
+				return nil, fmt.Errorf("starting gRPC server: %w", err)
+			}
+		}
+	}
+
+	for _, a := range apps {
+		log.Info("Initial OAuth client generation", "profile", a.Profile)
+		if _, err := a.createOAuthClient(); err != nil {
+			return nil, fmt.Errorf("authorizing Gmail: %w", err)
+		}
+	}
+
+	daemonReady.Store(true)
+
+	return s, nil
 }
 
-func setupAgent(config *Config) error {
-	var err error
+// setupScheduler adds the profile's recurring tasks to s
+func (a *App) setupScheduler(s *scheduler.Scheduler) error {
+	config := a.Config
 
-	dailyTemplate, err = loadTemplate("daily_summary_prompt.tmpl")
+	log.Info("Setting up scheduler...")
+	daily, err := parseSchedule(config.DailySummaryTime)
 	if err != nil {
-		return fmt.Errorf("loading daily summary template: %w", err)
+		return fmt.Errorf("invalid daily summary time: %w", err)
 	}
 
-	weeklyTemplate, err = loadTemplate("weekly_summary_prompt.tmpl")
-	if err != nil {
-		return fmt.Errorf("loading weekly summary template: %w", err)
+	if config.Budget != nil {
+		if _, err := config.Budget.confirmWait(); err != nil {
+			return err
+		}
 	}
 
-	summaryTemplate, err = loadTemplate("scratchpad_to_summary_prompt.tmpl")
-	if err != nil {
-		return fmt.Errorf("loading scratchpad to summary prompt: %w", err)
+	var daysOff map[time.Weekday]bool
+	var datesOff []time.Time
+	if config.DaysOff != nil {
+		if daysOff, datesOff, err = config.DaysOff.days(a.Location); err != nil {
+			return fmt.Errorf("invalid days off: %w", err)
+		}
 	}
 
-	emailTemplate, err = loadTemplate("email_prompt.tmpl")
-	if err != nil {
-		return fmt.Errorf("loading email prompt: %w", err)
+	// the emails of the days off are picked up by the next digest anyway, since it fetches everything since the last
+	// one; SkippedRuns is what lets it say so
+	dailyTask := daily.apply(a.createScheduledTask(a.taskName("Daily summary"), a.sendDailySummary), a.Location).
+		Group(a.gmailGroup()).
+		SkipDays(daysOff).
+		SkipDates(datesOff...).
+		RestartOnPanic(3)
+	if err := a.addScheduledTask(s, a.taskName("Daily summary"), a.sendDailySummary, dailyTask); err != nil {
+		return err
+	}
+
+	if config.MiniDigests != nil {
+		times, err := config.MiniDigests.times(daily.at(time.UTC))
+		if err != nil {
+			return err
+		}
+		// the mini digests go out on the days the daily summary does
+		for _, at := range times {
+			name := a.taskName("Mini digest " + at.Format("15:04"))
+			mini := schedule{days: daily.days, hour: at.Hour(), minute: at.Minute()}
+			if err := a.addScheduledTask(s, name, a.sendMiniDigest,
+				mini.apply(a.createScheduledTask(name, a.sendMiniDigest), a.Location).
+					Group(a.gmailGroup()).
+					SkipDays(daysOff).
+					SkipDates(datesOff...),
+			); err != nil {
+				return err
+			}
+		}
 	}
 
-	userContext, err = loadUserContext()
+	weekly, err := parseSchedule(config.WeeklySummaryTime)
 	if err != nil {
-		return fmt.Errorf("loading user context: %w", err)
+		return fmt.Errorf("invalid weekly summary time: %w", err)
+	}
+	// a day in the time, "every friday at 5pm", takes the place of weekly_summary_day
+	switch len(weekly.days) {
+	case 0:
+		weekday, err := parseWeekday(config.WeeklySummaryDay)
+		if err != nil {
+			return err
+		}
+		weekly.days = map[time.Weekday]bool{weekday: true}
+	case 1:
+	default:
+		return fmt.Errorf("invalid weekly summary time %q, the weekly summary goes out on one day", config.WeeklySummaryTime)
+	}
+	if err := a.addScheduledTask(s, a.taskName("Weekly summary"), a.sendWeeklySummary,
+		weekly.apply(a.createScheduledTask(a.taskName("Weekly summary"), a.sendWeeklySummary), a.Location).
+			Group(a.gmailGroup()).
+			RestartOnPanic(3),
+	); err != nil {
+		return err
 	}
 
-	openAIClient = openai.NewClient(config.OpenAIKey)
+	if rollups := config.Rollups; rollups != nil {
+		hour, minute, err := parseTimeOfDay(rollups.Time)
+		if err != nil {
+			return fmt.Errorf("invalid rollup time: %w", err)
+		}
+		at := time.Date(0, 0, 0, hour, minute, 0, 0, a.Location)
+
+		if rollups.MonthlyChannelID != "" {
+			months := make(map[time.Month]bool)
+			for month := time.January; month <= time.December; month++ {
+				months[month] = true
+			}
+			if err := a.addScheduledTask(s, a.taskName("Monthly rollup"), a.sendMonthlyRollup,
+				a.createScheduledTask(a.taskName("Monthly rollup"), a.sendMonthlyRollup).
+					Monthly(months, scheduler.LastDayOfMonth, at).
+					GlobalBlocking(),
+			); err != nil {
+				return err
+			}
+		}
 
-	// Initialize Discord session
-	discordSession, err = discordgo.New("Bot " + config.DiscordToken)
-	if err != nil {
-		return fmt.Errorf("error creating Discord session: %w", err)
+		if rollups.QuarterlyChannelID != "" {
+			quarterEnds := map[time.Month]bool{time.March: true, time.June: true, time.September: true, time.December: true}
+			if err := a.addScheduledTask(s, a.taskName("Quarterly rollup"), a.sendQuarterlyRollup,
+				a.createScheduledTask(a.taskName("Quarterly rollup"), a.sendQuarterlyRollup).
+					Monthly(quarterEnds, scheduler.LastDayOfMonth, at).
+					GlobalBlocking(),
+			); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Open WebSocket connection to Discord
-	err = discordSession.Open()
-	if err != nil {
-		return fmt.Errorf("error opening Discord connection: %w", err)
+	if config.SecurityAlerts != nil {
+		interval, err := a.securityInterval()
+		if err != nil {
+			return err
+		}
+		if err := a.addScheduledTask(s, a.taskName("Security alerts"), a.checkSecurityEmails,
+			a.createScheduledTask(a.taskName("Security alerts"), a.checkSecurityEmails).
+				Every(interval).Aligned().
+				Group(a.gmailGroup()),
+		); err != nil {
+			return err
+		}
 	}
 
-	log.Info("Discord session initialized")
-	return nil
-}
+	if bills := config.Bills; bills != nil {
+		at := bills.Time
+		if at == "" {
+			at = defaultBillReminderTime
+		}
+		hour, minute, err := parseTimeOfDay(at)
+		if err != nil {
+			return fmt.Errorf("invalid bill reminder time: %w", err)
+		}
+		// every day, days off included: a bill is due when it's due
+		if err := a.addScheduledTask(s, a.taskName("Bill reminders"), a.sendBillReminders,
+			a.createScheduledTask(a.taskName("Bill reminders"), a.sendBillReminders).
+				Daily(time.Date(0, 0, 0, hour, minute, 0, 0, a.Location)),
+		); err != nil {
+			return err
+		}
+	}
+
+	// retention and the token refresh look after the replica's own state, so every replica runs them
+	if config.Retention != nil {
+		if err := a.addScheduledTask(s, a.taskName("Data retention"), a.enforceRetention,
+			createTask(a.taskName("Data retention"), a.enforceRetention).
+				Daily(time.Date(0, 0, 0, retentionHour, retentionMinute, 0, 0, a.Location)),
+		); err != nil {
+			return err
+		}
+	}
 
-func setupScheduler(config *Config) *scheduler.Scheduler {
-	s := scheduler.New().SetLogger(slog.New(log.Default()))
+	if err := a.addScheduledTask(s, a.taskName("Delivery retries"), a.retryOutbox,
+		a.createScheduledTask(a.taskName("Delivery retries"), a.retryOutbox).
+			Every(outboxInterval).Aligned(),
+	); err != nil {
+		return err
+	}
 
-	log.Info("Setting up scheduler...")
-	dailyTime, err := time.Parse("15:04", config.DailySummaryTime)
-	if err != nil {
-		log.Fatal("Invalid daily summary time format", "error", err)
+	if err := a.addScheduledTask(s, a.taskName("Follow-up digests"), a.sendRemainders,
+		a.createScheduledTask(a.taskName("Follow-up digests"), a.sendRemainders).
+			Every(remainderInterval).Aligned().
+			Group(a.gmailGroup()),
+	); err != nil {
+		return err
 	}
 
-	s.Add(
-		createTask("Daily summary", sendDailySummary).
-			Daily(time.Date(0, 0, 0, dailyTime.Hour(), dailyTime.Minute(), 0, 0, time.Local)).
-			GlobalBlocking(),
-	)
+	if err := a.addScheduledTask(s, a.taskName("OAuth token refresh"), a.refreshOAuthTokens,
+		createTask(a.taskName("OAuth token refresh"), a.refreshOAuthTokens).
+			Every(time.Hour).
+			Group(a.gmailGroup()),
+	); err != nil {
+		return err
+	}
+
+	if err := a.resumeDigests(s); err != nil {
+		return err
+	}
+	if err := a.resumeApprovals(s); err != nil {
+		return err
+	}
+
+	log.Info("Scheduler setup complete")
+	return nil
+}
 
-	weeklyTime, err := time.Parse("15:04", config.WeeklySummaryTime)
+func (a *App) addScheduledTask(s *scheduler.Scheduler, name string, fn func(ctx context.Context) error, task *scheduler.Task) error {
+	id, err := s.Add(task)
 	if err != nil {
-		log.Fatal("Invalid weekly summary time format", "error", err)
+		return fmt.Errorf("scheduling %q: %w", name, err)
 	}
+	scheduledTasks = append(scheduledTasks, scheduledTask{Name: name, ID: id, Profile: a.Profile, fn: fn})
+	return nil
+}
 
-	weekday := parseWeekday(config.WeeklySummaryDay)
-	s.Add(
-		createTask("Weekly summary", sendWeeklySummary).
-			Weekly(
-				map[time.Weekday]bool{weekday: true},
-				time.Date(0, 0, 0, weeklyTime.Hour(), weeklyTime.Minute(), 0, 0, time.Local),
-			).
-			GlobalBlocking(),
-	)
+// tasks are the profile's own scheduled tasks. the profiles share the scheduler, and with it the list of every task
+func (a *App) tasks() []scheduledTask {
+	var tasks []scheduledTask
+	for _, task := range scheduledTasks {
+		if task.Profile == a.Profile {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
 
-	s.Add(
-		createTask("OAuth token refresh", refreshOAuthTokens).
-			Every(time.Hour).
-			GlobalBlocking(),
-	)
+func createTask(name string, fn func(ctx context.Context) error) *scheduler.Task {
+	// the scheduler logs the start, end and error of every run under the task's name, and recordSchedulerEvent
+	// keeps their metrics
+	return scheduler.NewTaskWithContext(func(ctx context.Context) error {
+		return fn(withTaskRun(ctx, name))
+	}).Named(name).MaxRuntime(maxTaskRuntime)
+}
 
-	log.Info("Scheduler setup complete")
-	return s
+func (a *App) sendDailySummary(ctx context.Context) error {
+	return a.runDailySummary(withRoundup(ctx, scheduler.SkippedRuns(ctx)), a.periodDigestID("daily", a.periodTime(ctx)))
 }
 
-func createTask(name string, fn func() error) *scheduler.Task {
-	return scheduler.NewTask(func() error {
-		log.Info(name + " task starting...")
-		err := fn()
+// runDailySummary writes and sends the daily summary id stage by stage, carrying on from where an earlier run of it
+// stopped
+func (a *App) runDailySummary(ctx context.Context, id string) (err error) {
+	ctx = a.startDigest(ctx, id)
+	logger := log.FromContext(ctx)
+	defer func() {
 		if err != nil {
-			log.Error(name+" task error", "error", err)
-		} else {
-			log.Info(name + " task completed")
+			reportProgress(ctx, ProgressEvent{Kind: "daily", Stage: "failed", Error: err.Error()})
+		}
+	}()
+
+	p := a.startPipeline(ctx, "daily", id)
+	// a digest interrupted after it was posted still has to move the cursor on
+	if !p.resumed && a.alreadySent(ctx, id) {
+		logger.Info("Today's daily summary was already sent, skipping")
+		reportProgress(ctx, ProgressEvent{Kind: "daily", Stage: "skipped"})
+		return nil
+	}
+	if p.resumed {
+		ctx = withRoundup(ctx, p.cp.Roundup)
+	}
+
+	if !p.done(stageFetch) {
+		reportProgress(ctx, ProgressEvent{Kind: "daily", Stage: "fetching"})
+		lastFetchTime := a.getLastFetchTime()
+		fetchedAt := a.Clock.Now()
+		messages, err := a.Emails.Fetch(ctx, lastFetchTime)
+		if err != nil {
+			return fmt.Errorf("fetching emails: %w", err)
+		}
+		a.recordInboxCount(ctx)
+
+		var deferred []*gmail.Message
+		a.state.read(func(s *State) {
+			account := s.account()
+			deferred = append(deferred, account.DeferredDigest...)
+			p.cp.DeferredSince = account.DeferredSince
+			p.cp.MiniDigests = slices.Clone(account.MiniDigests)
+		})
+
+		if len(messages) == 0 && len(deferred) == 0 && len(p.cp.MiniDigests) == 0 {
+			logger.Info("No new messages, skipping daily summary")
+			reportProgress(ctx, ProgressEvent{Kind: "daily", Stage: "skipped"})
+			return nil
+		}
+		// a digest that isn't confirmed leaves the cursor where it was, so the next one fetches these emails again
+		proceed, err := a.confirmDigestCost(ctx, "daily", a.dailyChannel(), append(slices.Clone(deferred), messages...))
+		if err != nil {
+			return err
+		}
+		if !proceed {
+			reportProgress(ctx, ProgressEvent{Kind: "daily", Stage: "skipped"})
+			return nil
+		}
+
+		p.cp.FetchedAt = fetchedAt
+		p.cp.Roundup = roundupFromContext(ctx)
+		p.cp.Emails = append(slices.Clone(deferred), messages...)
+		p.cp.Deferred = messageIDs(deferred)
+		p.cp.Fetched = messageIDs(messages)
+		if err := p.finish(stageFetch); err != nil {
+			return err
+		}
+	}
+
+	if !p.done(stageParse) {
+		p.cp.Parsed = messageIDs(a.parseEmails(ctx, p.emails(p.cp.Fetched)))
+		if err := p.finish(stageParse); err != nil {
+			return err
 		}
+	}
+
+	if !p.done(stageClassify) {
+		var triaged *triage
+		if ctx, triaged, err = a.classifyEmails(ctx, p.emails(p.cp.Parsed), a.taskName("Daily summary")); err != nil {
+			return err
+		}
+		// the emails held back on quiet days come first, they're the oldest
+		digestEmails := append(p.emails(p.cp.Deferred), triaged.digest...)
+		p.cp.Kept = messageIDs(triaged.kept)
+		p.cp.Digest = messageIDs(digestEmails)
+		// with mini digests the day was covered already, and the rollup is needed however quiet the evening is
+		p.cp.Action = "rollup"
+		if len(p.cp.MiniDigests) == 0 {
+			p.cp.Action = a.lowVolumeAction(ctx, digestEmails, p.cp.DeferredSince)
+		}
+		if err := p.finish(stageClassify); err != nil {
+			return err
+		}
+	} else if ctx, err = a.ruleContext(ctx, p.emails(p.cp.Kept)); err != nil {
 		return err
-	})
+	}
+	digestEmails := p.emails(p.cp.Digest)
+
+	if !p.done(stageSummarize) {
+		switch p.cp.Action {
+		case "rollup":
+			if p.cp.Result, err = a.summarizeDailyRollup(ctx, digestEmails, p.cp.MiniDigests); err != nil {
+				return err
+			}
+		case "merge", "one_liner":
+		default:
+			if len(digestEmails) == 0 {
+				logger.Info("Every message was skipped or routed, no main daily summary")
+				break
+			}
+			if p.cp.Result, err = a.summarizeDailyDigest(ctx, digestEmails); err != nil {
+				return err
+			}
+		}
+		if err := p.finish(stageSummarize); err != nil {
+			return err
+		}
+	}
+
+	if !p.done(stageRender) {
+		if p.cp.Result != nil {
+			a.renderDailyDigest(ctx, p.cp.Result)
+		}
+		if err := p.finish(stageRender); err != nil {
+			return err
+		}
+	}
+
+	var holdBack []*gmail.Message
+	switch {
+	case p.cp.Action == "merge":
+		holdBack = digestEmails
+	case a.alreadySent(ctx, id):
+		logger.Info("The daily summary went out before the digest was interrupted")
+	case p.cp.Action == "one_liner":
+		if err := a.sendToDiscord(a.dailyChannel(), quietDayLine(digestEmails, a.Config.LowVolume.Trivial)); err != nil {
+			return fmt.Errorf("sending the quiet day line to Discord: %w", err)
+		}
+		if err := a.state.markDelivered(id, a.Clock.Now()); err != nil {
+			logger.Error("Unable to record the quiet day line as delivered", "error", err)
+		}
+	case p.cp.Result != nil:
+		if err := a.postDailyDigest(ctx, p.cp.Result, digestEmails); err != nil {
+			return err
+		}
+		// a rollup's emails were recorded by their mini digests
+		if p.cp.Action != "rollup" {
+			if err := a.state.recordVolume(a.Clock.Now(), digestEmails, p.cp.Result.Categories); err != nil {
+				logger.Error("Unable to record email volume", "error", err)
+			}
+			if err := a.state.cacheDigestEmails(p.cp.Result.Kind, digestEmails); err != nil {
+				logger.Error("Unable to keep emails for regenerating", "error", err)
+			}
+		}
+	}
+
+	// queue for the weekly summary, move the cursor and drop the checkpoint in one write, so a crash can't do one
+	// without the others. the emails held back are already in the weekly queue from the day they came in
+	kept := p.emails(p.cp.Kept)
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		account.WeeklyQueue = append(account.WeeklyQueue, kept...)
+		account.LastFetch = p.cp.FetchedAt
+		account.DeferredDigest = holdBack
+		account.MiniDigests = account.MiniDigests[min(len(p.cp.MiniDigests), len(account.MiniDigests)):]
+		switch {
+		case len(holdBack) == 0:
+			account.DeferredSince = time.Time{}
+		case account.DeferredSince.IsZero():
+			account.DeferredSince = a.Clock.Now()
+		}
+		delete(account.Checkpoints, "daily")
+	}); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	a.checkVolumeAnomalies(ctx, true)
+
+	total := len(p.cp.Fetched)
+	reportProgress(ctx, ProgressEvent{Kind: "daily", Stage: "done", Done: total, Total: total})
+	return nil
+}
+
+// triageNewEmails prepares freshly fetched emails for a digest, parseEmails then classifyEmails. the triage says what's
+// left for the digest
+func (a *App) triageNewEmails(ctx context.Context, messages []*gmail.Message, task string) (context.Context, []*gmail.Message, *triage, error) {
+	messages = a.parseEmails(ctx, messages)
+	ctx, triaged, err := a.classifyEmails(ctx, messages, task)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ctx, messages, triaged, nil
+}
+
+// parseEmails reads the text of image-only emails, and indexes and deduplicates the emails
+func (a *App) parseEmails(ctx context.Context, messages []*gmail.Message) []*gmail.Message {
+	a.recognizeImageOnlyEmails(ctx, messages)
+	return a.indexAndDedupe(ctx, messages)
 }
 
-func sendDailySummary() error {
-	lastFetchTime := getLastFetchTime()
-	oauthClient := createOAuthClient()
+// classifyEmails sorts parsed emails out: security emails are alerted about and taken out, the rules are applied,
+// escalations go out and the routed emails are summarized in their channels
+func (a *App) classifyEmails(ctx context.Context, messages []*gmail.Message, task string) (context.Context, *triage, error) {
+	logger := log.FromContext(ctx)
+
+	messages = a.fastPathSecurityEmails(ctx, messages)
 
-	messages, err := fetchEmails(oauthClient, lastFetchTime)
+	ctx, triaged, err := a.applyRules(ctx, messages)
 	if err != nil {
-		return fmt.Errorf("fetching emails: %w", err)
+		return nil, nil, fmt.Errorf("applying rules: %w", err)
+	}
+	a.escalate(ctx, triaged.escalated)
+	ctx = withUrgentEmails(ctx, triaged.escalated)
+	for channelID, routed := range triaged.routed {
+		// the other channels shouldn't miss out because one of them failed
+		if err := a.sendRoutedDigest(ctx, channelID, routed); err != nil {
+			logger.Error("Routed summary failed", "channel_id", channelID, "error", err)
+			recordTaskError(task, err)
+		}
+	}
+	a.declineReadReceipts(ctx, triaged.kept)
+	a.trackRecruiting(ctx, triaged.kept)
+	a.trackBills(ctx, triaged.kept)
+	// the bookings are shown as their trip's itinerary instead of one summary each
+	if bookings := a.trackTravel(ctx, triaged.kept); len(bookings) > 0 {
+		triaged.digest = slices.DeleteFunc(triaged.digest, func(m *gmail.Message) bool { return bookings[m.Id] })
 	}
+	return ctx, triaged, nil
+}
 
-	if len(messages) == 0 {
-		log.Info("No new messages, skipping daily summary")
-		return nil
+// ruleContext puts what the rules say about the emails they kept into ctx for the summarizer, like classifyEmails
+// does, but without alerting or routing them again. it's for a digest resumed after its emails were classified
+func (a *App) ruleContext(ctx context.Context, kept []*gmail.Message) (context.Context, error) {
+	ctx, triaged, err := a.applyRules(ctx, kept)
+	if err != nil {
+		return nil, fmt.Errorf("applying rules: %w", err)
 	}
+	return withUrgentEmails(ctx, triaged.escalated), nil
+}
 
-	summary, err := dailySummary(messages)
+// summarizeDailyDigest summarizes the emails for the main daily channel
+func (a *App) summarizeDailyDigest(ctx context.Context, messages []*gmail.Message) (*Digest, error) {
+	usageBefore := currentUsage()
+	digest, err := a.summarizeWithinBudget(ctx, "daily", messages)
 	if err != nil {
-		return fmt.Errorf("generating daily summary: %w", err)
+		return nil, fmt.Errorf("generating daily summary: %w", err)
+	}
+	digest.Usage = currentUsage().Sub(usageBefore)
+	a.holdRemainder(ctx, digest, a.dailyChannel(), digest.ID, 2)
+	return digest, nil
+}
+
+// renderDailyDigest adds what goes with a daily digest: the threads waiting on a reply and the upcoming trips
+func (a *App) renderDailyDigest(ctx context.Context, digest *Digest) {
+	if a.Config.FollowUps != nil {
+		// a missing section isn't worth failing the digest over
+		waitingOn, err := a.checkFollowUps(ctx)
+		if err != nil {
+			log.FromContext(ctx).Error("Unable to check for threads awaiting a reply", "error", err)
+		}
+		digest.WaitingOn = waitingOn
 	}
+	digest.addSection(a.travelSection("daily", a.Clock.Now().Add(-24*time.Hour)))
+}
 
-	if err := sendToDiscord(config.DailySummaryChannelID, summary); err != nil {
+// postDailyDigest sends a daily digest with everything that goes with it. messages are the emails it has menus for
+func (a *App) postDailyDigest(ctx context.Context, digest *Digest, messages []*gmail.Message) error {
+	reportProgress(ctx, ProgressEvent{Kind: "daily", Stage: "delivering", Done: len(messages), Total: len(messages)})
+	if err := a.postOrQueue(ctx, a.dailyChannel(), digest, nil, DigestExtras{Emails: messages}); err != nil {
 		return fmt.Errorf("sending daily summary to Discord: %w", err)
 	}
+	a.state.archiveDigest(digest)
+	return nil
+}
 
-	weeklySummaryQueue = append(weeklySummaryQueue, messages...)
-	updateLastFetchTime(time.Now())
+func (a *App) sendWeeklySummary(ctx context.Context) error {
+	return a.runWeeklySummary(ctx, a.periodDigestID("weekly", a.periodTime(ctx)))
+}
 
-	return nil
+// summarizeNow is the daily or weekly summary asked for by hand, through the API, gRPC or the TUI. it's a digest of
+// its own, named by oneOffDigestID rather than after the period, so it goes out even when the period's scheduled one
+// already did
+func (a *App) summarizeNow(kind string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if kind == "weekly" {
+			return a.runWeeklySummary(ctx, oneOffDigestID(a.Profile, kind, a.Clock.Now()))
+		}
+		return a.runDailySummary(ctx, oneOffDigestID(a.Profile, kind, a.Clock.Now()))
+	}
 }
 
-func sendWeeklySummary() error {
-	if len(weeklySummaryQueue) == 0 {
-		log.Info("No new messages, skipping weekly summary")
+// runWeeklySummary writes and sends the weekly summary id from the weekly queue, stage by stage like
+// runDailySummary. the queue was parsed and classified by the daily summaries already
+func (a *App) runWeeklySummary(ctx context.Context, id string) (err error) {
+	ctx = a.startDigest(ctx, id)
+	logger := log.FromContext(ctx)
+	defer func() {
+		if err != nil {
+			reportProgress(ctx, ProgressEvent{Kind: "weekly", Stage: "failed", Error: err.Error()})
+		}
+	}()
+
+	p := a.startPipeline(ctx, "weekly", id)
+	if !p.resumed && a.alreadySent(ctx, id) {
+		logger.Info("This week's summary was already sent, skipping")
+		reportProgress(ctx, ProgressEvent{Kind: "weekly", Stage: "skipped"})
 		return nil
 	}
 
-	summary, err := weeklySummary(weeklySummaryQueue)
-	if err != nil {
-		return fmt.Errorf("generating weekly summary: %w", err)
+	if !p.done(stageFetch) {
+		var queue []*gmail.Message
+		a.state.read(func(s *State) {
+			queue = append(queue, s.account().WeeklyQueue...)
+		})
+
+		if len(queue) == 0 {
+			logger.Info("No new messages, skipping weekly summary")
+			reportProgress(ctx, ProgressEvent{Kind: "weekly", Stage: "skipped"})
+			return nil
+		}
+		// the queue stays as it is for next week's summary when this one isn't confirmed
+		proceed, err := a.confirmDigestCost(ctx, "weekly", a.weeklyChannel(), queue)
+		if err != nil {
+			return err
+		}
+		if !proceed {
+			reportProgress(ctx, ProgressEvent{Kind: "weekly", Stage: "skipped"})
+			return nil
+		}
+
+		p.cp.FetchedAt = a.Clock.Now()
+		p.cp.Emails = queue
+		p.cp.Digest = messageIDs(queue)
+		if err := p.finish(stageFetch); err != nil {
+			return err
+		}
 	}
+	queue := p.emails(p.cp.Digest)
 
-	if err := sendToDiscord(config.WeeklySummaryChannelID, summary); err != nil {
-		return fmt.Errorf("sending weekly summary to Discord: %w", err)
+	if !p.done(stageSummarize) {
+		usageBefore := currentUsage()
+		if p.cp.Result, err = a.summarizeWithinBudget(ctx, "weekly", queue); err != nil {
+			return fmt.Errorf("generating weekly summary: %w", err)
+		}
+		p.cp.Result.Usage = currentUsage().Sub(usageBefore)
+		a.holdRemainder(ctx, p.cp.Result, a.weeklyChannel(), p.cp.Result.ID, 2)
+		if err := p.finish(stageSummarize); err != nil {
+			return err
+		}
 	}
+	digest := p.cp.Result
 
-	weeklySummaryQueue = nil
-	return nil
-}
+	stats := a.state.weeklyVolumeStats(a.Clock.Now())
+	var dailyPosts []DigestPost
+	a.state.read(func(s *State) {
+		dailyPosts = append(dailyPosts, s.account().DailyDigestPosts...)
+	})
+	if !p.done(stageRender) {
+		digest.addSection(&DigestSection{Key: "stats", Title: "Stats", Lines: []string{stats.String()}, Inline: true})
+		digest.addSection(a.recruitingSection())
+		digest.addSection(a.travelSection("weekly", time.Time{}))
+		digest.addSection(a.inboxZeroSection(ctx, queue))
+		digest.addSection(dailyPostsSection(dailyPosts, a.Location))
+		p.cp.DailyPosts = len(dailyPosts)
+		if err := p.finish(stageRender); err != nil {
+			return err
+		}
+	}
+	// the daily digests posted since the summary was rendered are for next week's
+	dailyPosts = dailyPosts[:min(p.cp.DailyPosts, len(dailyPosts))]
 
-func refreshOAuthTokens() error {
-	log.Info("Refreshing OAuth tokens...")
+	total := len(queue)
+	if a.alreadySent(ctx, id) {
+		logger.Info("The weekly summary went out before the digest was interrupted")
+	} else {
+		reportProgress(ctx, ProgressEvent{Kind: "weekly", Stage: "delivering", Done: total, Total: total})
+		if err := a.postOrQueue(ctx, a.weeklyChannel(), digest, weeklyReference(a.weeklyChannel(), dailyPosts), DigestExtras{VolumeStats: &stats}); err != nil {
+			return fmt.Errorf("sending weekly summary to Discord: %w", err)
+		}
+		a.state.archiveDigest(digest)
+	}
 
-	b, err := os.ReadFile(credentialsFile)
-	if err != nil {
-		log.Fatal("Unable to read client secret file", "error", err)
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		account.WeeklyQueue = account.WeeklyQueue[min(len(queue), len(account.WeeklyQueue)):]
+		account.DailyDigestPosts = account.DailyDigestPosts[min(len(dailyPosts), len(account.DailyDigestPosts)):]
+		if account.LastDigestEmails == nil {
+			account.LastDigestEmails = make(map[string][]*gmail.Message)
+		}
+		account.LastDigestEmails["weekly"] = queue
+		delete(account.Checkpoints, "weekly")
+	}); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	if err := a.pruneRecruiting(); err != nil {
+		logger.Error("Unable to prune the recruiting pipeline", "error", err)
 	}
 
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	reportProgress(ctx, ProgressEvent{Kind: "weekly", Stage: "done", Done: total, Total: total})
+	return nil
+}
+
+func (a *App) refreshOAuthTokens(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	logger.Info("Refreshing OAuth tokens...")
+
+	config, err := loadOAuthConfig(a.gmailScopes()...)
 	if err != nil {
-		log.Fatal("Unable to parse client secret file to config", "error", err)
+		return err
 	}
 
-	tok, err := tokenFromFile(tokenFile)
+	tok, err := a.state.loadToken()
 	if err != nil {
-		log.Fatal("Unable to load token file", "error", err)
+		return err
 	}
 
 	if !tok.Valid() {
-		log.Info("Token expired, refreshing...")
-		newTok, err := config.TokenSource(context.Background(), tok).Token()
+		logger.Info("Token expired, refreshing...")
+		newTok, err := config.TokenSource(a.oauthContext(ctx), tok).Token()
+		if isInvalidGrant(err) {
+			a.reauthorize("the refresh token was rejected")
+			return errReauthorizing
+		}
 		if err != nil {
 			return fmt.Errorf("unable to refresh token: %w", err)
 		}
-		saveToken(tokenFile, newTok)
-		log.Info("Token successfully refreshed and saved")
+		if err := a.state.saveToken(newTok); err != nil {
+			return err
+		}
+		logger.Info("Token successfully refreshed and saved")
 	} else {
-		log.Info("Token is still valid")
+		logger.Info("Token is still valid")
 	}
 
-	return nil
+	return a.checkTokenExpiry()
 }
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxHTMLDepth is how deeply nested HTML is read. every element around a piece of text is rendered on its own, so an
+// email nesting thousands of them would take time and memory out of all proportion to what it says
+const maxHTMLDepth = 128
+
+// htmlToMarkdown converts an HTML email body to Markdown, keeping the headings, links, lists, emphasis and tables
+// that plain text would flatten away. the error says what couldn't be read; the Markdown is still whatever could be
+func htmlToMarkdown(htmlContent string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		return "", fmt.Errorf("parsing HTML: %w", err)
+	}
+
+	w := &markdownWriter{out: &strings.Builder{}}
+	w.node(doc)
+	markdown := tidyMarkdown(w.out.String())
+	if w.tooDeep {
+		return markdown, fmt.Errorf("HTML nested over %d levels deep, the rest was left out", maxHTMLDepth)
+	}
+	return markdown, nil
+}
+
+// markdownWriter renders a parsed HTML tree as Markdown
+type markdownWriter struct {
+	out   *strings.Builder
+	lists []markdownList // lists are the lists being rendered, innermost last
+	pre   bool           // pre is set inside <pre>, where whitespace is kept as is
+	// depth is how many elements deep the writer is, tooDeep set once it went past maxHTMLDepth
+	depth   int
+	tooDeep bool
+}
+
+type markdownList struct {
+	ordered bool
+	items   int
+}
+
+// inner renders n's children on their own, e.g. for a link's text or a table cell
+func (w *markdownWriter) inner(n *html.Node) string {
+	out := w.out
+	w.out = &strings.Builder{}
+	w.children(n)
+	rendered := w.out.String()
+	w.out = out
+	return rendered
+}
+
+func (w *markdownWriter) children(n *html.Node) {
+	if w.depth >= maxHTMLDepth {
+		w.tooDeep = true
+		return
+	}
+	w.depth++
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+	w.depth--
+}
+
+// block writes s as a paragraph of its own
+func (w *markdownWriter) block(s string) {
+	if s = strings.TrimSpace(s); s != "" {
+		w.out.WriteString("\n\n" + s + "\n\n")
+	}
+}
+
+// whitespace is collapsed like a browser would, so the source's indentation doesn't end up in the prompt
+var whitespace = regexp.MustCompile(`[ \t\r\n\f]+`)
+
+func (w *markdownWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		if w.pre {
+			w.out.WriteString(n.Data)
+		} else {
+			w.out.WriteString(whitespace.ReplaceAllString(n.Data, " "))
+		}
+		return
+	case html.DocumentNode:
+		w.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Title, atom.Noscript, atom.Template:
+		return
+
+	case atom.Br:
+		w.out.WriteString("\n")
+
+	case atom.Hr:
+		w.out.WriteString("\n\n---\n\n")
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		if text := oneLine(w.inner(n)); text != "" {
+			w.block(strings.Repeat("#", level) + " " + text)
+		}
+
+	case atom.A:
+		text := strings.TrimSpace(w.inner(n))
+		href := strings.TrimSpace(attr(n, "href"))
+		switch {
+		case href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:"):
+			w.out.WriteString(text)
+		case strings.TrimPrefix(href, "mailto:") == text:
+			w.out.WriteString(text)
+		case text == "" || text == href:
+			w.out.WriteString("<" + href + ">")
+		default:
+			w.out.WriteString("[" + oneLine(text) + "](" + href + ")")
+		}
+
+	case atom.Strong, atom.B:
+		w.emphasis(n, "**")
+
+	case atom.Em, atom.I:
+		w.emphasis(n, "_")
+
+	case atom.Code:
+		if w.pre {
+			w.children(n)
+		} else {
+			w.emphasis(n, "`")
+		}
+
+	case atom.Pre:
+		w.pre = true
+		code := w.inner(n)
+		w.pre = false
+		w.out.WriteString("\n\n```\n" + strings.Trim(code, "\n") + "\n```\n\n")
+
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			w.out.WriteString("[image: " + oneLine(alt) + "]")
+		}
+
+	case atom.Blockquote:
+		quoted := strings.TrimSpace(tidyMarkdown(w.inner(n)))
+		if quoted != "" {
+			w.block("> " + strings.ReplaceAll(quoted, "\n", "\n> "))
+		}
+
+	case atom.Ul, atom.Ol:
+		w.lists = append(w.lists, markdownList{ordered: n.DataAtom == atom.Ol})
+		w.out.WriteString("\n\n")
+		w.children(n)
+		w.out.WriteString("\n\n")
+		w.lists = w.lists[:len(w.lists)-1]
+
+	case atom.Li:
+		w.listItem(n)
+
+	case atom.Table:
+		if isDataTable(n) {
+			w.block(w.table(n))
+		} else {
+			// tables used for layout, which most marketing emails are made of, are just blocks
+			w.block(w.inner(n))
+		}
+
+	case atom.Td, atom.Th:
+		w.block(w.inner(n))
+
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main, atom.Center, atom.Tr:
+		w.block(w.inner(n))
+
+	default:
+		w.children(n)
+	}
+}
+
+// emphasis wraps n's text in marker, keeping the spaces around it outside so the Markdown stays valid
+func (w *markdownWriter) emphasis(n *html.Node, marker string) {
+	text := w.inner(n)
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		w.out.WriteString(text)
+		return
+	}
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+	w.out.WriteString(lead + marker + trimmed + marker + trail)
+}
+
+func (w *markdownWriter) listItem(n *html.Node) {
+	if len(w.lists) == 0 {
+		w.block(w.inner(n))
+		return
+	}
+	list := &w.lists[len(w.lists)-1]
+	list.items++
+
+	marker := "- "
+	if list.ordered {
+		marker = strconv.Itoa(list.items) + ". "
+	}
+	// items are kept tight, so a nested list or a second paragraph doesn't leave blank lines in the list
+	content := strings.ReplaceAll(strings.TrimSpace(tidyMarkdown(w.inner(n))), "\n\n", "\n")
+	// continuation lines, nested lists included, line up under the item's text
+	content = strings.ReplaceAll(content, "\n", "\n"+strings.Repeat(" ", len(marker)))
+	w.out.WriteString("\n" + marker + content)
+}
+
+// maxColspan bounds the colspan honored, layout tables sometimes use huge ones
+const maxColspan = 20
+
+// isDataTable tells a table of data from one used for layout: data tables don't nest tables, and have at least two
+// rows of at least two cells. rows of one cell, like a title or a total spanning the table, are fine
+func isDataTable(table *html.Node) bool {
+	wide := 0
+	for _, row := range tableRows(table) {
+		if len(tableCells(row)) >= 2 {
+			wide++
+		}
+	}
+	if wide < 2 {
+		return false
+	}
+
+	var nested func(n *html.Node, depth int) bool
+	nested = func(n *html.Node, depth int) bool {
+		if depth >= maxHTMLDepth {
+			// too deep to be rendered anyway
+			return true
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.DataAtom == atom.Table || nested(c, depth+1) {
+				return true
+			}
+		}
+		return false
+	}
+	return !nested(table, 0)
+}
+
+// table renders a data table, its first row as the header
+func (w *markdownWriter) table(table *html.Node) string {
+	var rows [][]string
+	columns := 0
+	for _, row := range tableRows(table) {
+		var cells []string
+		for _, cell := range tableCells(row) {
+			text := oneLine(tidyMarkdown(w.inner(cell)))
+			cells = append(cells, strings.ReplaceAll(text, "|", `\|`))
+			// a cell spanning columns, like the label of a total, is followed by empty ones to keep the rest aligned
+			if span, err := strconv.Atoi(attr(cell, "colspan")); err == nil && span > 1 && span <= maxColspan {
+				cells = append(cells, make([]string, span-1)...)
+			}
+		}
+		columns = max(columns, len(cells))
+		rows = append(rows, cells)
+	}
+
+	var sb strings.Builder
+	// a title row spanning the whole table makes a poor header, so it goes above it
+	if len(rows) > 2 && len(tableCells(tableRows(table)[0])) == 1 && rows[0][0] != "" {
+		sb.WriteString("**" + rows[0][0] + "**\n\n")
+		rows = rows[1:]
+	}
+	for i, cells := range rows {
+		for len(cells) < columns {
+			cells = append(cells, "")
+		}
+		sb.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+		if i == 0 {
+			sb.WriteString(strings.Repeat("| --- ", columns) + "|\n")
+		}
+	}
+	return sb.String()
+}
+
+// tableRows are the rows of table, not those of tables nested in it
+func tableRows(table *html.Node) []*html.Node {
+	var rows []*html.Node
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		switch c.DataAtom {
+		case atom.Tr:
+			rows = append(rows, c)
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			for r := c.FirstChild; r != nil; r = r.NextSibling {
+				if r.DataAtom == atom.Tr {
+					rows = append(rows, r)
+				}
+			}
+		}
+	}
+	return rows
+}
+
+func tableCells(row *html.Node) []*html.Node {
+	var cells []*html.Node
+	for c := row.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == atom.Td || c.DataAtom == atom.Th {
+			cells = append(cells, c)
+		}
+	}
+	return cells
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// oneLine joins s onto a single line
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// tidyMarkdown trims the spaces collapsing left at the ends of lines and squeezes runs of blank lines into one,
+// leaving code blocks alone
+func tidyMarkdown(s string) string {
+	var lines []string
+	inCode, blank := false, false
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+		} else if inCode {
+			lines = append(lines, line)
+			continue
+		}
+
+		line = strings.TrimRight(line, " ")
+		// a line starting with spaces is a nested list item or a continuation of one, anything else was just
+		// collapsed whitespace
+		if trimmed := strings.TrimLeft(line, " "); !isListLine(trimmed) || !strings.HasPrefix(line, "  ") {
+			line = trimmed
+		}
+
+		if line == "" {
+			if blank || len(lines) == 0 {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// listMarker matches the start of a list item
+var listMarker = regexp.MustCompile(`^(- |\d+\. )`)
+
+func isListLine(line string) bool {
+	return listMarker.MatchString(line)
+}
+
+// tableSeparator matches the line under a Markdown table's header, e.g. "| --- | :---: |"
+var tableSeparator = regexp.MustCompile(`^\|?\s*:?-{3,}:?\s*(\|\s*:?-{3,}:?\s*)*\|?$`)
+
+// discordTables puts the Markdown tables of message in code blocks with their columns aligned, since Discord
+// doesn't render tables and the raw pipes are hard to read
+func discordTables(message string) string {
+	lines := strings.Split(message, "\n")
+	var out []string
+	inCode := false
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, "```") {
+			inCode = !inCode
+		}
+		if inCode || !strings.HasPrefix(trimmed, "|") || i+1 >= len(lines) || !tableSeparator.MatchString(strings.TrimSpace(lines[i+1])) {
+			out = append(out, lines[i])
+			continue
+		}
+
+		rows := [][]string{tableRow(trimmed)}
+		i += 2
+		for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "|"); i++ {
+			rows = append(rows, tableRow(strings.TrimSpace(lines[i])))
+		}
+		i--
+		out = append(out, "```", alignTable(rows), "```")
+	}
+	return strings.Join(out, "\n")
+}
+
+// tableRow splits a Markdown table line into its cells, keeping escaped pipes in them
+func tableRow(line string) []string {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+	cells := strings.Split(strings.ReplaceAll(line, `\|`, "\x00"), "|")
+	for i, cell := range cells {
+		cells[i] = strings.ReplaceAll(strings.TrimSpace(cell), "\x00", "|")
+	}
+	return cells
+}
+
+// alignTable lays rows out in padded columns, with a rule under the header
+func alignTable(rows [][]string) string {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+
+	var sb strings.Builder
+	for r, row := range rows {
+		for i, width := range widths {
+			cell := ""
+			if i < len(row) {
+				cell = row[i]
+			}
+			if i > 0 {
+				sb.WriteString("  ")
+			}
+			sb.WriteString(cell + strings.Repeat(" ", width-utf8.RuneCountInString(cell)))
+		}
+		sb.WriteString("\n")
+		if r == 0 {
+			for i, width := range widths {
+				if i > 0 {
+					sb.WriteString("  ")
+				}
+				sb.WriteString(strings.Repeat("-", width))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n ")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"scheduler"
+)
+
+// MetricsConfig enables the unauthenticated metrics and health server, meant to be scraped from inside a cluster
+type MetricsConfig struct {
+	Listen string `json:"listen"`
+}
+
+type taskMetrics struct {
+	runs     int
+	errors   int
+	duration time.Duration
+	// lastError is why the last run failed, "" when it didn't
+	lastError string
+}
+
+var (
+	emailsFetched int
+	digestsSent   = make(map[string]int)
+	taskStats     = make(map[string]*taskMetrics)
+	metricsMu     sync.Mutex
+
+	// daemonReady is set once startDaemon has everything running
+	daemonReady atomic.Bool
+)
+
+func recordEmailsFetched(n int) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	emailsFetched += n
+}
+
+func recordDigestSent(kind string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	digestsSent[kind]++
+}
+
+func recordTaskRun(name string, duration time.Duration, err error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	t, ok := taskStats[name]
+	if !ok {
+		t = &taskMetrics{}
+		taskStats[name] = t
+	}
+	t.runs++
+	t.duration += duration
+	t.lastError = ""
+	if err != nil {
+		t.errors++
+		t.lastError = err.Error()
+	}
+}
+
+// lastTaskStatus is how the task's last run went, "ok" or why it failed, and "" when it hasn't run yet
+func lastTaskStatus(name string) string {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	t, ok := taskStats[name]
+	switch {
+	case !ok:
+		return ""
+	case t.lastError != "":
+		return "failed: " + t.lastError
+	default:
+		return "ok"
+	}
+}
+
+// recordSchedulerEvent keeps the task metrics and the dashboard's errors from the scheduler's events, so runs that
+// panicked or timed out count too
+func recordSchedulerEvent(event scheduler.Event) {
+	switch event.Kind {
+	case scheduler.TaskFinished, scheduler.TaskFailed:
+		recordTaskRun(event.Name, event.Duration, event.Err)
+		if event.Err != nil {
+			recordTaskError(event.Name, event.Err)
+		}
+	}
+}
+
+func startMetricsServer(a *App, config MetricsConfig) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadyz(w, r, a)
+	})
+
+	log.Info("Metrics server listening", "addr", config.Listen)
+	go func() {
+		if err := http.ListenAndServe(config.Listen, mux); err != nil {
+			log.Error("Metrics server stopped", "error", err)
+		}
+	}()
+}
+
+// handleMetrics writes the metrics in the Prometheus text exposition format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	usage := currentUsage()
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	writeMetric(w, "reads_ur_emails_emails_fetched_total", "counter", "Emails fetched from Gmail.", nil, float64(emailsFetched))
+
+	writeMetricHeader(w, "reads_ur_emails_digests_sent_total", "counter", "Digests delivered, by kind.")
+	for _, kind := range sortedKeys(digestsSent) {
+		writeMetricValue(w, "reads_ur_emails_digests_sent_total", map[string]string{"kind": kind}, float64(digestsSent[kind]))
+	}
+
+	writeMetricHeader(w, "reads_ur_emails_llm_tokens_total", "counter", "LLM tokens used, by type.")
+	writeMetricValue(w, "reads_ur_emails_llm_tokens_total", map[string]string{"type": "prompt"}, float64(usage.PromptTokens))
+	writeMetricValue(w, "reads_ur_emails_llm_tokens_total", map[string]string{"type": "completion"}, float64(usage.CompletionTokens))
+	writeMetric(w, "reads_ur_emails_llm_cost_usd_total", "counter", "Estimated LLM cost in USD.", nil, usage.CostUSD)
+
+	writeMetricHeader(w, "reads_ur_emails_task_duration_seconds", "summary", "Scheduled task run time.")
+	for _, name := range sortedKeys(taskStats) {
+		labels := map[string]string{"task": name}
+		writeMetricValue(w, "reads_ur_emails_task_duration_seconds_sum", labels, taskStats[name].duration.Seconds())
+		writeMetricValue(w, "reads_ur_emails_task_duration_seconds_count", labels, float64(taskStats[name].runs))
+	}
+
+	writeMetricHeader(w, "reads_ur_emails_task_errors_total", "counter", "Failed scheduled task runs.")
+	for _, name := range sortedKeys(taskStats) {
+		writeMetricValue(w, "reads_ur_emails_task_errors_total", map[string]string{"task": name}, float64(taskStats[name].errors))
+	}
+
+	writeMetric(w, "reads_ur_emails_uptime_seconds", "gauge", "Seconds since the process started.", nil, time.Since(startTime).Seconds())
+}
+
+// handleHealthz is the liveness probe: if the process can answer, it's alive
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz is the readiness probe: the daemon has started and Discord is connected
+func handleReadyz(w http.ResponseWriter, r *http.Request, a *App) {
+	if !daemonReady.Load() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	if a.Discord != nil && !a.Discord.DataReady {
+		http.Error(w, "discord disconnected", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func writeMetric(w io.Writer, name, kind, help string, labels map[string]string, value float64) {
+	writeMetricHeader(w, name, kind, help)
+	writeMetricValue(w, name, labels, value)
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetricValue(w io.Writer, name string, labels map[string]string, value float64) {
+	fmt.Fprint(w, name)
+	if len(labels) > 0 {
+		fmt.Fprint(w, "{")
+		for i, key := range sortedKeys(labels) {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, "%s=%q", key, labels[key])
+		}
+		fmt.Fprint(w, "}")
+	}
+	fmt.Fprintf(w, " %g\n", value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
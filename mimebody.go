@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// the limits on reading an email's body. a malformed or hostile email can nest its parts without end, split itself
+// into thousands of them or decode to far more than the model is ever sent, so past these the rest is left out and
+// the email is listed at the end of the digest
+const (
+	// maxPartDepth is how deeply nested MIME parts are read, real emails nest three or four levels at most
+	maxPartDepth = 16
+	// maxBodyParts is how many MIME parts of an email are read
+	maxBodyParts = 256
+	// maxBodySize is how much decoded text is read from an email, all its parts together
+	maxBodySize = 2 << 20
+)
+
+// emailBody is an email's text, and what went wrong reading it
+type emailBody struct {
+	text     string
+	problems []string
+}
+
+// bodyReader walks an email's parts, keeping count against the limits
+type bodyReader struct {
+	sb       strings.Builder
+	parts    int
+	size     int
+	problems []string
+	// textParts is how many text parts had anything in them, to tell an email without text from one whose text was
+	// lost
+	textParts int
+}
+
+// readBody reads the text of an email: its plain text and HTML parts at any depth, the HTML as Markdown, and only one
+// of the formats a multipart/alternative has
+func readBody(message *gmail.Message) emailBody {
+	if message.Payload == nil {
+		return emailBody{}
+	}
+	r := &bodyReader{}
+	if len(message.Payload.Parts) == 0 {
+		// a single part email is its own body
+		r.leaf(message.Payload, false)
+	} else {
+		r.walk(message.Payload, 0)
+	}
+	text := r.sb.String()
+	if r.textParts > 0 && strings.TrimSpace(text) == "" {
+		r.problem("no readable text in its %s", pluralize(r.textParts, "text part"))
+	}
+	return emailBody{text: text, problems: r.problems}
+}
+
+// problem records what went wrong, once each
+func (r *bodyReader) problem(format string, args ...any) {
+	problem := fmt.Sprintf(format, args...)
+	for _, p := range r.problems {
+		if p == problem {
+			return
+		}
+	}
+	r.problems = append(r.problems, problem)
+}
+
+func (r *bodyReader) walk(part *gmail.MessagePart, depth int) {
+	if depth > maxPartDepth {
+		r.problem("parts nested over %d levels deep were left out", maxPartDepth)
+		return
+	}
+	if r.parts++; r.parts > maxBodyParts {
+		r.problem("only the first %d parts were read", maxBodyParts)
+		return
+	}
+	if len(part.Parts) == 0 {
+		r.leaf(part, true)
+		return
+	}
+	if part.MimeType == "multipart/alternative" {
+		r.alternative(part, depth)
+		return
+	}
+	for _, child := range part.Parts {
+		r.walk(child, depth+1)
+	}
+}
+
+// alternative reads one of the parts of a multipart/alternative, which are the same content in different formats. the
+// last is the sender's favourite, usually the HTML, and an earlier one is only read when those after it had no text
+func (r *bodyReader) alternative(part *gmail.MessagePart, depth int) {
+	for i := len(part.Parts) - 1; i >= 0; i-- {
+		before := r.sb.Len()
+		r.walk(part.Parts[i], depth+1)
+		if strings.TrimSpace(r.sb.String()[before:]) != "" {
+			return
+		}
+		// a part without text can still have left its newline, which would come before the next alternative's text
+		if r.sb.Len() > before {
+			prefix := r.sb.String()[:before]
+			r.sb.Reset()
+			r.sb.WriteString(prefix)
+		}
+	}
+}
+
+// leaf reads a part with no parts of its own, if it's text. the parts of a multipart email each end in a newline
+func (r *bodyReader) leaf(part *gmail.MessagePart, multipart bool) {
+	if part.Body == nil || part.Body.Data == "" {
+		return
+	}
+	html := part.MimeType == "text/html"
+	switch {
+	case html, part.MimeType == "text/plain":
+	case !multipart && (part.MimeType == "" || strings.HasPrefix(part.MimeType, "text/")):
+		// a single part email of another text type, like text/calendar, is read as it is
+	default:
+		return
+	}
+	r.textParts++
+
+	data, err := r.decode(part.Body.Data)
+	if err != nil {
+		r.problem("a %s part couldn't be decoded", part.MimeType)
+		return
+	}
+	text := string(data)
+	if html {
+		// Markdown keeps the links, lists and tables that plain text would lose
+		if text, err = htmlToMarkdown(text); err != nil {
+			r.problem("%v", err)
+		}
+	}
+	r.sb.WriteString(text)
+	if multipart {
+		r.sb.WriteString("\n")
+	}
+}
+
+// decode decodes a part's base64url body, cutting it short once the email has used up maxBodySize
+func (r *bodyReader) decode(data string) ([]byte, error) {
+	left := maxBodySize - r.size
+	if left <= 0 {
+		r.problem("cut short at %d MB", maxBodySize>>20)
+		return nil, nil
+	}
+	truncated := false
+	if base64.URLEncoding.DecodedLen(len(data)) > left {
+		// a multiple of four characters decodes on its own
+		data = data[:base64.URLEncoding.EncodedLen(left)]
+		truncated = true
+	}
+	decoded, err := base64.URLEncoding.DecodeString(data)
+	if err != nil {
+		// some senders' parts come through without the padding
+		raw, rawErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+		if rawErr != nil {
+			return nil, err
+		}
+		decoded = raw
+	}
+	r.size += len(decoded)
+	if truncated {
+		r.problem("cut short at %d MB", maxBodySize>>20)
+		// the cut can fall inside a character
+		for i := 1; i < utf8.UTFMax && len(decoded) > 0; i++ {
+			if last, size := utf8.DecodeLastRune(decoded); last != utf8.RuneError || size != 1 {
+				break
+			}
+			decoded = decoded[:len(decoded)-1]
+		}
+	}
+	return decoded, nil
+}
+
+// bodyProblemSection lists the emails whose bodies couldn't be read in full, so a summary missing something from them
+// doesn't go unexplained
+func bodyProblemSection(messages []*gmail.Message, account int) *DigestSection {
+	section := &DigestSection{Key: "body_problems", Title: "🧩 Emails that didn't read cleanly"}
+	for _, message := range messages {
+		problems := readBody(message).problems
+		if len(problems) == 0 {
+			continue
+		}
+		label := extractHeader(message, "Subject")
+		if label == "" {
+			label = "(no subject)"
+		}
+		label = strings.NewReplacer("[", "(", "]", ")").Replace(label)
+		if url := gmailThreadURL(account, message.ThreadId); url != "" {
+			label = fmt.Sprintf("[%s](<%s>)", label, url)
+		}
+		section.Lines = append(section.Lines, fmt.Sprintf("%s · %s: %s", label, senderName(extractHeader(message, "From")), strings.Join(problems, ", ")))
+	}
+	return section
+}
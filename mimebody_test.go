@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// FuzzReadBody reads random MIME emails, seeded with the golden test's samples. whatever the email, reading it has to
+// stay within the limits and say why when text parts came out empty
+func FuzzReadBody(f *testing.F) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "emails", "*.eml"))
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(raw)
+	}
+	f.Add([]byte("Content-Type: multipart/mixed; boundary=x\n\n--x\nContent-Type: multipart/mixed; boundary=x\n\n--x--\n"))
+	f.Add([]byte("Content-Type: text/html\nContent-Transfer-Encoding: base64\n\nPGI+PGk+PHU+\n"))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		message, err := gmailMessage("fuzz", raw)
+		if err != nil {
+			return
+		}
+		body := readBody(message)
+		// Markdown can add a little to the text around links and tables, never this much
+		if len(body.text) > 4*maxBodySize {
+			t.Fatalf("read %d bytes, over the limit of %d", len(body.text), maxBodySize)
+		}
+		if extractBody(message) != body.text {
+			t.Fatal("extractBody and readBody disagree")
+		}
+	})
+}
+
+// FuzzHTMLToMarkdown converts random HTML. the output can't be checked for much, but the conversion mustn't panic or
+// run away with deeply nested input
+func FuzzHTMLToMarkdown(f *testing.F) {
+	f.Add(`<table><tr><td>a</td><td colspan="99999">b</td></tr><tr><td>c</td><td>d</td></tr></table>`)
+	f.Add(`<ul><li><ol><li><blockquote><pre><code>x</code></pre></blockquote></li></ol></li></ul>`)
+	f.Add(`<a href="javascript:alert(1)"><b><i>`)
+	f.Add(strings.Repeat("<div>", 10000) + "deep")
+	f.Fuzz(func(t *testing.T, html string) {
+		markdown, _ := htmlToMarkdown(html)
+		if utf8.ValidString(html) && !utf8.ValidString(markdown) {
+			t.Fatalf("valid UTF-8 in, invalid out: %q", markdown)
+		}
+	})
+}
+
+// TestReadBodyNestedAlternative reads an email whose alternatives are inside a multipart/mixed, next to an attachment,
+// and expects the HTML alone
+func TestReadBodyNestedAlternative(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "emails", "nested_alternative.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := gmailMessage("nested_alternative", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(message)
+	if len(body.problems) > 0 {
+		t.Errorf("problems = %q, want none", body.problems)
+	}
+	if want := "Could you add the **budget numbers** by _Sunday evening_?"; !strings.Contains(body.text, want) {
+		t.Errorf("text = %q, want the HTML alternative %q", body.text, want)
+	}
+	if strings.Count(body.text, "Hi Sam") != 1 {
+		t.Errorf("text = %q, want only one of the alternatives", body.text)
+	}
+}
+
+func TestReadBodyLimits(t *testing.T) {
+	text := func(s string) *gmail.MessagePart {
+		return &gmail.MessagePart{MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(s))}}
+	}
+	html := func(s string) *gmail.MessagePart {
+		return &gmail.MessagePart{MimeType: "text/html", Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(s))}}
+	}
+	multipart := func(parts ...*gmail.MessagePart) *gmail.MessagePart {
+		return &gmail.MessagePart{MimeType: "multipart/mixed", Body: &gmail.MessagePartBody{}, Parts: parts}
+	}
+	alternative := func(parts ...*gmail.MessagePart) *gmail.MessagePart {
+		return &gmail.MessagePart{MimeType: "multipart/alternative", Body: &gmail.MessagePartBody{}, Parts: parts}
+	}
+
+	deep := text("too deep")
+	for range maxPartDepth + 1 {
+		deep = multipart(deep)
+	}
+	var many []*gmail.MessagePart
+	for range maxBodyParts + 10 {
+		many = append(many, text("part"))
+	}
+
+	tests := []struct {
+		name    string
+		payload *gmail.MessagePart
+		problem string
+		text    string
+	}{
+		{"nested", multipart(multipart(text("inner"))), "", "inner\n"},
+		{"alternative", alternative(text("plain"), html("<b>rich</b>")), "", "**rich**\n"},
+		{"nested alternative", multipart(multipart(alternative(text("plain"), html("<b>rich</b>"))), text("after")), "", "**rich**\nafter\n"},
+		{"alternative in alternative", alternative(text("plain"), alternative(text("inner plain"), html("<i>inner rich</i>"))), "", "_inner rich_\n"},
+		{"alternative without html text", alternative(text("plain"), html("<img src=x>")), "", "plain\n"},
+		{"too deep", multipart(text("shallow"), deep), "nested over", "shallow\n"},
+		{"too many parts", multipart(many...), "only the first", strings.Repeat("part\n", maxBodyParts-1)},
+		{"too big", text(strings.Repeat("é", maxBodySize)), "cut short", ""},
+		{"unpadded", &gmail.MessagePart{MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: base64.RawURLEncoding.EncodeToString([]byte("hi!?"))}}, "", "hi!?"},
+		{"undecodable", multipart(text("fine"), &gmail.MessagePart{MimeType: "text/html", Body: &gmail.MessagePartBody{Data: "!!!!"}}), "couldn't be decoded", "fine\n"},
+		{"html too deep", &gmail.MessagePart{MimeType: "text/html", Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(strings.Repeat("<div>", 2*maxHTMLDepth)))}}, "HTML nested", ""},
+		{"empty text", &gmail.MessagePart{MimeType: "text/html", Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("<img src=x>"))}}, "no readable text", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := readBody(&gmail.Message{Payload: tt.payload})
+			problems := strings.Join(body.problems, "; ")
+			if tt.problem == "" && problems != "" || !strings.Contains(problems, tt.problem) {
+				t.Errorf("problems = %q, want %q", problems, tt.problem)
+			}
+			if tt.name == "too big" {
+				if len(body.text) > maxBodySize || !utf8.ValidString(body.text) {
+					t.Errorf("read %d bytes, valid UTF-8 %v", len(body.text), utf8.ValidString(body.text))
+				}
+				return
+			}
+			if body.text != tt.text {
+				t.Errorf("text = %q, want %q", body.text, tt.text)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+// defaultMiniDigestStart is when the first mini digest of the day goes out when the config doesn't say
+const defaultMiniDigestStart = "08:00"
+
+type MiniDigestsConfig struct {
+	// EveryHours is how many hours apart the mini digests are
+	EveryHours int `json:"every_hours"`
+	// Start is the time of the first mini digest of the day, default 08:00. the last one is the last before the daily
+	// summary
+	Start string `json:"start"`
+}
+
+// times are when the mini digests go out, every EveryHours from Start until the daily summary
+func (c *MiniDigestsConfig) times(daily time.Time) ([]time.Time, error) {
+	if c.EveryHours <= 0 {
+		return nil, fmt.Errorf("invalid mini digests every_hours %d, it has to be at least 1", c.EveryHours)
+	}
+	start := c.Start
+	if start == "" {
+		start = defaultMiniDigestStart
+	}
+	hour, minute, err := parseTimeOfDay(start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mini digests start time: %w", err)
+	}
+	first := time.Date(0, 0, 0, hour, minute, 0, 0, daily.Location())
+	var times []time.Time
+	for at := first; at.Before(daily); at = at.Add(time.Duration(c.EveryHours) * time.Hour) {
+		times = append(times, at)
+	}
+	if len(times) == 0 {
+		return nil, fmt.Errorf("the first mini digest at %s isn't before the daily summary at %s", start, daily.Format("15:04"))
+	}
+	return times, nil
+}
+
+// sendMiniDigest summarizes the emails since the last digest of the day, mini or daily, in the daily channel. it goes
+// through the same rules as the daily summary, which then only has the emails since the last mini digest to read
+func (a *App) sendMiniDigest(ctx context.Context) (err error) {
+	now := a.Clock.Now()
+	id := a.periodDigestID("mini", a.periodTime(ctx))
+	ctx = a.startDigest(ctx, id)
+	logger := log.FromContext(ctx)
+	defer func() {
+		if err != nil {
+			reportProgress(ctx, ProgressEvent{Kind: "mini", Stage: "failed", Error: err.Error()})
+		}
+	}()
+
+	if a.alreadySent(ctx, id) {
+		logger.Info("This mini digest was already sent, skipping")
+		reportProgress(ctx, ProgressEvent{Kind: "mini", Stage: "skipped"})
+		return nil
+	}
+
+	reportProgress(ctx, ProgressEvent{Kind: "mini", Stage: "fetching"})
+	lastFetchTime := a.getLastFetchTime()
+	messages, err := a.Emails.Fetch(ctx, lastFetchTime)
+	if err != nil {
+		return fmt.Errorf("fetching emails: %w", err)
+	}
+	a.recordInboxCount(ctx)
+	if len(messages) == 0 {
+		logger.Info("No new messages, skipping mini digest")
+		reportProgress(ctx, ProgressEvent{Kind: "mini", Stage: "skipped"})
+		return nil
+	}
+	ctx, messages, triaged, err := a.triageNewEmails(ctx, messages, a.taskName("Mini digest"))
+	if err != nil {
+		return err
+	}
+
+	var digest *Digest
+	if len(triaged.digest) > 0 {
+		usageBefore := currentUsage()
+		digest, err = a.summarizeWithinBudget(ctx, "mini", triaged.digest)
+		if err != nil {
+			return fmt.Errorf("generating mini digest: %w", err)
+		}
+		digest.Usage = currentUsage().Sub(usageBefore)
+		digest.Title = "Since " + lastFetchTime.In(a.Location).Format("15:04")
+		if section := digest.section("unsummarized"); section != nil {
+			section.Intro += " They'll be in the daily summary."
+		}
+
+		reportProgress(ctx, ProgressEvent{Kind: "mini", Stage: "delivering", Done: len(messages), Total: len(messages)})
+		if err := a.postOrQueue(ctx, a.dailyChannel(), digest, nil, DigestExtras{}); err != nil {
+			return fmt.Errorf("sending mini digest to Discord: %w", err)
+		}
+		a.state.archiveDigest(digest)
+		if err := a.state.recordVolume(now, triaged.digest, digest.Categories); err != nil {
+			logger.Error("Unable to record email volume", "error", err)
+		}
+		a.checkVolumeAnomalies(ctx, false)
+	} else {
+		logger.Info("Every message was skipped or routed, no mini digest")
+	}
+
+	// like the daily summary, queue for the weekly summary and move the cursor in one write
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		account.WeeklyQueue = append(account.WeeklyQueue, triaged.kept...)
+		account.LastFetch = now
+		if digest != nil {
+			account.MiniDigests = append(account.MiniDigests, digest.ID)
+			// the emails the model gave up on wait for the daily summary
+			account.DeferredDigest = append(account.DeferredDigest, digest.Unsummarized...)
+		}
+	}); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+
+	reportProgress(ctx, ProgressEvent{Kind: "mini", Stage: "done", Done: len(messages), Total: len(messages)})
+	return nil
+}
+
+// summarizeDailyRollup writes the daily summary of a day with mini digests. the emails since the last one are
+// summarized like another mini digest, and the daily summary is written from all of them, the way a monthly rollup is
+// written from the daily digests. it's nil when the mini digests aren't in the archive anymore
+func (a *App) summarizeDailyRollup(ctx context.Context, messages []*gmail.Message, miniIDs []string) (*Digest, error) {
+	logger := log.FromContext(ctx)
+	now := a.Clock.Now()
+
+	var minis []*Digest
+	for _, id := range miniIDs {
+		if digest := a.state.findDigest(id); digest != nil {
+			minis = append(minis, digest)
+		}
+	}
+
+	usageBefore := currentUsage()
+	var last *Digest
+	if len(messages) > 0 {
+		var err error
+		last, err = a.summarizeWithinBudget(a.startDigest(ctx, oneOffDigestID(a.Profile, "mini", now)), "mini", messages)
+		if err != nil {
+			return nil, fmt.Errorf("generating the rest of the daily summary: %w", err)
+		}
+		minis = append(minis, last)
+		// the mini digests recorded their own emails
+		if err := a.state.recordVolume(now, messages, last.Categories); err != nil {
+			logger.Error("Unable to record email volume", "error", err)
+		}
+	}
+	if len(minis) == 0 {
+		logger.Warn("The day's mini digests aren't in the archive anymore, no daily summary")
+		return nil, nil
+	}
+
+	rollup := &Rollup{
+		Kind:       "daily",
+		From:       minis[0].GeneratedAt,
+		To:         now,
+		Digests:    minis,
+		Categories: make(map[string]int),
+	}
+	var entries []DigestEntry
+	var ids []string
+	for _, mini := range minis {
+		ids = append(ids, mini.MessageIDs...)
+		rollup.EmailCount += mini.EmailCount
+		for category, n := range mini.Categories {
+			rollup.Categories[category] += n
+		}
+		entries = append(entries, mini.Entries...)
+	}
+
+	reportProgress(ctx, ProgressEvent{Kind: "daily", Stage: "summarizing", Total: len(minis)})
+	digest, err := a.Summarizer.SummarizeRollup(ctx, rollup)
+	if err != nil {
+		return nil, fmt.Errorf("generating daily summary: %w", err)
+	}
+	digest.Usage = currentUsage().Sub(usageBefore)
+	// the entries are what the monthly rollup counts senders and action items from
+	digest.Entries = entries
+	digest.MessageIDs = ids
+	if last != nil {
+		digest.Unsummarized = last.Unsummarized
+		digest.addSection(unsummarizedSection(digest.Unsummarized))
+		a.holdRemainder(ctx, digest, a.dailyChannel(), digest.ID, 2)
+	}
+	return digest, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// newHTTPClient builds the client that OpenAI and Gmail requests go through. proxy is an http, https or socks5 url; when
+// it's empty, the usual HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment variables apply. timeout is a duration like "2m",
+// empty for none
+func newHTTPClient(proxy, timeout string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid proxy url %q, the scheme must be http, https or socks5", proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	client := &http.Client{Transport: transport}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request timeout: %w", err)
+		}
+		client.Timeout = d
+	}
+	return client, nil
+}
+
+// oauthContext makes the OAuth token exchanges and refreshes, and the Gmail client built on them, use the app's client
+func (a *App) oauthContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, a.httpClient)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// archiveNewslettersPrefix starts the custom id of the button under a daily digest that archives its newsletters,
+// followed by the digest's id
+const archiveNewslettersPrefix = "newsletters:"
+
+const (
+	// maxNewsletterBatches is how many digests' newsletters are kept for their buttons. an older button says it expired
+	maxNewsletterBatches = 7
+	// maxBatchModify is the most message ids one Gmail batchModify call takes
+	maxBatchModify = 1000
+)
+
+type NewslettersConfig struct {
+	// Categories are the Gmail inbox tabs that count as newsletters, promotions by default
+	Categories []string `json:"categories"`
+	// Label is a Gmail label name added to the newsletters as they're archived, none when empty
+	Label string `json:"label"`
+	// MarkRead marks them read too
+	MarkRead bool `json:"mark_read"`
+}
+
+// NewsletterBatch are the newsletters a daily digest covered, for its archive button
+type NewsletterBatch struct {
+	DigestID   string   `json:"digest_id"`
+	MessageIDs []string `json:"message_ids"`
+}
+
+// newsletterIDs are the ids of the emails in the newsletter categories
+func (c *NewslettersConfig) newsletterIDs(messages []*gmail.Message) []string {
+	categories := c.Categories
+	if len(categories) == 0 {
+		categories = []string{"promotions"}
+	}
+	var ids []string
+	for _, emails := range trivialEmails(messages, categories) {
+		for _, message := range emails {
+			ids = append(ids, message.Id)
+		}
+	}
+	if len(ids) > maxBatchModify {
+		ids = ids[:maxBatchModify]
+	}
+	return ids
+}
+
+// sendNewsletterButton follows a daily digest with a button that archives all of its newsletters at once. there's no
+// button without gmail_access.archive, or when the digest had no newsletters
+func (a *App) sendNewsletterButton(channelID, digestID string, messages []*gmail.Message) error {
+	config := a.Config.Newsletters
+	if config == nil || a.Config.GmailAccess == nil || !a.Config.GmailAccess.Archive || !a.canModify() {
+		return nil
+	}
+	ids := config.newsletterIDs(messages)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		account.NewsletterBatches = append(account.NewsletterBatches, NewsletterBatch{DigestID: digestID, MessageIDs: ids})
+		if len(account.NewsletterBatches) > maxNewsletterBatches {
+			account.NewsletterBatches = account.NewsletterBatches[len(account.NewsletterBatches)-maxNewsletterBatches:]
+		}
+	}); err != nil {
+		return fmt.Errorf("remembering the digest's newsletters: %w", err)
+	}
+
+	if _, err := a.Discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("📰 This digest covered %s.", pluralize(len(ids), "newsletter")),
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Label:    fmt.Sprintf("Archive all %s", pluralize(len(ids), "newsletter")),
+				Style:    discordgo.SecondaryButton,
+				CustomID: archiveNewslettersPrefix + digestID,
+			},
+		}}},
+	}); err != nil {
+		return fmt.Errorf("sending newsletter button: %w", err)
+	}
+	return nil
+}
+
+// handleArchiveNewsletters archives the newsletters of a digest in one batchModify call, and takes the button off
+func (a *App) handleArchiveNewsletters(i *discordgo.InteractionCreate, digestID string) {
+	ctx := withTaskRun(context.Background(), "archive newsletters")
+	logger := log.FromContext(ctx)
+
+	if err := a.Discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	}); err != nil {
+		logger.Error("Failed to acknowledge newsletter button", "error", err)
+		return
+	}
+
+	var ids []string
+	a.state.read(func(s *State) {
+		for _, batch := range s.account().NewsletterBatches {
+			if batch.DigestID == digestID {
+				ids = batch.MessageIDs
+			}
+		}
+	})
+
+	content := i.Message.Content
+	components := []discordgo.MessageComponent{}
+	if ids == nil {
+		content += "\n*These newsletters were archived already, or the button expired.*"
+	} else if err := a.archiveNewsletters(ctx, ids); err != nil {
+		logger.Error("Failed to archive newsletters", "error", err)
+		recordTaskError(a.taskName("archive newsletters"), err)
+		content += "\n*Sorry, that failed: " + err.Error() + "*"
+		// the button stays, to try again
+		components = i.Message.Components
+	} else {
+		logger.Info("Archived newsletters", "digest_id", digestID, "count", len(ids))
+		content += fmt.Sprintf("\n*Archived by %s.*", interactionUserMention(i))
+		if err := a.state.update(func(s *State) {
+			account := s.account()
+			for n, batch := range account.NewsletterBatches {
+				if batch.DigestID == digestID {
+					account.NewsletterBatches = append(account.NewsletterBatches[:n], account.NewsletterBatches[n+1:]...)
+					break
+				}
+			}
+		}); err != nil {
+			logger.Error("Unable to forget the archived newsletters", "error", err)
+		}
+	}
+
+	if _, err := a.Discord.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content, Components: &components}); err != nil {
+		logger.Error("Failed to update newsletter button", "error", err)
+	}
+}
+
+// archiveNewsletters takes the emails out of the inbox, adding the configured label and marking them read if asked to
+func (a *App) archiveNewsletters(ctx context.Context, ids []string) error {
+	config := a.Config.Newsletters
+	request := &gmail.BatchModifyMessagesRequest{Ids: ids, RemoveLabelIds: []string{"INBOX"}}
+	if config.MarkRead {
+		request.RemoveLabelIds = append(request.RemoveLabelIds, "UNREAD")
+	}
+	if config.Label != "" {
+		if !a.Config.GmailAccess.Label {
+			return fmt.Errorf("adding the %q label needs gmail_access.label", config.Label)
+		}
+		labels, err := a.Emails.Labels(ctx)
+		if err != nil {
+			return fmt.Errorf("listing labels: %w", err)
+		}
+		var labelID string
+		for id, name := range labels {
+			if strings.EqualFold(name, config.Label) || id == config.Label {
+				labelID = id
+				break
+			}
+		}
+		if labelID == "" {
+			return fmt.Errorf("there's no Gmail label named %q", config.Label)
+		}
+		request.AddLabelIds = []string{labelID}
+	}
+	return a.Emails.Modify(ctx, request)
+}
+
+func batchModifyEmails(ctx context.Context, client *http.Client, request *gmail.BatchModifyMessagesRequest) error {
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return fmt.Errorf("unable to retrieve Gmail client: %v", err)
+	}
+
+	if err := srv.Users.Messages.BatchModify("me", request).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to modify messages: %w", err)
+	}
+	return nil
+}
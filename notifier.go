@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+
+	"github.com/charmbracelet/log"
+)
+
+// Notifier delivers a finished digest somewhere other than the main Discord channels
+type Notifier interface {
+	Name() string
+	Notify(digest *Digest) error
+}
+
+func (a *App) setupNotifiers() {
+	config := a.Config
+
+	for _, webhook := range config.Webhooks {
+		a.Notifiers = append(a.Notifiers, newWebhookNotifier(webhook, a.Clock))
+	}
+
+	if config.Mattermost != nil {
+		a.Notifiers = append(a.Notifiers, newMattermostNotifier(*config.Mattermost))
+	}
+
+	if config.Teams != nil {
+		a.Notifiers = append(a.Notifiers, newTeamsNotifier(*config.Teams))
+	}
+
+	if config.Twilio != nil {
+		a.smsAlerts = newSMSNotifier(a, *config.Twilio)
+		a.Notifiers = append(a.Notifiers, a.smsAlerts)
+	}
+
+	if config.Todoist != nil {
+		a.Notifiers = append(a.Notifiers, &todoNotifier{provider: newTodoistProvider(*config.Todoist)})
+	}
+
+	if config.TTS != nil {
+		a.Notifiers = append(a.Notifiers, &audioNotifier{app: a, channelID: config.TTS.ChannelID, provider: newOpenAISpeechProvider(a.openAI, *config.TTS)})
+	}
+
+	log.Info("Notifiers initialized", "count", len(a.Notifiers))
+}
+
+// notifyAll fans the digest out to every configured notifier. failures are logged rather than returned,
+// since the digest has already been delivered to Discord by the time this runs
+func (a *App) notifyAll(ctx context.Context, digest *Digest) {
+	logger := log.FromContext(ctx)
+	for _, n := range a.Notifiers {
+		if err := n.Notify(a.filterForNotifier(n, digest)); err != nil {
+			logger.Error("Notifier failed", "notifier", n.Name(), "error", err)
+		} else {
+			logger.Info("Notifier delivered digest", "notifier", n.Name(), "kind", digest.Kind)
+		}
+	}
+}
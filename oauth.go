@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/oauth2"
+)
+
+// loopbackAuthTimeout is how long the loopback flow waits for the browser to come back
+const loopbackAuthTimeout = 5 * time.Minute
+
+// oauthFlow picks how a new token is obtained: "discord" posts the auth url to the debug channel, "loopback" opens
+// a browser and catches the redirect on localhost, "paste" asks for the code on the terminal
+func (a *App) oauthFlow() string {
+	if a.Config.OAuthFlow != "" {
+		return a.Config.OAuthFlow
+	}
+	if a.Discord != nil && a.oauthChannel() != "" {
+		return "discord"
+	}
+	return "loopback"
+}
+
+// getTokenFromLoopback runs the installed-app loopback flow: it listens on a random localhost port, sends the browser
+// to the consent screen with that port as the redirect uri, and takes the code from the redirect
+func getTokenFromLoopback(ctx context.Context, oauthConfig *oauth2.Config) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("starting OAuth callback listener: %w", err)
+	}
+	defer listener.Close()
+
+	stateBytes := make([]byte, 16)
+	if _, err := rand.Read(stateBytes); err != nil {
+		return nil, fmt.Errorf("generating OAuth state: %w", err)
+	}
+	state := hex.EncodeToString(stateBytes)
+
+	// copy so the redirect uri doesn't leak into the shared config used for refreshing
+	loopbackConfig := *oauthConfig
+	loopbackConfig.RedirectURL = "http://" + listener.Addr().String() + "/"
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+
+	server := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			if query.Get("state") != state {
+				http.Error(w, "state mismatch", http.StatusBadRequest)
+				return
+			}
+
+			var res result
+			if e := query.Get("error"); e != "" {
+				res.err = fmt.Errorf("authorization denied: %s", e)
+				fmt.Fprintln(w, "Authorization failed, you can close this tab.")
+			} else if code := query.Get("code"); code == "" {
+				res.err = errors.New("no authorization code in callback")
+				fmt.Fprintln(w, "Authorization failed, you can close this tab.")
+			} else {
+				res.code = code
+				fmt.Fprintln(w, "reads_ur_emails is authorized, you can close this tab.")
+			}
+
+			select {
+			case results <- res:
+			default:
+			}
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("OAuth callback server error", "error", err)
+		}
+	}()
+	defer server.Close()
+
+	authURL := loopbackConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	fmt.Printf("Authorize this app in your browser. If it doesn't open, visit:\n%s\n", authURL)
+	if err := openBrowser(authURL); err != nil {
+		log.Warn("Unable to open browser", "error", err)
+	}
+
+	log.Info("Waiting for OAuth callback...", "redirect", loopbackConfig.RedirectURL)
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(loopbackAuthTimeout):
+		return nil, fmt.Errorf("timed out after %s waiting for authorization", loopbackAuthTimeout)
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	tok, err := loopbackConfig.Exchange(ctx, res.code)
+	if err != nil {
+		return nil, fmt.Errorf("exchanging authorization code: %w", err)
+	}
+	return tok, nil
+}
+
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// testingModeTokenLifetime is how long Google keeps refresh tokens alive for apps whose consent screen is still in
+// testing mode
+const testingModeTokenLifetime = 7 * 24 * time.Hour
+
+// tokenReauthMargin is how close to expiry the refresh task starts the re-auth flow by itself. the task runs hourly,
+// so this has to be comfortably more than an hour
+const tokenReauthMargin = 3 * time.Hour
+
+// isInvalidGrant reports whether err is Google refusing the refresh token, which only a new consent can fix
+func isInvalidGrant(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant"
+}
+
+// reauthTimeout is how long a re-authorization waits for the user. the next token check asks again after that
+const reauthTimeout = 12 * time.Hour
+
+// errReauthorizing is what the Gmail calls fail with while a new consent is being waited for
+var errReauthorizing = errors.New("gmail is waiting to be authorized again")
+
+// reauthorize runs the configured OAuth flow to get a new token in the background, so the Gmail tasks waiting on the
+// token's group aren't held up while the user gets to it. the saved token is kept, and used, until the new one
+// replaces it. a re-authorization already under way isn't started twice
+func (a *App) reauthorize(reason string) {
+	if !a.reauthorizing.CompareAndSwap(false, true) {
+		log.Info("Gmail is already waiting to be authorized again", "reason", reason)
+		return
+	}
+	log.Warn("Gmail needs to be authorized again", "reason", reason)
+	a.alertTokenHealth(fmt.Sprintf("reads_ur_emails: Gmail authorization needs renewing (%s).", reason))
+
+	go func() {
+		defer a.reauthorizing.Store(false)
+		ctx, cancel := context.WithTimeout(a.oauthContext(context.Background()), reauthTimeout)
+		defer cancel()
+
+		config, err := loadOAuthConfig(a.gmailScopes()...)
+		if err == nil {
+			_, err = a.obtainToken(ctx, config)
+		}
+		if err != nil {
+			log.Error("Unable to authorize Gmail again", "error", err)
+			return
+		}
+		log.Info("Gmail is authorized again")
+	}()
+}
+
+// checkTokenExpiry warns ahead of a testing-mode refresh token dying, and renews it shortly before it does
+func (a *App) checkTokenExpiry() error {
+	if !a.Config.OAuthTestingMode {
+		return nil
+	}
+
+	var issuedAt time.Time
+	var warned bool
+	a.state.read(func(s *State) {
+		issuedAt, warned = s.account().TokenIssuedAt, s.account().TokenExpiryWarned
+	})
+	if issuedAt.IsZero() {
+		log.Warn("Refresh token age is unknown, its expiry can't be tracked until Gmail is authorized again")
+		return nil
+	}
+
+	expires := issuedAt.Add(testingModeTokenLifetime)
+	remaining := expires.Sub(a.Clock.Now())
+	log.Info("Refresh token expiry", "expires", expires, "remaining", remaining.Round(time.Minute))
+
+	if remaining < tokenReauthMargin {
+		a.reauthorize(fmt.Sprintf("the refresh token expires at %s", expires.Format("Mon 2 Jan 15:04")))
+		return nil
+	}
+
+	warningDays := a.Config.OAuthExpiryWarningDays
+	if warningDays <= 0 {
+		warningDays = 1
+	}
+	if !warned && remaining < time.Duration(warningDays)*24*time.Hour {
+		a.alertTokenHealth(fmt.Sprintf("reads_ur_emails: Gmail authorization expires %s. It will be renewed automatically a few hours before, or run `auth --force` to do it now.", expires.Format("Mon 2 Jan 15:04")))
+		if err := a.state.update(func(s *State) {
+			s.account().TokenExpiryWarned = true
+		}); err != nil {
+			return fmt.Errorf("saving token warning: %w", err)
+		}
+	}
+	return nil
+}
+
+// alertTokenHealth tells the user about the token on the OAuth debug channel and by SMS, whichever are set up
+func (a *App) alertTokenHealth(message string) {
+	if a.Discord != nil && a.oauthChannel() != "" {
+		if err := a.sendToDiscord(a.oauthChannel(), message); err != nil {
+			log.Error("Failed to send token alert to Discord", "error", err)
+		}
+	}
+	a.sendSMSAlert(message)
+}
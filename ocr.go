@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// defaultOCRMinTextLength is how short a body has to be for the email to count as image-only
+	defaultOCRMinTextLength = 50
+	// defaultOCRMaxImages caps the images recognized per email, newsletters can carry dozens
+	defaultOCRMaxImages = 3
+	// minOCRImageSize skips tracking pixels, spacers and logos, which have nothing worth reading
+	minOCRImageSize = 2 << 10
+)
+
+// OCRProvider reads the text in an image
+type OCRProvider interface {
+	Name() string
+	Recognize(ctx context.Context, image []byte, mimeType string) (string, error)
+}
+
+type OCRConfig struct {
+	Engine        string `json:"engine"`
+	TesseractPath string `json:"tesseract_path"`
+	Languages     string `json:"languages"`
+	Model         string `json:"model"`
+	MinTextLength int    `json:"min_text_length"`
+	MaxImages     int    `json:"max_images"`
+}
+
+func newOCRProvider(client *openai.Client, config OCRConfig) (OCRProvider, error) {
+	switch config.Engine {
+	case "", "tesseract":
+		p := &tesseractOCRProvider{path: "tesseract", languages: config.Languages}
+		if config.TesseractPath != "" {
+			p.path = config.TesseractPath
+		}
+		if _, err := exec.LookPath(p.path); err != nil {
+			return nil, fmt.Errorf("tesseract not found: %w", err)
+		}
+		return p, nil
+	case "openai":
+		p := &openAIOCRProvider{client: client, model: openai.GPT4o}
+		if config.Model != "" {
+			p.model = config.Model
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown OCR engine %q, expected tesseract or openai", config.Engine)
+	}
+}
+
+// tesseractOCRProvider runs a local tesseract, so the images never leave the machine
+type tesseractOCRProvider struct {
+	path      string
+	languages string
+}
+
+func (p *tesseractOCRProvider) Name() string {
+	return "tesseract"
+}
+
+func (p *tesseractOCRProvider) Recognize(ctx context.Context, image []byte, mimeType string) (string, error) {
+	args := []string{"stdin", "stdout"}
+	if p.languages != "" {
+		args = append(args, "-l", p.languages)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.path, args...)
+	cmd.Stdin = bytes.NewReader(image)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("running tesseract: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// openAIOCRProvider asks a vision model to transcribe the image
+type openAIOCRProvider struct {
+	client *openai.Client
+	model  string
+}
+
+func (p *openAIOCRProvider) Name() string {
+	return "openai"
+}
+
+func (p *openAIOCRProvider) Recognize(ctx context.Context, image []byte, mimeType string) (string, error) {
+	resp, err := p.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: p.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role: openai.ChatMessageRoleUser,
+				MultiContent: []openai.ChatMessagePart{
+					{
+						Type: openai.ChatMessagePartTypeText,
+						Text: "Transcribe all the text in this image, keeping its reading order. Reply with the text only, or nothing if there is none.",
+					},
+					{
+						Type: openai.ChatMessagePartTypeImageURL,
+						ImageURL: &openai.ChatMessageImageURL{
+							URL:    imageDataURL(mimeType, image),
+							Detail: openai.ImageURLDetailHigh,
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("ChatCompletion error: %v", err)
+	}
+	recordUsage(resp.Usage)
+	if len(resp.Choices) == 0 {
+		return "", errors.New("ChatCompletion returned no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// recognizeImageOnlyEmails reads the images of emails that have next to no text, like scanned letters, and adds what
+// it finds to the email as a text/plain part. the rest of the pipeline, the weekly queue included, then sees it as the
+// email's body
+func (a *App) recognizeImageOnlyEmails(ctx context.Context, messages []*gmail.Message) {
+	if a.ocr == nil {
+		return
+	}
+	logger := log.FromContext(ctx)
+
+	minTextLength, maxImages := defaultOCRMinTextLength, defaultOCRMaxImages
+	if a.Config.OCR.MinTextLength > 0 {
+		minTextLength = a.Config.OCR.MinTextLength
+	}
+	if a.Config.OCR.MaxImages > 0 {
+		maxImages = a.Config.OCR.MaxImages
+	}
+
+	for _, message := range messages {
+		if message.Payload == nil || len(strings.TrimSpace(extractBody(message))) >= minTextLength {
+			continue
+		}
+		images := imageParts(message.Payload)
+		if len(images) > maxImages {
+			images = images[:maxImages]
+		}
+
+		var texts []string
+		for _, part := range images {
+			image, err := a.partData(ctx, message.Id, part)
+			if err != nil {
+				logger.Error("Failed to read image", "message_id", message.Id, "filename", part.Filename, "error", err)
+				continue
+			}
+			text, err := a.ocr.Recognize(ctx, image, part.MimeType)
+			if err != nil {
+				logger.Error("Failed to recognize image text", "message_id", message.Id, "ocr", a.ocr.Name(), "error", err)
+				continue
+			}
+			if text = strings.TrimSpace(text); text != "" {
+				texts = append(texts, text)
+			}
+		}
+		if len(texts) == 0 {
+			continue
+		}
+
+		logger.Info("Recognized text in image-only email", "message_id", message.Id, "images", len(texts))
+		addTextPart(message, "[Text recognized in the email's images]\n"+strings.Join(texts, "\n\n"))
+	}
+}
+
+// imageParts lists the image parts of an email, at any depth, that are big enough to be worth reading
+func imageParts(part *gmail.MessagePart) []*gmail.MessagePart {
+	var images []*gmail.MessagePart
+	if strings.HasPrefix(part.MimeType, "image/") && part.Body != nil && part.Body.Size >= minOCRImageSize {
+		images = append(images, part)
+	}
+	for _, child := range part.Parts {
+		images = append(images, imageParts(child)...)
+	}
+	return images
+}
+
+// partData returns the decoded content of a part, downloading it when Gmail left it out of the message
+func (a *App) partData(ctx context.Context, messageID string, part *gmail.MessagePart) ([]byte, error) {
+	if part.Body.Data != "" {
+		return base64.URLEncoding.DecodeString(part.Body.Data)
+	}
+	return a.Emails.Attachment(ctx, messageID, part.Body.AttachmentId)
+}
+
+// addTextPart appends text to the email as a top-level text/plain part, where extractBody looks for it
+func addTextPart(message *gmail.Message, text string) {
+	if len(message.Payload.Parts) == 0 && message.Payload.Body != nil && message.Payload.Body.Data != "" {
+		// a single-part email keeps its body in the payload, which extractBody only reads when no part has text
+		message.Payload.Parts = append(message.Payload.Parts, &gmail.MessagePart{
+			MimeType: message.Payload.MimeType,
+			Body:     &gmail.MessagePartBody{Data: message.Payload.Body.Data},
+		})
+	}
+	message.Payload.Parts = append(message.Payload.Parts, &gmail.MessagePart{
+		MimeType: "text/plain",
+		Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(text))},
+	})
+}
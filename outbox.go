@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// outboxInterval is how often the outbox is checked for digests due another try
+	outboxInterval = time.Minute
+	// firstRetryDelay doubles with every failed try, up to maxRetryDelay
+	firstRetryDelay = time.Minute
+	maxRetryDelay   = time.Hour
+	// maxOutboxAge is how long a digest is retried before it's given up on. by then the next one is out anyway
+	maxOutboxAge = 48 * time.Hour
+)
+
+// OutboxEntry is a digest Discord wouldn't take, waiting to be tried again
+type OutboxEntry struct {
+	Digest    *Digest                     `json:"digest"`
+	ChannelID string                      `json:"channel_id"`
+	Reference *discordgo.MessageReference `json:"reference,omitempty"`
+	QueuedAt  time.Time                   `json:"queued_at"`
+	Attempts  int                         `json:"attempts"`
+	NextTry   time.Time                   `json:"next_try"`
+	LastError string                      `json:"last_error"`
+	// Sent are the ids of the digest's messages that did get posted, in order, so the next try picks up after them
+	Sent []string `json:"sent,omitempty"`
+}
+
+// DigestExtras are what goes under a digest once it's posted, besides the digest itself. a digest held for approval
+// keeps them, so they still follow it once it's approved
+type DigestExtras struct {
+	// Emails are the emails of a daily digest, for its feedback menus and newsletter button
+	Emails []*gmail.Message `json:"emails,omitempty"`
+	// VolumeStats are the week's numbers behind a weekly digest's chart
+	VolumeStats *VolumeStats `json:"volume_stats,omitempty"`
+}
+
+// postOrQueue posts a digest with everything that follows it, or puts it in the outbox when Discord won't take it so
+// a Discord outage at the scheduled minute doesn't lose the digest. a queued digest goes out on its own later, without
+// what follows it, but the notifiers get it straight away, so it still reaches them while Discord is down. a digest
+// that needs approval is held back instead, and what follows it waits with it
+func (a *App) postOrQueue(ctx context.Context, channelID string, digest *Digest, reference *discordgo.MessageReference, extras DigestExtras) error {
+	if a.needsApproval(digest.Kind) {
+		return a.holdForApproval(ctx, channelID, digest, reference, extras)
+	}
+	posted, err := a.deliverOrQueue(ctx, channelID, digest, reference)
+	if err != nil || posted == nil {
+		return err
+	}
+	a.afterPosting(ctx, channelID, digest, posted, extras)
+	return nil
+}
+
+// afterPosting is what follows a digest once it's posted in channelID, whether straight away or once approved: for a
+// daily digest the feedback menus, the "Waiting on" section, the category posts and the newsletter button, the chart
+// under a weekly one, and the notifiers for every kind
+func (a *App) afterPosting(ctx context.Context, channelID string, digest *Digest, posted *discordgo.Message, extras DigestExtras) {
+	logger := log.FromContext(ctx)
+	switch digest.Kind {
+	case "daily":
+		if channelID == a.dailyChannel() {
+			if err := a.recordDailyPost(posted); err != nil {
+				logger.Error("Unable to remember the daily digest message", "error", err)
+			}
+		}
+		if a.Config.SenderFeedback {
+			if err := a.sendFeedbackMenus(channelID, digest.ID, extras.Emails); err != nil {
+				logger.Error("Unable to send feedback menus", "error", err)
+			}
+		}
+		if len(digest.WaitingOn) > 0 {
+			if err := a.sendWaitingOn(channelID, digest.WaitingOn); err != nil {
+				logger.Error("Unable to send waiting on section", "error", err)
+			}
+		}
+		a.routeCategories(digest)
+		if err := a.sendNewsletterButton(channelID, digest.ID, extras.Emails); err != nil {
+			logger.Error("Unable to send newsletter button", "error", err)
+		}
+	case "weekly":
+		if extras.VolumeStats != nil {
+			a.sendVolumeChart(ctx, channelID, *extras.VolumeStats)
+		}
+	}
+	recordDigestSent(digest.Kind)
+	a.notifyAll(ctx, digest)
+}
+
+// deliverOrQueue is postOrQueue without the approval, for the digests that have it
+func (a *App) deliverOrQueue(ctx context.Context, channelID string, digest *Digest, reference *discordgo.MessageReference) (*discordgo.Message, error) {
+	sent, err := a.resumeDigest(channelID, digest, reference, nil)
+	if err == nil {
+		if err := a.state.markDelivered(digest.ID, a.Clock.Now()); err != nil {
+			log.FromContext(ctx).Error("Unable to record the digest as delivered", "digest_id", digest.ID, "error", err)
+		}
+		return firstMessage(channelID, sent), nil
+	}
+	logger := log.FromContext(ctx)
+	logger.Error("Unable to send digest to Discord, queueing it to retry", "kind", digest.Kind, "channel_id", channelID, "posted", len(sent), "error", err)
+	recordTaskError(a.taskName("Delivery"), err)
+
+	now := a.Clock.Now()
+	entry := OutboxEntry{
+		Digest:    digest,
+		ChannelID: channelID,
+		Reference: reference,
+		QueuedAt:  now,
+		Attempts:  1,
+		NextTry:   now.Add(firstRetryDelay),
+		LastError: err.Error(),
+		Sent:      sent,
+	}
+	if err := a.outbox.put(ctx, entry); err != nil {
+		return nil, fmt.Errorf("queueing the digest: %w", err)
+	}
+	a.notifyAll(ctx, digest)
+	return nil, nil
+}
+
+// retryOutbox tries the queued digests that are due again, backing off after each failure
+func (a *App) retryOutbox(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	now := a.Clock.Now()
+
+	queued, err := a.outbox.list(ctx)
+	if err != nil {
+		return fmt.Errorf("reading the outbox: %w", err)
+	}
+	var due []OutboxEntry
+	for _, entry := range queued {
+		if !entry.NextTry.After(now) {
+			due = append(due, entry)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	var done []string
+	var retries []OutboxEntry
+	for _, entry := range due {
+		if a.state.delivered(entry.Digest.ID) {
+			logger.Info("Queued digest was delivered already, dropping it", "digest_id", entry.Digest.ID)
+			done = append(done, entry.Digest.ID)
+			continue
+		}
+		release, ok := a.leaseOutboxEntry(ctx, entry)
+		if !ok {
+			logger.Info("Another replica is trying the queued digest", "digest_id", entry.Digest.ID)
+			continue
+		}
+		// the lease is held until the try is recorded below
+		defer release()
+		sent, err := a.resumeDigest(entry.ChannelID, entry.Digest, entry.Reference, entry.Sent)
+		if err != nil {
+			logger.Warn("Digest still can't be sent to Discord", "kind", entry.Digest.Kind, "digest_id", entry.Digest.ID, "attempts", entry.Attempts+1, "posted", len(sent), "error", err)
+			if now.Sub(entry.QueuedAt) >= maxOutboxAge {
+				logger.Error("Giving up on a digest Discord wouldn't take", "kind", entry.Digest.Kind, "digest_id", entry.Digest.ID, "attempts", entry.Attempts+1, "error", err)
+				// half a digest is worse than none
+				a.deleteMessages(entry.ChannelID, sent)
+				done = append(done, entry.Digest.ID)
+				continue
+			}
+			entry.Sent = sent
+			entry.Attempts++
+			entry.LastError = err.Error()
+			entry.NextTry = now.Add(retryDelay(entry.Attempts))
+			retries = append(retries, entry)
+			continue
+		}
+		posted := firstMessage(entry.ChannelID, sent)
+		done = append(done, entry.Digest.ID)
+		logger.Info("Queued digest sent", "kind", entry.Digest.Kind, "digest_id", entry.Digest.ID, "late_by", now.Sub(entry.QueuedAt).Round(time.Second))
+		recordDigestSent(entry.Digest.Kind)
+		if err := a.state.markDelivered(entry.Digest.ID, now); err != nil {
+			logger.Error("Unable to record the digest as delivered", "digest_id", entry.Digest.ID, "error", err)
+		}
+		if entry.Digest.Kind == "daily" && entry.ChannelID == a.dailyChannel() {
+			if err := a.recordDailyPost(posted); err != nil {
+				logger.Error("Unable to remember the daily digest message", "error", err)
+			}
+		}
+	}
+
+	for _, entry := range retries {
+		if err := a.outbox.put(ctx, entry); err != nil {
+			return fmt.Errorf("requeueing the digest: %w", err)
+		}
+	}
+	if len(done) == 0 {
+		return nil
+	}
+	return a.outbox.remove(ctx, done...)
+}
+
+// retryDelay is how long to wait after a digest failed to send attempts times
+func retryDelay(attempts int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// outboxStore is where the outbox is kept: in the state, or in Redis when replicas share it, so whichever replica is
+// up retries the digests any of them queued
+type outboxStore interface {
+	// list is the queued digests, oldest first
+	list(ctx context.Context) ([]OutboxEntry, error)
+	// get is the queued digest with this id, nil when it isn't queued
+	get(ctx context.Context, id string) (*OutboxEntry, error)
+	// put queues entry, in place of the digest's earlier entry if it has one
+	put(ctx context.Context, entry OutboxEntry) error
+	// remove takes the digests with these ids out of the outbox
+	remove(ctx context.Context, ids ...string) error
+}
+
+// newOutboxStore is the outbox in Redis when it's configured, and in the state otherwise
+func newOutboxStore(state *stateStore, redis *redisClient) outboxStore {
+	if redis != nil {
+		return redisOutbox{redis: redis}
+	}
+	return stateOutbox{state: state}
+}
+
+type stateOutbox struct {
+	state *stateStore
+}
+
+func (o stateOutbox) list(context.Context) ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+	o.state.read(func(s *State) {
+		entries = append(entries, s.account().Outbox...)
+	})
+	return entries, nil
+}
+
+func (o stateOutbox) get(_ context.Context, id string) (*OutboxEntry, error) {
+	var entry *OutboxEntry
+	o.state.read(func(s *State) {
+		account := s.account()
+		if i := slices.IndexFunc(account.Outbox, func(queued OutboxEntry) bool { return queued.Digest.ID == id }); i >= 0 {
+			queued := account.Outbox[i]
+			entry = &queued
+		}
+	})
+	return entry, nil
+}
+
+func (o stateOutbox) put(_ context.Context, entry OutboxEntry) error {
+	return o.state.update(func(s *State) {
+		account := s.account()
+		if i := slices.IndexFunc(account.Outbox, func(queued OutboxEntry) bool { return queued.Digest.ID == entry.Digest.ID }); i >= 0 {
+			account.Outbox[i] = entry
+			return
+		}
+		account.Outbox = append(account.Outbox, entry)
+	})
+}
+
+func (o stateOutbox) remove(_ context.Context, ids ...string) error {
+	return o.state.update(func(s *State) {
+		account := s.account()
+		account.Outbox = slices.DeleteFunc(account.Outbox, func(queued OutboxEntry) bool {
+			return slices.Contains(ids, queued.Digest.ID)
+		})
+	})
+}
+
+// redisOutbox keeps the outbox in a hash of the entries by digest id, encrypted when a passphrase is configured
+type redisOutbox struct {
+	redis *redisClient
+}
+
+func (o redisOutbox) list(ctx context.Context) ([]OutboxEntry, error) {
+	values, err := o.redis.hvals(ctx, o.redis.key("outbox"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]OutboxEntry, 0, len(values))
+	for _, value := range values {
+		entry, err := parseRedisOutboxEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	slices.SortFunc(entries, func(x, y OutboxEntry) int { return x.QueuedAt.Compare(y.QueuedAt) })
+	return entries, nil
+}
+
+func (o redisOutbox) get(ctx context.Context, id string) (*OutboxEntry, error) {
+	value, err := o.redis.hget(ctx, o.redis.key("outbox"), id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return parseRedisOutboxEntry(value)
+}
+
+func parseRedisOutboxEntry(value []byte) (*OutboxEntry, error) {
+	data, err := openState("the redis outbox", value)
+	if err != nil {
+		return nil, err
+	}
+	var entry OutboxEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("parsing the redis outbox: %w", err)
+	}
+	return &entry, nil
+}
+
+func (o redisOutbox) put(ctx context.Context, entry OutboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if data, err = sealState(data); err != nil {
+		return err
+	}
+	return o.redis.hset(ctx, o.redis.key("outbox"), entry.Digest.ID, data)
+}
+
+func (o redisOutbox) remove(ctx context.Context, ids ...string) error {
+	return o.redis.hdel(ctx, o.redis.key("outbox"), ids...)
+}
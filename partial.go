@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// remainderInterval is how often the emails a digest couldn't summarize are checked for a follow-up that's due
+	remainderInterval = 5 * time.Minute
+	// firstRemainderDelay gives the model a moment to recover before the follow-up, and doubles with every failure
+	firstRemainderDelay = 15 * time.Minute
+	// maxRemainderAttempts is how many follow-ups can fail before the emails go to the next daily digest instead
+	maxRemainderAttempts = 4
+	// maxUnsummarizedLines is how many of the emails the trailer names
+	maxUnsummarizedLines = 5
+)
+
+// DigestRemainder are the emails a digest couldn't summarize, waiting for the follow-up digest that covers them
+type DigestRemainder struct {
+	// DigestID is the digest they were left out of. the follow-ups are its parts 2, 3 and so on
+	DigestID  string           `json:"digest_id"`
+	Kind      string           `json:"kind"`
+	ChannelID string           `json:"channel_id"`
+	Part      int              `json:"part"`
+	Emails    []*gmail.Message `json:"emails"`
+	Attempts  int              `json:"attempts"`
+	NextTry   time.Time        `json:"next_try"`
+}
+
+// unsummarizedSection is the trailer of a digest the model gave up on partway through, naming the emails it left out
+func unsummarizedSection(messages []*gmail.Message) *DigestSection {
+	if len(messages) == 0 {
+		return nil
+	}
+	section := &DigestSection{
+		Key:   "unsummarized",
+		Title: "⚠️ Not summarized",
+		Intro: fmt.Sprintf("%s could not be summarized.", pluralize(len(messages), "email")),
+	}
+	for _, message := range messages[:min(len(messages), maxUnsummarizedLines)] {
+		section.Lines = append(section.Lines, fmt.Sprintf("**%s**: %s", senderName(extractHeader(message, "From")), extractHeader(message, "Subject")))
+	}
+	if more := len(messages) - maxUnsummarizedLines; more > 0 {
+		section.Lines = append(section.Lines, fmt.Sprintf("…and %d more", more))
+	}
+	return section
+}
+
+// holdRemainder keeps the emails the digest couldn't summarize for a follow-up digest in the same channel, and says so
+// in the digest's trailer. part is the part of digestID the follow-up will be, 2 for the first
+func (a *App) holdRemainder(ctx context.Context, digest *Digest, channelID, digestID string, part int) {
+	if len(digest.Unsummarized) == 0 {
+		return
+	}
+	remainder := DigestRemainder{
+		DigestID:  digestID,
+		Kind:      digest.Kind,
+		ChannelID: channelID,
+		Part:      part,
+		Emails:    digest.Unsummarized,
+		NextTry:   a.Clock.Now().Add(firstRemainderDelay),
+	}
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		account.Remainders = append(account.Remainders, remainder)
+	}); err != nil {
+		// they're in the trailer at least, and the next digest won't see them either way
+		log.FromContext(ctx).Error("Unable to keep the emails that weren't summarized for a follow-up", "digest_id", digest.ID, "emails", len(digest.Unsummarized), "error", err)
+		return
+	}
+	if section := digest.section("unsummarized"); section != nil {
+		section.Intro += " They'll follow in a separate digest."
+	}
+}
+
+// sendRemainders sends the follow-up digests that are due. one that fails is tried again later, until the emails are
+// handed to the next daily digest instead
+func (a *App) sendRemainders(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	now := a.Clock.Now()
+
+	var due []DigestRemainder
+	a.state.read(func(s *State) {
+		for _, remainder := range s.account().Remainders {
+			if !remainder.NextTry.After(now) {
+				due = append(due, remainder)
+			}
+		}
+	})
+
+	for _, remainder := range due {
+		err := a.sendRemainder(ctx, remainder)
+		if err := a.state.update(func(s *State) {
+			account := s.account()
+			i := slices.IndexFunc(account.Remainders, func(r DigestRemainder) bool {
+				return r.DigestID == remainder.DigestID && r.Part == remainder.Part
+			})
+			if i < 0 {
+				return
+			}
+			switch {
+			case err == nil:
+				account.Remainders = slices.Delete(account.Remainders, i, i+1)
+			case remainder.Attempts+1 < maxRemainderAttempts:
+				logger.Warn("Follow-up digest failed, trying again later", "digest_id", remainder.DigestID, "part", remainder.Part, "attempts", remainder.Attempts+1, "error", err)
+				account.Remainders[i].Attempts++
+				account.Remainders[i].NextTry = now.Add(firstRemainderDelay << remainder.Attempts)
+			default:
+				logger.Error("Giving up on the follow-up digest, the next daily digest will have its emails", "digest_id", remainder.DigestID, "part", remainder.Part, "emails", len(remainder.Emails), "error", err)
+				recordTaskError(a.taskName("Follow-up digests"), err)
+				account.Remainders = slices.Delete(account.Remainders, i, i+1)
+				account.DeferredDigest = append(account.DeferredDigest, remainder.Emails...)
+				if account.DeferredSince.IsZero() {
+					account.DeferredSince = now
+				}
+			}
+		}); err != nil {
+			return fmt.Errorf("saving state: %w", err)
+		}
+	}
+	return nil
+}
+
+// sendRemainder summarizes and posts a follow-up digest. the emails it couldn't summarize either make another one
+func (a *App) sendRemainder(ctx context.Context, remainder DigestRemainder) error {
+	id := fmt.Sprintf("%s-part%d", remainder.DigestID, remainder.Part)
+	ctx = a.startDigest(ctx, id)
+	logger := log.FromContext(ctx)
+	if a.alreadySent(ctx, id) {
+		logger.Info("Follow-up digest was sent already")
+		return nil
+	}
+
+	usageBefore := currentUsage()
+	digest, err := a.summarizeWithinBudget(ctx, remainder.Kind, remainder.Emails)
+	if err != nil {
+		return fmt.Errorf("generating the follow-up digest: %w", err)
+	}
+	digest.Usage = currentUsage().Sub(usageBefore)
+	digest.Title = fmt.Sprintf("%s summary, part %d", strings.ToUpper(remainder.Kind[:1])+remainder.Kind[1:], remainder.Part)
+	a.holdRemainder(ctx, digest, remainder.ChannelID, remainder.DigestID, remainder.Part+1)
+
+	if err := a.postOrQueue(ctx, remainder.ChannelID, digest, nil, DigestExtras{}); err != nil {
+		return fmt.Errorf("sending the follow-up digest to Discord: %w", err)
+	}
+	a.state.archiveDigest(digest)
+	logger.Info("Follow-up digest sent", "emails", len(remainder.Emails)-len(digest.Unsummarized), "left", len(digest.Unsummarized))
+	return nil
+}
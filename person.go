@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// contactEmails is how many of a contact's latest emails their history is written from
+	contactEmails = 12
+	// contactEmailTokens is how much of each email the model gets, less than /ask since there are twice as many
+	contactEmailTokens = 250
+	// contactDigestDays is how far back the archived digests are read for a contact's open items
+	contactDigestDays = 30
+)
+
+// ContactHistory is what the bot has kept locally about a contact
+type ContactHistory struct {
+	Address string
+	// Emails are the contact's latest emails in the index, and the ones that mention them, oldest first
+	Emails []*IndexedEmail
+	// OpenItems are the action items the digests found in the contact's emails, and the threads waiting on their reply
+	OpenItems []string
+}
+
+// contactHistory gathers what the index and the state know about the contact: the emails from them, the emails the
+// index finds about them, the action items of their emails in the recent digests and the threads waiting on them
+func (a *App) contactHistory(ctx context.Context, address string) (*ContactHistory, error) {
+	history := &ContactHistory{Address: address}
+	if a.embedder != nil {
+		// the search catches the emails that are about the contact without being from them, like a colleague's
+		// introduction or a thread they were copied on
+		results, err := a.searchIndex(ctx, address, contactEmails)
+		if err != nil {
+			return nil, err
+		}
+		a.index.mu.Lock()
+		var emails []*IndexedEmail
+		for _, email := range a.index.Emails {
+			if senderAddress(email.From) == address {
+				emails = append(emails, email)
+			}
+		}
+		a.index.mu.Unlock()
+		for _, result := range results {
+			if strings.Contains(strings.ToLower(result.email.Text), address) && !slices.Contains(emails, result.email) {
+				emails = append(emails, result.email)
+			}
+		}
+		slices.SortStableFunc(emails, func(x, y *IndexedEmail) int { return x.Date.Compare(y.Date) })
+		history.Emails = emails[max(len(emails)-contactEmails, 0):]
+	}
+
+	location := a.Location
+	since := a.Clock.Now().AddDate(0, 0, -contactDigestDays)
+	a.state.read(func(s *State) {
+		for _, digest := range s.Digests {
+			if digest.GeneratedAt.Before(since) {
+				continue
+			}
+			for _, entry := range digest.Entries {
+				if senderAddress(entry.From) != address {
+					continue
+				}
+				for _, item := range entry.ActionItems {
+					line := fmt.Sprintf("%s (from %q, %s digest of %s)", item.Description, entry.Subject, digest.Kind, digest.GeneratedAt.In(location).Format("Mon 2 Jan"))
+					if item.Due != "" {
+						line += ", due " + item.Due
+					}
+					history.OpenItems = append(history.OpenItems, line)
+				}
+			}
+		}
+		for _, reply := range s.account().AwaitingReplies {
+			if strings.Contains(strings.ToLower(reply.To), address) {
+				history.OpenItems = append(history.OpenItems, fmt.Sprintf("Waiting on their reply to %q, sent %s", reply.Subject, reply.SentAt.In(location).Format("Mon 2 Jan")))
+			}
+		}
+	})
+	return history, nil
+}
+
+// personCommand is /person: a summary of the recent history with a contact, from the emails in the index and the
+// digests' action items
+func personCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	address := senderAddress(options["contact"])
+	if !strings.Contains(address, "@") {
+		return "", fmt.Errorf("%q isn't an email address", options["contact"])
+	}
+	history, err := a.contactHistory(ctx, address)
+	if err != nil {
+		return "", err
+	}
+	if len(history.Emails) == 0 && len(history.OpenItems) == 0 {
+		if a.embedder == nil {
+			return fmt.Sprintf("Nothing about %s in the recent digests. Set up `embeddings` in the config to build the email index, which has their emails.", address), nil
+		}
+		return fmt.Sprintf("Nothing about %s in the email index or the recent digests.", address), nil
+	}
+
+	summary, err := a.Summarizer.SummarizeContact(ctx, history)
+	if err != nil {
+		return "", fmt.Errorf("summarizing the history with %s: %w", address, err)
+	}
+	log.FromContext(ctx).Debug("Contact history summarized", "emails", len(history.Emails), "open_items", len(history.OpenItems))
+
+	var sb strings.Builder
+	sb.WriteString(summary)
+	var links []string
+	for _, n := range citations(summary, len(history.Emails)) {
+		email := history.Emails[n-1]
+		label := fmt.Sprintf("[%d] %s", n, email.Subject)
+		if url := gmailThreadURL(a.Config.GmailAccount, email.ThreadID); url != "" {
+			label = fmt.Sprintf("[%d] [%s](<%s>)", n, strings.NewReplacer("[", "(", "]", ")").Replace(email.Subject), url)
+		}
+		links = append(links, label)
+	}
+	if len(links) > 0 {
+		sb.WriteString("\n\n" + strings.Join(links, " · "))
+	}
+	return sb.String(), nil
+}
+
+func (s *openAISummarizer) SummarizeContact(ctx context.Context, history *ContactHistory) (string, error) {
+	location := s.clock.Now().Location()
+	var emails strings.Builder
+	for i, email := range history.Emails {
+		fmt.Fprintf(&emails, "## [%d] %s\n- **From:** %s\n", i+1, email.Subject, email.From)
+		if !email.Date.IsZero() {
+			fmt.Fprintf(&emails, "- **Date:** %s\n", email.Date.In(location).Format("Mon, 2 Jan 2006 15:04 MST"))
+		}
+		text := email.Text
+		if text == "" {
+			text = "(the text is past its retention, only the subject is left)"
+		}
+		fmt.Fprintf(&emails, "\n%s\n\n", truncateTokens(contactEmailTokens, text))
+	}
+	openItems := "None."
+	if len(history.OpenItems) > 0 {
+		openItems = "- " + strings.Join(history.OpenItems, "\n- ")
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().Person, map[string]any{
+		"contact":    history.Address,
+		"emails":     emails.String(),
+		"open_items": openItems,
+	})
+	if err != nil {
+		return "", err
+	}
+	return s.callOpenAI(ctx, []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: prompt,
+		},
+	})
+}
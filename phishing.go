@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// phishingEmailTokens is how much of the email the model reads
+	phishingEmailTokens = 1500
+	// maxPhishingLinks is how many of the email's links are looked at
+	maxPhishingLinks = 30
+)
+
+var (
+	// gmailMessageIDPattern matches the ids Gmail's API uses, which older Gmail links end in too
+	gmailMessageIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	// rfc822IDPattern matches a Message-ID header, as shown by Gmail's "Show original"
+	rfc822IDPattern = regexp.MustCompile(`^<?([^\s<>@]+@[^\s<>@]+)>?$`)
+	// markdownLinkPattern matches the links readBody writes, [text](href) and <href>
+	markdownLinkPattern = regexp.MustCompile(`\[([^\]]*)\]\((https?://[^)\s]+)\)|<(https?://[^>\s]+)>`)
+	// domainTextPattern matches link text that reads like an address, e.g. "paypal.com/login"
+	domainTextPattern = regexp.MustCompile(`(?i)^(?:https?://)?((?:[a-z0-9-]+\.)+[a-z]{2,})(?:[/:?#]\S*)?$`)
+	// authResultPattern reads one method's result out of an Authentication-Results header
+	authResultPattern = regexp.MustCompile(`(?i)\b(spf|dkim|dmarc)=([a-z]+)`)
+	// urgencyPattern matches the pressure phishing relies on, lowercased
+	urgencyPattern = regexp.MustCompile(`urgent|immediately|right away|as soon as possible|within (?:24|48|72) hours|within \d+ (?:hours|days)|account (?:will be |has been )?(?:suspended|locked|closed|disabled|terminated)|verify your (?:account|identity|information)|confirm your (?:account|identity|details)|unusual activity|suspicious activity|final (?:notice|warning|reminder)|act now|last chance|failure to|legal action|your password (?:will )?expires?|gift cards?|wire transfer|bitcoin|payment (?:failed|declined)|update your (?:payment|billing)`)
+)
+
+// linkShorteners hide where a link goes
+var linkShorteners = map[string]bool{
+	"bit.ly": true, "tinyurl.com": true, "t.co": true, "goo.gl": true, "ow.ly": true, "is.gd": true, "buff.ly": true,
+	"rebrand.ly": true, "cutt.ly": true, "shorturl.at": true, "rb.gy": true, "t.ly": true, "tiny.cc": true,
+}
+
+// phishingFinding is one thing the checks that don't need the model noticed about an email
+type phishingFinding struct {
+	// Check is what was looked at: "authentication", "sender", "route", "links", "language" or "attachments"
+	Check string `json:"check"`
+	// Severity is "info", "warning" or "danger"
+	Severity string `json:"severity"`
+	Detail   string `json:"detail"`
+}
+
+// PhishingSignal is one reason for the model's verdict
+type PhishingSignal struct {
+	Signal   string `json:"signal"`
+	Severity string `json:"severity"`
+	Detail   string `json:"detail"`
+}
+
+// PhishingAssessment is the model's verdict on a suspicious email
+type PhishingAssessment struct {
+	// Risk is "low", "medium" or "high"
+	Risk    string           `json:"risk"`
+	Verdict string           `json:"verdict"`
+	Signals []PhishingSignal `json:"signals"`
+	// Advice is what the user should do about the email
+	Advice []string `json:"advice"`
+}
+
+// phishingRiskTitles head the assessment
+var phishingRiskTitles = map[string]string{
+	"low":    "🟢 Low risk",
+	"medium": "🟠 Medium risk",
+	"high":   "🔴 High risk",
+}
+
+// severityEmoji mark each finding and signal
+var severityEmoji = map[string]string{
+	"info":    "ℹ️",
+	"warning": "⚠️",
+	"danger":  "🚩",
+}
+
+// headerValues are every value of a header, in the order the email has them. Received is added once per hop
+func headerValues(message *gmail.Message, name string) []string {
+	var values []string
+	for _, header := range message.Payload.Headers {
+		if strings.EqualFold(header.Name, name) {
+			values = append(values, header.Value)
+		}
+	}
+	return values
+}
+
+// addressDomain is the domain of an address header, lowercased, or "" when it doesn't parse
+func addressDomain(header string) string {
+	address, err := mail.ParseAddress(header)
+	if err != nil {
+		return ""
+	}
+	_, domain, _ := strings.Cut(address.Address, "@")
+	return strings.ToLower(domain)
+}
+
+// baseDomain is the last two labels of a host, so mail.paypal.com and www.paypal.com are the same site. it's rough:
+// co.uk style suffixes make every site under them look the same, which only hides a mismatch, never makes one up
+func baseDomain(host string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(host), "."), ".")
+	if len(labels) <= 2 {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// phishingFindings runs the checks that don't need the model: how the email authenticated, whether the sender's
+// addresses agree, where it came from, what its links say against where they go, pressure in its wording and risky
+// attachments
+func phishingFindings(message *gmail.Message) []phishingFinding {
+	var findings []phishingFinding
+	add := func(check, severity, format string, args ...any) {
+		findings = append(findings, phishingFinding{Check: check, Severity: severity, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	// the receiving server's verdict is the first Authentication-Results, added on top of whatever the sender put in
+	if results := headerValues(message, "Authentication-Results"); len(results) > 0 {
+		seen := make(map[string]bool)
+		for _, match := range authResultPattern.FindAllStringSubmatch(results[0], -1) {
+			method, result := strings.ToUpper(match[1]), strings.ToLower(match[2])
+			if seen[method] {
+				continue
+			}
+			seen[method] = true
+			switch result {
+			case "pass":
+				add("authentication", "info", "%s passed", method)
+			case "none", "neutral":
+				add("authentication", "warning", "%s: %s, the sender's domain doesn't vouch for it", method, result)
+			default:
+				add("authentication", "danger", "%s: %s", method, result)
+			}
+		}
+	} else {
+		add("authentication", "warning", "no Authentication-Results header, there's no telling whether the sender is who they say")
+	}
+
+	from := extractHeader(message, "From")
+	fromDomain := addressDomain(from)
+	if address, err := mail.ParseAddress(from); err == nil && strings.Contains(address.Name, "@") && !strings.Contains(strings.ToLower(address.Name), strings.ToLower(address.Address)) {
+		add("sender", "danger", "the display name %q shows an address, but it's from %s", address.Name, address.Address)
+	}
+	for _, name := range []string{"Reply-To", "Return-Path"} {
+		value := extractHeaderFold(message, name)
+		if value == "" {
+			continue
+		}
+		if domain := addressDomain(value); domain != "" && fromDomain != "" && baseDomain(domain) != baseDomain(fromDomain) {
+			// bulk mail bounces through its sending service, but replies going somewhere else is how a lookalike
+			// invoice gets answered by the scammer
+			severity := "info"
+			if name == "Reply-To" {
+				severity = "warning"
+			}
+			add("sender", severity, "%s is at %s, but it's from %s", name, domain, fromDomain)
+		}
+	}
+
+	// each server adds its Received on top, so the last one is where the email started
+	if received := headerValues(message, "Received"); len(received) > 0 {
+		origin := strings.Join(strings.Fields(received[len(received)-1]), " ")
+		if i := strings.Index(origin, ";"); i >= 0 {
+			origin = origin[:i]
+		}
+		add("route", "info", "%d hops, first: %s", len(received), truncateTokens(40, origin))
+	}
+
+	body := extractBody(message)
+	findings = append(findings, linkFindings(body, fromDomain)...)
+
+	text := strings.ToLower(extractHeader(message, "Subject") + "\n" + body)
+	var urgent []string
+	for _, match := range urgencyPattern.FindAllString(text, -1) {
+		if !slices.Contains(urgent, match) {
+			urgent = append(urgent, match)
+		}
+	}
+	if len(urgent) > 0 {
+		severity := "warning"
+		if len(urgent) >= 3 {
+			severity = "danger"
+		}
+		add("language", severity, "pressure to act: %q", strings.Join(urgent, `", "`))
+	}
+
+	for _, warning := range attachmentWarnings(message) {
+		add("attachments", "danger", "%s: %s", warning.Filename, warning.Reason)
+	}
+	return findings
+}
+
+// linkFindings compares what each link says with where it goes
+func linkFindings(body, fromDomain string) []phishingFinding {
+	var findings []phishingFinding
+	elsewhere := make(map[string]bool)
+	for i, match := range markdownLinkPattern.FindAllStringSubmatch(body, -1) {
+		if i == maxPhishingLinks {
+			break
+		}
+		text, href := strings.TrimSpace(match[1]), match[2]
+		if href == "" {
+			href = match[3]
+		}
+		u, err := url.Parse(href)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+
+		switch {
+		case net.ParseIP(host) != nil:
+			findings = append(findings, phishingFinding{Check: "links", Severity: "danger", Detail: fmt.Sprintf("a link goes to a bare IP address, %s", host)})
+		case strings.HasPrefix(host, "xn--") || strings.Contains(host, ".xn--"):
+			findings = append(findings, phishingFinding{Check: "links", Severity: "danger", Detail: fmt.Sprintf("a link goes to %s, a punycode domain that can look like another one", host)})
+		case linkShorteners[host]:
+			findings = append(findings, phishingFinding{Check: "links", Severity: "warning", Detail: fmt.Sprintf("a link goes through %s, which hides where it ends up", host)})
+		}
+		if shown := domainTextPattern.FindStringSubmatch(text); shown != nil && baseDomain(shown[1]) != baseDomain(host) {
+			findings = append(findings, phishingFinding{Check: "links", Severity: "danger", Detail: fmt.Sprintf("a link shows %s but goes to %s", shown[1], host)})
+		}
+		if fromDomain != "" && baseDomain(host) != baseDomain(fromDomain) {
+			elsewhere[baseDomain(host)] = true
+		}
+	}
+	if len(elsewhere) > 0 {
+		findings = append(findings, phishingFinding{Check: "links", Severity: "info", Detail: fmt.Sprintf("links to sites other than the sender's: %s", strings.Join(sortedKeys(elsewhere), ", "))})
+	}
+	return findings
+}
+
+// AssessPhishing asks the model for a risk assessment of the email, with what the other checks found
+func (s *openAISummarizer) AssessPhishing(ctx context.Context, message *gmail.Message, findings []phishingFinding) (*PhishingAssessment, error) {
+	var headers strings.Builder
+	for _, name := range []string{"From", "Reply-To", "Return-Path", "To", "Subject", "Date"} {
+		if value := extractHeaderFold(message, name); value != "" {
+			fmt.Fprintf(&headers, "- **%s:** %s\n", name, value)
+		}
+	}
+	var found strings.Builder
+	for _, finding := range findings {
+		fmt.Fprintf(&found, "- %s (%s): %s\n", finding.Check, finding.Severity, finding.Detail)
+	}
+	if found.Len() == 0 {
+		found.WriteString("Nothing.\n")
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().Phishing, map[string]any{
+		"email":    headers.String() + "\n" + truncateTokens(phishingEmailTokens, extractBody(message)),
+		"findings": found.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.callOpenAIJSON(ctx, []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: prompt,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var assessment PhishingAssessment
+	if err := json.Unmarshal([]byte(resp), &assessment); err != nil {
+		return nil, fmt.Errorf("unable to parse the phishing assessment: %v", err)
+	}
+	return &assessment, nil
+}
+
+// findEmail fetches the email a /check points at: a Gmail message id or a link ending in one, a Message-ID header,
+// or else a Gmail search query, whose newest match is the one
+func (a *App) findEmail(ctx context.Context, ref string) (*gmail.Message, error) {
+	ref = strings.TrimSpace(ref)
+	if u, err := url.Parse(ref); err == nil && u.Host == "mail.google.com" {
+		id := u.Fragment[strings.LastIndex(u.Fragment, "/")+1:]
+		if !gmailMessageIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("that Gmail link doesn't have a message id the API knows, use the Message-ID from \"Show original\" instead")
+		}
+		ref = id
+	}
+	if gmailMessageIDPattern.MatchString(ref) {
+		return a.Emails.Message(ctx, ref)
+	}
+
+	query := ref
+	if match := rfc822IDPattern.FindStringSubmatch(ref); match != nil {
+		query = "rfc822msgid:" + match[1]
+	}
+	preview, err := a.Emails.Preview(ctx, query, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(preview.Newest) == 0 {
+		return nil, nil
+	}
+	return a.Emails.Message(ctx, preview.Newest[0].Id)
+}
+
+// checkCommand is /check: a phishing assessment of one email, from its headers, links and wording, with the model's
+// verdict on top
+func checkCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	ref := strings.TrimSpace(options["email"])
+	if ref == "" {
+		return "", fmt.Errorf("check which email?")
+	}
+	message, err := a.findEmail(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("finding the email: %w", err)
+	}
+	if message == nil {
+		return fmt.Sprintf("No email matches %q.", ref), nil
+	}
+
+	findings := phishingFindings(message)
+	assessment, err := a.Summarizer.AssessPhishing(ctx, message, findings)
+	if err != nil {
+		return "", fmt.Errorf("assessing the email: %w", err)
+	}
+	log.FromContext(ctx).Info("Email checked for phishing", "message_id", message.Id, "risk", assessment.Risk, "findings", len(findings))
+	return formatPhishingCheck(message, findings, assessment), nil
+}
+
+// formatPhishingCheck is the reply to /check: the verdict, the model's reasons, what to do, then what each check found
+func formatPhishingCheck(message *gmail.Message, findings []phishingFinding, assessment *PhishingAssessment) string {
+	var sb strings.Builder
+	title, ok := phishingRiskTitles[assessment.Risk]
+	if !ok {
+		title = "⚪ Unknown risk"
+	}
+	fmt.Fprintf(&sb, "**%s**: %s\n", title, assessment.Verdict)
+	fmt.Fprintf(&sb, "> %s · %s\n", senderName(extractHeader(message, "From")), extractHeader(message, "Subject"))
+
+	if len(assessment.Signals) > 0 {
+		sb.WriteString("\n**Why**\n")
+		for _, signal := range assessment.Signals {
+			fmt.Fprintf(&sb, "- %s **%s**: %s\n", severityEmoji[signal.Severity], signal.Signal, signal.Detail)
+		}
+	}
+	if len(assessment.Advice) > 0 {
+		sb.WriteString("\n**What to do**\n")
+		for _, advice := range assessment.Advice {
+			fmt.Fprintf(&sb, "- %s\n", advice)
+		}
+	}
+	if len(findings) > 0 {
+		sb.WriteString("\n**Checks**\n")
+		for _, finding := range findings {
+			fmt.Fprintf(&sb, "- %s %s: %s\n", severityEmoji[finding.Severity], finding.Check, finding.Detail)
+		}
+	}
+	return sb.String()
+}
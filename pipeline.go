@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+	"scheduler"
+)
+
+// the stages of a scheduled digest, in order. each one's result is checkpointed in the state, so a digest that crashed
+// or was killed picks up at the stage that didn't finish instead of starting over. the weekly summary starts from the
+// queue the daily ones parsed and classified, so it goes from fetch straight to summarize
+const (
+	// stageFetch reads the new emails from Gmail
+	stageFetch = "fetch"
+	// stageParse reads the text in images and indexes and deduplicates the emails
+	stageParse = "parse"
+	// stageClassify alerts about security emails, applies the rules, escalates and routes. what's left is the digest's
+	stageClassify = "classify"
+	// stageSummarize has the model write the digest. within the stage, the summary cache picks up the emails already read
+	stageSummarize = "summarize"
+	// stageRender adds the sections that go with the digest
+	stageRender = "render"
+	// stageDeliver posts it and moves the cursor on, which ends the digest and drops its checkpoint
+	stageDeliver = "deliver"
+)
+
+var digestStages = []string{stageFetch, stageParse, stageClassify, stageSummarize, stageRender, stageDeliver}
+
+// maxCheckpointAge is how old a checkpoint can be for the digest to be resumed at startup. an older one is dropped: its
+// emails are still after the cursor, so the next digest has them anyway
+const maxCheckpointAge = 24 * time.Hour
+
+// DigestCheckpoint is how far a scheduled digest got
+type DigestCheckpoint struct {
+	DigestID string `json:"digest_id"`
+	// Stage is the last stage that finished
+	Stage     string    `json:"stage"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// FetchedAt is when the emails were fetched, where the cursor moves to once the digest is delivered
+	FetchedAt time.Time `json:"fetched_at"`
+	// Roundup are the days off the digest covers, see withRoundup
+	Roundup []time.Time `json:"roundup,omitempty"`
+
+	// Emails are every email the digest started with, as the stages so far left them, e.g. with the text of their
+	// images. the stages say which of them they kept by id
+	Emails []*gmail.Message `json:"emails"`
+	// Deferred and Fetched are the emails held back from quiet days and the new ones
+	Deferred []string `json:"deferred,omitempty"`
+	Fetched  []string `json:"fetched,omitempty"`
+	// Parsed are the new emails left after deduplication
+	Parsed []string `json:"parsed,omitempty"`
+	// Kept are the emails the rules kept, for the weekly queue, and Digest the ones left for the digest
+	Kept   []string `json:"kept,omitempty"`
+	Digest []string `json:"digest,omitempty"`
+
+	// DeferredSince and MiniDigests are what the state said when the emails were fetched
+	DeferredSince time.Time `json:"deferred_since,omitempty"`
+	MiniDigests   []string  `json:"mini_digests,omitempty"`
+	// Action is what the quiet day check decided, see lowVolumeAction
+	Action string `json:"action,omitempty"`
+	// DailyPosts is how many of the daily digests posted this week the weekly summary links back to
+	DailyPosts int `json:"daily_posts,omitempty"`
+
+	// Result is the digest, once it's written
+	Result *Digest `json:"result,omitempty"`
+}
+
+// pipeline runs the stages of a scheduled digest, keeping its checkpoint
+type pipeline struct {
+	a    *App
+	kind string
+	cp   *DigestCheckpoint
+	// resumed is whether an earlier run of the digest left a checkpoint
+	resumed bool
+}
+
+// startPipeline picks up the checkpoint of the digest id, if an earlier run left one. a checkpoint of another digest
+// of the same kind is dropped: that digest never went out, so its emails are still after the cursor
+func (a *App) startPipeline(ctx context.Context, kind, id string) *pipeline {
+	p := &pipeline{a: a, kind: kind, cp: &DigestCheckpoint{DigestID: id}}
+	logger := log.FromContext(ctx)
+	var stale string
+	a.state.read(func(s *State) {
+		cp, ok := s.account().Checkpoints[kind]
+		switch {
+		case !ok:
+		case cp.DigestID == id:
+			// the stages change the emails, the state's copy stays as it was saved
+			resumed, err := cloneCheckpoint(cp)
+			if err != nil {
+				logger.Error("Unable to read the checkpoint, starting the digest over", "error", err)
+				return
+			}
+			p.cp, p.resumed = resumed, true
+		default:
+			stale = cp.DigestID
+		}
+	})
+	if p.resumed {
+		logger.Info("Resuming the digest", "after_stage", p.cp.Stage, "checkpoint", p.cp.UpdatedAt)
+	}
+	if stale != "" {
+		logger.Warn("Dropping the checkpoint of a digest that never went out", "stale_digest_id", stale)
+		if err := a.state.update(func(s *State) {
+			delete(s.account().Checkpoints, kind)
+		}); err != nil {
+			logger.Error("Unable to drop the checkpoint", "error", err)
+		}
+	}
+	return p
+}
+
+// cloneCheckpoint is a deep copy of cp
+func cloneCheckpoint(cp *DigestCheckpoint) (*DigestCheckpoint, error) {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return nil, err
+	}
+	clone := &DigestCheckpoint{}
+	if err := json.Unmarshal(data, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// done reports whether stage has finished, in this run or an earlier one
+func (p *pipeline) done(stage string) bool {
+	return p.cp.Stage != "" && slices.Index(digestStages, stage) <= slices.Index(digestStages, p.cp.Stage)
+}
+
+// finish saves the checkpoint once stage is done. the state gets a copy, so the stages after can change the emails
+// while it's being saved
+func (p *pipeline) finish(stage string) error {
+	p.cp.Stage = stage
+	p.cp.UpdatedAt = p.a.Clock.Now()
+	saved, err := cloneCheckpoint(p.cp)
+	if err != nil {
+		return fmt.Errorf("encoding the checkpoint: %w", err)
+	}
+	if err := p.a.state.update(func(s *State) {
+		account := s.account()
+		if account.Checkpoints == nil {
+			account.Checkpoints = make(map[string]*DigestCheckpoint)
+		}
+		account.Checkpoints[p.kind] = saved
+	}); err != nil {
+		return fmt.Errorf("saving the checkpoint after %s: %w", stage, err)
+	}
+	return nil
+}
+
+// emails are the checkpoint's emails with the ids, in that order
+func (p *pipeline) emails(ids []string) []*gmail.Message {
+	byID := make(map[string]*gmail.Message, len(p.cp.Emails))
+	for _, message := range p.cp.Emails {
+		byID[message.Id] = message
+	}
+	messages := make([]*gmail.Message, 0, len(ids))
+	for _, id := range ids {
+		if message, ok := byID[id]; ok {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// resumeDigests schedules the digests a crash or restart interrupted to carry on from their checkpoints straight away
+func (a *App) resumeDigests(s *scheduler.Scheduler) error {
+	runs := map[string]func(ctx context.Context, id string) error{
+		"daily":  a.runDailySummary,
+		"weekly": a.runWeeklySummary,
+	}
+	var resume, drop []string
+	checkpoints := make(map[string]string)
+	a.state.read(func(st *State) {
+		for kind, cp := range st.account().Checkpoints {
+			if _, ok := runs[kind]; !ok || a.Clock.Now().Sub(cp.UpdatedAt) > maxCheckpointAge {
+				drop = append(drop, kind)
+				continue
+			}
+			resume = append(resume, kind)
+			checkpoints[kind] = cp.DigestID
+		}
+	})
+	if len(drop) > 0 {
+		log.Warn("Dropping old checkpoints, the next digests will cover their emails", "profile", a.Profile, "kinds", drop)
+		if err := a.state.update(func(st *State) {
+			for _, kind := range drop {
+				delete(st.account().Checkpoints, kind)
+			}
+		}); err != nil {
+			return fmt.Errorf("dropping old checkpoints: %w", err)
+		}
+	}
+	slices.Sort(resume)
+	for _, kind := range resume {
+		run, id := runs[kind], checkpoints[kind]
+		log.Info("Resuming an interrupted digest", "profile", a.Profile, "digest_id", id)
+		name := a.taskName(fmt.Sprintf("Resume %s summary", kind))
+		if _, err := s.Add(a.createResumeTask(name, id, func(ctx context.Context) error {
+			// another replica may have finished the digest since this one started
+			var pending bool
+			a.state.read(func(st *State) {
+				cp, ok := st.account().Checkpoints[kind]
+				pending = ok && cp.DigestID == id
+			})
+			if !pending {
+				log.FromContext(ctx).Info("The digest was finished in the meantime", "digest_id", id)
+				return nil
+			}
+			return run(ctx, id)
+		}).Once().Group(a.gmailGroup())); err != nil {
+			return fmt.Errorf("scheduling %q: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// defaultTenant is the tenant of the state of a config without profiles
+const defaultTenant = "default"
+
+// defaultPostgresConns is the size of the connection pool when the config doesn't say. the state is saved a few times
+// a digest, so a handful of connections serves a good number of profiles
+const defaultPostgresConns = 4
+
+// postgresMigrations bring the schema up to date, postgresMigrations[i] taking it from version i to i+1. they're only
+// ever appended to
+var postgresMigrations = [][]string{
+	// the table from before migrations, one state per database
+	{`CREATE TABLE IF NOT EXISTS reu_state (part TEXT PRIMARY KEY, data BYTEA NOT NULL)`},
+	// a row per tenant and part, so the profiles of one or several deployments can share the database. the rows from
+	// before are the state of a config without profiles
+	{
+		`ALTER TABLE reu_state ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default'`,
+		`ALTER TABLE reu_state ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+		`ALTER TABLE reu_state DROP CONSTRAINT reu_state_pkey`,
+		`ALTER TABLE reu_state ADD PRIMARY KEY (tenant, part)`,
+		`ALTER TABLE reu_state ALTER COLUMN tenant DROP DEFAULT`,
+	},
+}
+
+// postgresPool is a connection pool, shared by the profiles that use the same dsn
+type postgresPool struct {
+	db    *sql.DB
+	users int
+}
+
+var postgresPools = struct {
+	sync.Mutex
+	pools map[string]*postgresPool
+}{pools: make(map[string]*postgresPool)}
+
+// postgresStore keeps the state's parts in a table of a postgres database, a row each for every tenant. every query
+// is scoped to the store's tenant, so a profile never reads or overwrites another's rows
+type postgresStore struct {
+	dsn    string
+	pool   *postgresPool
+	tenant string
+}
+
+func openPostgresStore(config *StorageConfig, _, profile string) (partStore, error) {
+	if config.DSN == "" {
+		return nil, errors.New("the postgres storage backend needs a dsn")
+	}
+	tenant := config.Tenant
+	if tenant == "" {
+		tenant = profile
+	}
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+
+	postgresPools.Lock()
+	defer postgresPools.Unlock()
+	pool, ok := postgresPools.pools[config.DSN]
+	if !ok {
+		db, err := sql.Open("pgx", config.DSN)
+		if err != nil {
+			return nil, err
+		}
+		conns := config.MaxConns
+		if conns <= 0 {
+			conns = defaultPostgresConns
+		}
+		db.SetMaxOpenConns(conns)
+		db.SetMaxIdleConns(min(conns, 2))
+		db.SetConnMaxIdleTime(5 * time.Minute)
+		// a long lived connection outlasts a failover or a pgbouncer restart, recycling them picks up the new server
+		db.SetConnMaxLifetime(30 * time.Minute)
+		if err := migratePostgres(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		pool = &postgresPool{db: db}
+		postgresPools.pools[config.DSN] = pool
+	}
+	pool.users++
+	return &postgresStore{dsn: config.DSN, pool: pool, tenant: tenant}, nil
+}
+
+// migratePostgres runs the migrations the database hasn't had yet. a lock serializes the replicas and profiles that
+// start at the same time, so each migration runs once
+func migratePostgres(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('reu_schema'))`); err != nil {
+		return fmt.Errorf("locking the schema: %w", err)
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS reu_schema (version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("creating the schema table: %w", err)
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT coalesce(max(version), 0) FROM reu_schema`).Scan(&version); err != nil {
+		return fmt.Errorf("reading the schema version: %w", err)
+	}
+	if version > len(postgresMigrations) {
+		return fmt.Errorf("the database schema is version %d, but this build only understands up to %d", version, len(postgresMigrations))
+	}
+	for ; version < len(postgresMigrations); version++ {
+		log.Info("Migrating the postgres schema", "from", version, "to", version+1)
+		for _, statement := range postgresMigrations[version] {
+			if _, err := tx.Exec(statement); err != nil {
+				return fmt.Errorf("migrating the schema to version %d: %w", version+1, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO reu_schema (version) VALUES ($1)`, version+1); err != nil {
+			return fmt.Errorf("migrating the schema to version %d: %w", version+1, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (st *postgresStore) get(part string) ([]byte, error) {
+	var data []byte
+	err := st.pool.db.QueryRow(`SELECT data FROM reu_state WHERE tenant = $1 AND part = $2`, st.tenant, part).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (st *postgresStore) put(records map[string][]byte, expected map[string][32]byte) error {
+	tx, err := st.pool.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, part := range sortedKeys(records) {
+		// the row is only written over if it's the one this replica last saw, and only added if no other replica
+		// added it first
+		var result sql.Result
+		if hash, ok := expected[part]; ok {
+			result, err = tx.Exec(`UPDATE reu_state SET data = $3, updated_at = now() WHERE tenant = $1 AND part = $2 AND sha256(data) = $4`,
+				st.tenant, part, records[part], hash[:])
+		} else {
+			result, err = tx.Exec(`INSERT INTO reu_state (tenant, part, data, updated_at) VALUES ($1, $2, $3, now()) ON CONFLICT (tenant, part) DO NOTHING`,
+				st.tenant, part, records[part])
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errStateConflict
+		}
+	}
+	return tx.Commit()
+}
+
+// close lets go of the pool, closing it with its last user
+func (st *postgresStore) close() error {
+	postgresPools.Lock()
+	defer postgresPools.Unlock()
+	if st.pool.users--; st.pool.users > 0 {
+		return nil
+	}
+	delete(postgresPools.pools, st.dsn)
+	return st.pool.db.Close()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// profilesDir holds a directory per profile, with its state, email index and its own copies of the prompt templates
+const profilesDir = "profiles"
+
+// profileNamePattern keeps profile names usable as directory names
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// profileDir is where a profile keeps its files, the working directory when the config has no profiles
+func profileDir(profile string) string {
+	if profile == "" {
+		return ""
+	}
+	return filepath.Join(profilesDir, profile)
+}
+
+// profileFile is the profile's own copy of a shared file, like a prompt template, when it has one, and the shared file
+// otherwise
+func profileFile(dir, name string) string {
+	if dir != "" {
+		if path := filepath.Join(dir, name); fileExists(path) {
+			return path
+		}
+	}
+	return name
+}
+
+// profileNames are the names of the config's profiles, sorted
+func profileNames(config *Config) []string {
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// sharedOnlySettings can't be set by a profile: the state encryption is set up once for the whole process
+var sharedOnlySettings = []string{"encryption_passphrase", "encryption_passphrase_command"}
+
+// profileConfig is the config of a profile: the top level config with the profile's settings on top. objects are
+// merged field by field, so a profile only has to say what it does differently; lists are replaced
+func profileConfig(config *Config, profile string) (*Config, error) {
+	raw, ok := config.Profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("there's no profile %q, the config has %s", profile, strings.Join(profileNames(config), ", "))
+	}
+	if !profileNamePattern.MatchString(profile) {
+		return nil, fmt.Errorf("invalid profile name %q, use lowercase letters, digits, - and _", profile)
+	}
+
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return nil, fmt.Errorf("parsing profile %s: %w", profile, err)
+	}
+	for _, key := range sharedOnlySettings {
+		if _, ok := settings[key]; ok {
+			return nil, fmt.Errorf("profile %s sets %s, which only the top level config can", profile, key)
+		}
+	}
+
+	shared, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("encoding the config: %w", err)
+	}
+	merged := &Config{}
+	if err := json.Unmarshal(shared, merged); err != nil {
+		return nil, fmt.Errorf("copying the config: %w", err)
+	}
+	if err := json.Unmarshal(raw, merged); err != nil {
+		return nil, fmt.Errorf("parsing profile %s: %w", profile, err)
+	}
+	merged.Profiles = nil
+	return merged, nil
+}
+
+// newProfileApps makes the App of every profile, or of only the named one. a config without profiles makes a single
+// App, that keeps its files in the working directory like before profiles existed
+func newProfileApps(config *Config, only string) ([]*App, error) {
+	if len(config.Profiles) == 0 {
+		if only != "" {
+			return nil, fmt.Errorf("there's no profile %q, the config has no profiles", only)
+		}
+		a, err := newApp(config, "")
+		if err != nil {
+			return nil, err
+		}
+		a.profiles = []*App{a}
+		return []*App{a}, nil
+	}
+
+	names := profileNames(config)
+	if only != "" {
+		names = []string{only}
+	}
+	var apps []*App
+	for _, name := range names {
+		profile, err := profileConfig(config, name)
+		if err != nil {
+			return nil, err
+		}
+		a, err := newApp(profile, name)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		apps = append(apps, a)
+	}
+	if err := checkProfileServers(apps); err != nil {
+		return nil, err
+	}
+	for _, a := range apps {
+		a.profiles = apps
+	}
+	log.Info("Profiles loaded", "profiles", strings.Join(names, ", "))
+	return apps, nil
+}
+
+// checkProfileServers makes sure no two profiles serve on the same address. a server only knows the profile that
+// started it, so a second profile on its address would never be served. profiles inherit the top level servers, so
+// each needs its own listen
+func checkProfileServers(apps []*App) error {
+	serving := make(map[string]string)
+	for _, a := range apps {
+		servers := map[string]string{}
+		if a.Config.API != nil {
+			servers["api"] = a.Config.API.Listen
+		}
+		if a.Config.Metrics != nil {
+			servers["metrics"] = a.Config.Metrics.Listen
+		}
+		if a.Config.GRPC != nil {
+			servers["grpc"] = a.Config.GRPC.Listen
+		}
+		for _, server := range sortedKeys(servers) {
+			address := servers[server]
+			if other, ok := serving[address]; ok {
+				return fmt.Errorf("profile %s serves %s on %s, where %s already listens, give it its own listen", a.Profile, server, address, other)
+			}
+			serving[address] = fmt.Sprintf("the %s of profile %s", server, a.Profile)
+		}
+	}
+	return nil
+}
+
+// taskName is the name of one of the profile's scheduled tasks, prefixed with the profile so they can be told apart
+func (a *App) taskName(name string) string {
+	if a.Profile == "" {
+		return name
+	}
+	return a.Profile + ": " + name
+}
+
+// gmailGroup is the scheduler group of the profile's Gmail tasks. each profile has its own token, so only a profile's
+// own tasks need to wait for each other
+func (a *App) gmailGroup() string {
+	if a.Profile == "" {
+		return gmailTasks
+	}
+	return gmailTasks + ":" + a.Profile
+}
+
+// handles is whether an interaction in a channel is for this profile. the profiles sharing a Discord bot each answer
+// in their own channels, and the first of them everywhere else
+func (a *App) handles(channelID string) bool {
+	var sharing []*App
+	for _, b := range a.profiles {
+		if b.Discord == a.Discord {
+			sharing = append(sharing, b)
+		}
+	}
+	if len(sharing) < 2 {
+		return true
+	}
+	for _, b := range sharing {
+		if slices.Contains(b.channels(), channelID) {
+			return b == a
+		}
+	}
+	return a == sharing[0]
+}
+
+// channels are the Discord channels the profile posts to
+func (a *App) channels() []string {
+	channels := []string{a.dailyChannel(), a.weeklyChannel(), a.oauthChannel()}
+	if rollups := a.Config.Rollups; rollups != nil {
+		channels = append(channels, rollups.MonthlyChannelID, rollups.QuarterlyChannelID)
+	}
+	for _, r := range a.Rules {
+		channels = append(channels, r.ChannelID)
+	}
+	return slices.DeleteFunc(channels, func(channel string) bool { return channel == "" })
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ProgressEvent describes how far along a digest run is
+type ProgressEvent struct {
+	Kind  string `json:"kind"`
+	Stage string `json:"stage"` // Stage is one of fetching, summarizing, delivering, done, skipped or failed
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+	Error string `json:"error,omitempty"`
+	// Run is the id of the task run it's from, and Profile the profile it's for, so a subscriber can follow one run
+	Run     string `json:"run,omitempty"`
+	Profile string `json:"profile,omitempty"`
+}
+
+// Finished reports whether this is the last event of a run
+func (e ProgressEvent) Finished() bool {
+	return e.Stage == "done" || e.Stage == "skipped" || e.Stage == "failed"
+}
+
+var (
+	progressSubs   = make(map[chan ProgressEvent]struct{})
+	progressSubsMu sync.Mutex
+)
+
+func subscribeProgress() chan ProgressEvent {
+	ch := make(chan ProgressEvent, 64)
+	progressSubsMu.Lock()
+	progressSubs[ch] = struct{}{}
+	progressSubsMu.Unlock()
+	return ch
+}
+
+func unsubscribeProgress(ch chan ProgressEvent) {
+	progressSubsMu.Lock()
+	delete(progressSubs, ch)
+	progressSubsMu.Unlock()
+}
+
+// reportProgress publishes an event to every subscriber, tagged with the run and the profile in ctx. slow subscribers
+// miss events rather than stall the digest
+func reportProgress(ctx context.Context, event ProgressEvent) {
+	event.Run, _ = ctx.Value(runIDKey{}).(string)
+	event.Profile, _ = ctx.Value(profileKey{}).(string)
+
+	progressSubsMu.Lock()
+	defer progressSubsMu.Unlock()
+
+	for ch := range progressSubs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
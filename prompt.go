@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// placeholderPattern matches the plain {{name}} placeholders the templates used before they were text/template. they're
+// rewritten to {{.name}} before parsing, so older templates keep working
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(from|to|subject|date|body|scratchpad|context|topic|digests|stats|kind|waiting|emails|threads|today|contact|open_items|email|findings|categories)\s*\}\}`)
+
+// replyHeaderPattern matches the line a mail client puts above the quoted email in a reply, everything after it is
+// the quoted email
+var replyHeaderPattern = regexp.MustCompile(`(?m)^\s*(On .+ wrote:|-{2,} ?Original Message ?-{2,}|_{10,})\s*$`)
+
+// parsePrompt parses a prompt template with the template functions. location is the user's timezone, for formatDate
+func parsePrompt(name, text string, location *time.Location) (*template.Template, error) {
+	text = placeholderPattern.ReplaceAllString(text, "{{.$1}}")
+	return template.New(name).Option("missingkey=zero").Funcs(promptFuncs(location)).Parse(text)
+}
+
+// renderPrompt fills in a prompt template with data, with the user's context and in their timezone
+func (s *openAISummarizer) renderPrompt(text string, data map[string]any) (string, error) {
+	return renderPromptText(text, data, s.templates.Load().UserContext, s.clock.Now().Location())
+}
+
+// renderPromptText is renderPrompt without the summarizer: it depends on nothing but its arguments, so the golden tests
+// render the templates exactly as the model gets them
+func renderPromptText(text string, data map[string]any, userContext string, location *time.Location) (string, error) {
+	t, err := parsePrompt("prompt", text, location)
+	if err != nil {
+		return "", fmt.Errorf("parsing prompt template: %w", err)
+	}
+	if _, ok := data["context"]; !ok {
+		data["context"] = userContext
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("rendering prompt template: %w", err)
+	}
+	return strings.ReplaceAll(sb.String(), "<no value>", ""), nil
+}
+
+// emailPromptData is what an email template can use: the headers the summarizer always had, the date as a time for
+// formatDate, and every header of the email for joinHeaders
+func emailPromptData(message *gmail.Message, body string, location *time.Location) map[string]any {
+	headers := make(map[string]string, len(message.Payload.Headers))
+	for _, header := range message.Payload.Headers {
+		if _, ok := headers[header.Name]; !ok {
+			headers[header.Name] = header.Value
+		}
+	}
+	date := extractHeader(message, "Date")
+	sent, _ := mail.ParseDate(date)
+	return map[string]any{
+		"from":    extractHeader(message, "From"),
+		"to":      extractHeader(message, "To"),
+		"subject": extractHeader(message, "Subject"),
+		"date":    localDate(date, location),
+		"time":    sent,
+		"body":    body,
+		"headers": headers,
+	}
+}
+
+// promptFuncs are the functions prompt templates can call, so their authors can shape what the model gets
+func promptFuncs(location *time.Location) template.FuncMap {
+	return template.FuncMap{
+		"truncateTokens": truncateTokens,
+		"stripQuotes":    stripQuotes,
+		"formatDate": func(layout string, value any) string {
+			return formatDate(layout, value, location)
+		},
+		"joinHeaders": joinHeaders,
+		"wordcount": func(s string) int {
+			return len(strings.Fields(s))
+		},
+	}
+}
+
+// truncateTokens cuts s to about n tokens, at about four characters to a token, at a word boundary when there's one
+// close enough
+func truncateTokens(n int, s string) string {
+	limit := n * 4
+	if n < 0 || len(s) <= limit {
+		return s
+	}
+	cut := strings.LastIndexAny(s[:limit], " \t\n")
+	if cut < limit/2 {
+		cut = limit
+	}
+	return strings.ToValidUTF8(strings.TrimSpace(s[:cut]), "") + "…"
+}
+
+// stripQuotes drops the quoted lines of a reply, and the previous email a client appends under "On ... wrote:"
+func stripQuotes(s string) string {
+	if loc := replyHeaderPattern.FindStringIndex(s); loc != nil {
+		s = s[:loc[0]]
+	}
+	var kept []string
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), ">") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+// formatDate formats a time, or a date header, in the user's timezone with a Go layout like "Mon 2 Jan 15:04". a date
+// that doesn't parse is returned as it is
+func formatDate(layout string, value any, location *time.Location) string {
+	var t time.Time
+	switch v := value.(type) {
+	case time.Time:
+		t = v
+	case string:
+		parsed, err := mail.ParseDate(v)
+		if err != nil {
+			return v
+		}
+		t = parsed
+	default:
+		return fmt.Sprint(value)
+	}
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(location).Format(layout)
+}
+
+// joinHeaders lists the named headers an email has, a "Name: value" line each, e.g. {{joinHeaders .headers "Cc" "Reply-To"}}
+func joinHeaders(headers map[string]string, names ...string) string {
+	var lines []string
+	for _, name := range names {
+		if value, ok := headers[name]; ok && value != "" {
+			lines = append(lines, name+": "+value)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// maxPromptVersions bounds the history kept for each template
+const maxPromptVersions = 20
+
+// maxDiffLines keeps a /prompts diff within a few Discord messages
+const maxDiffLines = 120
+
+// digestPromptFiles are the digest templates each kind of digest is written with, on top of the email and summary ones
+var digestPromptFiles = map[string]string{
+	"daily":  "daily_summary_prompt.tmpl",
+	"weekly": "weekly_summary_prompt.tmpl",
+	"topic":  "topic_summary_prompt.tmpl",
+}
+
+// PromptVersion is one version of a prompt template, saved the first time the bot started with it
+type PromptVersion struct {
+	Hash    string    `json:"hash"`
+	Text    string    `json:"text"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// promptHash identifies a version of a template by its content
+func promptHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// hashes are the hashes of the named templates, for recording on a digest
+func (t *Templates) hashes(names ...string) map[string]string {
+	files := t.files()
+	hashes := make(map[string]string, len(names))
+	for _, name := range names {
+		if field, ok := files[name]; ok {
+			hashes[name] = promptHash(*field)
+		}
+	}
+	return hashes
+}
+
+// recordPromptVersions adds the templates that changed since they were last recorded to their history
+func (st *stateStore) recordPromptVersions(t *Templates, now time.Time) error {
+	return st.update(func(s *State) {
+		if s.Prompts == nil {
+			s.Prompts = make(map[string][]PromptVersion)
+		}
+		for name, field := range t.files() {
+			hash := promptHash(*field)
+			versions := s.Prompts[name]
+			if len(versions) > 0 && versions[len(versions)-1].Hash == hash {
+				continue
+			}
+			if len(versions) > 0 {
+				log.Info("Prompt template changed", "template", name, "from", versions[len(versions)-1].Hash, "to", hash)
+			}
+			versions = append(versions, PromptVersion{Hash: hash, Text: *field, SavedAt: now})
+			if len(versions) > maxPromptVersions {
+				versions = versions[len(versions)-maxPromptVersions:]
+			}
+			s.Prompts[name] = versions
+		}
+	})
+}
+
+// promptVersions is the history of a template, oldest first. the name can leave out the .tmpl extension
+func (st *stateStore) promptVersions(name string) (string, []PromptVersion, error) {
+	if name == "" {
+		return "", nil, fmt.Errorf("which template? e.g. daily_summary_prompt.tmpl")
+	}
+	if !strings.HasSuffix(name, ".tmpl") {
+		name += ".tmpl"
+	}
+	var versions []PromptVersion
+	st.read(func(s *State) {
+		versions = append(versions, s.Prompts[name]...)
+	})
+	if len(versions) == 0 {
+		return "", nil, fmt.Errorf("no history for %s", name)
+	}
+	return name, versions, nil
+}
+
+// findPromptVersion finds a version by its hash, or the start of it
+func findPromptVersion(versions []PromptVersion, ref string) (PromptVersion, error) {
+	var found []PromptVersion
+	for _, v := range versions {
+		if ref != "" && strings.HasPrefix(v.Hash, ref) {
+			found = append(found, v)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return PromptVersion{}, fmt.Errorf("no version %q", ref)
+	case len(found) > 1 && found[0].Hash != found[len(found)-1].Hash:
+		return PromptVersion{}, fmt.Errorf("%q matches more than one version, give more of the hash", ref)
+	}
+	return found[len(found)-1], nil
+}
+
+// promptsCommand is /prompts: the history of the prompt templates, what changed between versions, and going back to one
+func promptsCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	switch options["action"] {
+	case "", "list":
+		if options["template"] == "" {
+			return listPromptTemplates(a), nil
+		}
+		return listPromptVersions(a, options["template"])
+	case "diff":
+		return diffPromptVersions(a, options["template"], options["version"])
+	case "rollback":
+		return a.rollbackPrompt(ctx, options["template"], options["version"])
+	default:
+		return "", fmt.Errorf("unknown action %q, expected list, diff or rollback", options["action"])
+	}
+}
+
+// listPromptTemplates is the current version of each template and when it last changed
+func listPromptTemplates(a *App) string {
+	var sb strings.Builder
+	a.state.read(func(s *State) {
+		names := make([]string, 0, len(s.Prompts))
+		for name := range s.Prompts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			versions := s.Prompts[name]
+			current := versions[len(versions)-1]
+			fmt.Fprintf(&sb, "**%s**: `%s` since %s, %s\n", name, current.Hash, current.SavedAt.In(a.Location).Format("Mon Jan 2 15:04"), pluralize(len(versions), "version"))
+		}
+	})
+	if sb.Len() == 0 {
+		return "No prompt versions recorded yet."
+	}
+	return sb.String()
+}
+
+// listPromptVersions lists a template's versions, newest first, with the digests written with each and how their
+// entries were rated, so the edit that made digests worse stands out
+func listPromptVersions(a *App, template string) (string, error) {
+	name, versions, err := a.state.promptVersions(template)
+	if err != nil {
+		return "", err
+	}
+
+	type usage struct{ digests, up, down int }
+	used := make(map[string]*usage)
+	a.state.read(func(s *State) {
+		byDigest := make(map[string]string)
+		for _, digest := range s.Digests {
+			if hash, ok := digest.Prompts[name]; ok {
+				byDigest[digest.ID] = hash
+				if used[hash] == nil {
+					used[hash] = &usage{}
+				}
+				used[hash].digests++
+			}
+		}
+		for _, feedback := range s.Feedback {
+			hash, ok := byDigest[feedback.DigestID]
+			if !ok {
+				continue
+			}
+			if feedback.Rating > 0 {
+				used[hash].up++
+			} else if feedback.Rating < 0 {
+				used[hash].down++
+			}
+		}
+	})
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "**%s**\n", name)
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		fmt.Fprintf(&sb, "- `%s` from %s", v.Hash, v.SavedAt.In(a.Location).Format("Mon Jan 2 15:04"))
+		if i == len(versions)-1 {
+			sb.WriteString(" (current)")
+		}
+		if u := used[v.Hash]; u != nil {
+			fmt.Fprintf(&sb, ": %s, 👍 %d 👎 %d", pluralize(u.digests, "digest"), u.up, u.down)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// diffPromptVersions shows what changed from a version to the current one, or from the one before the current when no
+// version is given
+func diffPromptVersions(a *App, template, ref string) (string, error) {
+	name, versions, err := a.state.promptVersions(template)
+	if err != nil {
+		return "", err
+	}
+	current := versions[len(versions)-1]
+	var from PromptVersion
+	if ref == "" {
+		if len(versions) < 2 {
+			return fmt.Sprintf("%s hasn't changed since `%s`.", name, current.Hash), nil
+		}
+		from = versions[len(versions)-2]
+	} else if from, err = findPromptVersion(versions, ref); err != nil {
+		return "", err
+	}
+	if from.Hash == current.Hash {
+		return fmt.Sprintf("`%s` is the current version of %s.", from.Hash, name), nil
+	}
+
+	lines := lineDiff(strings.Split(from.Text, "\n"), strings.Split(current.Text, "\n"))
+	if len(lines) > maxDiffLines {
+		lines = append(lines[:maxDiffLines], fmt.Sprintf("… %d more lines", len(lines)-maxDiffLines))
+	}
+	return fmt.Sprintf("**%s** `%s` → `%s`\n```diff\n%s\n```", name, from.Hash, current.Hash, strings.Join(lines, "\n")), nil
+}
+
+// rollbackPrompt puts an earlier version of a template back, in the profile's templates directory and in the running
+// summarizer
+func (a *App) rollbackPrompt(ctx context.Context, template, ref string) (string, error) {
+	name, versions, err := a.state.promptVersions(template)
+	if err != nil {
+		return "", err
+	}
+	if ref == "" {
+		return "", fmt.Errorf("which version? /prompts list shows them")
+	}
+	version, err := findPromptVersion(versions, ref)
+	if err != nil {
+		return "", err
+	}
+	if version.Hash == versions[len(versions)-1].Hash {
+		return fmt.Sprintf("`%s` is already the current version of %s.", version.Hash, name), nil
+	}
+	if _, err := parsePrompt(name, version.Text, a.Location); err != nil {
+		return "", fmt.Errorf("version %s doesn't parse anymore: %w", version.Hash, err)
+	}
+
+	path := a.state.path(filepath.Join("templates", name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", fmt.Errorf("writing %s: %w", name, err)
+	}
+	if err := writeFileAtomic(path, []byte(version.Text), 0o644); err != nil {
+		return "", fmt.Errorf("writing %s: %w", name, err)
+	}
+	templates := *a.templates.Load()
+	*templates.files()[name] = version.Text
+	a.templates.Store(&templates)
+	if err := a.state.recordPromptVersions(&templates, a.Clock.Now()); err != nil {
+		return "", fmt.Errorf("recording the rollback: %w", err)
+	}
+
+	log.FromContext(ctx).Info("Prompt template rolled back", "template", name, "version", version.Hash)
+	return fmt.Sprintf("%s is back to `%s` from %s.", name, version.Hash, version.SavedAt.In(a.Location).Format("Mon Jan 2 15:04")), nil
+}
+
+// lineDiff compares two texts line by line, marking removed lines with "-", added ones with "+", and keeping a line of
+// unchanged context around each change
+func lineDiff(old, new []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of old[i:] and new[j:]
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var all []string
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case i < len(old) && j < len(new) && old[i] == new[j]:
+			all = append(all, "  "+old[i])
+			i++
+			j++
+		case i < len(old) && (j == len(new) || lcs[i+1][j] >= lcs[i][j+1]):
+			all = append(all, "- "+old[i])
+			i++
+		default:
+			all = append(all, "+ "+new[j])
+			j++
+		}
+	}
+
+	var out []string
+	skipped := false
+	for k, line := range all {
+		near := !strings.HasPrefix(line, "  ") ||
+			(k > 0 && !strings.HasPrefix(all[k-1], "  ")) ||
+			(k+1 < len(all) && !strings.HasPrefix(all[k+1], "  "))
+		if !near {
+			skipped = true
+			continue
+		}
+		if skipped && len(out) > 0 {
+			out = append(out, "  …")
+		}
+		skipped = false
+		out = append(out, line)
+	}
+	return out
+}
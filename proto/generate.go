@@ -0,0 +1,4 @@
+// Package readsuremailsv1 is the code generated from reads_ur_emails.proto, the grpc service's contract
+package readsuremailsv1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative reads_ur_emails.proto
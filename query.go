@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	// queryPreviewSize is how many of the matching emails /query test lists
+	queryPreviewSize = 5
+	// queryCountLimit is where /query test stops counting, so a query matching the whole mailbox answers quickly
+	queryCountLimit = 2000
+)
+
+// QueryPreview is what a Gmail search query matches
+type QueryPreview struct {
+	// Count is the number of matches, up to queryCountLimit
+	Count int
+	// More is whether there are more than Count
+	More bool
+	// Newest are the first few matches, newest first, with only their subject and sender
+	Newest []*gmail.Message
+}
+
+// fetchQueryPreview counts the emails matching query and reads the headers of the newest few, without fetching any
+// of their bodies
+func fetchQueryPreview(ctx context.Context, client *http.Client, query string, size int) (*QueryPreview, error) {
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Gmail client: %v", err)
+	}
+
+	preview := &QueryPreview{}
+	var ids []string
+	page := ""
+	for {
+		call := srv.Users.Messages.List("me").Q(query).MaxResults(500).Context(ctx)
+		if page != "" {
+			call = call.PageToken(page)
+		}
+		r, err := call.Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to run the query: %w", err)
+		}
+		for _, m := range r.Messages {
+			if len(ids) < size {
+				ids = append(ids, m.Id)
+			}
+		}
+		preview.Count += len(r.Messages)
+		if page = r.NextPageToken; page == "" {
+			break
+		}
+		if preview.Count >= queryCountLimit {
+			preview.More = true
+			break
+		}
+	}
+
+	for _, id := range ids {
+		msg, err := srv.Users.Messages.Get("me", id).Format("metadata").MetadataHeaders("Subject", "From").Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve message: %w", err)
+		}
+		preview.Newest = append(preview.Newest, msg)
+	}
+	return preview, nil
+}
+
+// queryCommand is /query test: what a Gmail search query matches, to get a fetch_query right before it goes in the
+// config
+func queryCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	query := strings.TrimSpace(options["query"])
+	if query == "" {
+		return "", fmt.Errorf("test which query?")
+	}
+
+	preview, err := a.Emails.Preview(ctx, query, queryPreviewSize)
+	if err != nil {
+		return "", err
+	}
+	if preview.Count == 0 {
+		return fmt.Sprintf("`%s` matches no emails. Gmail ignores what it doesn't understand, so check the operators are spelled right.", query), nil
+	}
+
+	var sb strings.Builder
+	count := pluralize(preview.Count, "email")
+	if preview.More {
+		count = "more than " + count
+	}
+	fmt.Fprintf(&sb, "`%s` matches %s. The newest:\n", query, count)
+	for _, msg := range preview.Newest {
+		subject := extractHeader(msg, "Subject")
+		if subject == "" {
+			subject = "(no subject)"
+		}
+		date := time.UnixMilli(msg.InternalDate).In(a.Location)
+		fmt.Fprintf(&sb, "- **%s** · %s · %s\n", subject, senderName(extractHeader(msg, "From")), a.locale().shortDate(date))
+	}
+	if query != a.Config.FetchQuery {
+		sb.WriteString("\nSet it as `fetch_query` in the config to only digest these emails.")
+	}
+	return sb.String(), nil
+}
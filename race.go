@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// raceGrace is how long the "best" strategy waits for the slower provider once the first has answered
+const raceGrace = 30 * time.Second
+
+// refusalPattern matches the answers a model gives instead of a summary
+var refusalPattern = regexp.MustCompile(`(?i)\b(i'm sorry|i am sorry|i cannot|i can't|as an ai)\b`)
+
+type RaceConfig struct {
+	Model    string `json:"model"`
+	BaseURL  string `json:"base_url"`
+	APIKey   string `json:"api_key"`
+	Strategy string `json:"strategy"`
+}
+
+// racer is the second provider the final summary is requested from, alongside the main one
+type racer struct {
+	client   *openai.Client
+	name     string
+	model    string
+	strategy string
+}
+
+func newRacer(config RaceConfig, openAIKey string, httpClient *http.Client) (*racer, error) {
+	switch config.Strategy {
+	case "", "first", "best":
+	default:
+		return nil, fmt.Errorf("unknown race strategy %q, expected first or best", config.Strategy)
+	}
+
+	key := config.APIKey
+	if key == "" {
+		key = openAIKey
+	}
+	clientConfig := openai.DefaultConfig(key)
+	if config.BaseURL != "" {
+		clientConfig.BaseURL = config.BaseURL
+	}
+	clientConfig.HTTPClient = withFixtures(httpClient)
+
+	r := &racer{
+		client:   openai.NewClientWithConfig(clientConfig),
+		model:    openai.GPT4o,
+		strategy: config.Strategy,
+	}
+	if config.Model != "" {
+		r.model = config.Model
+	}
+	r.name = r.model
+	if config.BaseURL != "" {
+		r.name += " at " + config.BaseURL
+	}
+	return r, nil
+}
+
+type raceResult struct {
+	provider string
+	text     string
+	err      error
+}
+
+// raceChatCompletion sends req to the main provider and the racer at once. with the "first" strategy the first
+// successful answer wins and the other request is cancelled, with "best" both answers are scored by summaryScore
+func (s *openAISummarizer) raceChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (string, error) {
+	if s.racer == nil {
+		return s.createChatCompletion(ctx, req)
+	}
+	logger := log.FromContext(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, 2)
+	go func() {
+		text, err := s.createChatCompletion(ctx, req)
+		results <- raceResult{provider: string(req.Model), text: text, err: err}
+	}()
+	go func() {
+		raced := req
+		raced.Model = s.racer.model
+		text, err := s.racer.createChatCompletion(ctx, raced)
+		results <- raceResult{provider: s.racer.name, text: text, err: err}
+	}()
+
+	var best *raceResult
+	var errs []error
+	var grace <-chan time.Time
+	for received := 0; received < 2; received++ {
+		var result raceResult
+		select {
+		case result = <-results:
+		case <-grace:
+			logger.Info("Race grace period over, keeping the answer we have", "provider", best.provider)
+			return best.text, nil
+		}
+
+		if result.err != nil {
+			logger.Warn("Provider failed in race", "provider", result.provider, "error", result.err)
+			errs = append(errs, fmt.Errorf("%s: %w", result.provider, result.err))
+			continue
+		}
+		if s.racer.strategy != "best" {
+			logger.Info("Race won", "provider", result.provider)
+			return result.text, nil
+		}
+		if best == nil {
+			best = &result
+			grace = time.After(raceGrace)
+			continue
+		}
+		if summaryScore(result.text) > summaryScore(best.text) {
+			best = &result
+		}
+	}
+
+	if best == nil {
+		return "", errors.Join(errs...)
+	}
+	logger.Info("Race won", "provider", best.provider, "score", summaryScore(best.text))
+	return best.text, nil
+}
+
+func (r *racer) createChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (string, error) {
+	resp, err := r.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("ChatCompletion error: %v", err)
+	}
+	recordUsage(resp.Usage)
+	if len(resp.Choices) == 0 {
+		return "", errors.New("ChatCompletion returned no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// summaryScore is a rough quality heuristic for a rendered summary: sections and bullet points are what the prompt
+// asks for, refusals and answers too short to cover anything are not
+func summaryScore(summary string) int {
+	summary = strings.TrimSpace(summary)
+	if summary == "" || refusalPattern.MatchString(summary) {
+		return 0
+	}
+
+	score := 1
+	lines := strings.Split(summary, "\n")
+	headings, bullets := 0, 0
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#"):
+			headings++
+		case strings.HasPrefix(line, "- "), strings.HasPrefix(line, "* "):
+			bullets++
+		}
+	}
+	score += min(headings, 6) * 2
+	score += min(bullets, 30)
+	if len(summary) >= 300 {
+		score += 5
+	}
+	return score
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// rateLimitWindow is the window both limits are counted over
+	rateLimitWindow = time.Minute
+	// maxRateLimitRetries is how many times a request the provider turned away with a 429 is sent again
+	maxRateLimitRetries = 3
+	// answerTokensEstimate is what a request is assumed to get back, until the response says
+	answerTokensEstimate = 500
+)
+
+type RateLimitConfig struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+	TokensPerMinute   int `json:"tokens_per_minute"`
+}
+
+// rateLimiter keeps every LLM request of the process within a requests and a tokens per minute limit, whichever
+// worker, command or pass it comes from. tokens are estimated from the request before it's sent, then corrected to what
+// the provider reports once the response is in
+type rateLimiter struct {
+	requestsPerMinute int
+	tokensPerMinute   int
+	now               func() time.Time
+
+	mu   sync.Mutex
+	sent []*rateLimitedRequest
+}
+
+type rateLimitedRequest struct {
+	at     time.Time
+	tokens int
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		requestsPerMinute: config.RequestsPerMinute,
+		tokensPerMinute:   config.TokensPerMinute,
+		now:               time.Now,
+	}
+}
+
+// wait blocks until a request of about tokens fits both limits, and counts it against them. a request bigger than the
+// whole tokens per minute limit goes out once the window is empty, instead of never
+func (l *rateLimiter) wait(ctx context.Context, tokens int) (*rateLimitedRequest, error) {
+	for {
+		l.mu.Lock()
+		now := l.now()
+		l.expire(now)
+
+		inWindow := 0
+		for _, r := range l.sent {
+			inWindow += r.tokens
+		}
+		requestsOK := l.requestsPerMinute <= 0 || len(l.sent) < l.requestsPerMinute
+		tokensOK := l.tokensPerMinute <= 0 || len(l.sent) == 0 || inWindow+tokens <= l.tokensPerMinute
+		if requestsOK && tokensOK {
+			r := &rateLimitedRequest{at: now, tokens: tokens}
+			l.sent = append(l.sent, r)
+			l.mu.Unlock()
+			return r, nil
+		}
+		delay := l.sent[0].at.Add(rateLimitWindow).Sub(now)
+		l.mu.Unlock()
+
+		log.Debug("Waiting for the LLM rate limit", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// expire drops the requests that have left the window. sent is in the order the requests went out
+func (l *rateLimiter) expire(now time.Time) {
+	i := 0
+	for i < len(l.sent) && now.Sub(l.sent[i].at) >= rateLimitWindow {
+		i++
+	}
+	l.sent = l.sent[i:]
+}
+
+// settle replaces the estimate of a request with the tokens it actually used
+func (l *rateLimiter) settle(r *rateLimitedRequest, tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.tokens = tokens
+}
+
+// rateLimitedTransport puts every request through the limiter, and retries the ones the provider rejects with a 429
+// after the delay it asks for
+type rateLimitedTransport struct {
+	limiter *rateLimiter
+	next    http.RoundTripper
+}
+
+// withRateLimit is client with its requests going through limiter, or client itself when there's no limiter
+func withRateLimit(client *http.Client, limiter *rateLimiter) *http.Client {
+	if limiter == nil {
+		return client
+	}
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	limited := *client
+	limited.Transport = &rateLimitedTransport{limiter: limiter, next: next}
+	return &limited
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	for attempt := 0; ; attempt++ {
+		sent, err := t.limiter.wait(req.Context(), estimateRequestTokens(body))
+		if err != nil {
+			return nil, err
+		}
+
+		attemptReq := req.Clone(req.Context())
+		if body != nil {
+			attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.next.RoundTrip(attemptReq)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < maxRateLimitRetries {
+			delay := retryAfter(resp.Header, attempt)
+			resp.Body.Close()
+			log.Warn("LLM provider is rate limiting, retrying", "delay", delay, "attempt", attempt+1)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			return resp, nil
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		if tokens, ok := responseTokens(data); ok {
+			t.limiter.settle(sent, tokens)
+		}
+		return resp, nil
+	}
+}
+
+// estimateRequestTokens guesses the tokens of a request from its size, at about four bytes to a token, plus room for
+// the answer
+func estimateRequestTokens(body []byte) int {
+	return len(body)/4 + answerTokensEstimate
+}
+
+// responseTokens reads the total token count out of a JSON response
+func responseTokens(data []byte) (int, bool) {
+	var parsed struct {
+		Usage *struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(data, &parsed) != nil || parsed.Usage == nil {
+		return 0, false
+	}
+	return parsed.Usage.TotalTokens, true
+}
+
+// retryAfter is the delay a 429 asks for, or an exponential backoff when it doesn't say
+func retryAfter(header http.Header, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(1<<attempt) * 5 * time.Second
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+// declinedReceiptRetention is how long a declined receipt request is remembered, long enough that no digest or mini
+// digest reads the email again
+const declinedReceiptRetention = 30 * 24 * time.Hour
+
+// receiptHeaders ask for a read receipt, the standard one first
+var receiptHeaders = []string{"Disposition-Notification-To", "Return-Receipt-To", "X-Confirm-Reading-To", "Read-Receipt-To"}
+
+// openTracker is a service that tracks when an email is opened, known by the host its pixel is loaded from
+type openTracker struct {
+	host string
+	name string
+	// personal trackers are the ones a person adds to their own emails, which are worth naming one by one, rather
+	// than the mailing services every newsletter comes through
+	personal bool
+}
+
+var openTrackers = []openTracker{
+	{"mailtrack.io", "Mailtrack", true},
+	{"superhuman.com", "Superhuman", true},
+	{"mixmax.com", "Mixmax", true},
+	{"yesware.com", "Yesware", true},
+	{"streak.com", "Streak", true},
+	{"mailsuite.com", "Mailsuite", true},
+	{"polymail.io", "Polymail", true},
+	{"bananatag.com", "Bananatag", true},
+	{"gmass.co", "GMass", true},
+	{"saleshandy.com", "SalesHandy", true},
+	{"mailshake.com", "Mailshake", true},
+	{"outreach.io", "Outreach", true},
+	{"salesloft.com", "Salesloft", true},
+	{"hubspotemail.net", "HubSpot", true},
+	{"hubspotlinks.com", "HubSpot", true},
+	{"list-manage.com", "Mailchimp", false},
+	{"sendgrid.net", "SendGrid", false},
+	{"mailgun.org", "Mailgun", false},
+	{"sparkpostmail.com", "SparkPost", false},
+	{"mandrillapp.com", "Mandrill", false},
+	{"klaviyo.com", "Klaviyo", false},
+	{"exct.net", "Salesforce Marketing Cloud", false},
+	{"rs6.net", "Constant Contact", false},
+	{"createsend.com", "Campaign Monitor", false},
+	{"convertkit-mail.com", "ConvertKit", false},
+	{"substack.com", "Substack", false},
+	{"awstrack.me", "Amazon SES", false},
+}
+
+var (
+	imgTagPattern    = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+	imgSrcPattern    = regexp.MustCompile(`(?is)\bsrc\s*=\s*["']?([^"'\s>]+)`)
+	tinyImagePattern = regexp.MustCompile(`(?is)\b(?:width\s*=\s*["']?[01]["'\s/>]|height\s*=\s*["']?[01]["'\s/>]|width\s*:\s*[01]px|height\s*:\s*[01]px)`)
+)
+
+type ReadReceiptsConfig struct {
+	// Decline answers each receipt request with a notice that the receipt was declined, which says nothing about
+	// whether the email was read. it needs gmail_access.send
+	Decline bool `json:"decline"`
+}
+
+// receiptRequest is where an email asks for its read receipt to go, "" when it doesn't ask for one
+func receiptRequest(message *gmail.Message) string {
+	if message.Payload == nil {
+		return ""
+	}
+	for _, header := range receiptHeaders {
+		if to := strings.TrimSpace(extractHeaderFold(message, header)); to != "" {
+			return to
+		}
+	}
+	return ""
+}
+
+// emailTrackers names the open trackers in an email's HTML: the known services, and "other invisible pixels" for a
+// tiny image from anywhere else
+func emailTrackers(message *gmail.Message) (trackers []openTracker) {
+	if message.Payload == nil {
+		return nil
+	}
+	for _, html := range htmlParts(message.Payload) {
+		for _, tag := range imgTagPattern.FindAllString(html, -1) {
+			match := imgSrcPattern.FindStringSubmatch(tag)
+			if match == nil || strings.HasPrefix(match[1], "cid:") || strings.HasPrefix(match[1], "data:") {
+				continue
+			}
+			src := strings.ToLower(match[1])
+			i := slices.IndexFunc(openTrackers, func(t openTracker) bool { return strings.Contains(src, t.host) })
+			var tracker openTracker
+			switch {
+			case i >= 0:
+				tracker = openTrackers[i]
+			case tinyImagePattern.MatchString(tag):
+				tracker = openTracker{name: "other invisible pixels"}
+			default:
+				continue
+			}
+			if !slices.ContainsFunc(trackers, func(t openTracker) bool { return t.name == tracker.name }) {
+				trackers = append(trackers, tracker)
+			}
+		}
+	}
+	return trackers
+}
+
+// htmlParts are the decoded HTML parts of an email, at any depth
+func htmlParts(part *gmail.MessagePart) []string {
+	var parts []string
+	if part.MimeType == "text/html" && part.Body != nil && part.Body.Data != "" {
+		if data, err := base64.URLEncoding.DecodeString(part.Body.Data); err == nil {
+			parts = append(parts, string(data))
+		}
+	}
+	for _, child := range part.Parts {
+		parts = append(parts, htmlParts(child)...)
+	}
+	return parts
+}
+
+// declineReadReceipts answers the receipt requests among the emails, once each, when the config says to and the
+// user let the bot send email
+func (a *App) declineReadReceipts(ctx context.Context, messages []*gmail.Message) {
+	config := a.Config.ReadReceipts
+	if config == nil || !config.Decline {
+		return
+	}
+	logger := log.FromContext(ctx)
+	if !a.hasScope(gmail.GmailSendScope) {
+		logger.Warn("Declining read receipts needs gmail_access.send, leaving them unanswered")
+		return
+	}
+
+	var declined map[string]time.Time
+	a.state.read(func(s *State) {
+		declined = maps.Clone(s.account().ReceiptsDeclined)
+	})
+
+	var sent []string
+	for _, message := range messages {
+		to := receiptRequest(message)
+		if to == "" {
+			continue
+		}
+		if _, ok := declined[message.Id]; ok {
+			continue
+		}
+		raw, err := declinedReceipt(message, to)
+		if err != nil {
+			logger.Error("Unable to write a declined read receipt", "message_id", message.Id, "error", err)
+			continue
+		}
+		if err := a.Emails.Send(ctx, raw, message.ThreadId); err != nil {
+			logger.Error("Unable to decline a read receipt", "message_id", message.Id, "error", err)
+			continue
+		}
+		logger.Info("Read receipt declined", "message_id", message.Id, "to", senderAddress(to))
+		sent = append(sent, message.Id)
+	}
+	if len(sent) == 0 {
+		return
+	}
+
+	now := a.Clock.Now()
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		if account.ReceiptsDeclined == nil {
+			account.ReceiptsDeclined = make(map[string]time.Time)
+		}
+		for id, at := range account.ReceiptsDeclined {
+			if now.Sub(at) > declinedReceiptRetention {
+				delete(account.ReceiptsDeclined, id)
+			}
+		}
+		for _, id := range sent {
+			account.ReceiptsDeclined[id] = now
+		}
+	}); err != nil {
+		logger.Error("Unable to remember the declined read receipts", "error", err)
+	}
+}
+
+// declinedReceipt is a message disposition notification (RFC 8098) that declines the receipt, with the "denied"
+// disposition of RFC 2298 that most mail clients still show as such
+func declinedReceipt(message *gmail.Message, to string) ([]byte, error) {
+	subject := extractHeader(message, "Subject")
+	messageID := extractHeaderFold(message, "Message-ID")
+	recipient := extractHeaderFold(message, "Delivered-To")
+	if recipient == "" {
+		recipient = senderAddress(extractHeader(message, "To"))
+	}
+
+	var body strings.Builder
+	w := multipart.NewWriter(&body)
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "The recipient declined to send a read receipt for your message %q.\r\n", subject)
+	report, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/disposition-notification"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(report, "Reporting-UA: reads_ur_emails\r\nFinal-Recipient: rfc822;%s\r\n", recipient)
+	if messageID != "" {
+		fmt.Fprintf(report, "Original-Message-ID: %s\r\n", messageID)
+	}
+	fmt.Fprint(report, "Disposition: manual-action/MDN-sent-automatically; denied\r\n")
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var raw strings.Builder
+	fmt.Fprintf(&raw, "To: %s\r\n", to)
+	fmt.Fprintf(&raw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Read receipt declined: "+strings.NewReplacer("\r", "", "\n", " ").Replace(subject)))
+	if messageID != "" {
+		fmt.Fprintf(&raw, "In-Reply-To: %s\r\nReferences: %s\r\n", messageID, messageID)
+	}
+	fmt.Fprintf(&raw, "Auto-Submitted: auto-replied\r\nMIME-Version: 1.0\r\n")
+	fmt.Fprintf(&raw, "Content-Type: multipart/report; report-type=disposition-notification; boundary=%q\r\n\r\n", w.Boundary())
+	raw.WriteString(body.String())
+	return []byte(raw.String()), nil
+}
+
+// privacySection notes which emails asked for a read receipt, and which track opens. trackers a person added are
+// named by sender; the mailing services nearly every newsletter uses are only counted
+func (a *App) privacySection(messages []*gmail.Message) *DigestSection {
+	if a.Config.ReadReceipts == nil {
+		return nil
+	}
+	var declined map[string]time.Time
+	a.state.read(func(s *State) {
+		declined = maps.Clone(s.account().ReceiptsDeclined)
+	})
+
+	section := &DigestSection{Key: "privacy", Title: "🕵️ Privacy notes"}
+	bulk := make(map[string]int)
+	for _, message := range messages {
+		sender := senderName(extractHeader(message, "From"))
+		subject := extractHeader(message, "Subject")
+		if receiptRequest(message) != "" {
+			line := fmt.Sprintf("**%s** asked for a read receipt on %q", sender, subject)
+			if _, ok := declined[message.Id]; ok {
+				line += ", declined"
+			}
+			section.Lines = append(section.Lines, line)
+		}
+		var personal []string
+		for _, tracker := range emailTrackers(message) {
+			if tracker.personal {
+				personal = append(personal, tracker.name)
+			} else {
+				bulk[tracker.name]++
+			}
+		}
+		if len(personal) > 0 {
+			section.Lines = append(section.Lines, fmt.Sprintf("**%s** tracks whether you open %q (%s)", sender, subject, strings.Join(personal, ", ")))
+		}
+	}
+	if len(bulk) > 0 {
+		var counts []string
+		for _, name := range sortedKeys(bulk) {
+			counts = append(counts, fmt.Sprintf("%s (%d)", name, bulk[name]))
+		}
+		section.Lines = append(section.Lines, "Newsletters tracking opens: "+strings.Join(counts, ", "))
+	}
+	return section
+}
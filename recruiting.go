@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+)
+
+// defaultRecruitingStaleDays is how long an application can go quiet before it leaves the pipeline when the config
+// doesn't say
+const defaultRecruitingStaleDays = 30
+
+// recruitingPattern picks out the emails worth asking the model about, lowercased. an email in a thread that's already
+// in the pipeline is always asked about
+var recruitingPattern = regexp.MustCompile(`recruit|talent|hiring|interview|application|applied|candidate|position|role at|opportunity|offer letter|job offer|greenhouse|lever\.co|workday|ashbyhq|smartrecruiters|jobvite|linkedin`)
+
+// recruitingStages are the stages of an application, in the order the pipeline lists them
+var recruitingStages = []string{"offer", "interviewing", "screening", "applied", "contacted", "rejected", "withdrawn"}
+
+type RecruitingConfig struct {
+	// StaleDays is how many days an application can go without news before it leaves the pipeline. rejected and
+	// withdrawn ones leave after the weekly summary that shows them
+	StaleDays int `json:"stale_days"`
+}
+
+// RecruitingThread is one application or recruiter conversation, followed across days and email threads
+type RecruitingThread struct {
+	Company      string    `json:"company"`
+	Role         string    `json:"role"`
+	Stage        string    `json:"stage"`
+	NextStep     string    `json:"next_step"`
+	NextStepDate string    `json:"next_step_date"`
+	ThreadIDs    []string  `json:"thread_ids"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastUpdate   time.Time `json:"last_update"`
+}
+
+// key tells applications apart: the same role at the same company is the same application, however many threads
+func (t *RecruitingThread) key() string {
+	return strings.ToLower(strings.TrimSpace(t.Company)) + "|" + strings.ToLower(strings.TrimSpace(t.Role))
+}
+
+// RecruitingUpdate is what the model read from one email about an application
+type RecruitingUpdate struct {
+	MessageID    string `json:"message_id"`
+	Company      string `json:"company"`
+	Role         string `json:"role"`
+	Stage        string `json:"stage"`
+	NextStep     string `json:"next_step"`
+	NextStepDate string `json:"next_step_date"`
+}
+
+// ExtractRecruiting asks the model which emails are about the user's job search and where each application stands.
+// the known applications are in the prompt, so an update is filed under the one it belongs to
+func (s *openAISummarizer) ExtractRecruiting(ctx context.Context, messages []*gmail.Message, known []RecruitingThread) ([]RecruitingUpdate, error) {
+	location := s.clock.Now().Location()
+
+	var threads strings.Builder
+	for _, thread := range known {
+		fmt.Fprintf(&threads, "- %s, %s: %s\n", thread.Company, thread.Role, thread.Stage)
+	}
+	if threads.Len() == 0 {
+		threads.WriteString("None yet.\n")
+	}
+
+	var emails strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&emails, "## id: %s\n- **From:** %s\n- **Subject:** %s\n- **Date:** %s\n\n%s\n\n",
+			message.Id,
+			extractHeader(message, "From"),
+			extractHeader(message, "Subject"),
+			localDate(extractHeader(message, "Date"), location),
+			truncateTokens(500, stripQuotes(extractBody(message))),
+		)
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().Recruiting, map[string]any{"threads": threads.String(), "emails": emails.String()})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.callOpenAIJSON(ctx, []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: prompt,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Updates []RecruitingUpdate `json:"updates"`
+	}
+	if err := json.Unmarshal([]byte(resp), &parsed); err != nil {
+		return nil, fmt.Errorf("unable to parse recruiting updates: %v", err)
+	}
+	return parsed.Updates, nil
+}
+
+// trackRecruiting files the day's recruiting emails into the pipeline. it's best effort: a failure only means the
+// pipeline misses a day, the emails are in the digest either way
+func (a *App) trackRecruiting(ctx context.Context, messages []*gmail.Message) {
+	if a.Config.Recruiting == nil || len(messages) == 0 {
+		return
+	}
+	logger := log.FromContext(ctx)
+
+	var known []RecruitingThread
+	a.state.read(func(s *State) {
+		known = append(known, s.account().Recruiting...)
+	})
+	tracked := make(map[string]bool)
+	for _, thread := range known {
+		for _, id := range thread.ThreadIDs {
+			tracked[id] = true
+		}
+	}
+
+	var candidates []*gmail.Message
+	for _, message := range messages {
+		text := strings.ToLower(extractHeader(message, "From") + " " + extractHeader(message, "Subject") + " " + message.Snippet)
+		if tracked[message.ThreadId] || recruitingPattern.MatchString(text) {
+			candidates = append(candidates, message)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	updates, err := a.Summarizer.ExtractRecruiting(ctx, candidates, known)
+	if err != nil {
+		logger.Error("Unable to track recruiting emails", "error", err)
+		return
+	}
+	byID := make(map[string]*gmail.Message, len(candidates))
+	for _, message := range candidates {
+		byID[message.Id] = message
+	}
+
+	now := a.Clock.Now()
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		for _, update := range updates {
+			message, ok := byID[update.MessageID]
+			if !ok || (update.Company == "" && update.Role == "") || !slices.Contains(recruitingStages, update.Stage) {
+				continue
+			}
+			account.Recruiting = applyRecruitingUpdate(account.Recruiting, update, message.ThreadId, now)
+		}
+	}); err != nil {
+		logger.Error("Unable to save the recruiting pipeline", "error", err)
+		return
+	}
+	logger.Info("Recruiting pipeline updated", "emails", len(candidates), "updates", len(updates))
+}
+
+// applyRecruitingUpdate moves an application along, or starts one. an application is found by its company and role,
+// or failing that by the email's thread, since a later email may name the role differently
+func applyRecruitingUpdate(threads []RecruitingThread, update RecruitingUpdate, threadID string, now time.Time) []RecruitingThread {
+	incoming := RecruitingThread{Company: update.Company, Role: update.Role}
+	i := slices.IndexFunc(threads, func(t RecruitingThread) bool { return t.key() == incoming.key() })
+	if i < 0 && threadID != "" {
+		i = slices.IndexFunc(threads, func(t RecruitingThread) bool { return slices.Contains(t.ThreadIDs, threadID) })
+	}
+	if i < 0 {
+		threads = append(threads, RecruitingThread{Company: update.Company, Role: update.Role, FirstSeen: now})
+		i = len(threads) - 1
+	}
+
+	thread := &threads[i]
+	if thread.Company == "" {
+		thread.Company = update.Company
+	}
+	if thread.Role == "" {
+		thread.Role = update.Role
+	}
+	thread.Stage = update.Stage
+	thread.NextStep = update.NextStep
+	thread.NextStepDate = update.NextStepDate
+	thread.LastUpdate = now
+	if threadID != "" && !slices.Contains(thread.ThreadIDs, threadID) {
+		thread.ThreadIDs = append(thread.ThreadIDs, threadID)
+	}
+	return threads
+}
+
+// recruitingSection is the weekly summary's pipeline table, with the upcoming next steps listed under it
+func (a *App) recruitingSection() *DigestSection {
+	if a.Config.Recruiting == nil {
+		return nil
+	}
+	var threads []RecruitingThread
+	a.state.read(func(s *State) {
+		threads = append(threads, s.account().Recruiting...)
+	})
+	if len(threads) == 0 {
+		return nil
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		si, sj := slices.Index(recruitingStages, threads[i].Stage), slices.Index(recruitingStages, threads[j].Stage)
+		if si != sj {
+			return si < sj
+		}
+		return threads[i].LastUpdate.After(threads[j].LastUpdate)
+	})
+
+	var table strings.Builder
+	table.WriteString("| Company | Role | Stage | Next step | Last news |\n|---|---|---|---|---|\n")
+	cell := strings.NewReplacer("|", "/", "\n", " ")
+	var lines []string
+	for _, thread := range threads {
+		next := thread.NextStep
+		if thread.NextStepDate != "" {
+			next = strings.TrimSpace(next + " " + thread.NextStepDate)
+		}
+		fmt.Fprintf(&table, "| %s | %s | %s | %s | %s |\n", cell.Replace(thread.Company), cell.Replace(thread.Role), thread.Stage,
+			cell.Replace(next), a.locale().shortDate(thread.LastUpdate.In(a.Location)))
+		if next != "" && thread.Stage != "rejected" && thread.Stage != "withdrawn" {
+			lines = append(lines, fmt.Sprintf("**%s**: %s", thread.Company, next))
+		}
+	}
+	if len(lines) == 0 {
+		lines = []string{"Nothing to do, waiting to hear back."}
+	}
+	return &DigestSection{
+		Key:   "recruiting",
+		Title: "💼 Job pipeline",
+		Intro: strings.TrimSuffix(table.String(), "\n") + "\n\nNext steps:",
+		Lines: lines,
+	}
+}
+
+// pruneRecruiting drops the applications that are over: rejected or withdrawn, now that a weekly summary showed them,
+// and the ones without news for longer than stale_days
+func (a *App) pruneRecruiting() error {
+	if a.Config.Recruiting == nil {
+		return nil
+	}
+	staleDays := a.Config.Recruiting.StaleDays
+	if staleDays <= 0 {
+		staleDays = defaultRecruitingStaleDays
+	}
+	cutoff := a.Clock.Now().AddDate(0, 0, -staleDays)
+	return a.state.update(func(s *State) {
+		account := s.account()
+		account.Recruiting = slices.DeleteFunc(account.Recruiting, func(t RecruitingThread) bool {
+			return t.Stage == "rejected" || t.Stage == "withdrawn" || t.LastUpdate.Before(cutoff)
+		})
+	})
+}
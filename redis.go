@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/redis/go-redis/v9"
+	"scheduler"
+)
+
+// redisTimeout bounds a Redis command when the context doesn't, so a stalled server can't hold up a digest
+const redisTimeout = 10 * time.Second
+
+// runClaimTTL is how long a replica's claim on a run of a scheduled task is kept, longer than any clock skew between
+// the replicas
+const runClaimTTL = maxTaskRuntime
+
+// outboxLeaseTTL is how long a replica's lease on a queued digest lasts if it stops renewing it
+const outboxLeaseTTL = 30 * time.Second
+
+type RedisConfig struct {
+	// URL is the server, redis://[user:password@]host:port[/db], or rediss:// for TLS
+	URL string `json:"url"`
+	// Prefix starts every key, so several deployments can share a server. "reu" when unset
+	Prefix string `json:"prefix"`
+}
+
+// redisClient is the connection the replicas coordinate through, with the keys of the profile
+type redisClient struct {
+	rdb *redis.Client
+	// prefix starts the keys of the profile, the config's prefix and the profile's name
+	prefix string
+}
+
+func newRedisClient(config *RedisConfig, profile string) (*redisClient, error) {
+	options, err := redis.ParseURL(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	// a command's deadline is its context's, or redisTimeout when the context has none
+	options.DialTimeout = redisTimeout
+	options.ReadTimeout = redisTimeout
+	options.WriteTimeout = redisTimeout
+	options.ContextTimeoutEnabled = true
+
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = "reu"
+	}
+	if profile == "" {
+		profile = defaultTenant
+	}
+	return &redisClient{rdb: redis.NewClient(options), prefix: prefix + ":" + profile}, nil
+}
+
+// key is the profile's key made of parts
+func (c *redisClient) key(parts ...string) string {
+	return c.prefix + ":" + strings.Join(parts, ":")
+}
+
+// get is the value of key, nil when there isn't one
+func (c *redisClient) get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.rdb.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// set sets key to value, expiring after ttl. with onlyNew it only sets a key that doesn't exist, and says whether it did
+func (c *redisClient) set(ctx context.Context, key string, value []byte, ttl time.Duration, onlyNew bool) (bool, error) {
+	if onlyNew {
+		return c.rdb.SetNX(ctx, key, value, ttl).Result()
+	}
+	if err := c.rdb.Set(ctx, key, value, ttl).Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hget is field of the hash at key, nil when there isn't one
+func (c *redisClient) hget(ctx context.Context, key, field string) ([]byte, error) {
+	data, err := c.rdb.HGet(ctx, key, field).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// hset sets field of the hash at key
+func (c *redisClient) hset(ctx context.Context, key, field string, value []byte) error {
+	return c.rdb.HSet(ctx, key, field, value).Err()
+}
+
+// hdel deletes fields of the hash at key
+func (c *redisClient) hdel(ctx context.Context, key string, fields ...string) error {
+	return c.rdb.HDel(ctx, key, fields...).Err()
+}
+
+// hvals are the values of the hash at key
+func (c *redisClient) hvals(ctx context.Context, key string) ([][]byte, error) {
+	values, err := c.rdb.HVals(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	data := make([][]byte, len(values))
+	for i, value := range values {
+		data[i] = []byte(value)
+	}
+	return data, nil
+}
+
+// the lease scripts only touch a key that still holds the lease's token, so a replica whose lease ran out can't renew
+// or release the lease another replica took since
+var (
+	renewLeaseScript   = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`)
+	releaseLeaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+)
+
+// redisLease is a key this replica holds for as long as it keeps renewing it. a replica that dies holding it only
+// holds it up for the rest of its ttl
+type redisLease struct {
+	client *redisClient
+	key    string
+	// token tells this replica's lease from one another replica took after it ran out
+	token string
+	ttl   time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// lease takes key for ttl at a time, renewing it until it's released. nil when another replica holds it
+func (c *redisClient) lease(ctx context.Context, key string, ttl time.Duration) (*redisLease, error) {
+	l := &redisLease{client: c, key: key, token: newRunID(), ttl: ttl, stop: make(chan struct{}), done: make(chan struct{})}
+	taken, err := c.rdb.SetNX(ctx, key, l.token, ttl).Result()
+	if err != nil || !taken {
+		return nil, err
+	}
+	go l.renew(log.FromContext(ctx))
+	return l, nil
+}
+
+// renew extends the lease every third of its ttl, until it's released or lost
+func (l *redisLease) renew(logger *log.Logger) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		renewed, err := renewLeaseScript.Run(ctx, l.client.rdb, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+		cancel()
+		if err != nil {
+			// the next tick tries again, the lease has two more in it
+			logger.Warn("Unable to renew the lease in Redis", "key", l.key, "error", err)
+		} else if renewed == 0 {
+			logger.Warn("The lease in Redis ran out before it was renewed", "key", l.key)
+			return
+		}
+	}
+}
+
+// release stops renewing the lease and gives it up, so another replica can take it straight away
+func (l *redisLease) release() {
+	close(l.stop)
+	<-l.done
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	// a lease that can't be released runs out on its own
+	_ = releaseLeaseScript.Run(ctx, l.client.rdb, []string{l.key}, l.token).Err()
+}
+
+// claimRun is whether this replica is the one to do a run of a scheduled task. the run is named after the time the
+// schedule had it due, which is the same on every replica however late each gets to start it, so the first to claim
+// that time does the run. when Redis can't be reached the run goes ahead: a digest twice beats none
+func (a *App) claimRun(ctx context.Context, name string) bool {
+	due, ok := scheduler.ScheduledAt(ctx)
+	if !ok {
+		// a retry after a panic, which only this replica makes
+		due = a.Clock.Now()
+	}
+	return a.claim(ctx, name, strconv.FormatInt(due.Unix(), 10))
+}
+
+// claim is whether this replica is the first to claim run of the task called name
+func (a *App) claim(ctx context.Context, name, run string) bool {
+	// the claim names the replica, for whoever looks at the keys
+	replica, _ := os.Hostname()
+	claimed, err := a.redis.set(ctx, a.redis.key("run", name, run), []byte(replica), runClaimTTL, true)
+	if err != nil {
+		log.FromContext(ctx).Warn("Unable to claim the run in Redis, running it anyway", "error", err)
+		return true
+	}
+	return claimed
+}
+
+// leaseOutboxEntry is whether this replica is the one to try the queued digest now. the lease on the digest is short
+// and renewed while the replica holds it, so a replica that dies mid-send only holds the digest up for a moment, and
+// release gives it up once the try is recorded in the outbox. a replica that listed the outbox before another tried the
+// digest finds it gone or further along once it has the lease, and leaves it. without Redis the outbox is the
+// replica's own
+func (a *App) leaseOutboxEntry(ctx context.Context, entry OutboxEntry) (release func(), ok bool) {
+	if a.redis == nil {
+		return func() {}, true
+	}
+	logger := log.FromContext(ctx)
+	lease, err := a.redis.lease(ctx, a.redis.key("outbox-lease", entry.Digest.ID), outboxLeaseTTL)
+	if err != nil {
+		logger.Warn("Unable to lease the queued digest in Redis, trying it anyway", "digest_id", entry.Digest.ID, "error", err)
+		return func() {}, true
+	}
+	if lease == nil {
+		return nil, false
+	}
+	current, err := a.outbox.get(ctx, entry.Digest.ID)
+	if err != nil {
+		logger.Warn("Unable to read the queued digest again, leaving it for the next check", "digest_id", entry.Digest.ID, "error", err)
+	}
+	if err != nil || current == nil || current.Attempts != entry.Attempts {
+		lease.release()
+		return nil, false
+	}
+	return lease.release, true
+}
+
+// createScheduledTask is createTask for the recurring tasks. with Redis, each run is done by one replica only, which
+// starts it from the state as the replicas last saved it
+func (a *App) createScheduledTask(name string, fn func(ctx context.Context) error) *scheduler.Task {
+	return a.createClaimedTask(name, func(ctx context.Context) bool {
+		return a.claimRun(ctx, name)
+	}, fn)
+}
+
+// createResumeTask is createScheduledTask for a one-off task that every replica schedules on its own when it starts,
+// like resuming a digest or settling an approval. the run is claimed by id, what it resumes, since each replica
+// schedules it at its own time
+func (a *App) createResumeTask(name, id string, fn func(ctx context.Context) error) *scheduler.Task {
+	return a.createClaimedTask(name, func(ctx context.Context) bool {
+		return a.claim(ctx, name, id)
+	}, fn)
+}
+
+func (a *App) createClaimedTask(name string, claim func(ctx context.Context) bool, fn func(ctx context.Context) error) *scheduler.Task {
+	if a.redis == nil {
+		return createTask(name, fn)
+	}
+	return createTask(name, func(ctx context.Context) error {
+		if !claim(ctx) {
+			log.FromContext(ctx).Info("Another replica has this run, skipping")
+			return nil
+		}
+		if err := a.state.reload(); err != nil {
+			return err
+		}
+		return fn(ctx)
+	})
+}
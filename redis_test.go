@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// fixedClock is always at the same time
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// newTestReplicas are replicas of one profile sharing a Redis server of their own
+func newTestReplicas(t *testing.T, n int) (*miniredis.Miniredis, []*App) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	replicas := make([]*App, n)
+	for i := range replicas {
+		client, err := newRedisClient(&RedisConfig{URL: "redis://" + server.Addr()}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.rdb.Close() })
+		replicas[i] = &App{
+			Clock:  fixedClock(time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)),
+			redis:  client,
+			outbox: redisOutbox{redis: client},
+		}
+	}
+	return server, replicas
+}
+
+// TestClaimRun has two replicas start the same run of a task, and only the first does it
+func TestClaimRun(t *testing.T) {
+	server, replicas := newTestReplicas(t, 2)
+	ctx := context.Background()
+
+	if !replicas[0].claimRun(ctx, "daily") {
+		t.Fatal("the first replica didn't get the run")
+	}
+	if replicas[1].claimRun(ctx, "daily") {
+		t.Error("the second replica got the run the first claimed")
+	}
+	if !replicas[1].claimRun(ctx, "weekly") {
+		t.Error("the second replica didn't get a run of another task")
+	}
+
+	// a claim outlives the run, so a replica that gets to it late still skips it
+	server.FastForward(runClaimTTL - time.Second)
+	if replicas[1].claimRun(ctx, "daily") {
+		t.Error("the second replica got the run before its claim expired")
+	}
+
+	server.Close()
+	if !replicas[1].claimRun(ctx, "monthly") {
+		t.Error("the run was skipped without Redis, want it done anyway")
+	}
+}
+
+// TestLeaseOutboxEntry has two replicas try the same queued digest, and only one at a time does
+func TestLeaseOutboxEntry(t *testing.T) {
+	server, replicas := newTestReplicas(t, 2)
+	ctx := context.Background()
+	entry := OutboxEntry{Digest: &Digest{ID: "daily-2026-10-16", Kind: "daily"}, ChannelID: "123", Attempts: 1}
+	if err := replicas[0].outbox.put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	release, ok := replicas[0].leaseOutboxEntry(ctx, entry)
+	if !ok {
+		t.Fatal("the first replica didn't get the lease")
+	}
+	if _, ok := replicas[1].leaseOutboxEntry(ctx, entry); ok {
+		t.Error("the second replica got the lease the first holds")
+	}
+
+	// the first replica's try fails and is recorded before it lets go
+	tried := entry
+	tried.Attempts++
+	if err := replicas[0].outbox.put(ctx, tried); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, ok := replicas[1].leaseOutboxEntry(ctx, entry); ok {
+		t.Error("the second replica got the lease on the digest as it listed it, after the first tried it")
+	}
+	release, ok = replicas[1].leaseOutboxEntry(ctx, tried)
+	if !ok {
+		t.Fatal("the second replica didn't get the lease on the digest as it's queued now")
+	}
+	release()
+
+	// a replica that dies holding the lease only holds the digest up until it runs out
+	key := replicas[0].redis.key("outbox-lease", entry.Digest.ID)
+	server.Set(key, "gone")
+	server.SetTTL(key, outboxLeaseTTL)
+	if _, ok := replicas[1].leaseOutboxEntry(ctx, tried); ok {
+		t.Error("the second replica got the lease another holds")
+	}
+	server.FastForward(outboxLeaseTTL)
+	release, ok = replicas[1].leaseOutboxEntry(ctx, tried)
+	if !ok {
+		t.Fatal("the second replica didn't get the lease once it ran out")
+	}
+	release()
+
+	if err := replicas[0].outbox.remove(ctx, entry.Digest.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := replicas[1].leaseOutboxEntry(ctx, tried); ok {
+		t.Error("a replica got the lease on a digest that isn't queued any more")
+	}
+}
+
+// TestRedisLeaseRenew checks a lease is renewed while it's held, and that a lease that ran out and was taken by
+// another replica isn't renewed or released by the one that lost it
+func TestRedisLeaseRenew(t *testing.T) {
+	server, replicas := newTestReplicas(t, 1)
+	ctx := context.Background()
+	client := replicas[0].redis
+	ttl := 300 * time.Millisecond
+
+	lease, err := client.lease(ctx, "lease", ttl)
+	if err != nil || lease == nil {
+		t.Fatalf("lease = %v, %v, want it taken", lease, err)
+	}
+	server.FastForward(ttl / 2)
+	time.Sleep(ttl / 2)
+	if left := server.TTL("lease"); left <= ttl/2 {
+		t.Errorf("the lease has %v left, want it renewed to %v", left, ttl)
+	}
+
+	// the lease runs out and another replica takes it
+	server.Set("lease", "another")
+	lease.release()
+	if value, _ := server.Get("lease"); value != "another" {
+		t.Errorf("lease = %q, want the other replica's lease kept", value)
+	}
+}
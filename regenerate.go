@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+// digestStyles are extra instructions for the final summary message, picked with /regenerate style:...
+var digestStyles = map[string]string{
+	"brief":    "Keep the message very short: one line per topic, only what needs the user's attention, no greeting.",
+	"detailed": "Be thorough: cover every topic in the scratchpad with its context, names, dates and amounts.",
+	"bullets":  "Format the whole message as a flat bulleted list, one bullet per email or thread, without headings or prose.",
+}
+
+type digestStyleKey struct{}
+
+// withDigestStyle asks the summarizer to write the summary message in one of digestStyles
+func withDigestStyle(ctx context.Context, style string) context.Context {
+	return context.WithValue(ctx, digestStyleKey{}, style)
+}
+
+func digestStyleFromContext(ctx context.Context) string {
+	style, _ := ctx.Value(digestStyleKey{}).(string)
+	return style
+}
+
+// cacheDigestEmails keeps the emails behind the latest digest of a kind, for /regenerate
+func (st *stateStore) cacheDigestEmails(kind string, messages []*gmail.Message) error {
+	return st.update(func(s *State) {
+		account := s.account()
+		if account.LastDigestEmails == nil {
+			account.LastDigestEmails = make(map[string][]*gmail.Message)
+		}
+		account.LastDigestEmails[kind] = messages
+	})
+}
+
+// regenerateCommand is /regenerate: summarizes the emails behind the latest daily or weekly digest again, optionally in
+// another style. nothing is fetched, queued or archived, so it can be run as often as you like
+func regenerateCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	kind := options["kind"]
+	if kind == "" {
+		kind = "daily"
+	}
+	style := options["style"]
+	if _, ok := digestStyles[style]; style != "" && !ok {
+		return "", fmt.Errorf("unknown style %q", style)
+	}
+
+	var messages []*gmail.Message
+	a.state.read(func(s *State) {
+		messages = s.account().LastDigestEmails[kind]
+	})
+	if len(messages) == 0 {
+		return fmt.Sprintf("There's no %s digest to regenerate yet.", kind), nil
+	}
+
+	ctx = a.startDigest(ctx, oneOffDigestID(a.Profile, kind, a.Clock.Now()))
+	ctx = withDigestStyle(ctx, style)
+	log.FromContext(ctx).Info("Regenerating digest", "kind", kind, "style", style, "emails", len(messages))
+
+	digest, err := a.summarizeWithinBudget(ctx, kind, messages)
+	if err != nil {
+		return "", fmt.Errorf("regenerating %s summary: %w", kind, err)
+	}
+	return renderDiscord(digest), nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord's embed limits
+const (
+	maxEmbedDescription     = 4096
+	maxEmbedsPerMessage     = 10
+	maxEmbedCharsPerMessage = 6000
+)
+
+// embedColors tell the digest kinds apart at a glance
+var embedColors = map[string]int{
+	"daily":     0x5865F2,
+	"weekly":    0x57F287,
+	"topic":     0xFEE75C,
+	"monthly":   0xEB459E,
+	"quarterly": 0xEB459E,
+}
+
+// digestRenderers turn a digest into each of the text formats it can be delivered in, by name. embeds aren't text, see
+// renderEmbeds
+var digestRenderers = map[string]func(d *Digest) (string, error){
+	"markdown": func(d *Digest) (string, error) { return renderMarkdown(d), nil },
+	"discord":  func(d *Digest) (string, error) { return renderDiscord(d), nil },
+	"html":     func(d *Digest) (string, error) { return renderHTML(d), nil },
+	"text":     func(d *Digest) (string, error) { return renderText(d), nil },
+	"json":     renderJSON,
+}
+
+// renderDigest renders d in the named format
+func renderDigest(d *Digest, format string) (string, error) {
+	render, ok := digestRenderers[format]
+	if !ok {
+		return "", fmt.Errorf("unknown digest format %q, expected one of %s", format, strings.Join(digestFormats(), ", "))
+	}
+	return render(d)
+}
+
+// digestFormats lists the names of the text renderers
+func digestFormats() []string {
+	formats := make([]string, 0, len(digestRenderers))
+	for format := range digestRenderers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// digestTitle names a digest, e.g. "Daily summary · Fri 16 Oct"
+func digestTitle(d *Digest) string {
+	date := localeOf(d.Locale).shortDate(d.GeneratedAt)
+	if d.Title != "" {
+		return fmt.Sprintf("%s · %s", d.Title, date)
+	}
+	kind := d.Kind
+	if kind != "" {
+		kind = strings.ToUpper(kind[:1]) + kind[1:]
+	}
+	return fmt.Sprintf("%s summary · %s", kind, date)
+}
+
+// renderMarkdown is the summary followed by the sections, in plain Markdown
+func renderMarkdown(d *Digest) string {
+	var sb strings.Builder
+	sb.WriteString(strings.TrimSpace(d.Summary))
+	for _, section := range d.Sections {
+		sb.WriteString("\n\n")
+		sb.WriteString(sectionMarkdown(section))
+	}
+	return sb.String()
+}
+
+// sectionMarkdown renders a section as a heading and a list, or as a single "**Title:** a · b" line when it's inline
+func sectionMarkdown(section DigestSection) string {
+	if section.Inline {
+		return fmt.Sprintf("**%s:** %s", section.Title, strings.Join(section.Lines, " · "))
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "## %s\n", section.Title)
+	if section.Intro != "" {
+		sb.WriteString(section.Intro + "\n")
+	}
+	for _, line := range section.Lines {
+		sb.WriteString("- " + line + "\n")
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// renderDiscord is renderMarkdown with the tables Discord can't show turned into code blocks
+func renderDiscord(d *Digest) string {
+	return discordTables(renderMarkdown(d))
+}
+
+// renderEmbeds lays the digest out as Discord embeds: the summary under the digest's title, then one embed per
+// section, with anything over Discord's limits carried on in further embeds. the last one has the email count and cost
+func renderEmbeds(d *Digest) []*discordgo.MessageEmbed {
+	color := embedColors[d.Kind]
+	var embeds []*discordgo.MessageEmbed
+	add := func(title, text string) {
+		for i, chunk := range splitMessage(discordTables(text), maxEmbedDescription) {
+			embed := &discordgo.MessageEmbed{Description: chunk, Color: color}
+			if i == 0 {
+				embed.Title = title
+			}
+			embeds = append(embeds, embed)
+		}
+	}
+
+	add(digestTitle(d), strings.TrimSpace(d.Summary))
+	for _, section := range d.Sections {
+		if section.Inline {
+			add(section.Title, strings.Join(section.Lines, " · "))
+			continue
+		}
+		text := ""
+		if section.Intro != "" {
+			text = section.Intro + "\n"
+		}
+		for _, line := range section.Lines {
+			text += "- " + line + "\n"
+		}
+		add(section.Title, text)
+	}
+
+	last := embeds[len(embeds)-1]
+	last.Footer = &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("%s · $%.2f", pluralize(d.EmailCount, "email"), d.Usage.CostUSD)}
+	last.Timestamp = d.GeneratedAt.Format("2006-01-02T15:04:05Z07:00")
+	return embeds
+}
+
+// groupEmbeds splits embeds into messages within Discord's per-message limits
+func groupEmbeds(embeds []*discordgo.MessageEmbed) [][]*discordgo.MessageEmbed {
+	var groups [][]*discordgo.MessageEmbed
+	var current []*discordgo.MessageEmbed
+	chars := 0
+	for _, embed := range embeds {
+		size := utf8.RuneCountInString(embed.Title) + utf8.RuneCountInString(embed.Description)
+		if embed.Footer != nil {
+			size += utf8.RuneCountInString(embed.Footer.Text)
+		}
+		if len(current) > 0 && (len(current) == maxEmbedsPerMessage || chars+size > maxEmbedCharsPerMessage) {
+			groups = append(groups, current)
+			current, chars = nil, 0
+		}
+		current = append(current, embed)
+		chars += size
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+	return groups
+}
+
+// renderJSON is the digest itself, indented
+func renderJSON(d *Digest) (string, error) {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding digest: %w", err)
+	}
+	return string(data), nil
+}
+
+// renderHTML is the digest as a standalone HTML email, with inline styles since mail clients drop stylesheets
+func renderHTML(d *Digest) string {
+	title := html.EscapeString(digestTitle(d))
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&sb, "<title>%s</title>\n</head>\n", title)
+	sb.WriteString(`<body style="font-family: -apple-system, 'Segoe UI', Helvetica, Arial, sans-serif; font-size: 15px; line-height: 1.5; color: #1f2328; max-width: 680px; margin: 0 auto; padding: 16px;">` + "\n")
+	fmt.Fprintf(&sb, "<h1 style=\"font-size: 22px;\">%s</h1>\n", title)
+	sb.WriteString(markdownToHTML(renderMarkdown(d)))
+	fmt.Fprintf(&sb, "<p style=\"color: #656d76; font-size: 12px;\">%s · generated %s</p>\n",
+		html.EscapeString(pluralize(d.EmailCount, "email")), html.EscapeString(localeOf(d.Locale).fullDate(d.GeneratedAt)+" "+d.GeneratedAt.Format("15:04")))
+	sb.WriteString("</body>\n</html>\n")
+	return sb.String()
+}
+
+var (
+	headingLine  = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	bulletLine   = regexp.MustCompile(`^(\s*)[-*]\s+(.*)$`)
+	numberedLine = regexp.MustCompile(`^(\s*)\d+[.)]\s+(.*)$`)
+	// inlineMarkdown matches, in order: code, links (with or without <> around the url), bold, italics
+	inlineMarkdown = regexp.MustCompile("`([^`]+)`" + `|\[([^\]]+)\]\(<?([^)<>\s]+)>?\)|\*\*(.+?)\*\*|__(.+?)__|\*([^*\s][^*]*?)\*`)
+)
+
+// markdownToHTML converts the Markdown the model and the sections write: headings, lists, tables, code blocks,
+// paragraphs, and links, bold, italics and code within them
+func markdownToHTML(markdown string) string {
+	var sb strings.Builder
+	lines := strings.Split(markdown, "\n")
+	var paragraph []string
+	var lists []string // the open list tags, innermost last
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			sb.WriteString("<p>" + strings.Join(paragraph, "<br>\n") + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeLists := func(depth int) {
+		for len(lists) > depth {
+			sb.WriteString("</" + lists[len(lists)-1] + ">\n")
+			lists = lists[:len(lists)-1]
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushParagraph()
+			closeLists(0)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, html.EscapeString(lines[i]))
+			}
+			sb.WriteString(`<pre style="background: #f6f8fa; padding: 8px; overflow-x: auto;"><code>` + strings.Join(code, "\n") + "</code></pre>\n")
+
+		case trimmed == "":
+			flushParagraph()
+			closeLists(0)
+
+		case headingLine.MatchString(trimmed):
+			flushParagraph()
+			closeLists(0)
+			m := headingLine.FindStringSubmatch(trimmed)
+			level := min(len(m[1])+1, 6) // the email's own title is the h1
+			fmt.Fprintf(&sb, "<h%d>%s</h%d>\n", level, inlineHTML(m[2]), level)
+
+		case strings.HasPrefix(trimmed, "|") && i+1 < len(lines) && tableSeparator.MatchString(strings.TrimSpace(lines[i+1])):
+			flushParagraph()
+			closeLists(0)
+			sb.WriteString(`<table style="border-collapse: collapse;">` + "\n<tr>")
+			for _, cell := range tableRow(trimmed) {
+				sb.WriteString(`<th style="border: 1px solid #d0d7de; padding: 4px 8px; text-align: left;">` + inlineHTML(cell) + "</th>")
+			}
+			sb.WriteString("</tr>\n")
+			for i += 2; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "|"); i++ {
+				sb.WriteString("<tr>")
+				for _, cell := range tableRow(strings.TrimSpace(lines[i])) {
+					sb.WriteString(`<td style="border: 1px solid #d0d7de; padding: 4px 8px;">` + inlineHTML(cell) + "</td>")
+				}
+				sb.WriteString("</tr>\n")
+			}
+			i--
+			sb.WriteString("</table>\n")
+
+		case bulletLine.MatchString(line), numberedLine.MatchString(line):
+			flushParagraph()
+			tag, m := "ul", bulletLine.FindStringSubmatch(line)
+			if m == nil {
+				tag, m = "ol", numberedLine.FindStringSubmatch(line)
+			}
+			depth := len(strings.ReplaceAll(m[1], "\t", "  "))/2 + 1
+			closeLists(depth)
+			for len(lists) < depth {
+				sb.WriteString("<" + tag + ">\n")
+				lists = append(lists, tag)
+			}
+			sb.WriteString("<li>" + inlineHTML(m[2]) + "</li>\n")
+
+		default:
+			closeLists(0)
+			paragraph = append(paragraph, inlineHTML(trimmed))
+		}
+	}
+	flushParagraph()
+	closeLists(0)
+	return sb.String()
+}
+
+// inlineHTML converts the inline Markdown of a line, escaping everything else
+func inlineHTML(text string) string {
+	var sb strings.Builder
+	last := 0
+	for _, m := range inlineMarkdown.FindAllStringSubmatchIndex(text, -1) {
+		sb.WriteString(html.EscapeString(text[last:m[0]]))
+		group := func(n int) string { return text[m[2*n]:m[2*n+1]] }
+		switch {
+		case m[2] >= 0:
+			sb.WriteString("<code>" + html.EscapeString(group(1)) + "</code>")
+		case m[4] >= 0 && linkAllowed(group(3)):
+			fmt.Fprintf(&sb, `<a href="%s">%s</a>`, html.EscapeString(group(3)), inlineHTML(group(2)))
+		case m[4] >= 0:
+			// a link the email could have planted, like javascript: or data:, is only its text
+			sb.WriteString(inlineHTML(group(2)))
+		case m[8] >= 0:
+			sb.WriteString("<strong>" + inlineHTML(group(4)) + "</strong>")
+		case m[10] >= 0:
+			sb.WriteString("<strong>" + inlineHTML(group(5)) + "</strong>")
+		case m[12] >= 0:
+			sb.WriteString("<em>" + inlineHTML(group(6)) + "</em>")
+		}
+		last = m[1]
+	}
+	sb.WriteString(html.EscapeString(text[last:]))
+	return sb.String()
+}
+
+// linkAllowed is whether a link's url is one a digest's reader can safely follow: the web or an email address
+func linkAllowed(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// renderText is the digest as plain text, for terminals and mail clients that don't do HTML: headings are underlined,
+// links spelled out and tables aligned
+func renderText(d *Digest) string {
+	return markdownToText(renderMarkdown(d))
+}
+
+// markdownToText strips the Markdown formatting that reads badly as plain text
+func markdownToText(markdown string) string {
+	var out []string
+	inCode := false
+	for _, line := range strings.Split(discordTables(markdown), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out = append(out, line)
+			continue
+		}
+		if m := headingLine.FindStringSubmatch(trimmed); m != nil {
+			heading := inlineText(m[2])
+			underline := "-"
+			if len(m[1]) == 1 {
+				underline = "="
+			}
+			out = append(out, heading, strings.Repeat(underline, utf8.RuneCountInString(heading)))
+			continue
+		}
+		out = append(out, inlineText(line))
+	}
+	return strings.Join(out, "\n")
+}
+
+// inlineText turns links into "text (url)" and drops emphasis and code markers
+func inlineText(text string) string {
+	return inlineMarkdown.ReplaceAllStringFunc(text, func(match string) string {
+		m := inlineMarkdown.FindStringSubmatch(match)
+		switch {
+		case m[1] != "":
+			return m[1]
+		case m[2] != "":
+			return inlineText(m[2]) + " (" + m[3] + ")"
+		case m[4] != "":
+			return inlineText(m[4])
+		case m[5] != "":
+			return inlineText(m[5])
+		default:
+			return inlineText(m[6])
+		}
+	})
+}
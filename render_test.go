@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+// TestInlineHTMLLinks checks only web and email links become links, and the rest are left as their text
+func TestInlineHTMLLinks(t *testing.T) {
+	for markdown, want := range map[string]string{
+		"[site](https://example.com/a?b=1&c=2)": `<a href="https://example.com/a?b=1&amp;c=2">site</a>`,
+		"[site](<http://example.com>)":          `<a href="http://example.com">site</a>`,
+		"[Ann](mailto:ann@example.com)":         `<a href="mailto:ann@example.com">Ann</a>`,
+		"[click](javascript:document.cookie)":   `click`,
+		"[click](JavaScript:alert`1`)":          `click`,
+		"[**bold**](data:text/html,hi)":         `<strong>bold</strong>`,
+		"[page](/relative)":                     `page`,
+	} {
+		if got := inlineHTML(markdown); got != want {
+			t.Errorf("inlineHTML(%q) = %q, want %q", markdown, got, want)
+		}
+	}
+}
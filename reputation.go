@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// feedbackMenuPrefix starts the custom id of the feedback menus, followed by the rating and the digest id
+	feedbackMenuPrefix = "feedback:"
+
+	// maxMenuOptions is Discord's limit of options in a select menu
+	maxMenuOptions = 25
+
+	// maxFeedback bounds how many ratings are kept
+	maxFeedback = 1000
+
+	// demoteScore is the score at which a sender's emails are only mentioned in passing, dropScore the one at which
+	// they're left out altogether
+	demoteScore = -2
+	dropScore   = -4
+)
+
+// SenderReputation is what the user has told us about a sender
+type SenderReputation struct {
+	Up    int  `json:"up"`
+	Down  int  `json:"down"`
+	Muted bool `json:"muted"`
+}
+
+// Score is the net rating, negative for senders the user finds unhelpful
+func (r *SenderReputation) Score() int {
+	return r.Up - r.Down
+}
+
+// senderAddress is the lowercased email address of a From header, the key of the reputation table
+func senderAddress(from string) string {
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(from))
+	}
+	return strings.ToLower(address.Address)
+}
+
+// senderVerdict says what the reputation table wants done with a message: "mute", "drop", "demote" or ""
+func (st *stateStore) senderVerdict(message *gmail.Message) string {
+	address := senderAddress(extractHeader(message, "From"))
+
+	var verdict string
+	st.read(func(s *State) {
+		reputation, ok := s.Senders[address]
+		switch {
+		case !ok:
+		case reputation.Muted:
+			verdict = "mute"
+		case reputation.Score() <= dropScore:
+			verdict = "drop"
+		case reputation.Score() <= demoteScore:
+			verdict = "demote"
+		}
+	})
+	return verdict
+}
+
+// demotedInstructions are given to the model for senders the user keeps rating down
+const demotedInstructions = "The user usually finds emails from this sender unhelpful. Mention it in a single short line at most, or leave it out if nothing in it needs the user's attention."
+
+// sendFeedbackMenus posts menus to rate or mute the senders of a digest
+func (a *App) sendFeedbackMenus(channelID, digestID string, messages []*gmail.Message) error {
+	var options []discordgo.SelectMenuOption
+	seen := make(map[string]bool)
+	for _, message := range messages {
+		from := extractHeader(message, "From")
+		address := senderAddress(from)
+		if address == "" || seen[address] || len(address) > 100 {
+			continue
+		}
+		seen[address] = true
+
+		label := senderName(from)
+		if len(label) > 100 {
+			label = label[:100]
+		}
+		description := extractHeader(message, "Subject")
+		if len(description) > 100 {
+			description = description[:100]
+		}
+		options = append(options, discordgo.SelectMenuOption{Label: label, Value: address, Description: description})
+		if len(options) == maxMenuOptions {
+			break
+		}
+	}
+	if len(options) == 0 {
+		return nil
+	}
+
+	menu := func(rating, placeholder string) discordgo.ActionsRow {
+		return discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{
+				MenuType:    discordgo.StringSelectMenu,
+				CustomID:    feedbackMenuPrefix + rating + ":" + digestID,
+				Placeholder: placeholder,
+				MaxValues:   len(options),
+				Options:     options,
+			},
+		}}
+	}
+
+	if _, err := a.Discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: "How useful were these senders?",
+		Components: []discordgo.MessageComponent{
+			menu("up", "👍 Worth hearing about"),
+			menu("down", "👎 Not worth it"),
+			menu("mute", "🔇 Never show me again"),
+		},
+	}); err != nil {
+		return fmt.Errorf("sending feedback menus: %w", err)
+	}
+	return nil
+}
+
+// handleFeedbackMenu records the senders picked in a feedback menu. id is the rating and the digest id
+func (a *App) handleFeedbackMenu(i *discordgo.InteractionCreate, id string) {
+	logger := log.FromContext(withTaskRun(context.Background(), "feedback"))
+	rating, digestID, _ := strings.Cut(id, ":")
+	senders := i.MessageComponentData().Values
+	now := a.Clock.Now()
+
+	if err := a.state.update(func(s *State) {
+		if s.Senders == nil {
+			s.Senders = make(map[string]*SenderReputation)
+		}
+		for _, sender := range senders {
+			reputation, ok := s.Senders[sender]
+			if !ok {
+				reputation = &SenderReputation{}
+				s.Senders[sender] = reputation
+			}
+
+			feedback := Feedback{DigestID: digestID, Sender: sender, Time: now}
+			switch rating {
+			case "up":
+				reputation.Up++
+				feedback.Rating = 1
+			case "down":
+				reputation.Down++
+				feedback.Rating = -1
+			case "mute":
+				reputation.Muted = true
+				continue
+			}
+			s.Feedback = append(s.Feedback, feedback)
+		}
+		if len(s.Feedback) > maxFeedback {
+			s.Feedback = s.Feedback[len(s.Feedback)-maxFeedback:]
+		}
+		if rating == "up" {
+			if added := seedExamples(s, digestID, senders, now); added > 0 {
+				logger.Info("Examples added from feedback", "digest_id", digestID, "examples", added)
+			}
+		}
+	}); err != nil {
+		logger.Error("Unable to save feedback", "error", err)
+		return
+	}
+	logger.Info("Sender feedback recorded", "rating", rating, "digest_id", digestID, "senders", len(senders))
+
+	reply := "Thanks, noted."
+	if rating == "mute" {
+		reply = fmt.Sprintf("Muted %s. Use `/unmute` to undo.", strings.Join(senders, ", "))
+	}
+	if err := a.Discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: reply, Flags: discordgo.MessageFlagsEphemeral},
+	}); err != nil {
+		logger.Error("Failed to answer feedback", "error", err)
+	}
+}
+
+// unmuteCommand is /unmute: lets a muted sender back in, and forgets their bad ratings
+func unmuteCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	sender := senderAddress(options["sender"])
+
+	var found bool
+	if err := a.state.update(func(s *State) {
+		reputation, ok := s.Senders[sender]
+		found = ok
+		if ok {
+			reputation.Muted = false
+			reputation.Down = 0
+		}
+	}); err != nil {
+		return "", fmt.Errorf("saving sender: %w", err)
+	}
+
+	if !found {
+		return fmt.Sprintf("%s wasn't muted or rated.", sender), nil
+	}
+	log.FromContext(ctx).Info("Sender unmuted", "sender", sender)
+	return fmt.Sprintf("%s is back in your digests.", sender), nil
+}
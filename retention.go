@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// retentionHour and retentionMinute are when the retention cleanup runs each day, at night when nothing else does
+const retentionHour, retentionMinute = 3, 30
+
+type RetentionConfig struct {
+	// BodyDays is how long email text is kept once it's been summarized: the emails behind the latest digests, the
+	// model's cached output, the few-shot examples, /ask conversations, the thread memory and the text in the search
+	// index. the emails still waiting for a digest are kept until it goes out
+	BodyDays int `json:"body_days"`
+	// DigestMonths is how long digests stay in the archive
+	DigestMonths int `json:"digest_months"`
+}
+
+// enforceRetention deletes what's older than the retention config allows
+func (a *App) enforceRetention(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	config := a.Config.Retention
+	now := a.Clock.Now()
+
+	var bodies, digests int
+	if err := a.state.update(func(s *State) {
+		bodies, digests = 0, 0
+		if config.BodyDays > 0 {
+			bodies = expireBodies(s.account(), now.AddDate(0, 0, -config.BodyDays))
+		}
+		if config.DigestMonths > 0 {
+			cutoff := now.AddDate(0, -config.DigestMonths, 0)
+			kept := s.Digests[:0]
+			for _, digest := range s.Digests {
+				if digest.GeneratedAt.Before(cutoff) {
+					digests++
+					continue
+				}
+				kept = append(kept, digest)
+			}
+			s.Digests = kept
+		}
+	}); err != nil {
+		return fmt.Errorf("applying retention: %w", err)
+	}
+
+	var indexed int
+	if config.BodyDays > 0 {
+		var err error
+		if indexed, err = a.index.expireText(now.AddDate(0, 0, -config.BodyDays)); err != nil {
+			return fmt.Errorf("applying retention to the email index: %w", err)
+		}
+	}
+	logger.Info("Retention applied", "bodies", bodies, "digests", digests, "indexed_texts", indexed)
+	return nil
+}
+
+// expireBodies drops the email text in the account kept from before cutoff, and returns how many pieces it dropped
+func expireBodies(account *AccountState, cutoff time.Time) int {
+	dropped := 0
+	for kind, messages := range account.LastDigestEmails {
+		kept := messages[:0]
+		for _, message := range messages {
+			if message.InternalDate > 0 && time.UnixMilli(message.InternalDate).Before(cutoff) {
+				dropped++
+				continue
+			}
+			kept = append(kept, message)
+		}
+		if len(kept) == 0 {
+			delete(account.LastDigestEmails, kind)
+		} else {
+			account.LastDigestEmails[kind] = kept
+		}
+	}
+	for key, cached := range account.SummaryCache {
+		if cached.CachedAt.Before(cutoff) {
+			delete(account.SummaryCache, key)
+			dropped++
+		}
+	}
+	for category, examples := range account.Examples {
+		kept := examples[:0]
+		for _, example := range examples {
+			if example.AddedAt.Before(cutoff) {
+				dropped++
+				continue
+			}
+			kept = append(kept, example)
+		}
+		account.Examples[category] = kept
+	}
+	for id, memory := range account.Threads {
+		if memory.UpdatedAt.Before(cutoff) {
+			delete(account.Threads, id)
+			dropped++
+		}
+	}
+	for channel, turns := range account.Conversations {
+		kept := turns[:0]
+		for _, turn := range turns {
+			if turn.At.Before(cutoff) {
+				dropped++
+				continue
+			}
+			kept = append(kept, turn)
+		}
+		account.Conversations[channel] = kept
+	}
+	return dropped
+}
+
+// expireText drops the text of the emails in the index from before cutoff. their vectors stay, so they can still be
+// found by meaning, just not by keyword
+func (ix *emailIndex) expireText(cutoff time.Time) (int, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.loadLocked(); err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, email := range ix.Emails {
+		if email.Text != "" && !email.Date.IsZero() && email.Date.Before(cutoff) {
+			email.Text = ""
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	return dropped, ix.saveLocked()
+}
+
+// purge deletes the index, embeddings and all
+func (ix *emailIndex) purge() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.Emails = nil
+	ix.Model = ""
+	ix.loaded = true
+	ix.version++
+	if err := os.Remove(ix.file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("deleting the email index: %w", err)
+	}
+	return nil
+}
+
+// purge wipes everything the profile remembers: the token, queues, caches, archive, feedback and reputation. only the
+// state's version survives, so it isn't migrated again
+func (st *stateStore) purge() error {
+	return st.update(func(s *State) {
+		*s = State{Version: s.Version}
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// RollupsConfig enables the monthly and quarterly rollups, which are built from the archived daily and weekly digests
+// rather than from the emails themselves. a rollup with no channel isn't sent
+type RollupsConfig struct {
+	Time               string `json:"time"`
+	MonthlyChannelID   string `json:"monthly_channel_id"`
+	QuarterlyChannelID string `json:"quarterly_channel_id"`
+}
+
+// maxRollupSenders is how many recurring senders a rollup lists
+const maxRollupSenders = 10
+
+// Rollup is everything a rollup digest is written from: the digests archived over the period, and the numbers that
+// can be counted from them without asking the model
+type Rollup struct {
+	Kind string
+	From time.Time
+	To   time.Time
+
+	// Digests are the summaries the model reads, oldest first
+	Digests []*Digest
+
+	EmailCount         int
+	PreviousEmailCount int
+	Categories         map[string]int
+	PreviousCategories map[string]int
+	Senders            []SenderCount
+	ActionItems        []ActionItem
+}
+
+// SenderCount is how many emails a sender had summarized over a rollup's period
+type SenderCount struct {
+	Sender string
+	Count  int
+}
+
+func (a *App) sendMonthlyRollup(ctx context.Context) error {
+	return a.sendRollup(ctx, "monthly", a.Config.Rollups.MonthlyChannelID)
+}
+
+func (a *App) sendQuarterlyRollup(ctx context.Context) error {
+	return a.sendRollup(ctx, "quarterly", a.Config.Rollups.QuarterlyChannelID)
+}
+
+func (a *App) sendRollup(ctx context.Context, kind, channelID string) (err error) {
+	// the period the run was scheduled for, even when it starts after the next one began
+	now := a.periodTime(ctx)
+	id := a.periodDigestID(kind, now)
+	ctx = a.startDigest(ctx, id)
+	logger := log.FromContext(ctx)
+	defer func() {
+		if err != nil {
+			reportProgress(ctx, ProgressEvent{Kind: kind, Stage: "failed", Error: err.Error()})
+		}
+	}()
+
+	if a.alreadySent(ctx, id) {
+		logger.Info("The " + kind + " rollup was already sent, skipping")
+		reportProgress(ctx, ProgressEvent{Kind: kind, Stage: "skipped"})
+		return nil
+	}
+
+	rollup := a.state.buildRollup(kind, now)
+	if len(rollup.Digests) == 0 {
+		logger.Info("No digests archived this period, skipping " + kind + " rollup")
+		reportProgress(ctx, ProgressEvent{Kind: kind, Stage: "skipped"})
+		return nil
+	}
+
+	total := len(rollup.Digests)
+	reportProgress(ctx, ProgressEvent{Kind: kind, Stage: "summarizing", Total: total})
+	usageBefore := currentUsage()
+	digest, err := a.Summarizer.SummarizeRollup(ctx, rollup)
+	if err != nil {
+		return fmt.Errorf("generating %s rollup: %w", kind, err)
+	}
+	digest.Usage = currentUsage().Sub(usageBefore)
+
+	reportProgress(ctx, ProgressEvent{Kind: kind, Stage: "delivering", Done: total, Total: total})
+	if err := a.postOrQueue(ctx, channelID, digest, nil, DigestExtras{}); err != nil {
+		return fmt.Errorf("sending %s rollup to Discord: %w", kind, err)
+	}
+	a.state.archiveDigest(digest)
+
+	reportProgress(ctx, ProgressEvent{Kind: kind, Stage: "done", Done: total, Total: total})
+	return nil
+}
+
+// rollupPeriod is the calendar month or quarter that now falls in, up to now
+func rollupPeriod(kind string, now time.Time) (from time.Time, months int) {
+	month := now.Month()
+	months = 1
+	if kind == "quarterly" {
+		month -= (month - 1) % 3
+		months = 3
+	}
+	return time.Date(now.Year(), month, 1, 0, 0, 0, 0, now.Location()), months
+}
+
+// buildRollup collects the period's digests and counts what it can. the numbers come from the daily digests only,
+// since a weekly digest covers the same emails again
+func (st *stateStore) buildRollup(kind string, now time.Time) *Rollup {
+	from, months := rollupPeriod(kind, now)
+	previousFrom := from.AddDate(0, -months, 0)
+
+	rollup := &Rollup{
+		Kind:               kind,
+		From:               from,
+		To:                 now,
+		Categories:         make(map[string]int),
+		PreviousCategories: make(map[string]int),
+	}
+
+	var daily, weekly []*Digest
+	senders := make(map[string]int)
+	seenItems := make(map[string]bool)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	st.read(func(s *State) {
+		for _, digest := range s.Digests {
+			generated := digest.GeneratedAt
+			if digest.Kind == "daily" && !generated.Before(previousFrom) && generated.Before(from) {
+				rollup.PreviousEmailCount += digest.EmailCount
+				for category, n := range digest.Categories {
+					rollup.PreviousCategories[category] += n
+				}
+				continue
+			}
+			if generated.Before(from) || generated.After(now) {
+				continue
+			}
+
+			switch digest.Kind {
+			case "weekly":
+				weekly = append(weekly, digest)
+			case "daily":
+				daily = append(daily, digest)
+				rollup.EmailCount += digest.EmailCount
+				for category, n := range digest.Categories {
+					rollup.Categories[category] += n
+				}
+				for _, entry := range digest.Entries {
+					if entry.From != "" {
+						senders[entry.From]++
+					}
+					for _, item := range entry.ActionItems {
+						key := strings.ToLower(strings.TrimSpace(item.Description))
+						if seenItems[key] || isPastDue(item, today) {
+							continue
+						}
+						seenItems[key] = true
+						rollup.ActionItems = append(rollup.ActionItems, item)
+					}
+				}
+			}
+		}
+	})
+
+	// a month of dailies fits in one prompt, a quarter of them doesn't, so quarters are read from the weeklies
+	rollup.Digests = daily
+	if kind == "quarterly" && len(weekly) > 0 {
+		rollup.Digests = weekly
+	}
+
+	for sender, count := range senders {
+		if count > 1 {
+			rollup.Senders = append(rollup.Senders, SenderCount{Sender: sender, Count: count})
+		}
+	}
+	sort.Slice(rollup.Senders, func(i, j int) bool {
+		if rollup.Senders[i].Count != rollup.Senders[j].Count {
+			return rollup.Senders[i].Count > rollup.Senders[j].Count
+		}
+		return rollup.Senders[i].Sender < rollup.Senders[j].Sender
+	})
+	if len(rollup.Senders) > maxRollupSenders {
+		rollup.Senders = rollup.Senders[:maxRollupSenders]
+	}
+
+	return rollup
+}
+
+// isPastDue reports whether an action item had a YYYY-MM-DD deadline before today. items without one stay open
+func isPastDue(item ActionItem, today time.Time) bool {
+	due, err := time.ParseInLocation(time.DateOnly, item.Due, today.Location())
+	return err == nil && due.Before(today)
+}
+
+// Stats renders the counted part of the rollup for the prompt
+func (r *Rollup) Stats() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Period: %s to %s\n", r.From.Format("Mon 2 Jan 2006"), r.To.Format("Mon 2 Jan 2006"))
+	fmt.Fprintf(&sb, "Emails summarized: %d", r.EmailCount)
+	if r.PreviousEmailCount > 0 {
+		fmt.Fprintf(&sb, " (previous period: %d)", r.PreviousEmailCount)
+	}
+	sb.WriteString("\n")
+
+	if len(r.Categories) > 0 {
+		sb.WriteString("\nEmails by category (previous period in brackets):\n")
+		for _, category := range sortedKeys(r.Categories) {
+			fmt.Fprintf(&sb, "- %s: %d (%d)\n", category, r.Categories[category], r.PreviousCategories[category])
+		}
+	}
+
+	if len(r.Senders) > 0 {
+		sb.WriteString("\nRecurring senders:\n")
+		for _, s := range r.Senders {
+			fmt.Fprintf(&sb, "- %s: %d emails\n", s.Sender, s.Count)
+		}
+	}
+
+	if len(r.ActionItems) > 0 {
+		sb.WriteString("\nOpen action items:\n")
+		for _, item := range r.ActionItems {
+			if item.Due != "" {
+				fmt.Fprintf(&sb, "- %s (due %s)\n", item.Description, item.Due)
+			} else {
+				fmt.Fprintf(&sb, "- %s\n", item.Description)
+			}
+		}
+	}
+
+	return sb.String()
+}
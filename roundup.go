@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type DaysOffConfig struct {
+	// Weekdays are the days of the week without a daily digest, e.g. ["saturday", "sunday"]
+	Weekdays []string `json:"weekdays"`
+	// Holidays are dates without a daily digest, as 2006-01-02, or ranges like 2006-12-24..2006-12-26
+	Holidays []string `json:"holidays"`
+}
+
+// days are the weekdays and dates off, for the scheduler
+func (c *DaysOffConfig) days(location *time.Location) (map[time.Weekday]bool, []time.Time, error) {
+	weekdays := make(map[time.Weekday]bool)
+	for _, day := range c.Weekdays {
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			return nil, nil, err
+		}
+		weekdays[weekday] = true
+	}
+
+	var dates []time.Time
+	for _, holiday := range c.Holidays {
+		from, to, isRange := strings.Cut(holiday, "..")
+		start, err := time.ParseInLocation(time.DateOnly, strings.TrimSpace(from), location)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid holiday %q: %w", holiday, err)
+		}
+		end := start
+		if isRange {
+			if end, err = time.ParseInLocation(time.DateOnly, strings.TrimSpace(to), location); err != nil {
+				return nil, nil, fmt.Errorf("invalid holiday %q: %w", holiday, err)
+			}
+			if end.Before(start) {
+				return nil, nil, fmt.Errorf("invalid holiday %q: it ends before it starts", holiday)
+			}
+		}
+		for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+			dates = append(dates, day)
+		}
+	}
+	return weekdays, dates, nil
+}
+
+type roundupKey struct{}
+
+// withRoundup marks the digest being made as a roundup that also covers the skipped days off
+func withRoundup(ctx context.Context, skipped []time.Time) context.Context {
+	if len(skipped) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, roundupKey{}, skipped)
+}
+
+func roundupFromContext(ctx context.Context) []time.Time {
+	skipped, _ := ctx.Value(roundupKey{}).([]time.Time)
+	return skipped
+}
+
+// roundupTitle names a roundup: "Weekend roundup" when it covers only a weekend, "Roundup since Wed 24 Dec" otherwise
+func roundupTitle(l *locale, skipped []time.Time) string {
+	weekend := true
+	for _, day := range skipped {
+		if day.Weekday() != time.Saturday && day.Weekday() != time.Sunday {
+			weekend = false
+		}
+	}
+	if weekend {
+		return "Weekend roundup"
+	}
+	return "Roundup since " + l.shortDate(skipped[0])
+}
+
+// roundupInstructions tell the model the digest covers the days off too
+func roundupInstructions(l *locale, skipped []time.Time) string {
+	days := make([]string, len(skipped))
+	for i, day := range skipped {
+		days[i] = l.longDate(day)
+	}
+	return fmt.Sprintf("There was no digest on %s, so this one covers those days as well as today. Title it %q, and group the emails by day where that makes them easier to follow.",
+		strings.Join(days, ", "), roundupTitle(l, skipped))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+// RuleConfig is one triage rule. every matcher that is set has to match, and the first rule that matches an email
+// decides what happens to it, like Gmail filters
+type RuleConfig struct {
+	Name string `json:"name"`
+
+	// From and Subject are case-insensitive regular expressions
+	From     string `json:"from"`
+	Subject  string `json:"subject"`
+	Label    string `json:"label"`    // Label is a Gmail label name or id
+	Category string `json:"category"` // Category is a Gmail inbox tab: primary, social, promotions, updates or forums
+
+	// Action is "skip" to leave the email out, "route" to summarize it in its own digest in ChannelID, "escalate" to
+	// also alert about it straight away, or empty to only apply Prompt
+	Action    string `json:"action"`
+	ChannelID string `json:"channel_id"`
+
+	// Prompt is extra instructions for the model when it reads a matching email
+	Prompt string `json:"prompt"`
+	// Template is a file in the templates directory used instead of email_prompt.tmpl for matching emails
+	Template string `json:"template"`
+	// Examples is a category of the few-shot example library to show the model with matching emails
+	Examples string `json:"examples"`
+}
+
+type rule struct {
+	RuleConfig
+	from     *regexp.Regexp
+	subject  *regexp.Regexp
+	template string
+}
+
+func compileRules(configs []RuleConfig, dir string) ([]*rule, error) {
+	rules := make([]*rule, 0, len(configs))
+	for i, config := range configs {
+		r := &rule{RuleConfig: config}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+
+		switch r.Action {
+		case "", "skip", "escalate":
+		case "route":
+			if r.ChannelID == "" {
+				return nil, fmt.Errorf("%s: route needs a channel_id", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown action %q", r.Name, r.Action)
+		}
+
+		var err error
+		if r.From != "" {
+			if r.from, err = regexp.Compile("(?i)" + r.From); err != nil {
+				return nil, fmt.Errorf("%s: invalid from pattern: %w", r.Name, err)
+			}
+		}
+		if r.Subject != "" {
+			if r.subject, err = regexp.Compile("(?i)" + r.Subject); err != nil {
+				return nil, fmt.Errorf("%s: invalid subject pattern: %w", r.Name, err)
+			}
+		}
+		if r.Template != "" {
+			if r.template, err = loadTemplate(dir, r.Template); err != nil {
+				return nil, fmt.Errorf("%s: loading template: %w", r.Name, err)
+			}
+			if _, err := parsePrompt(r.Template, r.template, time.Local); err != nil {
+				return nil, fmt.Errorf("%s: invalid template: %w", r.Name, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// matches reports whether message matches every matcher the rule sets. labels maps label ids to names
+func (r *rule) matches(message *gmail.Message, labels map[string]string) bool {
+	if r.from != nil && !r.from.MatchString(extractHeader(message, "From")) {
+		return false
+	}
+	if r.subject != nil && !r.subject.MatchString(extractHeader(message, "Subject")) {
+		return false
+	}
+	if r.Category != "" && !hasLabel(message, "CATEGORY_"+strings.ToUpper(r.Category)) {
+		return false
+	}
+	if r.Label != "" {
+		found := false
+		for _, id := range message.LabelIds {
+			if strings.EqualFold(id, r.Label) || strings.EqualFold(labels[id], r.Label) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// triage is what the rules made of a batch of emails
+type triage struct {
+	// digest are the emails for the main digest, escalated ones included
+	digest []*gmail.Message
+	// routed are the emails summarized separately, by channel
+	routed map[string][]*gmail.Message
+	// escalated are the emails to alert about
+	escalated []escalation
+	// kept is every email that wasn't skipped, in the order they came in
+	kept    []*gmail.Message
+	skipped int
+}
+
+type escalation struct {
+	message *gmail.Message
+	rule    *rule
+}
+
+// applyRules sorts the emails by the first rule each matches, and puts the rules' prompts and templates into ctx for
+// the summarizer. muted senders are dropped before any rule, and emails no rule matched go by the sender's reputation
+func (a *App) applyRules(ctx context.Context, messages []*gmail.Message) (context.Context, *triage, error) {
+	t := &triage{routed: make(map[string][]*gmail.Message)}
+	logger := log.FromContext(ctx)
+
+	var labels map[string]string
+	for _, r := range a.Rules {
+		if r.Label != "" {
+			var err error
+			if labels, err = a.Emails.Labels(ctx); err != nil {
+				return ctx, nil, fmt.Errorf("fetching labels: %w", err)
+			}
+			break
+		}
+	}
+
+	prompts := make(map[string]emailPrompt)
+	for _, message := range messages {
+		verdict := a.state.senderVerdict(message)
+		if verdict == "mute" {
+			logger.Debug("Sender is muted", "message_id", message.Id)
+			t.skipped++
+			continue
+		}
+
+		var matched *rule
+		for _, r := range a.Rules {
+			if r.matches(message, labels) {
+				matched = r
+				break
+			}
+		}
+		if matched == nil {
+			switch verdict {
+			case "drop":
+				logger.Debug("Sender is rated too low, dropping", "message_id", message.Id)
+				t.skipped++
+				continue
+			case "demote":
+				prompts[message.Id] = emailPrompt{instructions: demotedInstructions}
+			}
+			t.digest = append(t.digest, message)
+			t.kept = append(t.kept, message)
+			continue
+		}
+
+		logger.Debug("Rule matched", "rule", matched.Name, "action", matched.Action, "message_id", message.Id)
+		if matched.Prompt != "" || matched.template != "" || matched.Examples != "" {
+			prompts[message.Id] = emailPrompt{template: matched.template, instructions: matched.Prompt, examples: matched.Examples}
+		}
+		if matched.Action == "skip" {
+			t.skipped++
+			continue
+		}
+		t.kept = append(t.kept, message)
+		switch matched.Action {
+		case "route":
+			t.routed[matched.ChannelID] = append(t.routed[matched.ChannelID], message)
+		case "escalate":
+			t.escalated = append(t.escalated, escalation{message: message, rule: matched})
+			t.digest = append(t.digest, message)
+		default:
+			t.digest = append(t.digest, message)
+		}
+	}
+
+	logger.Info("Rules applied", "digest", len(t.digest), "routed", len(t.kept)-len(t.digest), "escalated", len(t.escalated), "skipped", t.skipped)
+	return withEmailPrompts(ctx, prompts), t, nil
+}
+
+// emailPrompt overrides how the summarizer reads one email. an empty template keeps the default email prompt
+type emailPrompt struct {
+	template     string
+	instructions string
+	// examples is the category of few-shot examples to show, empty to pick them by sender
+	examples string
+	// condensed cuts the email short and asks for a line at most, to keep the digest within its budget
+	condensed bool
+}
+
+type emailPromptsKey struct{}
+
+// withEmailPrompts attaches per-email prompt overrides, by message id, for the summarizer to use
+func withEmailPrompts(ctx context.Context, prompts map[string]emailPrompt) context.Context {
+	return context.WithValue(ctx, emailPromptsKey{}, prompts)
+}
+
+func emailPromptsFromContext(ctx context.Context) map[string]emailPrompt {
+	prompts, _ := ctx.Value(emailPromptsKey{}).(map[string]emailPrompt)
+	return prompts
+}
+
+// escalate alerts about escalated emails right away, in the rule's channel (or the daily one) and by SMS
+func (a *App) escalate(ctx context.Context, escalated []escalation) {
+	logger := log.FromContext(ctx)
+	for _, e := range escalated {
+		message, r := e.message, e.rule
+		alert := fmt.Sprintf("🚨 **%s** (%s): %s", senderName(extractHeader(message, "From")), r.Name, extractHeader(message, "Subject"))
+
+		channelID := r.ChannelID
+		if channelID == "" {
+			channelID = a.dailyChannel()
+		}
+		if err := a.sendToDiscord(channelID, alert+"\n> "+message.Snippet); err != nil {
+			logger.Error("Failed to send escalation", "message_id", message.Id, "error", err)
+		}
+		a.sendSMSAlert(alert)
+	}
+}
+
+// sendRoutedDigest summarizes the emails a rule routed to a channel of their own
+func (a *App) sendRoutedDigest(ctx context.Context, channelID string, messages []*gmail.Message) error {
+	usageBefore := currentUsage()
+	digest, err := a.summarizeWithinBudget(ctx, "daily", messages)
+	if err != nil {
+		return fmt.Errorf("generating routed summary: %w", err)
+	}
+	digest.ID += "-" + channelID
+	digest.Usage = currentUsage().Sub(usageBefore)
+
+	if _, err := a.postDigest(channelID, digest, nil); err != nil {
+		return fmt.Errorf("sending routed summary to Discord: %w", err)
+	}
+	a.state.archiveDigest(digest)
+	recordDigestSent(digest.Kind)
+	return nil
+}
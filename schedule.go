@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"scheduler"
+)
+
+// schedule is when a recurring task runs, read from a config field like "07:30", "8:30pm" or "every weekday at 9"
+type schedule struct {
+	// days are the weekdays it runs on, nil for every day
+	days   map[time.Weekday]bool
+	hour   int
+	minute int
+}
+
+// clockPattern is a time of day: "7", "07:30", "19:30", "7pm" or "7:30 a.m."
+var clockPattern = regexp.MustCompile(`^(\d{1,2})(?:[:.](\d{2}))?\s*(am|pm|a\.m\.|p\.m\.)?$`)
+
+// parseTimeOfDay reads a time of day, in 24-hour or 12-hour format or as "noon" or "midnight"
+func parseTimeOfDay(s string) (hour, minute int, err error) {
+	s = strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	switch s {
+	case "noon", "midday":
+		return 12, 0, nil
+	case "midnight":
+		return 0, 0, nil
+	}
+	match := clockPattern.FindStringSubmatch(s)
+	if match == nil {
+		return 0, 0, fmt.Errorf("invalid time %q, use e.g. \"07:30\", \"7:30am\" or \"noon\"", s)
+	}
+	hour, _ = strconv.Atoi(match[1])
+	if match[2] != "" {
+		minute, _ = strconv.Atoi(match[2])
+	}
+	if minute > 59 {
+		return 0, 0, fmt.Errorf("invalid time %q, the minutes go up to 59", s)
+	}
+	switch strings.ReplaceAll(match[3], ".", "") {
+	case "":
+		if hour > 23 {
+			return 0, 0, fmt.Errorf("invalid time %q, the hours go up to 23", s)
+		}
+	case "am", "pm":
+		if hour < 1 || hour > 12 {
+			return 0, 0, fmt.Errorf("invalid time %q, a 12-hour time goes from 1 to 12", s)
+		}
+		// 12am is midnight and 12pm is noon
+		hour %= 12
+		if strings.HasPrefix(match[3], "p") {
+			hour += 12
+		}
+	}
+	return hour, minute, nil
+}
+
+// parseSchedule reads a time of day, optionally with the days it's on: "every day at 7", "every weekday at 8:30pm",
+// "weekends at noon" or "every monday and thursday at 9"
+func parseSchedule(s string) (schedule, error) {
+	s = strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	when, at, ok := cutLast(s, " at ")
+	if !ok {
+		when, at = "", strings.TrimPrefix(s, "at ")
+	}
+	var sc schedule
+	var err error
+	if sc.hour, sc.minute, err = parseTimeOfDay(at); err != nil {
+		return schedule{}, err
+	}
+	if sc.days, err = parseDays(strings.TrimPrefix(when, "every ")); err != nil {
+		return schedule{}, fmt.Errorf("invalid schedule %q: %w", s, err)
+	}
+	return sc, nil
+}
+
+// parseDays reads the days part of a schedule, nil for every day
+func parseDays(s string) (map[time.Weekday]bool, error) {
+	switch s {
+	case "", "day", "daily":
+		return nil, nil
+	case "weekday", "weekdays":
+		return map[time.Weekday]bool{time.Monday: true, time.Tuesday: true, time.Wednesday: true, time.Thursday: true, time.Friday: true}, nil
+	case "weekend", "weekends":
+		return map[time.Weekday]bool{time.Saturday: true, time.Sunday: true}, nil
+	}
+	days := make(map[time.Weekday]bool)
+	for _, name := range strings.FieldsFunc(strings.ReplaceAll(s, " and ", ","), func(r rune) bool { return r == ',' || r == '&' }) {
+		name = strings.TrimSpace(name)
+		day, err := parseWeekday(name)
+		if err != nil {
+			// "mondays"
+			if day, err = parseWeekday(strings.TrimSuffix(name, "s")); err != nil {
+				return nil, fmt.Errorf("invalid weekday %q", name)
+			}
+		}
+		days[day] = true
+	}
+	if len(days) == 0 {
+		return nil, fmt.Errorf("no days in %q", s)
+	}
+	return days, nil
+}
+
+// cutLast is strings.Cut around the last sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// at is the schedule's time of day in location
+func (sc schedule) at(location *time.Location) time.Time {
+	return time.Date(0, 0, 0, sc.hour, sc.minute, 0, 0, location)
+}
+
+// apply sets t to run on the schedule, in location
+func (sc schedule) apply(t *scheduler.Task, location *time.Location) *scheduler.Task {
+	if sc.days == nil {
+		return t.Daily(sc.at(location))
+	}
+	return t.Weekly(sc.days, sc.at(location))
+}
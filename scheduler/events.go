@@ -0,0 +1,69 @@
+package scheduler
+
+import "time"
+
+// EventKind is a step in a task's lifecycle
+type EventKind uint8
+
+const (
+	// TaskScheduled is sent when a task's next run is set, including retries after a panic
+	TaskScheduled EventKind = iota
+	// TaskStarted is sent when a run starts, once it holds the locks its blocking mode asks for
+	TaskStarted
+	// TaskFinished is sent when a run returns without an error
+	TaskFinished
+	// TaskFailed is sent when a run returns an error, panics or exceeds its max runtime
+	TaskFailed
+	// TaskDisposed is sent when a task is removed, because it has no runs left, was deleted or kept panicking
+	TaskDisposed
+	// TaskOverran is sent when a run exceeds its max runtime and its context is cancelled. the run keeps its locks
+	// until the job returns, and TaskFailed follows then
+	TaskOverran
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case TaskScheduled:
+		return "scheduled"
+	case TaskStarted:
+		return "started"
+	case TaskFinished:
+		return "finished"
+	case TaskFailed:
+		return "failed"
+	case TaskDisposed:
+		return "disposed"
+	case TaskOverran:
+		return "overran"
+	}
+	return "unknown"
+}
+
+// Event is something that happened to a task
+type Event struct {
+	Kind   EventKind
+	TaskID uint64
+	Name   string // Name is the task's name, if it was given one with Named
+	Time   time.Time
+
+	NextRun  time.Time     // NextRun is when the task will run, for TaskScheduled
+	Duration time.Duration // Duration is how long the run took, for TaskFinished, TaskFailed and TaskOverran
+	Err      error         // Err is why the run failed, for TaskFailed
+}
+
+// OnEvent has the scheduler call fn with every lifecycle event. fn is called from the scheduler's goroutines, so it
+// must be safe for concurrent use and return quickly. it must be called before any task is added
+func (s *Scheduler) OnEvent(fn func(Event)) *Scheduler {
+	s.onEvent = fn
+	return s
+}
+
+func (s *Scheduler) emit(task *Task, event Event) {
+	if s.onEvent == nil {
+		return
+	}
+	event.TaskID = task.id
+	event.Name = task.name
+	event.Time = s.clock.Now()
+	s.onEvent(event)
+}
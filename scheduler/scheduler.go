@@ -2,24 +2,47 @@ package scheduler
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrStopped is returned when adding or deleting a task after the scheduler was stopped
+	ErrStopped = errors.New("scheduler: stopped")
+	// ErrQueueFull is returned by Add and Del under OverflowFail when the scheduler is too far behind to take them
+	ErrQueueFull = errors.New("scheduler: queue full")
+)
+
+// OverflowPolicy decides what Add and Del do when the scheduler's queue is full
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock waits for room in the queue. this is the default
+	OverflowBlock OverflowPolicy = iota
+	// OverflowFail returns ErrQueueFull straight away
+	OverflowFail
+)
+
+// defaultQueueSize is the buffer size of the scheduler's queues
+const defaultQueueSize = 256
+
 // New creates a new *Scheduler
 func New() *Scheduler {
-	return &Scheduler{
-		tasks:   make(map[uint64]*Task),
-		taskMus: make(map[uint64]*sync.Mutex),
+	s := &Scheduler{
+		tasks:    make(map[uint64]*Task),
+		taskMus:  make(map[uint64]*sync.Mutex),
+		groupMus: make(map[string]*sync.Mutex),
 
-		run: make(chan uint64, 256),
-		add: make(chan *Task, 256),
-		del: make(chan uint64, 256),
+		done: make(chan struct{}),
 
 		logger: slog.Default(),
+		clock:  systemClock{},
 	}
+	return s.WithQueueSize(defaultQueueSize)
 }
 
 type Scheduler struct {
@@ -30,13 +53,33 @@ type Scheduler struct {
 
 	taskMus      map[uint64]*sync.Mutex
 	taskMusMu    sync.Mutex
+	groupMus     map[string]*sync.Mutex // groupMus serialize the tasks of each group, created on first use
 	globalTaskMu sync.RWMutex
 
-	run chan uint64
-	add chan *Task
-	del chan uint64
+	run      chan uint64
+	add      chan *Task
+	del      chan uint64
+	moves    chan move
+	retry    chan *Task
+	finished chan taskResult
+	done     chan struct{} // done is closed by Stop
+	overflow OverflowPolicy
+
+	logger  *slog.Logger
+	clock   Clock
+	onEvent func(Event)
+}
+
+// move is a Reschedule for the Run loop
+type move struct {
+	id uint64
+	at time.Time
+}
 
-	logger *slog.Logger
+// taskResult reports how a run of a task with a restart policy went
+type taskResult struct {
+	task     *Task
+	panicked bool
 }
 
 // SetLogger allows users to set a custom logger.
@@ -45,16 +88,89 @@ func (s *Scheduler) SetLogger(logger *slog.Logger) *Scheduler {
 	return s
 }
 
-func (s *Scheduler) Add(task *Task) uint64 {
+// WithClock makes the scheduler use clock for the time and its timers, e.g. a FakeClock in tests. it must be called
+// before any task is added
+func (s *Scheduler) WithClock(clock Clock) *Scheduler {
+	s.clock = clock
+	return s
+}
+
+// WithQueueSize sets how many adds, deletes and due runs can wait for the scheduler before they block or, under
+// OverflowFail, are refused. it must be called before any task is added
+func (s *Scheduler) WithQueueSize(size int) *Scheduler {
+	if size < 0 {
+		panic("the queue size can't be negative")
+	}
+	s.run = make(chan uint64, size)
+	s.add = make(chan *Task, size)
+	s.del = make(chan uint64, size)
+	s.moves = make(chan move, size)
+	s.retry = make(chan *Task, size)
+	s.finished = make(chan taskResult, size)
+	return s
+}
+
+// WithOverflow sets what Add and Del do when the queue is full. runs that come due while it's full always wait
+// for room, so a repeating task is never lost
+func (s *Scheduler) WithOverflow(policy OverflowPolicy) *Scheduler {
+	s.overflow = policy
+	return s
+}
+
+// Add queues a task to be scheduled and returns its id. it fails with ErrStopped once the scheduler is stopped, and
+// with ErrQueueFull under OverflowFail
+func (s *Scheduler) Add(task *Task) (uint64, error) {
 	task.id = s.nextID.Add(1)
-	s.logger.Debug("Adding task", "task_id", task.id)
-	s.add <- task
-	return task.id
+	s.taskLogger(task).Debug("Adding task")
+	if err := enqueue(s, s.add, task, s.overflow); err != nil {
+		s.taskLogger(task).Warn("Unable to add task", "error", err)
+		return 0, err
+	}
+	return task.id, nil
 }
 
-func (s *Scheduler) Del(id uint64) {
+// Del queues a task to be cancelled. it fails like Add
+func (s *Scheduler) Del(id uint64) error {
 	s.logger.Debug("Deleting task", "task_id", id)
-	s.del <- id
+	if err := enqueue(s, s.del, id, s.overflow); err != nil {
+		s.logger.Warn("Unable to delete task", "task_id", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+// Reschedule queues the task's next run to be moved to at, straight away when at has passed. the runs after it follow
+// the task's schedule as before, so it moves one run. it fails like Add
+func (s *Scheduler) Reschedule(id uint64, at time.Time) error {
+	s.logger.Debug("Rescheduling task", "task_id", id, "at", at)
+	if err := enqueue(s, s.moves, move{id: id, at: at}, s.overflow); err != nil {
+		s.logger.Warn("Unable to reschedule task", "task_id", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+// enqueue sends v to the Run loop, unless the scheduler is stopped
+func enqueue[T any](s *Scheduler, ch chan<- T, v T, policy OverflowPolicy) error {
+	if s.stopped.Load() {
+		return ErrStopped
+	}
+	if policy == OverflowFail {
+		select {
+		case ch <- v:
+			return nil
+		case <-s.done:
+			return ErrStopped
+		default:
+			return ErrQueueFull
+		}
+	}
+	select {
+	case ch <- v:
+		return nil
+	case <-s.done:
+		return ErrStopped
+	}
 }
 
 // Run starts the scheduler to run tasks at their specified intervals.
@@ -67,11 +183,11 @@ func (s *Scheduler) Run(ctx context.Context) {
 			s.Stop()
 			return
 
-		case id, ok := <-s.run:
-			if !ok {
-				return
-			}
+		case <-s.done:
+			s.logger.Debug("Scheduler stopped")
+			return
 
+		case id := <-s.run:
 			s.tasksMu.Lock()
 			task, exists := s.tasks[id]
 			s.tasksMu.Unlock()
@@ -81,51 +197,123 @@ func (s *Scheduler) Run(ctx context.Context) {
 				continue
 			}
 
-			// fetch task and time until next run
-			next, ok := task.next()
+			// the runs skipped before this one, before next works out the ones before the run after, and when this one
+			// was due, before the schedule moves on to the next
+			skipped := task.skippedBefore
+			scheduled, _ := task.scheduledRun()
+
+			// fetch task and time until next run. a moved run hands over to the run after the one it was moved from, so
+			// moving a run earlier doesn't add one
+			now := s.clock.Now()
+			if task.movedFrom.After(now) {
+				now = task.movedFrom
+			}
+			task.movedFrom = time.Time{}
+			next, ok := task.next(now)
 
 			if ok { // if task is due to run again, schedule it
-				s.logger.Debug("Scheduling task", "task_id", task.id, "next_run", next)
-				task.timer = time.AfterFunc(next, s.taskCallbackGenerator(id))
+				// the timer is the one that fired, unless a run came due as it was being moved
+				task.stopTimer()
+				s.schedule(task, now.Add(next), s.taskCallbackGenerator(id))
 				s.tasksMu.Lock()
 				s.tasks[id] = task
 				s.tasksMu.Unlock()
 			} else { // otherwise dispose of the task
-				s.logger.Debug("Disposing task", "task_id", task.id)
+				s.taskLogger(task).Debug("Disposing task")
 				s.delTask(task.id)
 			}
 
 			// run task
-			go s.taskRunner(task)
-
-		case task, ok := <-s.add:
-			if !ok {
-				return
-			}
+			go s.taskRunner(task, skipped, scheduled)
 
+		case task := <-s.add:
 			s.addTask(task)
 
-		case id, ok := <-s.del:
-			if !ok {
-				return
-			}
-
+		case id := <-s.del:
 			s.delTask(id)
+
+		case move := <-s.moves:
+			s.moveTask(move)
+
+		case task := <-s.retry:
+			s.taskLogger(task).Info("Retrying panicked task", "attempt", task.panics)
+			go s.taskRunner(task, nil, time.Time{})
+
+		case result := <-s.finished:
+			s.handleResult(result)
 		}
 	}
 }
 
+// handleResult applies a task's restart policy: a panic pauses the schedule and retries the job with backoff, and a
+// clean run after panics resumes the schedule
+func (s *Scheduler) handleResult(result taskResult) {
+	task := result.task
+
+	s.tasksMu.Lock()
+	_, exists := s.tasks[task.id]
+	s.tasksMu.Unlock()
+
+	if !result.panicked {
+		if task.panics == 0 {
+			return
+		}
+		s.taskLogger(task).Info("Task recovered, resuming schedule", "panics", task.panics)
+		task.panics = 0
+		if !exists {
+			return
+		}
+		now := s.clock.Now()
+		if next, ok := task.next(now); ok {
+			s.schedule(task, now.Add(next), s.taskCallbackGenerator(task.id))
+		} else {
+			s.taskLogger(task).Debug("Disposing task")
+			s.delTask(task.id)
+		}
+		return
+	}
+
+	// pause the schedule, the next regular run could pick up whatever the panic left behind
+	task.stopTimer()
+	task.setNextRun(time.Time{})
+
+	if task.panics >= task.restartOnPanic {
+		s.taskLogger(task).Error("Task kept panicking, cancelling it", "restarts", task.restartOnPanic)
+		s.delTask(task.id)
+		return
+	}
+	task.panics++
+
+	// once tasks are disposed of before they run, so the retry carries the task itself rather than its id
+	delay := task.restartDelay()
+	s.taskLogger(task).Warn("Task panicked, restarting", "attempt", task.panics, "max", task.restartOnPanic, "delay", delay)
+	s.schedule(task, s.clock.Now().Add(delay), func() {
+		_ = enqueue(s, s.retry, task, OverflowBlock)
+	})
+	if !exists {
+		// keep it around so Del and Stop can cancel the retry
+		s.tasksMu.Lock()
+		s.tasks[task.id] = task
+		s.tasksMu.Unlock()
+
+		s.taskMusMu.Lock()
+		s.taskMus[task.id] = new(sync.Mutex)
+		s.taskMusMu.Unlock()
+	}
+}
+
+// Stop cancels every task and stops the Run loop. tasks already running are left to finish. it's safe to call more
+// than once
 func (s *Scheduler) Stop() {
+	if !s.stopped.CompareAndSwap(false, true) {
+		return
+	}
 	s.logger.Debug("Stopping scheduler")
 
-	s.stopped.Store(true)
-
 	// Stop all active tasks
 	s.tasksMu.Lock()
 	for id, task := range s.tasks {
-		if task.timer != nil {
-			task.timer.Stop()
-		}
+		task.stopTimer()
 		delete(s.tasks, id)
 	}
 	s.tasksMu.Unlock()
@@ -137,10 +325,14 @@ func (s *Scheduler) Stop() {
 	}
 	s.taskMusMu.Unlock()
 
-	// Close channels to prevent any further task addition
-	close(s.run)
-	close(s.add)
-	close(s.del)
+	// wake the Run loop and anything waiting to enqueue. the queues themselves are left open, so a late send can't
+	// panic
+	close(s.done)
+}
+
+// Done is closed once the scheduler is stopped
+func (s *Scheduler) Done() <-chan struct{} {
+	return s.done
 }
 
 func (s *Scheduler) addTask(task *Task) {
@@ -152,32 +344,53 @@ func (s *Scheduler) addTask(task *Task) {
 	s.taskMus[task.id] = new(sync.Mutex)
 	s.taskMusMu.Unlock()
 
-	s.logger.Debug("Task added", "task_id", task.id)
+	s.taskLogger(task).Debug("Task added")
 
 	// Schedule the task immediately
-	next, ok := task.next()
+	now := s.clock.Now()
+	next, ok := task.next(now)
 	if ok {
-		s.logger.Debug("Scheduling task", "task_id", task.id, "next_run", next)
-		task.timer = time.AfterFunc(next, s.taskCallbackGenerator(task.id))
+		s.schedule(task, now.Add(next), s.taskCallbackGenerator(task.id))
 		s.tasksMu.Lock()
 		s.tasks[task.id] = task
 		s.tasksMu.Unlock()
 	} else {
-		s.logger.Debug("Disposing task", "task_id", task.id)
+		s.taskLogger(task).Debug("Disposing task")
 		s.delTask(task.id)
 	}
 }
 
+// moveTask rearms the task's timer for the moved run. the timer can't be stopped once it has fired, so when the run
+// came due just before, it goes ahead as it was and the move is dropped
+func (s *Scheduler) moveTask(move move) {
+	task, ok := s.task(move.id)
+	if !ok {
+		s.logger.Warn("Task does not exist", "task_id", move.id)
+		return
+	}
+	if task.panics > 0 {
+		s.taskLogger(task).Warn("Task is being retried after a panic, leaving its schedule alone")
+		return
+	}
+	due, _ := task.scheduledRun()
+	if task.movedFrom.IsZero() {
+		task.movedFrom = due
+	}
+	task.stopTimer()
+	s.schedule(task, move.at, s.taskCallbackGenerator(task.id))
+}
+
 func (s *Scheduler) delTask(id uint64) {
 	s.tasksMu.Lock()
-	if task, exists := s.tasks[id]; exists {
-		if task.timer != nil {
-			task.timer.Stop()
-		}
-
+	task, exists := s.tasks[id]
+	if exists {
+		task.stopTimer()
 		delete(s.tasks, id)
 	}
 	s.tasksMu.Unlock()
+	if exists {
+		s.emit(task, Event{Kind: TaskDisposed})
+	}
 
 	s.taskMusMu.Lock()
 	delete(s.taskMus, id)
@@ -186,45 +399,192 @@ func (s *Scheduler) delTask(id uint64) {
 	s.logger.Debug("Task deleted", "task_id", id)
 }
 
-func (s *Scheduler) taskRunner(task *Task) {
+func (s *Scheduler) taskRunner(task *Task, skipped []time.Time, scheduled time.Time) {
 	switch task.blocking {
 	case nonBlocking:
 		s.globalTaskMu.RLock()
 		defer s.globalTaskMu.RUnlock()
 	case blocking:
 		s.taskMusMu.Lock()
-		taskMu := s.taskMus[task.id]
+		taskMu, ok := s.taskMus[task.id]
+		if !ok {
+			// the task was disposed of before this, its last run, so there's nothing left to block against
+			taskMu = new(sync.Mutex)
+		}
 		s.taskMusMu.Unlock()
 
 		taskMu.Lock()
 		defer taskMu.Unlock()
 
+		s.globalTaskMu.RLock()
+		defer s.globalTaskMu.RUnlock()
+	case groupBlocking:
+		s.taskMusMu.Lock()
+		groupMu, ok := s.groupMus[task.group]
+		if !ok {
+			groupMu = new(sync.Mutex)
+			s.groupMus[task.group] = groupMu
+		}
+		s.taskMusMu.Unlock()
+
+		groupMu.Lock()
+		defer groupMu.Unlock()
+
 		s.globalTaskMu.RLock()
 		defer s.globalTaskMu.RUnlock()
 	case globalBlocking:
 		s.globalTaskMu.Lock()
 		defer s.globalTaskMu.Unlock()
 	default:
-		s.logger.Error("unknown blocking mode!", "task_id", task.id)
+		s.taskLogger(task).Error("unknown blocking mode!")
 		panic("unknown blocking mode!")
 	}
 
-	defer func() {
-		if r := recover(); r != nil {
-			s.logger.Error("Task panicked", "task_id", task.id, "panic", r)
-		}
+	start := s.clock.Now()
+	task.runMu.Lock()
+	task.lastRun = start
+	task.runMu.Unlock()
+
+	logger := s.taskLogger(task)
+	logger.Info("Task starting")
+	s.emit(task, Event{Kind: TaskStarted})
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if len(skipped) > 0 {
+		ctx = context.WithValue(ctx, skippedRunsKey{}, skipped)
+	}
+	if !scheduled.IsZero() {
+		ctx = context.WithValue(ctx, scheduledAtKey{}, scheduled)
+	}
+	if task.maxRuntime > 0 {
+		ctx, cancel = context.WithTimeout(ctx, task.maxRuntime)
+	}
+	defer cancel()
+
+	// the job runs in its own goroutine so a run that overstays its max runtime is noticed even if the job ignores its
+	// context
+	done := make(chan jobResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("Task panicked", "panic", r)
+				done <- jobResult{err: fmt.Errorf("panic: %v", r), panicked: true}
+			}
+		}()
+		done <- jobResult{err: task.job(ctx)}
 	}()
-	if err := task.job(); err != nil {
-		s.logger.Error("Task returned error", "task_id", task.id, "error", err)
+
+	var result jobResult
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		// the run keeps its locks until the job returns, so a job that ignores its context can't overlap the next run
+		// of its task or group. it's only noticed, and waited for
+		logger.Warn("Task exceeded its max runtime, waiting for it to return", "max_runtime", task.maxRuntime)
+		s.emit(task, Event{Kind: TaskOverran, Duration: s.clock.Now().Sub(start)})
+		result = <-done
+		result.err = fmt.Errorf("exceeded max runtime of %s", task.maxRuntime)
+	}
+
+	duration := s.clock.Now().Sub(start)
+	switch {
+	case result.panicked:
+	case result.err != nil:
+		logger.Error("Task returned error", "error", result.err, "duration", duration)
+	default:
+		logger.Info("Task completed", "duration", duration)
+	}
+	if result.err != nil {
+		s.emit(task, Event{Kind: TaskFailed, Duration: duration, Err: result.err})
 	} else {
-		s.logger.Debug("Task completed successfully", "task_id", task.id)
+		s.emit(task, Event{Kind: TaskFinished, Duration: duration})
 	}
+	if task.restartOnPanic > 0 {
+		_ = enqueue(s, s.finished, taskResult{task: task, panicked: result.panicked}, OverflowBlock)
+	}
+}
+
+type skippedRunsKey struct{}
+
+// SkippedRuns are the runs SkipDays and SkipDates left out just before this one, oldest first, for a job that covers
+// the time since its last run to say it's covering theirs too
+func SkippedRuns(ctx context.Context) []time.Time {
+	skipped, _ := ctx.Value(skippedRunsKey{}).([]time.Time)
+	return skipped
+}
+
+type scheduledAtKey struct{}
+
+// ScheduledAt is when the run was due, as the schedule had it, rather than when it got to start after waiting for the
+// locks of its blocking mode. it's the same for every process running the task on the same schedule, as long as their
+// clocks agree, so it names the run. false for the retries of a panicked job
+func ScheduledAt(ctx context.Context) (time.Time, bool) {
+	at, ok := ctx.Value(scheduledAtKey{}).(time.Time)
+	return at, ok
+}
+
+// jobResult is how one run of a job ended
+type jobResult struct {
+	err      error
+	panicked bool
+}
+
+// schedule arms the task's timer to call fn at [at]. at is kept as it is, rather than worked out again from the time
+// now, so ScheduledAt is exactly the time the schedule asked for
+func (s *Scheduler) schedule(task *Task, at time.Time, fn func()) {
+	next := at.Sub(s.clock.Now())
+	s.taskLogger(task).Debug("Scheduling task", "next_run", next, "next_run_at", at)
+	task.setNextRun(at)
+	s.emit(task, Event{Kind: TaskScheduled, NextRun: at})
+	task.setTimer(s.clock.AfterFunc(next, fn))
+}
+
+// NextRun returns when the task will next run, or false if it doesn't exist or isn't scheduled to run again
+func (s *Scheduler) NextRun(id uint64) (time.Time, bool) {
+	task, ok := s.task(id)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	task.runMu.Lock()
+	defer task.runMu.Unlock()
+	return task.nextRun, !task.nextRun.IsZero()
+}
+
+// LastRun returns when the task last started running, or false if it doesn't exist or hasn't run yet
+func (s *Scheduler) LastRun(id uint64) (time.Time, bool) {
+	task, ok := s.task(id)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	task.runMu.Lock()
+	defer task.runMu.Unlock()
+	return task.lastRun, !task.lastRun.IsZero()
+}
+
+func (s *Scheduler) task(id uint64) (*Task, bool) {
+	s.tasksMu.Lock()
+	defer s.tasksMu.Unlock()
+	task, ok := s.tasks[id]
+	return task, ok
+}
+
+// taskLogger is the scheduler's logger with the task's id, name, variant and log attributes
+func (s *Scheduler) taskLogger(task *Task) *slog.Logger {
+	args := []any{"task_id", task.id}
+	if task.name != "" {
+		args = append(args, "task", task.name)
+	}
+	args = append(args, "variant", task.variant.String())
+	for _, attr := range task.logAttrs {
+		args = append(args, attr)
+	}
+	return s.logger.With(args...)
 }
 
 func (s *Scheduler) taskCallbackGenerator(id uint64) func() {
 	return func() {
-		if !s.stopped.Load() { // check before sending to the channel
-			s.run <- id
-		}
+		_ = enqueue(s, s.run, id, OverflowBlock)
 	}
 }
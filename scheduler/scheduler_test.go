@@ -0,0 +1,524 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	_ "time/tzdata" // the DST tests need Europe/Berlin wherever they run
+)
+
+// waitTimeout is how long a test waits for something the scheduler does in its own goroutines
+const waitTimeout = 2 * time.Second
+
+// quietPeriod is how long a test watches for something that shouldn't happen
+const quietPeriod = 50 * time.Millisecond
+
+// harness runs a scheduler on a FakeClock and collects its events
+type harness struct {
+	s      *Scheduler
+	clock  *FakeClock
+	events chan Event
+	// pending are the events received but not waited for yet, oldest first
+	pending []Event
+}
+
+func newHarness(t *testing.T, start time.Time, configure func(*Scheduler)) *harness {
+	t.Helper()
+	h := &harness{clock: NewFakeClock(start), events: make(chan Event, 1024)}
+	h.s = New().WithClock(h.clock).SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if configure != nil {
+		configure(h.s)
+	}
+	h.s.OnEvent(func(e Event) { h.events <- e })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go h.s.Run(ctx)
+	t.Cleanup(cancel)
+	return h
+}
+
+// add adds task and waits for it to be scheduled, returning its id and first run
+func (h *harness) add(t *testing.T, task *Task) (uint64, time.Time) {
+	t.Helper()
+	id, err := h.s.Add(task)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	return id, h.wait(t, TaskScheduled, id).NextRun
+}
+
+// wait returns the oldest event of kind for the task not waited for yet. the events of other kinds and tasks are kept
+// for later waits
+func (h *harness) wait(t *testing.T, kind EventKind, id uint64) Event {
+	t.Helper()
+	timeout := time.After(waitTimeout)
+	for {
+		if e, ok := h.take(kind, id); ok {
+			return e
+		}
+		select {
+		case e := <-h.events:
+			h.pending = append(h.pending, e)
+		case <-timeout:
+			t.Fatalf("task %d was never %s", id, kind)
+		}
+	}
+}
+
+// quiet fails if the task gets an event of kind within quietPeriod
+func (h *harness) quiet(t *testing.T, kind EventKind, id uint64) {
+	t.Helper()
+	timeout := time.After(quietPeriod)
+	for {
+		if _, ok := h.take(kind, id); ok {
+			t.Fatalf("task %d was %s too early", id, kind)
+		}
+		select {
+		case e := <-h.events:
+			h.pending = append(h.pending, e)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func (h *harness) take(kind EventKind, id uint64) (Event, bool) {
+	for i, e := range h.pending {
+		if e.Kind == kind && e.TaskID == id {
+			h.pending = append(h.pending[:i], h.pending[i+1:]...)
+			return e, true
+		}
+	}
+	return Event{}, false
+}
+
+// advanceTo moves the clock to at, which fires the timers due by then
+func (h *harness) advanceTo(at time.Time) {
+	h.clock.Advance(at.Sub(h.clock.Now()))
+}
+
+// recv is the next value from ch
+func recv[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out")
+		panic("unreachable")
+	}
+}
+
+// scheduledJob is a job that sends when each of its runs was due
+func scheduledJob(runs chan<- time.Time) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		at, _ := ScheduledAt(ctx)
+		runs <- at
+		return nil
+	}
+}
+
+func berlin(t *testing.T) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestDailyAcrossDST(t *testing.T) {
+	location := berlin(t)
+	tests := []struct {
+		name string
+		// start is the day before the day before the change, at noon
+		start time.Time
+		// gap is the time between the run before the change and the one on the day of it
+		gap time.Duration
+	}{
+		{"spring forward", time.Date(2024, 3, 29, 12, 0, 0, 0, location), 23 * time.Hour},
+		{"fall back", time.Date(2024, 10, 25, 12, 0, 0, 0, location), 25 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, tt.start, nil)
+			runs := make(chan time.Time, 8)
+			id, next := h.add(t, NewTaskWithContext(scheduledJob(runs)).Daily(time.Date(0, 0, 0, 8, 0, 0, 0, location)))
+
+			var previous time.Time
+			for day := 1; day <= 3; day++ {
+				h.advanceTo(next)
+				at := recv(t, runs)
+				if !at.Equal(next) {
+					t.Fatalf("day %d ran as scheduled at %s, want %s", day, at, next)
+				}
+				want := tt.start.AddDate(0, 0, day)
+				if local := at.In(location); local.Hour() != 8 || local.Minute() != 0 || local.Day() != want.Day() {
+					t.Errorf("day %d ran at %s, want 08:00 on %s", day, local, want.Format(time.DateOnly))
+				}
+				if day == 2 {
+					if gap := at.Sub(previous); gap != tt.gap {
+						t.Errorf("%s between the runs either side of the change, want %s", gap, tt.gap)
+					}
+				}
+				previous = at
+				next = h.wait(t, TaskScheduled, id).NextRun
+			}
+		})
+	}
+}
+
+func TestDailyAtChangingTime(t *testing.T) {
+	location := berlin(t)
+	tests := []struct {
+		name string
+		now  time.Time
+		// want is the local time of the run
+		want string
+	}{
+		// 02:30 doesn't happen that day, the clocks go from 02:00 to 03:00
+		{"skipped by spring forward", time.Date(2024, 3, 30, 12, 0, 0, 0, location), "2024-03-31 03:30"},
+		// 02:30 happens twice, time.Date picks one of them
+		{"repeated by fall back", time.Date(2024, 10, 26, 12, 0, 0, 0, location), "2024-10-27 02:30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := NewTask(func() error { return nil }).Daily(time.Date(0, 0, 0, 2, 30, 0, 0, location))
+			next, ok := task.next(tt.now)
+			if !ok {
+				t.Fatal("not scheduled")
+			}
+			if got := tt.now.Add(next).In(location).Format("2006-01-02 15:04"); got != tt.want {
+				t.Errorf("next run at %s, want %s", got, tt.want)
+			}
+			// and the day after is back to 02:30
+			after, _ := task.next(tt.now.Add(next))
+			if got := tt.now.Add(next + after).In(location).Format("15:04"); got != "02:30" {
+				t.Errorf("the run after is at %s, want 02:30", got)
+			}
+		})
+	}
+}
+
+func TestAtTime(t *testing.T) {
+	start := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+
+	t.Run("future", func(t *testing.T) {
+		h := newHarness(t, start, nil)
+		runs := make(chan time.Time, 1)
+		at := start.Add(90 * time.Minute)
+		id, next := h.add(t, NewTaskWithContext(scheduledJob(runs)).AtTime(at))
+		if !next.Equal(at) {
+			t.Fatalf("scheduled for %s, want %s", next, at)
+		}
+
+		h.clock.Advance(89 * time.Minute)
+		h.quiet(t, TaskStarted, id)
+
+		h.clock.Advance(time.Minute)
+		if got := recv(t, runs); !got.Equal(at) {
+			t.Errorf("ran as scheduled at %s, want %s", got, at)
+		}
+		h.wait(t, TaskDisposed, id)
+		if h.clock.Timers() != 0 {
+			t.Errorf("%d timers left after the only run", h.clock.Timers())
+		}
+	})
+
+	t.Run("past", func(t *testing.T) {
+		h := newHarness(t, start, nil)
+		runs := make(chan time.Time, 1)
+		_, next := h.add(t, NewTaskWithContext(scheduledJob(runs)).AtTime(start.Add(-time.Hour)))
+		if !next.Equal(start) {
+			t.Fatalf("scheduled for %s, want straight away at %s", next, start)
+		}
+		h.clock.Advance(0)
+		if got := recv(t, runs); !got.Equal(start) {
+			t.Errorf("ran as scheduled at %s, want %s", got, start)
+		}
+	})
+}
+
+func TestGroupMutualExclusion(t *testing.T) {
+	h := newHarness(t, time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC), nil)
+
+	var running, most atomic.Int32
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	job := func(name string) func() error {
+		return func() error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := most.Load()
+				if n <= m || most.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			started <- name
+			<-release
+			return nil
+		}
+	}
+
+	first, _ := h.add(t, NewTask(job("first")).Once().Group("gmail"))
+	second, _ := h.add(t, NewTask(job("second")).Once().Group("gmail"))
+	otherStarted := make(chan struct{})
+	other, _ := h.add(t, NewTask(func() error {
+		close(otherStarted)
+		return nil
+	}).Once().Group("discord"))
+
+	h.clock.Advance(0)
+	waiting := second
+	if recv(t, started) == "second" {
+		waiting = first
+	}
+	// another group isn't held up
+	recv(t, otherStarted)
+	h.wait(t, TaskFinished, other)
+	h.quiet(t, TaskStarted, waiting)
+
+	release <- struct{}{}
+	recv(t, started)
+	release <- struct{}{}
+	h.wait(t, TaskFinished, waiting)
+
+	if most.Load() != 1 {
+		t.Errorf("%d tasks of the group ran at once", most.Load())
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	job := func() error { return nil }
+
+	t.Run("fail", func(t *testing.T) {
+		// not running, so nothing takes from the queue
+		s := New().WithQueueSize(1).WithOverflow(OverflowFail).SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if _, err := s.Add(NewTask(job).Once()); err != nil {
+			t.Fatalf("first Add: %v", err)
+		}
+		if _, err := s.Add(NewTask(job).Once()); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("second Add returned %v, want ErrQueueFull", err)
+		}
+		// deletes have a queue of their own
+		if err := s.Del(1); err != nil {
+			t.Fatalf("first Del: %v", err)
+		}
+		if err := s.Del(1); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("second Del returned %v, want ErrQueueFull", err)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		s := New().WithClock(NewFakeClock(time.Now())).WithQueueSize(1).SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if _, err := s.Add(NewTask(job).Once()); err != nil {
+			t.Fatalf("first Add: %v", err)
+		}
+		added := make(chan error, 1)
+		go func() {
+			_, err := s.Add(NewTask(job).Once())
+			added <- err
+		}()
+		select {
+		case err := <-added:
+			t.Fatalf("second Add returned %v with the queue full, want it to wait", err)
+		case <-time.After(quietPeriod):
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.Run(ctx)
+		if err := recv(t, added); err != nil {
+			t.Errorf("second Add returned %v once there was room", err)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		s := New().WithQueueSize(1).SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if _, err := s.Add(NewTask(job).Once()); err != nil {
+			t.Fatalf("first Add: %v", err)
+		}
+		added := make(chan error, 1)
+		go func() {
+			_, err := s.Add(NewTask(job).Once())
+			added <- err
+		}()
+		time.Sleep(quietPeriod)
+		s.Stop()
+		if err := recv(t, added); !errors.Is(err, ErrStopped) {
+			t.Errorf("waiting Add returned %v when stopped, want ErrStopped", err)
+		}
+		if _, err := s.Add(NewTask(job).Once()); !errors.Is(err, ErrStopped) {
+			t.Errorf("Add after Stop returned %v, want ErrStopped", err)
+		}
+	})
+}
+
+func TestRestartOnPanic(t *testing.T) {
+	start := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+
+	t.Run("recovers", func(t *testing.T) {
+		h := newHarness(t, start, nil)
+		var runs atomic.Int32
+		retried := make(chan bool, 4)
+		id, next := h.add(t, NewTaskWithContext(func(ctx context.Context) error {
+			_, scheduled := ScheduledAt(ctx)
+			retried <- !scheduled
+			if runs.Add(1) == 1 {
+				panic("first run")
+			}
+			return nil
+		}).Every(time.Hour).RestartOnPanic(2))
+
+		h.advanceTo(next)
+		if recv(t, retried) {
+			t.Error("the first run has no scheduled time")
+		}
+		// the next regular run is set as the run starts, and paused when it panics
+		h.wait(t, TaskScheduled, id)
+		h.wait(t, TaskFailed, id)
+		retry := h.wait(t, TaskScheduled, id).NextRun
+		if want := next.Add(restartBackoff); !retry.Equal(want) {
+			t.Errorf("retry at %s, want %s", retry, want)
+		}
+
+		h.advanceTo(retry)
+		if !recv(t, retried) {
+			t.Error("the retry has a scheduled time")
+		}
+		h.wait(t, TaskFinished, id)
+		// the schedule resumes an hour after the clean run
+		if resumed := h.wait(t, TaskScheduled, id).NextRun; !resumed.Equal(retry.Add(time.Hour)) {
+			t.Errorf("schedule resumed at %s, want %s", resumed, retry.Add(time.Hour))
+		}
+		if h.clock.Timers() != 1 {
+			t.Errorf("%d timers pending, want only the next regular run", h.clock.Timers())
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		h := newHarness(t, start, nil)
+		id, next := h.add(t, NewTask(func() error { panic("always") }).Every(time.Hour).RestartOnPanic(1))
+
+		h.advanceTo(next)
+		h.wait(t, TaskScheduled, id)
+		h.wait(t, TaskFailed, id)
+		retry := h.wait(t, TaskScheduled, id).NextRun
+		h.advanceTo(retry)
+		h.wait(t, TaskFailed, id)
+		h.wait(t, TaskDisposed, id)
+		if _, ok := h.s.NextRun(id); ok {
+			t.Error("still scheduled after the last retry panicked")
+		}
+	})
+}
+
+func TestMaxRuntime(t *testing.T) {
+	h := newHarness(t, time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC), nil)
+	cancelled := make(chan error, 1)
+	id, _ := h.add(t, NewTaskWithContext(func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	}).Once().MaxRuntime(20*time.Millisecond))
+
+	h.clock.Advance(0)
+	if err := recv(t, cancelled); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("the job's context ended with %v, want DeadlineExceeded", err)
+	}
+	h.wait(t, TaskOverran, id)
+	failed := h.wait(t, TaskFailed, id)
+	if failed.Err == nil || !strings.Contains(failed.Err.Error(), "max runtime") {
+		t.Errorf("failed with %v, want the max runtime", failed.Err)
+	}
+}
+
+func TestMaxRuntimeHoldsGroupLock(t *testing.T) {
+	h := newHarness(t, time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC), nil)
+	release := make(chan struct{})
+	// a job that ignores its context, like a call without a timeout
+	hung, _ := h.add(t, NewTaskWithContext(func(ctx context.Context) error {
+		<-release
+		return nil
+	}).Once().Group("gmail").MaxRuntime(20*time.Millisecond))
+	h.clock.Advance(0)
+	h.wait(t, TaskStarted, hung)
+	h.wait(t, TaskOverran, hung)
+
+	next, _ := h.add(t, NewTask(func() error { return nil }).Once().Group("gmail"))
+	h.clock.Advance(0)
+	h.quiet(t, TaskStarted, next)
+	h.quiet(t, TaskFailed, hung)
+
+	close(release)
+	failed := h.wait(t, TaskFailed, hung)
+	if failed.Err == nil || !strings.Contains(failed.Err.Error(), "max runtime") {
+		t.Errorf("failed with %v, want the max runtime", failed.Err)
+	}
+	h.wait(t, TaskStarted, next)
+	h.wait(t, TaskFinished, next)
+}
+
+func TestReschedule(t *testing.T) {
+	start := time.Date(2024, 6, 1, 7, 0, 0, 0, time.UTC)
+	eight := time.Date(0, 0, 0, 8, 0, 0, 0, time.UTC)
+
+	t.Run("earlier", func(t *testing.T) {
+		h := newHarness(t, start, nil)
+		runs := make(chan time.Time, 2)
+		id, _ := h.add(t, NewTaskWithContext(scheduledJob(runs)).Daily(eight))
+
+		moved := start.Add(30 * time.Minute)
+		if err := h.s.Reschedule(id, moved); err != nil {
+			t.Fatalf("Reschedule: %v", err)
+		}
+		if next := h.wait(t, TaskScheduled, id).NextRun; !next.Equal(moved) {
+			t.Fatalf("moved to %s, want %s", next, moved)
+		}
+
+		h.advanceTo(moved)
+		if got := recv(t, runs); !got.Equal(moved) {
+			t.Errorf("ran as scheduled at %s, want %s", got, moved)
+		}
+		h.wait(t, TaskStarted, id)
+		// the 08:00 run was the one that moved, so the next is tomorrow's
+		tomorrow := time.Date(2024, 6, 2, 8, 0, 0, 0, time.UTC)
+		if next := h.wait(t, TaskScheduled, id).NextRun; !next.Equal(tomorrow) {
+			t.Errorf("next run at %s after the moved one, want %s", next, tomorrow)
+		}
+		h.advanceTo(time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC))
+		h.quiet(t, TaskStarted, id)
+	})
+
+	t.Run("later", func(t *testing.T) {
+		h := newHarness(t, start, nil)
+		runs := make(chan time.Time, 2)
+		id, _ := h.add(t, NewTaskWithContext(scheduledJob(runs)).Daily(eight))
+
+		moved := time.Date(2024, 6, 1, 9, 30, 0, 0, time.UTC)
+		if err := h.s.Reschedule(id, moved); err != nil {
+			t.Fatalf("Reschedule: %v", err)
+		}
+		h.wait(t, TaskScheduled, id)
+
+		h.advanceTo(time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC))
+		h.quiet(t, TaskStarted, id)
+		h.advanceTo(moved)
+		if got := recv(t, runs); !got.Equal(moved) {
+			t.Errorf("ran as scheduled at %s, want %s", got, moved)
+		}
+		tomorrow := time.Date(2024, 6, 2, 8, 0, 0, 0, time.UTC)
+		if next := h.wait(t, TaskScheduled, id).NextRun; !next.Equal(tomorrow) {
+			t.Errorf("next run at %s after the moved one, want %s", next, tomorrow)
+		}
+		if h.clock.Timers() != 1 {
+			t.Errorf("%d timers armed, want the next run's", h.clock.Timers())
+		}
+	})
+}
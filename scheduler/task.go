@@ -1,7 +1,10 @@
 package scheduler
 
 import (
+	"context"
+	"log/slog"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -14,17 +17,49 @@ const (
 	daily
 	weekly
 	monthly
+	absolute
 )
 
+func (v taskVariant) String() string {
+	switch v {
+	case once:
+		return "once"
+	case every:
+		return "every"
+	case random:
+		return "random"
+	case daily:
+		return "daily"
+	case weekly:
+		return "weekly"
+	case monthly:
+		return "monthly"
+	case absolute:
+		return "at"
+	}
+	return "unknown"
+}
+
+// LastDayOfMonth can be passed to Monthly as [on] to run on the last day of each month, whatever its length
+const LastDayOfMonth = -1
+
 type blockingMode uint8
 
 const (
 	nonBlocking blockingMode = iota
 	blocking
+	groupBlocking
 	globalBlocking
 )
 
 func NewTask(job func() error) *Task {
+	return NewTaskWithContext(func(context.Context) error {
+		return job()
+	})
+}
+
+// NewTaskWithContext creates a task whose job gets a context, which is cancelled when the run exceeds MaxRuntime
+func NewTaskWithContext(job func(ctx context.Context) error) *Task {
 	return &Task{
 		job: job,
 
@@ -38,9 +73,8 @@ func NewTask(job func() error) *Task {
 // Task represents a job to be scheduled
 type Task struct {
 	// main values
-	id    uint64       // id is a unique identifier for the task. will be set automatically - do not set manually
-	job   func() error // job is the task to be run
-	timer *time.Timer  // timer can be used to cancel the next scheduled task
+	id  uint64                          // id is a unique identifier for the task. will be set automatically - do not set manually
+	job func(ctx context.Context) error // job is the task to be run
 
 	// scheduling information
 	variant  taskVariant           // variant represents the type of task scheduling to use
@@ -48,15 +82,43 @@ type Task struct {
 	at       time.Time             // at represents the time of day to run at
 	days     map[time.Weekday]bool // days represents the days of the week to run on
 	months   map[time.Month]bool   // months represents the months of the year to run on
-	on       int                   // on represents the day of the month to run on
+	on       int                   // on represents the day of the month to run on, or LastDayOfMonth
 	times    int                   // times represents the number of times to run. -1 represents running indefinitely
 	randMin  time.Duration         // randMin represents the minimum duration a random task variant could take
 	randMax  time.Duration         // randMax represents the maximum duration a random task variant could take
+	aligned  bool                  // aligned puts the runs of an every task on the clock's multiples of duration
+
+	// skipping
+	skipDays      map[time.Weekday]bool // skipDays are the weekdays a daily or weekly task doesn't run on
+	skipDates     map[string]bool       // skipDates are the dates, as 2006-01-02, a daily or weekly task doesn't run on
+	skippedBefore []time.Time           // skippedBefore are the runs left out just before the next one. only touched by the Run loop
+	movedFrom     time.Time             // movedFrom is when the next run was due before Reschedule moved it. only touched by the Run loop
+
+	// logging
+	name     string      // name is how the task is called in the scheduler's log lines
+	logAttrs []slog.Attr // logAttrs are added to every log line about the task
 
 	// other options
-	blocking blockingMode
+	blocking       blockingMode
+	group          string        // group is the name of the group the task blocks with, when blocking is groupBlocking
+	maxRuntime     time.Duration // maxRuntime is how long a run may take before its context is cancelled
+	restartOnPanic int           // restartOnPanic is how many times in a row a panicking job is retried. 0 keeps the cadence going
+	panics         int           // panics counts the panics since the job last ran cleanly. only touched by the Run loop
+
+	// run times, for NextRun and LastRun, and the timer, which Stop reaches from outside the Run loop
+	runMu   sync.Mutex
+	timer   Timer     // timer can be used to cancel the next scheduled task
+	nextRun time.Time // nextRun is when the timer will fire, zero if it isn't set
+	lastRun time.Time // lastRun is when the job last started, zero if it never has
 }
 
+const (
+	// restartBackoff is the wait before the first retry of a panicked job, doubling with every retry after
+	restartBackoff = time.Second
+	// maxRestartBackoff caps the wait between retries
+	maxRestartBackoff = 5 * time.Minute
+)
+
 // Once runs the task once, and then self-cancels
 // if overridden with Times(n), it will behave the same as Every(0) n times.
 // if overridden with Forever(), it will behave the same as Every(0)
@@ -66,6 +128,14 @@ func (t *Task) Once() *Task {
 	return t
 }
 
+// AtTime runs the task once at [at], and then self-cancels. a time that has already passed runs it straight away
+func (t *Task) AtTime(at time.Time) *Task {
+	t.variant = absolute
+	t.at = at
+	t.times = 1
+	return t
+}
+
 // Every runs the task every [duration]
 func (t *Task) Every(duration time.Duration) *Task {
 	if duration < 0 {
@@ -76,6 +146,14 @@ func (t *Task) Every(duration time.Duration) *Task {
 	return t
 }
 
+// Aligned makes an Every task run on the clock's multiples of its duration, e.g. at :00, :05, :10 for every 5 minutes,
+// rather than a duration after it was added or last ran. two processes scheduling the same task then fire it at the same
+// times, see ScheduledAt
+func (t *Task) Aligned() *Task {
+	t.aligned = true
+	return t
+}
+
 // RandomInterval runs the task at random intervals between min and max duration
 func (t *Task) RandomInterval(min, max time.Duration) *Task {
 	if min < 0 || max < 0 {
@@ -92,7 +170,7 @@ func (t *Task) RandomInterval(min, max time.Duration) *Task {
 	return t
 }
 
-// Daily runs the task every day [at] a specific time
+// Daily runs the task every day [at] a specific time, in [at]'s location
 func (t *Task) Daily(at time.Time) *Task {
 	if at.IsZero() {
 		panic("at time must be a valid non-zero time")
@@ -102,7 +180,7 @@ func (t *Task) Daily(at time.Time) *Task {
 	return t
 }
 
-// Weekly runs the task weekly on specified [days] [at] a specific time
+// Weekly runs the task weekly on specified [days] [at] a specific time, in [at]'s location
 func (t *Task) Weekly(days map[time.Weekday]bool, at time.Time) *Task {
 	if len(days) == 0 {
 		panic("days map cannot be empty")
@@ -116,13 +194,14 @@ func (t *Task) Weekly(days map[time.Weekday]bool, at time.Time) *Task {
 	return t
 }
 
-// Monthly runs the task monthly on specified [months], [on] a specific day, [at] a specific time
+// Monthly runs the task monthly on specified [months], [on] a specific day, [at] a specific time, in [at]'s location.
+// [on] can be LastDayOfMonth
 func (t *Task) Monthly(months map[time.Month]bool, on int, at time.Time) *Task {
 	if len(months) == 0 {
 		panic("months map cannot be empty")
 	}
-	if on <= 0 || on > 31 {
-		panic("on must be a valid day of the month (1-31)")
+	if on != LastDayOfMonth && (on <= 0 || on > 31) {
+		panic("on must be a valid day of the month (1-31) or LastDayOfMonth")
 	}
 	if at.IsZero() {
 		panic("at time must be a valid non-zero time")
@@ -134,6 +213,93 @@ func (t *Task) Monthly(months map[time.Month]bool, on int, at time.Time) *Task {
 	return t
 }
 
+// SkipDays leaves [days] out of a daily or weekly schedule. the runs left out are passed to the next run that does
+// happen, see SkippedRuns
+func (t *Task) SkipDays(days map[time.Weekday]bool) *Task {
+	if t.skipDays == nil {
+		t.skipDays = make(map[time.Weekday]bool)
+	}
+	for day, skip := range days {
+		if skip {
+			t.skipDays[day] = true
+		}
+	}
+	return t
+}
+
+// SkipDates leaves the calendar days of [dates] out of a daily or weekly schedule, e.g. holidays. dates are read in
+// the location of the task's time of day. the runs left out are passed to the next run that does happen, see
+// SkippedRuns
+func (t *Task) SkipDates(dates ...time.Time) *Task {
+	if t.skipDates == nil {
+		t.skipDates = make(map[string]bool)
+	}
+	for _, date := range dates {
+		t.skipDates[date.Format(time.DateOnly)] = true
+	}
+	return t
+}
+
+// skips reports whether a run on day is left out by SkipDays or SkipDates
+func (t *Task) skips(day time.Time) bool {
+	return t.skipDays[day.Weekday()] || t.skipDates[day.Format(time.DateOnly)]
+}
+
+// RestartOnPanic retries a panicking job up to [max] times in a row, with exponential backoff, instead of carrying on
+// with its schedule as if nothing happened. the schedule is paused while retrying and resumes after a clean run. if
+// every retry panics, the task is cancelled
+func (t *Task) RestartOnPanic(max int) *Task {
+	if max <= 0 {
+		panic("max restarts must be a positive integer")
+	}
+	t.restartOnPanic = max
+	return t
+}
+
+// scheduledRun is when the task's timer was set to fire, false if it isn't set
+func (t *Task) scheduledRun() (time.Time, bool) {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	return t.nextRun, !t.nextRun.IsZero()
+}
+
+func (t *Task) setNextRun(next time.Time) {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	t.nextRun = next
+}
+
+func (t *Task) setTimer(timer Timer) {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	t.timer = timer
+}
+
+// stopTimer stops the task's timer, if it has one
+func (t *Task) stopTimer() {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// timeOnDay is the task's time of day, days after now's date. days are counted on the calendar rather than in 24h
+// steps, so the task keeps its local time across daylight saving changes. a time skipped by the clocks going forward
+// comes out an hour later, the way time.Date normalizes it
+func (t *Task) timeOnDay(now time.Time, days int) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day()+days, t.at.Hour(), t.at.Minute(), t.at.Second(), 0, now.Location())
+}
+
+// restartDelay is how long to wait before the next retry
+func (t *Task) restartDelay() time.Duration {
+	delay := restartBackoff << (t.panics - 1)
+	if delay > maxRestartBackoff || delay <= 0 {
+		delay = maxRestartBackoff
+	}
+	return delay
+}
+
 // Times is used to limit the task to running a specific number of times, before self-cancelling
 func (t *Task) Times(times int) *Task {
 	if times <= 0 {
@@ -150,6 +316,28 @@ func (t *Task) Forever() *Task {
 	return t
 }
 
+// MaxRuntime cancels the job's context once a run has taken longer than max, so a job that honours it gives up rather
+// than hold up the tasks it blocks. the run keeps its locks until the job returns, and is logged as failed
+func (t *Task) MaxRuntime(max time.Duration) *Task {
+	if max <= 0 {
+		panic("the max runtime must be positive")
+	}
+	t.maxRuntime = max
+	return t
+}
+
+// Named gives the task a name for the scheduler's log lines
+func (t *Task) Named(name string) *Task {
+	t.name = name
+	return t
+}
+
+// WithLogAttrs adds attributes to every log line the scheduler writes about the task
+func (t *Task) WithLogAttrs(attrs ...slog.Attr) *Task {
+	t.logAttrs = append(t.logAttrs, attrs...)
+	return t
+}
+
 // NonBlocking allows multiple instances of this task to run simultaneously
 func (t *Task) NonBlocking() *Task {
 	t.blocking = nonBlocking
@@ -162,15 +350,24 @@ func (t *Task) Blocking() *Task {
 	return t
 }
 
+// Group puts the task in a named group, of which only one task can run at once. tasks of other groups and
+// non-blocking tasks can still run alongside it
+func (t *Task) Group(name string) *Task {
+	t.blocking = groupBlocking
+	t.group = name
+	return t
+}
+
 // GlobalBlocking ensures that the task can be the only task running at a given time
 func (t *Task) GlobalBlocking() *Task {
 	t.blocking = globalBlocking
 	return t
 }
 
-// next evaluates when and whether the task should be scheduled to run next
-func (t *Task) next() (time.Duration, bool) {
-	now := time.Now()
+// next evaluates when and whether the task should be scheduled to run next, as of now
+func (t *Task) next(now time.Time) (time.Duration, bool) {
+	// times of day are read in at's location, which needn't be the host's
+	now = now.In(t.at.Location())
 
 	if t.times == 0 {
 		return 0, false
@@ -181,15 +378,26 @@ func (t *Task) next() (time.Duration, bool) {
 
 	var nextRun time.Time
 	var found bool
+	t.skippedBefore = nil
 
 	switch t.variant {
 	// run once immediately
 	case once:
 		nextRun = now
 
+	// run once at an absolute time
+	case absolute:
+		nextRun = t.at
+		if nextRun.Before(now) {
+			nextRun = now
+		}
+
 	// run every specified duration
 	case every:
 		nextRun = now.Add(t.duration)
+		if t.aligned && t.duration > 0 {
+			nextRun = now.Truncate(t.duration).Add(t.duration)
+		}
 
 	// run at random intervals between min and max duration
 	case random:
@@ -197,9 +405,21 @@ func (t *Task) next() (time.Duration, bool) {
 
 	// run daily at a specific time
 	case daily:
-		nextRun = time.Date(now.Year(), now.Month(), now.Day(), t.at.Hour(), t.at.Minute(), t.at.Second(), 0, now.Location())
-		if nextRun.Before(now) {
-			nextRun = nextRun.Add(24 * time.Hour)
+		// a year of skipped days is as good as never running again
+		for i := 0; i <= 366; i++ {
+			nextRun = t.timeOnDay(now, i)
+			if !nextRun.After(now) {
+				continue
+			}
+			if t.skips(nextRun) {
+				t.skippedBefore = append(t.skippedBefore, nextRun)
+				continue
+			}
+			found = true
+			break
+		}
+		if !found {
+			return 0, false
 		}
 
 		// run weekly on specified days at a specific time
@@ -208,23 +428,19 @@ func (t *Task) next() (time.Duration, bool) {
 			return 0, false
 		}
 
-		// Initialize nextRun to the scheduled time today
-		nextRun = time.Date(now.Year(), now.Month(), now.Day(), t.at.Hour(), t.at.Minute(), t.at.Second(), 0, now.Location())
-
-		// If the scheduled time for today has already passed, move to the next day
-		if !nextRun.After(now) {
-			nextRun = nextRun.Add(24 * time.Hour)
-		}
-
-		// Loop through the next 7 days to find the next valid day
-		for i := 0; i < 7; i++ {
-			if t.days[nextRun.Weekday()] {
-				// If the nextRun is in the future and falls on a valid day, stop here
-				found = true
-				break
+		// Loop through today and the following days to find the next valid day whose time hasn't passed. skipped
+		// dates can push it out by weeks, a year of them is as good as never running again
+		for i := 0; i <= 366; i++ {
+			nextRun = t.timeOnDay(now, i)
+			if !t.days[nextRun.Weekday()] || !nextRun.After(now) {
+				continue
+			}
+			if t.skips(nextRun) {
+				t.skippedBefore = append(t.skippedBefore, nextRun)
+				continue
 			}
-			// Otherwise, move to the next day
-			nextRun = nextRun.Add(24 * time.Hour)
+			found = true
+			break
 		}
 
 		// Self-cancel if no valid day is found
@@ -234,20 +450,20 @@ func (t *Task) next() (time.Duration, bool) {
 
 	// run monthly on specified months, on a specific day, at a specific time
 	case monthly:
-		if t.months == nil || t.on <= 0 || t.on > 31 {
+		if t.months == nil || (t.on != LastDayOfMonth && (t.on <= 0 || t.on > 31)) {
 			return 0, false
 		}
+
+		// check this month's run first, then each following month, up to the same month next year
 		year, month := now.Year(), now.Month()
-		if now.Day() > t.on || (now.Day() == t.on && now.After(time.Date(year, month, t.on, t.at.Hour(), t.at.Minute(), t.at.Second(), 0, now.Location()))) {
-			month++
-			if month > 12 {
-				month = 1
-				year++
+		for i := 0; i <= 12; i++ {
+			day := t.on
+			if day == LastDayOfMonth {
+				// day 0 of the next month is the last day of this one
+				day = time.Date(year, month+1, 0, 0, 0, 0, 0, now.Location()).Day()
 			}
-		}
-		found = false
-		for i := 0; i < 12; i++ {
-			if t.months[month] {
+			nextRun = time.Date(year, month, day, t.at.Hour(), t.at.Minute(), t.at.Second(), 0, now.Location())
+			if t.months[month] && nextRun.After(now) {
 				found = true
 				break
 			}
@@ -261,7 +477,6 @@ func (t *Task) next() (time.Duration, bool) {
 		if !found {
 			return 0, false
 		}
-		nextRun = time.Date(year, month, t.on, t.at.Hour(), t.at.Minute(), t.at.Second(), 0, now.Location())
 
 	default:
 		// handle unknown task variant
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// GmailAccessConfig turns on the features that need more than read access to Gmail. each one adds the scope it needs
+// to the consent screen, so a bot that only reads mail only ever asks to read it
+type GmailAccessConfig struct {
+	// Label lets the bot add and remove labels
+	Label bool `json:"label"`
+	// Archive lets the bot archive emails and mark them read
+	Archive bool `json:"archive"`
+	// Drafts lets the bot save drafts to the mailbox instead of only posting them to Discord
+	Drafts bool `json:"drafts"`
+	// Send lets the bot send emails
+	Send bool `json:"send"`
+}
+
+// gmailScopes are the scopes the enabled features need: read only, plus modify, compose or send for the features that
+// write to the mailbox
+func (a *App) gmailScopes() []string {
+	scopes := []string{gmail.GmailReadonlyScope}
+	access := a.Config.GmailAccess
+	if access == nil {
+		return scopes
+	}
+	if access.Label || access.Archive {
+		scopes = append(scopes, gmail.GmailModifyScope)
+	}
+	if access.Drafts {
+		scopes = append(scopes, gmail.GmailComposeScope)
+	}
+	if access.Send {
+		scopes = append(scopes, gmail.GmailSendScope)
+	}
+	return scopes
+}
+
+// canModify is whether the user agreed to the bot labelling and archiving their emails
+func (a *App) canModify() bool {
+	return a.hasScope(gmail.GmailModifyScope)
+}
+
+// hasScope is whether scope is both enabled in the config and granted by the saved token
+func (a *App) hasScope(scope string) bool {
+	if !slices.Contains(a.gmailScopes(), scope) {
+		return false
+	}
+	var granted []string
+	a.state.read(func(s *State) {
+		granted = s.account().Scopes
+	})
+	return slices.Contains(grantedOrDefault(granted), scope)
+}
+
+// grantedScopes are the scopes a new token was granted. google says which in the token response, since the user can
+// untick some on the consent screen; when it doesn't, the token has what was asked for
+func grantedScopes(tok *oauth2.Token, requested []string) []string {
+	if scope, ok := tok.Extra("scope").(string); ok && scope != "" {
+		return strings.Fields(scope)
+	}
+	return requested
+}
+
+// grantedOrDefault is the scopes saved with a token, read only for tokens from before they were saved, when that's
+// all the bot ever asked for
+func grantedOrDefault(granted []string) []string {
+	if len(granted) == 0 {
+		return []string{gmail.GmailReadonlyScope}
+	}
+	return granted
+}
+
+// scopeDifference are the scopes in a that aren't in b
+func scopeDifference(a, b []string) []string {
+	var missing []string
+	for _, scope := range a {
+		if !slices.Contains(b, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// scopeNames shortens scope URLs for logs and messages, e.g. "gmail.modify"
+func scopeNames(scopes []string) string {
+	names := make([]string, len(scopes))
+	for i, scope := range scopes {
+		names[i] = strings.TrimPrefix(scope, "https://www.googleapis.com/auth/")
+	}
+	return strings.Join(names, ", ")
+}
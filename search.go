@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// searchResults is how many emails /search answers with
+	searchResults = 5
+	// rrfK dampens how much the very top ranks of either search dominate the fused ranking
+	rrfK = 60
+	// snippetLength is about how many characters of an email a search result quotes
+	snippetLength = 200
+)
+
+// searchResult is an indexed email and how well it matched
+type searchResult struct {
+	email *IndexedEmail
+	score float64
+}
+
+// searchIndex finds the emails matching query with a hybrid of vector and keyword search. each ranks every email, and
+// the two rankings are fused by reciprocal rank, so an email either search finds near the top comes out near the top
+func (a *App) searchIndex(ctx context.Context, query string, limit int) ([]searchResult, error) {
+	embedded, err := a.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("embedding the query: %w", err)
+	}
+	if len(embedded) != 1 {
+		return nil, fmt.Errorf("%s returned no embedding for the query", a.embedder.Name())
+	}
+
+	a.index.mu.Lock()
+	defer a.index.mu.Unlock()
+	if err := a.index.loadLocked(); err != nil {
+		return nil, err
+	}
+	if a.index.Model != a.embedder.Name() {
+		return nil, nil
+	}
+
+	emails := a.index.Emails
+	semantic := make([]float64, len(emails))
+	for i, email := range emails {
+		semantic[i] = cosineSimilarity(embedded[0], email.Vector)
+	}
+	keyword := keywordScores(query, emails)
+
+	fused := make([]float64, len(emails))
+	for _, scores := range [][]float64{semantic, keyword} {
+		for rank, i := range rankByScore(scores) {
+			fused[i] += 1 / float64(rrfK+rank+1)
+		}
+	}
+
+	var results []searchResult
+	for _, i := range rankByScore(fused) {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, searchResult{email: emails[i], score: fused[i]})
+	}
+	return results, nil
+}
+
+// rankByScore is the indexes of scores, best first. zero scores don't match at all and are left out
+func rankByScore(scores []float64) []int {
+	var ranked []int
+	for i, score := range scores {
+		if score > 0 {
+			ranked = append(ranked, i)
+		}
+	}
+	sort.SliceStable(ranked, func(x, y int) bool {
+		return scores[ranked[x]] > scores[ranked[y]]
+	})
+	return ranked
+}
+
+// keywordScores scores each email by the query's words in it, BM25 style: rare words count more, and repeating a word
+// counts less each time. the subject and sender are counted twice, they're what people remember an email by
+func keywordScores(query string, emails []*IndexedEmail) []float64 {
+	terms := searchTerms(query)
+	scores := make([]float64, len(emails))
+	if len(terms) == 0 || len(emails) == 0 {
+		return scores
+	}
+
+	docs := make([]map[string]int, len(emails))
+	lengths := make([]int, len(emails))
+	total := 0
+	containing := make(map[string]int)
+	for i, email := range emails {
+		words := searchTerms(strings.Repeat(email.Subject+" "+email.From+" ", 2) + email.Text)
+		docs[i] = make(map[string]int)
+		for _, word := range words {
+			docs[i][word]++
+		}
+		for term := range docs[i] {
+			containing[term]++
+		}
+		lengths[i] = len(words)
+		total += len(words)
+	}
+	average := float64(total) / float64(len(emails))
+
+	const k1, b = 1.2, 0.75
+	n := float64(len(emails))
+	for i := range emails {
+		for _, term := range terms {
+			tf := float64(docs[i][term])
+			if tf == 0 {
+				continue
+			}
+			df := float64(containing[term])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			scores[i] += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(lengths[i])/average))
+		}
+	}
+	return scores
+}
+
+// searchTerms splits text into lowercase words
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchSnippet quotes the part of an email around the first word of the query it contains, or its start
+func searchSnippet(text, query string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	start := 0
+	lower := strings.ToLower(text)
+	for _, term := range searchTerms(query) {
+		if i := strings.Index(lower, term); i >= 0 {
+			start = max(0, i-snippetLength/3)
+			break
+		}
+	}
+	// move off the middle of a word or rune
+	for start > 0 && start < len(text) && text[start-1] != ' ' {
+		start++
+	}
+	end := min(len(text), start+snippetLength)
+	for end < len(text) && text[end] != ' ' {
+		end++
+	}
+	snippet := text[start:end]
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// searchCommand is /search: the archived emails best matching a query, by meaning and by keyword
+func searchCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	if a.embedder == nil {
+		return "Search needs the email index, set up `embeddings` in the config to build it.", nil
+	}
+	query := strings.TrimSpace(options["query"])
+	if query == "" {
+		return "", fmt.Errorf("search for what?")
+	}
+
+	results, err := a.searchIndex(ctx, query, searchResults)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return fmt.Sprintf("Nothing in the index matches %q.", query), nil
+	}
+
+	var sb strings.Builder
+	for _, result := range results {
+		email := result.email
+		fmt.Fprintf(&sb, "**%s** · %s", email.Subject, senderName(email.From))
+		if !email.Date.IsZero() {
+			fmt.Fprintf(&sb, " · %s", email.Date.In(a.Location).Format("Mon 2 Jan 2006"))
+		}
+		if url := gmailThreadURL(a.Config.GmailAccount, email.ThreadID); url != "" {
+			fmt.Fprintf(&sb, " · [open](<%s>)", url)
+		}
+		if snippet := searchSnippet(email.Text, query); snippet != "" {
+			fmt.Fprintf(&sb, "\n> %s", snippet)
+		}
+		sb.WriteString("\n\n")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// defaultSecurityInterval is how often Gmail is checked for security emails when the config doesn't say
+	defaultSecurityInterval = 5 * time.Minute
+	// securityAlertRetention is how long an alerted email is remembered, long enough for the digests to leave it out
+	securityAlertRetention = 7 * 24 * time.Hour
+	// maxSecurityDetails is how many lines of detail an alert quotes
+	maxSecurityDetails = 4
+)
+
+// securitySearch narrows the check down to the emails that could be security ones, the rest of the mail waits for the
+// digest as usual
+const securitySearch = `{subject:password subject:"sign-in" subject:"sign in" subject:login subject:"log in" subject:security subject:code subject:verification subject:verify subject:2fa subject:"two-factor" subject:"2-step"}`
+
+type SecurityAlertsConfig struct {
+	// ChannelID is where the alerts go, the daily channel by default
+	ChannelID string `json:"channel_id"`
+	// Interval is how often Gmail is checked, as a duration like "5m"
+	Interval string `json:"interval"`
+	// SMS texts the alerts too, when twilio is set up
+	SMS bool `json:"sms"`
+}
+
+// securityPatterns recognize each kind of security email from its subject and text, lowercased. the first kind that
+// matches wins, so a sign-in alert that mentions resetting the password is still a sign-in alert
+var securityPatterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{"code", regexp.MustCompile(`verification code|security code|login code|sign-in code|one-time (?:pass)?code|one-time password|\b2fa\b|two-factor|2-step verification code|your code is|confirmation code`)},
+	{"sign_in", regexp.MustCompile(`new sign-in|new sign in|new login|new log-in|signed in from|sign-in attempt|login attempt|unusual sign-in|suspicious (?:sign-in|login|activity)|new device|logged in from`)},
+	{"password_reset", regexp.MustCompile(`reset your password|password reset|reset password|password (?:was|has been) changed|password change|forgot your password|change your password`)},
+}
+
+// securityTitles head the alert of each kind
+var securityTitles = map[string]string{
+	"code":           "🔑 Verification code",
+	"sign_in":        "🛡️ New sign-in",
+	"password_reset": "🔐 Password reset",
+}
+
+var (
+	// securityCodePattern finds a one-time code: 4 to 8 digits, possibly split in two by a space or dash
+	securityCodePattern = regexp.MustCompile(`\b(\d{3,4}[ -]?\d{3,4}|\d{4,8})\b`)
+	// securityDetailPattern finds the lines of a sign-in alert that say where it came from
+	securityDetailPattern = regexp.MustCompile(`(?im)^\W*((?:device|browser|location|ip address|ip|operating system|os|app|where|when|time)\s*:\s*\S.{0,80})$`)
+)
+
+// securityAlertKind says which kind of account security email a message is: "code", "sign_in", "password_reset", or
+// "" for anything else. only the subject and the start of the text are read, a newsletter that mentions passwords
+// further down isn't one
+func securityAlertKind(message *gmail.Message) string {
+	if message.Payload == nil || autoReplyKind(message) != "" {
+		return ""
+	}
+	subject := strings.ToLower(extractHeader(message, "Subject"))
+	text := subject + "\n" + strings.ToLower(message.Snippet)
+	for _, p := range securityPatterns {
+		if p.pattern.MatchString(text) {
+			return p.kind
+		}
+	}
+	return ""
+}
+
+// securityAlert is the message for a security email: what it is, from whom, and the detail that matters for its kind.
+// codes are spoilered so they don't show in notifications or over a shoulder
+func securityAlert(message *gmail.Message, kind string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s from **%s**: %s", securityTitles[kind], senderName(extractHeader(message, "From")), extractHeader(message, "Subject"))
+
+	body := extractBody(message)
+	switch kind {
+	case "code":
+		if code := securityCodePattern.FindString(extractHeader(message, "Subject") + "\n" + message.Snippet + "\n" + body); code != "" {
+			fmt.Fprintf(&sb, "\nCode: ||%s||", code)
+		}
+	case "sign_in":
+		details := securityDetailPattern.FindAllStringSubmatch(body, maxSecurityDetails)
+		for _, detail := range details {
+			fmt.Fprintf(&sb, "\n> %s", strings.TrimSpace(detail[1]))
+		}
+		if len(details) == 0 && message.Snippet != "" {
+			fmt.Fprintf(&sb, "\n> %s", message.Snippet)
+		}
+		sb.WriteString("\nIf this wasn't you, change your password. Go to the site yourself rather than following the email's links.")
+	case "password_reset":
+		sb.WriteString("\nIf you didn't ask for this, don't follow the link, and check who else can get into the account.")
+	}
+	return sb.String()
+}
+
+// checkSecurityEmails alerts about the security emails that came in since the last check, as soon as they arrive
+// rather than in the next digest
+func (a *App) checkSecurityEmails(ctx context.Context) error {
+	// whatever the check asks the model goes ahead of the digests and commands
+	ctx = withLLMPriority(ctx, llmPriorityUrgent)
+	now := a.Clock.Now()
+	var since time.Time
+	a.state.read(func(s *State) {
+		since = s.account().SecurityCheckedAt
+	})
+	if since.IsZero() {
+		interval, _ := a.securityInterval()
+		since = now.Add(-interval)
+	}
+
+	messages, err := a.Emails.Search(ctx, securitySearch, since)
+	if err != nil {
+		return fmt.Errorf("searching for security emails: %w", err)
+	}
+	a.alertSecurityEmails(ctx, messages)
+
+	return a.state.update(func(s *State) {
+		s.account().SecurityCheckedAt = now
+	})
+}
+
+// fastPathSecurityEmails takes the security emails out of a digest's emails. they're alerted about on their own when
+// they come in, and any that weren't yet, because a check failed or the alerts are off, are alerted about now
+func (a *App) fastPathSecurityEmails(ctx context.Context, messages []*gmail.Message) []*gmail.Message {
+	rest := messages[:0:0]
+	var security []*gmail.Message
+	for _, message := range messages {
+		if securityAlertKind(message) != "" {
+			security = append(security, message)
+		} else {
+			rest = append(rest, message)
+		}
+	}
+	a.alertSecurityEmails(ctx, security)
+	return rest
+}
+
+// alertSecurityEmails sends the alert of each security email that hasn't had one
+func (a *App) alertSecurityEmails(ctx context.Context, messages []*gmail.Message) {
+	logger := log.FromContext(ctx)
+	now := a.Clock.Now()
+
+	var alerted map[string]time.Time
+	a.state.read(func(s *State) {
+		alerted = maps.Clone(s.account().SecurityAlerted)
+	})
+
+	channelID := a.dailyChannel()
+	sms := false
+	if config := a.Config.SecurityAlerts; config != nil {
+		if config.ChannelID != "" {
+			channelID = config.ChannelID
+		}
+		sms = config.SMS
+	}
+
+	var sent []string
+	for _, message := range messages {
+		kind := securityAlertKind(message)
+		if kind == "" {
+			continue
+		}
+		if _, ok := alerted[message.Id]; ok {
+			continue
+		}
+		alert := securityAlert(message, kind)
+		if err := a.sendToDiscord(channelID, alert); err != nil {
+			// it stays unalerted, so the next check or the digest tries again
+			logger.Error("Unable to send security alert", "message_id", message.Id, "error", err)
+			continue
+		}
+		if sms {
+			// the code stays out of texts, they aren't as private as the user's Discord
+			a.sendSMSAlert(fmt.Sprintf("%s from %s: %s", securityTitles[kind], senderName(extractHeader(message, "From")), extractHeader(message, "Subject")))
+		}
+		logger.Info("Security alert sent", "message_id", message.Id, "kind", kind)
+		sent = append(sent, message.Id)
+	}
+	if len(sent) == 0 {
+		return
+	}
+
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		if account.SecurityAlerted == nil {
+			account.SecurityAlerted = make(map[string]time.Time)
+		}
+		for id, at := range account.SecurityAlerted {
+			if now.Sub(at) > securityAlertRetention {
+				delete(account.SecurityAlerted, id)
+			}
+		}
+		for _, id := range sent {
+			account.SecurityAlerted[id] = now
+		}
+	}); err != nil {
+		logger.Error("Unable to record the security alerts sent", "error", err)
+	}
+}
+
+// securityInterval is how often the security check runs
+func (a *App) securityInterval() (time.Duration, error) {
+	config := a.Config.SecurityAlerts
+	if config == nil || config.Interval == "" {
+		return defaultSecurityInterval, nil
+	}
+	interval, err := time.ParseDuration(config.Interval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid security alerts interval %q", config.Interval)
+	}
+	return interval, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+// signingKeyFile is where the archive's signing key is kept in the profile's directory when the config doesn't say
+const signingKeyFile = "archive_signing.key"
+
+type ArchiveSigningConfig struct {
+	// KeyFile holds the ed25519 key the digests are signed with, base64. it's made on first start when it doesn't exist.
+	// relative paths are in the profile's directory
+	KeyFile string `json:"key_file"`
+}
+
+// loadSigningKey reads the archive's signing key, making one when there's none yet
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generating signing key: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("saving signing key: %w", err)
+		}
+		log.Info("Archive signing key created, keep a copy of the public key to verify the archive with", "file", path,
+			"public_key", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key in %s isn't a base64 ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signingKeyPath is where the config keeps the signing key, relative paths being in dir
+func signingKeyPath(config *ArchiveSigningConfig, dir string) string {
+	path := config.KeyFile
+	if path == "" {
+		path = signingKeyFile
+	}
+	if !filepath.IsAbs(path) && dir != "" {
+		path = filepath.Join(dir, path)
+	}
+	return path
+}
+
+// messageIDs are the ids of the emails a digest was made from, which the archive keeps as the record of what came in
+func messageIDs(messages []*gmail.Message) []string {
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.Id)
+	}
+	return ids
+}
+
+// digestHash is the sha256 of everything in the digest but its hash and signature, hex. the previous digest's hash is
+// part of it, so the archive is a chain: changing or dropping a digest breaks every hash after it
+func digestHash(digest *Digest) (string, error) {
+	hashed := *digest
+	hashed.Hash = ""
+	hashed.Signature = ""
+	data, err := json.Marshal(&hashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// sealDigest chains the digest onto the one archived before it, hashes it and signs the hash when there's a key
+func (st *stateStore) sealDigest(digest *Digest, previous *Digest) {
+	digest.PrevHash = ""
+	if previous != nil {
+		digest.PrevHash = previous.Hash
+	}
+	hash, err := digestHash(digest)
+	if err != nil {
+		log.Error("Unable to hash digest", "digest_id", digest.ID, "error", err)
+		return
+	}
+	digest.Hash = hash
+	digest.Signature = ""
+	if st.signingKey != nil {
+		digest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(st.signingKey, []byte(hash)))
+	}
+}
+
+// ArchiveCheck is the result of verifying the digest archive
+type ArchiveCheck struct {
+	Checked int `json:"checked"`
+	Signed  int `json:"signed"`
+	// Unsealed are the digests archived before hashing, which can't be checked
+	Unsealed  int      `json:"unsealed"`
+	Problems  []string `json:"problems"`
+	PublicKey string   `json:"public_key,omitempty"`
+}
+
+// verifyArchive recomputes every digest's hash and checks the chain and the signatures. publicKey is the key to check
+// the signatures with, nil to check them with the profile's own key or not at all. the oldest digest kept may point
+// to one dropped for space, so the chain is only checked from there on
+func (st *stateStore) verifyArchive(publicKey ed25519.PublicKey) ArchiveCheck {
+	if publicKey == nil && st.signingKey != nil {
+		publicKey = st.signingKey.Public().(ed25519.PublicKey)
+	}
+	var check ArchiveCheck
+	if publicKey != nil {
+		check.PublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	}
+
+	st.read(func(s *State) {
+		var previous *Digest
+		for i, digest := range s.Digests {
+			if digest.Hash == "" {
+				check.Unsealed++
+				previous = digest
+				continue
+			}
+			check.Checked++
+			if hash, err := digestHash(digest); err != nil || hash != digest.Hash {
+				check.Problems = append(check.Problems, fmt.Sprintf("digest %s was changed after it was archived", digest.ID))
+			}
+			if i > 0 && previous.Hash != "" && digest.PrevHash != previous.Hash {
+				check.Problems = append(check.Problems, fmt.Sprintf("the digest archived before %s is missing or was changed", digest.ID))
+			}
+			if digest.Signature != "" {
+				check.Signed++
+				signature, err := base64.StdEncoding.DecodeString(digest.Signature)
+				switch {
+				case publicKey == nil:
+				case err != nil || !ed25519.Verify(publicKey, []byte(digest.Hash), signature):
+					check.Problems = append(check.Problems, fmt.Sprintf("digest %s has a bad signature", digest.ID))
+				}
+			}
+			previous = digest
+		}
+	})
+	return check
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	defaultSMSDailyLimit = 5
+	maxSMSLength         = 320
+)
+
+type TwilioConfig struct {
+	AccountSID string `json:"account_sid"`
+	AuthToken  string `json:"auth_token"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	DailyLimit int    `json:"daily_limit"`
+}
+
+// smsNotifier texts the user about urgent emails only, and never more than DailyLimit times a day. the count is kept
+// in the state, so a restart or another replica doesn't start it over
+type smsNotifier struct {
+	app    *App
+	config TwilioConfig
+	client *http.Client
+}
+
+func newSMSNotifier(a *App, config TwilioConfig) *smsNotifier {
+	if config.DailyLimit <= 0 {
+		config.DailyLimit = defaultSMSDailyLimit
+	}
+	return &smsNotifier{
+		app:    a,
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *smsNotifier) Name() string {
+	return "twilio sms"
+}
+
+func (s *smsNotifier) Notify(digest *Digest) error {
+	var subjects []string
+	for _, entry := range digest.Entries {
+		if entry.Urgency == "high" {
+			subjects = append(subjects, entry.Subject)
+		}
+	}
+
+	if len(subjects) == 0 {
+		return nil
+	}
+
+	return s.Alert(fmt.Sprintf("%d urgent emails: %s", len(subjects), strings.Join(subjects, "; ")))
+}
+
+// Alert sends a single SMS, unless today's cap has already been reached. a text that fails to send doesn't count
+func (s *smsNotifier) Alert(message string) (err error) {
+	day, ok, err := s.count()
+	if err != nil {
+		return fmt.Errorf("counting the SMS against the daily limit: %w", err)
+	}
+	if !ok {
+		log.Warn("SMS daily limit reached, dropping alert", "limit", s.config.DailyLimit)
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			if uncountErr := s.uncount(day); uncountErr != nil {
+				log.Error("Unable to give back the SMS that failed to send", "error", uncountErr)
+			}
+		}
+	}()
+
+	if runes := []rune(message); len(runes) > maxSMSLength {
+		message = string(runes[:maxSMSLength-3]) + "..."
+	}
+
+	form := url.Values{}
+	form.Set("From", s.config.From)
+	form.Set("To", s.config.To)
+	form.Set("Body", message)
+
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", s.config.AccountSID)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("creating twilio request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.config.AccountSID, s.config.AuthToken)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending twilio request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("twilio returned status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// count counts a text against today's limit, a day in the configured timezone, before it's sent so that texts sent at
+// the same time can't go over it together. ok is false when the limit is reached
+func (s *smsNotifier) count() (today string, ok bool, err error) {
+	today = s.app.Clock.Now().In(s.app.Location).Format(time.DateOnly)
+	err = s.app.state.update(func(st *State) {
+		account := st.account()
+		if account.SMSDay != today {
+			account.SMSDay, account.SMSSent = today, 0
+		}
+		ok = account.SMSSent < s.config.DailyLimit
+		if ok {
+			account.SMSSent++
+		}
+	})
+	return today, ok, err
+}
+
+// uncount takes back a text counted on day that wasn't sent after all
+func (s *smsNotifier) uncount(day string) error {
+	return s.app.state.update(func(st *State) {
+		account := st.account()
+		if account.SMSDay == day && account.SMSSent > 0 {
+			account.SMSSent--
+		}
+	})
+}
+
+// sendSMSAlert is a best-effort text to the user for things that can't wait for them to check Discord
+func (a *App) sendSMSAlert(message string) {
+	if a.smsAlerts == nil {
+		return
+	}
+	if err := a.smsAlerts.Alert(message); err != nil {
+		log.Error("Failed to send SMS alert", "error", err)
+	}
+}
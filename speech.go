@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// maxSpeechInput is the most characters the OpenAI speech endpoint accepts in one request, longer digests are read in
+// several
+const maxSpeechInput = 4096
+
+// SpeechProvider turns text into audio
+type SpeechProvider interface {
+	Name() string
+	Synthesize(text string) (io.ReadCloser, error)
+}
+
+type TTSConfig struct {
+	ChannelID string `json:"channel_id"`
+	Model     string `json:"model"`
+	Voice     string `json:"voice"`
+}
+
+type openAISpeechProvider struct {
+	client *openai.Client
+	model  openai.SpeechModel
+	voice  openai.SpeechVoice
+}
+
+func newOpenAISpeechProvider(client *openai.Client, config TTSConfig) *openAISpeechProvider {
+	p := &openAISpeechProvider{
+		client: client,
+		model:  openai.TTSModel1,
+		voice:  openai.VoiceAlloy,
+	}
+	if config.Model != "" {
+		p.model = openai.SpeechModel(config.Model)
+	}
+	if config.Voice != "" {
+		p.voice = openai.SpeechVoice(config.Voice)
+	}
+	return p
+}
+
+func (p *openAISpeechProvider) Name() string {
+	return "openai"
+}
+
+func (p *openAISpeechProvider) Synthesize(text string) (io.ReadCloser, error) {
+	resp, err := p.client.CreateSpeech(context.Background(), openai.CreateSpeechRequest{
+		Model:          p.model,
+		Input:          text,
+		Voice:          p.voice,
+		ResponseFormat: openai.SpeechResponseFormatMp3,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CreateSpeech error: %v", err)
+	}
+	return resp, nil
+}
+
+// audioNotifier uploads a spoken version of the daily digest to a Discord channel
+type audioNotifier struct {
+	app *App
+	// channelID is where the audio goes, the daily digest's channel when it's empty
+	channelID string
+	provider  SpeechProvider
+}
+
+func (a *audioNotifier) Name() string {
+	return "audio " + a.provider.Name()
+}
+
+func (a *audioNotifier) Notify(digest *Digest) error {
+	if digest.Kind != "daily" {
+		return nil
+	}
+
+	// a digest longer than one request is read a chunk at a time, and the mp3s are joined, which plays as one
+	var audio bytes.Buffer
+	chunks := speechChunks(digest.Summary)
+	for i, chunk := range chunks {
+		part, err := a.provider.Synthesize(chunk)
+		if err != nil {
+			return fmt.Errorf("synthesizing digest audio, part %d of %d: %w", i+1, len(chunks), err)
+		}
+		_, err = io.Copy(&audio, part)
+		part.Close()
+		if err != nil {
+			return fmt.Errorf("reading digest audio, part %d of %d: %w", i+1, len(chunks), err)
+		}
+	}
+	if audio.Len() == 0 {
+		return nil
+	}
+
+	channelID := a.channelID
+	if channelID == "" {
+		channelID = a.app.dailyChannel()
+	}
+	name := fmt.Sprintf("digest-%s.mp3", digest.GeneratedAt.Format(time.DateOnly))
+	if _, err := a.app.Discord.ChannelFileSend(channelID, name, &audio); err != nil {
+		return fmt.Errorf("uploading digest audio to Discord: %w", err)
+	}
+
+	return nil
+}
+
+// speechChunks strips the markdown that would otherwise be read aloud, and splits the text into the pieces the
+// provider accepts in one request: between paragraphs where it can, then between lines, sentences and words
+func speechChunks(summary string) []string {
+	text := strings.NewReplacer("**", "", "__", "", "`", "", "#", "", "* ", "", "- ", "").Replace(summary)
+	return splitSpeech(text, []string{"\n\n", "\n", ". ", " "})
+}
+
+// splitSpeech packs as much of text into each chunk as fits, splitting it after seps[0], and the pieces that don't fit
+// on their own after the rest of seps. with no seps left it cuts at maxSpeechInput
+func splitSpeech(text string, seps []string) []string {
+	var chunks []string
+	add := func(chunk string) {
+		if chunk = strings.TrimSpace(chunk); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+	}
+	if utf8.RuneCountInString(text) <= maxSpeechInput {
+		add(text)
+		return chunks
+	}
+	if len(seps) == 0 {
+		runes := []rune(text)
+		for len(runes) > maxSpeechInput {
+			add(string(runes[:maxSpeechInput]))
+			runes = runes[maxSpeechInput:]
+		}
+		add(string(runes))
+		return chunks
+	}
+
+	var current strings.Builder
+	for _, piece := range strings.SplitAfter(text, seps[0]) {
+		if utf8.RuneCountInString(current.String())+utf8.RuneCountInString(piece) <= maxSpeechInput {
+			current.WriteString(piece)
+			continue
+		}
+		add(current.String())
+		current.Reset()
+		if utf8.RuneCountInString(piece) > maxSpeechInput {
+			chunks = append(chunks, splitSpeech(piece, seps[1:])...)
+			continue
+		}
+		current.WriteString(piece)
+	}
+	add(current.String())
+	return chunks
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxStateConflicts is how many times an update is tried when other replicas keep saving the state under it
+const maxStateConflicts = 5
+
+// defaultAccount is the key of the account in a State. a profile reads one mailbox, so there's only ever the one
+const defaultAccount = "default"
+
+// State is everything the bot needs to remember between runs. it is kept in a single, atomically replaced file, or in
+// one transaction of a storage backend, so that the token, fetch cursor and queue are always written together and a
+// crash mid-write can't corrupt any of them
+type State struct {
+	Version  int                      `json:"version"`
+	Accounts map[string]*AccountState `json:"accounts"`
+	Digests  []*Digest                `json:"digests"`
+	Feedback []Feedback               `json:"feedback"`
+
+	// Senders is the reputation table built from feedback, keyed by lowercased email address
+	Senders map[string]*SenderReputation `json:"senders"`
+
+	// Prompts are the versions each prompt template has had, by file name, oldest first
+	Prompts map[string][]PromptVersion `json:"prompts"`
+
+	// Channels are the channels /config set moved, by config key, until the config changes them
+	Channels map[string]string `json:"channels"`
+}
+
+// AccountState is the per-mailbox part of State
+type AccountState struct {
+	Token       *oauth2.Token    `json:"token"`
+	LastFetch   time.Time        `json:"last_fetch"`
+	WeeklyQueue []*gmail.Message `json:"weekly_queue"`
+
+	// TokenIssuedAt is when the refresh token was granted, zero if that's unknown
+	TokenIssuedAt     time.Time `json:"token_issued_at"`
+	TokenExpiryWarned bool      `json:"token_expiry_warned"`
+	// Scopes are what the user granted the token on the consent screen, empty for tokens from before they were kept
+	Scopes []string `json:"scopes"`
+
+	// Volume is the per-day email counts behind the weekly stats, oldest first
+	Volume []VolumeDay `json:"volume"`
+
+	// LastDigestEmails are the emails behind the latest digest of each kind, kept for /regenerate
+	LastDigestEmails map[string][]*gmail.Message `json:"last_digest_emails"`
+
+	// Outbox are the digests Discord wouldn't take, waiting to be retried
+	Outbox []OutboxEntry `json:"outbox"`
+	// Delivered is when each scheduled digest went out, by its period id, so none is ever posted twice
+	Delivered map[string]time.Time `json:"delivered"`
+	// Remainders are the emails digests couldn't summarize, waiting for their follow-up digests
+	Remainders []DigestRemainder `json:"remainders"`
+
+	// DeferredDigest are the emails of quiet days held back for the next daily digest, since DeferredSince
+	DeferredDigest []*gmail.Message `json:"deferred_digest"`
+	DeferredSince  time.Time        `json:"deferred_since"`
+
+	// SecurityCheckedAt is when Gmail was last checked for security emails, and SecurityAlerted when each one that was
+	// alerted about was, by message id
+	SecurityCheckedAt time.Time            `json:"security_checked_at"`
+	SecurityAlerted   map[string]time.Time `json:"security_alerted"`
+
+	// ReceiptsDeclined is when each read receipt request was declined, by message id
+	ReceiptsDeclined map[string]time.Time `json:"receipts_declined"`
+
+	// Threads are what the digests last said about each thread, by thread id, for the next ones to tell what changed
+	Threads map[string]ThreadMemory `json:"threads"`
+
+	// Recruiting is the job application pipeline, followed across days for the weekly summary
+	Recruiting []RecruitingThread `json:"recruiting"`
+
+	// Bills are the deadlines found in emails, waiting for their reminders
+	Bills []Bill `json:"bills"`
+
+	// Travel are the upcoming bookings found in emails, grouped into trips when they're shown
+	Travel []TravelSegment `json:"travel"`
+
+	// MiniDigests are the ids of the mini digests since the last daily summary, which rolls them up
+	MiniDigests []string `json:"mini_digests"`
+
+	// Conversations are the recent /ask turns of each channel, oldest first
+	Conversations map[string][]AskTurn `json:"conversations"`
+
+	// Examples are the few-shot example library, by category
+	Examples map[string][]FewShotExample `json:"examples"`
+
+	// AwaitingReplies are the threads in the last "Waiting on" section, kept for its nudge buttons
+	AwaitingReplies []AwaitingReply `json:"awaiting_replies"`
+
+	// InboxCounts are the size of the inbox at each fetch, oldest first, for the weekly inbox zero report
+	InboxCounts []InboxCount `json:"inbox_counts"`
+
+	// NewsletterBatches are the newsletters of the latest daily digests, kept for their archive buttons
+	NewsletterBatches []NewsletterBatch `json:"newsletter_batches"`
+
+	// DailyDigestPosts are the daily digests posted since the last weekly one, which links back to them
+	DailyDigestPosts []DigestPost `json:"daily_digest_posts"`
+
+	// SummaryCache is the model's output for each email it has read, by summaryCacheKey, so rerunning a digest after a
+	// crash or regenerating it doesn't pay for the same emails again
+	SummaryCache map[string]CachedSummary `json:"summary_cache"`
+
+	// VolumeAlerted is when each volume anomaly was alerted about, by its key, so it's only alerted about once a day
+	VolumeAlerted map[string]time.Time `json:"volume_alerted"`
+
+	// Approvals are the digests waiting for approval, oldest first
+	Approvals []PendingApproval `json:"approvals"`
+
+	// SMSSent is how many texts went out on SMSDay, a date in the configured timezone, for the daily limit
+	SMSDay  string `json:"sms_day"`
+	SMSSent int    `json:"sms_sent"`
+
+	// Checkpoints are how far the scheduled digests that haven't gone out yet got, by kind, for resuming them
+	Checkpoints map[string]*DigestCheckpoint `json:"checkpoints"`
+}
+
+// DigestPost is where a digest was posted in Discord
+type DigestPost struct {
+	ChannelID string    `json:"channel_id"`
+	MessageID string    `json:"message_id"`
+	URL       string    `json:"url"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// Feedback is a user's rating of a digest entry
+type Feedback struct {
+	DigestID  string    `json:"digest_id"`
+	MessageID string    `json:"message_id"`
+	Sender    string    `json:"sender"`
+	Rating    int       `json:"rating"`
+	Time      time.Time `json:"time"`
+}
+
+// stateStore holds the State of one profile. each profile has its own, kept in its own directory, so profiles sharing
+// a process never see each other's tokens, digests or caches
+type stateStore struct {
+	mu    sync.Mutex
+	state *State
+	// store is where state is saved, a sqlite database in dir unless the config picks another storage backend
+	store Store
+	// dir is where the profile's files are kept, the working directory when there are no profiles
+	dir string
+	// signingKey signs the archived digests, nil when archive_signing isn't configured
+	signingKey ed25519.PrivateKey
+}
+
+// stateMigrations upgrade a State one version at a time. stateMigrations[i] takes version i to version i+1
+var stateMigrations = []func(st *stateStore, s *State) error{
+	(*stateStore).migrateLegacyFiles,
+}
+
+// loadState reads the state of a profile, "" when there are no profiles, from its store, migrating it to the current
+// version if needed
+func loadState(profile string, storage *StorageConfig) (*stateStore, error) {
+	dir := profileDir(profile)
+	st := &stateStore{dir: dir}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("creating %s: %w", dir, err)
+		}
+	}
+	store, err := openStore(storage, profile)
+	if err != nil {
+		return nil, err
+	}
+	st.store = store
+	log.Info("Loading state", "store", store)
+
+	s, err := store.Load()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	imported := false
+	if _, ok := store.(*fileStore); !ok && s == nil {
+		// a database backend starts from the state file it replaces, if there is one
+		if s, err = (&fileStore{path: st.path(stateFile)}).Load(); err != nil {
+			store.Close()
+			return nil, err
+		}
+		imported = s != nil
+	}
+	if s == nil {
+		s = &State{}
+	}
+
+	if s.Version > len(stateMigrations) {
+		store.Close()
+		return nil, fmt.Errorf("state file is version %d, but this build only understands up to %d", s.Version, len(stateMigrations))
+	}
+
+	fromVersion := s.Version
+	for s.Version < len(stateMigrations) {
+		log.Info("Migrating state", "from", s.Version, "to", s.Version+1)
+		if err := stateMigrations[s.Version](st, s); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("migrating state to version %d: %w", s.Version+1, err)
+		}
+		s.Version++
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.state = s
+
+	if fromVersion != s.Version || imported {
+		if err := st.saveLocked(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	if imported {
+		log.Info("State file imported", "store", store)
+		st.retireStateFile()
+	}
+
+	// only retire the legacy files once their contents are safely in the state file
+	if fromVersion == 0 {
+		st.retireLegacyFiles()
+	}
+
+	log.Info("State loaded", "version", s.Version, "digests", len(s.Digests))
+	return st, nil
+}
+
+// path is where the profile keeps the file called name
+func (st *stateStore) path(name string) string {
+	return filepath.Join(st.dir, name)
+}
+
+// update applies fn to the state and persists the result. when replicas share the store and another one saved in the
+// meantime, the save is refused and fn is applied again, to the state as the other replica left it. fn can so be
+// called more than once, and has to set whatever it hands back on every call
+func (st *stateStore) update(fn func(s *State)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		fn(st.state)
+		err := st.saveLocked()
+		if !errors.Is(err, errStateConflict) || attempt == maxStateConflicts {
+			return err
+		}
+		if err := st.reloadLocked(); err != nil {
+			return err
+		}
+	}
+}
+
+// reload reads the state again from the store, for a replica to start a run from what the others saved. the state
+// file is the replica's own, so there's nothing to pick up from it
+func (st *stateStore) reload() error {
+	if _, ok := st.store.(*fileStore); ok {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.reloadLocked()
+}
+
+func (st *stateStore) reloadLocked() error {
+	s, err := st.store.Load()
+	if err != nil {
+		return fmt.Errorf("reloading state: %w", err)
+	}
+	if s != nil {
+		st.state = s
+	}
+	return nil
+}
+
+// read gives fn read access to the state. fn must not keep references to it
+func (st *stateStore) read(fn func(s *State)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fn(st.state)
+}
+
+func (st *stateStore) saveLocked() error {
+	if err := st.store.Save(st.state); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	return nil
+}
+
+// account returns the state of the default account, creating it if needed
+func (s *State) account() *AccountState {
+	if s.Accounts == nil {
+		s.Accounts = make(map[string]*AccountState)
+	}
+	a, ok := s.Accounts[defaultAccount]
+	if !ok {
+		a = &AccountState{}
+		s.Accounts[defaultAccount] = a
+	}
+	return a
+}
+
+// migrateLegacyFiles imports token.json, last_fetch.json and digests.json from before the state file existed
+func (st *stateStore) migrateLegacyFiles(s *State) error {
+	a := s.account()
+
+	if data, err := readStateFile(st.path(legacyTokenFile)); err == nil {
+		tok := &oauth2.Token{}
+		if err := json.Unmarshal(data, tok); err != nil {
+			return fmt.Errorf("parsing %s: %w", legacyTokenFile, err)
+		}
+		a.Token = tok
+	}
+
+	if data, err := os.ReadFile(st.path(legacyLastFetchFile)); err == nil {
+		if err := json.Unmarshal(data, &a.LastFetch); err != nil {
+			return fmt.Errorf("parsing %s: %w", legacyLastFetchFile, err)
+		}
+	}
+
+	if data, err := readStateFile(st.path(legacyDigestArchiveFile)); err == nil {
+		if err := json.Unmarshal(data, &s.Digests); err != nil {
+			return fmt.Errorf("parsing %s: %w", legacyDigestArchiveFile, err)
+		}
+	}
+
+	return nil
+}
+
+// retireStateFile renames the state file a database backend was started from to state.json.migrated, so it isn't
+// mistaken for the current state
+func (st *stateStore) retireStateFile() {
+	file := st.path(stateFile)
+	if err := os.Rename(file, file+".migrated"); err != nil {
+		log.Warn("Unable to rename imported state file", "file", file, "error", err)
+	}
+}
+
+// retireLegacyFiles renames the pre-state files to *.migrated rather than deleting them
+func (st *stateStore) retireLegacyFiles() {
+	for _, name := range []string{legacyTokenFile, legacyLastFetchFile, legacyDigestArchiveFile} {
+		file := st.path(name)
+		if fileExists(file) {
+			if err := os.Rename(file, file+".migrated"); err != nil {
+				log.Warn("Unable to rename migrated file", "file", file, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// gpt-4o list prices, in USD per million tokens
+	promptCostPerMillion     = 5.00
+	completionCostPerMillion = 15.00
+
+	maxTaskErrors = 50
+)
+
+// TokenUsage is an amount of LLM usage and what it cost
+type TokenUsage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// Sub returns the usage accrued since an earlier snapshot
+func (u TokenUsage) Sub(earlier TokenUsage) TokenUsage {
+	return TokenUsage{
+		PromptTokens:     u.PromptTokens - earlier.PromptTokens,
+		CompletionTokens: u.CompletionTokens - earlier.CompletionTokens,
+		CostUSD:          u.CostUSD - earlier.CostUSD,
+	}
+}
+
+// TaskError is a failed task run, kept for the dashboard
+type TaskError struct {
+	Task  string    `json:"task"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+var (
+	totalUsage TokenUsage
+	taskErrors []TaskError
+	statusMu   sync.Mutex
+)
+
+func recordUsage(usage openai.Usage) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	totalUsage.PromptTokens += usage.PromptTokens
+	totalUsage.CompletionTokens += usage.CompletionTokens
+	totalUsage.CostUSD += float64(usage.PromptTokens)/1e6*promptCostPerMillion +
+		float64(usage.CompletionTokens)/1e6*completionCostPerMillion
+}
+
+func currentUsage() TokenUsage {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return totalUsage
+}
+
+func recordTaskError(task string, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	taskErrors = append(taskErrors, TaskError{Task: task, Time: time.Now(), Error: err.Error()})
+	if len(taskErrors) > maxTaskErrors {
+		taskErrors = taskErrors[len(taskErrors)-maxTaskErrors:]
+	}
+}
+
+// recentTaskErrors returns the recorded task errors, newest first
+func recentTaskErrors() []TaskError {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	errs := make([]TaskError, 0, len(taskErrors))
+	for i := len(taskErrors) - 1; i >= 0; i-- {
+		errs = append(errs, taskErrors[i])
+	}
+	return errs
+}
+
+// taskErrors are the profile's own recent task errors, newest first. the errors are recorded under the task's name,
+// which starts with the profile's
+func (a *App) taskErrors() []TaskError {
+	errs := recentTaskErrors()
+	if a.Profile == "" {
+		return errs
+	}
+	return slices.DeleteFunc(errs, func(e TaskError) bool {
+		return !strings.HasPrefix(e.Task, a.Profile+": ")
+	})
+}
+
+// statusCommand is /status: when each scheduled task runs next and when it last ran
+func statusCommand(ctx context.Context, a *App, options map[string]string) (string, error) {
+	if a.scheduler == nil {
+		return "The scheduler isn't running.", nil
+	}
+
+	now := a.Clock.Now()
+	var sb strings.Builder
+	for _, task := range a.tasks() {
+		fmt.Fprintf(&sb, "**%s**: ", task.Name)
+		if next, ok := a.scheduler.NextRun(task.ID); ok {
+			fmt.Fprintf(&sb, "next %s (in %s)", next.In(a.Location).Format("Mon Jan 2 15:04"), formatUntil(next.Sub(now)))
+		} else {
+			sb.WriteString("not scheduled")
+		}
+		if last, ok := a.scheduler.LastRun(task.ID); ok {
+			fmt.Fprintf(&sb, ", last ran %s", last.In(a.Location).Format("Mon Jan 2 15:04"))
+		}
+		sb.WriteString("\n")
+	}
+
+	outbox, err := a.outbox.list(ctx)
+	if err != nil {
+		return "", fmt.Errorf("reading the outbox: %w", err)
+	}
+	if len(outbox) > 0 {
+		fmt.Fprintf(&sb, "**Outbox**: %s waiting for Discord, next try %s\n", pluralize(len(outbox), "digest"), outbox[0].NextTry.In(a.Location).Format("Mon Jan 2 15:04"))
+	}
+	if a.llmQueue != nil {
+		if running, limit, waiting := a.llmQueue.stats(); len(waiting) > 0 {
+			var parts []string
+			for _, name := range sortedKeys(waiting) {
+				parts = append(parts, fmt.Sprintf("%d %s", waiting[name], name))
+			}
+			fmt.Fprintf(&sb, "**LLM queue**: %d/%d out, waiting %s\n", running, limit, strings.Join(parts, ", "))
+		}
+	}
+	return sb.String(), nil
+}
+
+// formatUntil renders a wait to the minute, e.g. 3h12m
+func formatUntil(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	return strings.TrimSuffix(d.Truncate(time.Minute).String(), "0s")
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// the parts a State is stored in by the postgres and bbolt backends, so a new digest doesn't rewrite the summary cache and a
+// queued email doesn't rewrite the archive
+const (
+	statePart   = "state"
+	queuePart   = "queue"
+	digestsPart = "digests"
+	cachePart   = "cache"
+)
+
+// defaultStoreFile is the database file of the sqlite and bbolt backends in the profile's directory, when the config
+// doesn't name one
+const defaultStoreFile = "state.db"
+
+type StorageConfig struct {
+	// Backend is where the state is kept: "sqlite" (the default), "postgres", "bbolt" or "file", a single state.json
+	Backend string `json:"backend"`
+	// DSN is the database: a file for sqlite and bbolt, relative to the profile's directory and state.db when unset,
+	// and a connection string for postgres
+	DSN string `json:"dsn"`
+	// MaxConns is the size of the postgres connection pool, which the profiles sharing a dsn share too. 4 when unset
+	MaxConns int `json:"max_conns"`
+	// Tenant is whose rows of a shared postgres database are the profile's, the profile's name when unset. deployments
+	// sharing a database give their profiles different tenants
+	Tenant string `json:"tenant"`
+}
+
+// Store is where a profile's State is kept between runs
+type Store interface {
+	// Load reads the saved State, nil when nothing has been saved yet
+	Load() (*State, error)
+	// Save persists s, all of it or none of it
+	Save(s *State) error
+	Close() error
+	// String says where the state is kept, for the logs
+	String() string
+}
+
+// partStore is what a database backend provides: records by part name, written together in one transaction
+type partStore interface {
+	// get is the record of part, nil when there isn't one
+	get(part string) ([]byte, error)
+	// put writes records, as long as each part is still as expected has it, by the hash of its record, or still
+	// missing when expected doesn't have it. otherwise nothing is written and it returns errStateConflict
+	put(records map[string][]byte, expected map[string][32]byte) error
+	close() error
+}
+
+// errStateConflict is a save refused because another replica saved the state since it was read
+var errStateConflict = errors.New("the state was changed by another replica")
+
+// checkUnchanged is errStateConflict when part's record, nil when there's none, isn't the one expected
+func checkUnchanged(part string, record []byte, expected map[string][32]byte) error {
+	hash, ok := expected[part]
+	if record == nil && !ok || record != nil && ok && sha256.Sum256(record) == hash {
+		return nil
+	}
+	return errStateConflict
+}
+
+// storeBackends open the database backends that keep the state in parts by name, for the profile whose files are in
+// dir. sqlite has tables of its own, see sqliteStore
+var storeBackends = map[string]func(config *StorageConfig, dir, profile string) (partStore, error){
+	"postgres": openPostgresStore,
+	"bbolt":    openBoltStore,
+}
+
+// openStore opens the store the config asks for, a sqlite database in the profile's directory by default. a state.json
+// from before is imported into it by loadState
+func openStore(config *StorageConfig, profile string) (Store, error) {
+	dir := profileDir(profile)
+	if config == nil {
+		config = &StorageConfig{}
+	}
+	if config.Backend == "file" {
+		return &fileStore{path: filepath.Join(dir, stateFile)}, nil
+	}
+	if config.Backend == "" || config.Backend == "sqlite" {
+		store, err := openSQLiteStore(config, dir)
+		if err != nil {
+			return nil, fmt.Errorf("opening the sqlite storage backend: %w", err)
+		}
+		return store, nil
+	}
+	open, ok := storeBackends[config.Backend]
+	if !ok {
+		return nil, fmt.Errorf("storage backend must be sqlite, postgres, bbolt or file, got %q", config.Backend)
+	}
+	parts, err := open(config, dir, profile)
+	if err != nil {
+		return nil, fmt.Errorf("opening the %s storage backend: %w", config.Backend, err)
+	}
+	return &splitStore{parts: parts, name: config.Backend, saved: make(map[string][32]byte), stored: make(map[string][32]byte)}, nil
+}
+
+// storeFile is the database file of the sqlite and bbolt backends
+func storeFile(config *StorageConfig, dir string) string {
+	if config.DSN == "" {
+		return filepath.Join(dir, defaultStoreFile)
+	}
+	if filepath.IsAbs(config.DSN) {
+		return config.DSN
+	}
+	return filepath.Join(dir, config.DSN)
+}
+
+// fileStore keeps the State in a single, atomically replaced file
+type fileStore struct {
+	path string
+}
+
+func (f *fileStore) Load() (*State, error) {
+	data, err := readStateFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open state file: %v", err)
+	}
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("unable to parse state file: %v", err)
+	}
+	return s, nil
+}
+
+func (f *fileStore) Save(s *State) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encoding state: %w", err)
+	}
+	return writeStateFile(f.path, data)
+}
+
+func (f *fileStore) Close() error {
+	return nil
+}
+
+func (f *fileStore) String() string {
+	return f.path
+}
+
+// splitStore keeps the State in a database as its parts, writing only the ones that changed since the last save.
+// each part is encrypted on its own when a passphrase is configured. a part is only written over when the database
+// still has it as it was last read or written, so replicas sharing the database don't undo each other's saves
+type splitStore struct {
+	parts partStore
+	name  string
+	// saved is the hash of each part as it was last read or written
+	saved map[string][32]byte
+	// stored is the hash of each part's record as the database has it, encrypted, missing for the parts it doesn't
+	// have
+	stored map[string][32]byte
+}
+
+// accountQueue is the queue part of an account: the emails and digests waiting to go out
+type accountQueue struct {
+	WeeklyQueue    []*gmail.Message  `json:"weekly_queue"`
+	DeferredDigest []*gmail.Message  `json:"deferred_digest"`
+	Outbox         []OutboxEntry     `json:"outbox"`
+	Remainders     []DigestRemainder `json:"remainders"`
+	// Checkpoints hold the emails of the digests under way
+	Checkpoints map[string]*DigestCheckpoint `json:"checkpoints"`
+	// Approvals are the digests waiting for approval
+	Approvals []PendingApproval `json:"approvals"`
+}
+
+// splitState cuts s into its parts, encoded
+func splitState(s *State) (map[string][]byte, error) {
+	rest := *s
+	rest.Digests = nil
+	rest.Accounts = make(map[string]*AccountState, len(s.Accounts))
+	queues := make(map[string]accountQueue, len(s.Accounts))
+	caches := make(map[string]map[string]CachedSummary, len(s.Accounts))
+	for id, account := range s.Accounts {
+		queues[id] = accountQueue{
+			WeeklyQueue:    account.WeeklyQueue,
+			DeferredDigest: account.DeferredDigest,
+			Outbox:         account.Outbox,
+			Remainders:     account.Remainders,
+			Checkpoints:    account.Checkpoints,
+			Approvals:      account.Approvals,
+		}
+		caches[id] = account.SummaryCache
+		account := *account
+		account.WeeklyQueue, account.DeferredDigest, account.Outbox, account.Remainders = nil, nil, nil, nil
+		account.Checkpoints, account.Approvals = nil, nil
+		account.SummaryCache = nil
+		rest.Accounts[id] = &account
+	}
+
+	records := make(map[string][]byte)
+	for part, v := range map[string]any{statePart: &rest, queuePart: queues, digestsPart: s.Digests, cachePart: caches} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("encoding the %s: %w", part, err)
+		}
+		records[part] = data
+	}
+	return records, nil
+}
+
+// joinState puts a State back together from its parts. a State without its state part was never saved
+func joinState(records map[string][]byte) (*State, error) {
+	if records[statePart] == nil {
+		return nil, nil
+	}
+	s := &State{}
+	var queues map[string]accountQueue
+	var caches map[string]map[string]CachedSummary
+	// the state part first: it has the digests too, as null, which would otherwise be read over the digests part's
+	for _, part := range []struct {
+		name string
+		v    any
+	}{{statePart, s}, {queuePart, &queues}, {digestsPart, &s.Digests}, {cachePart, &caches}} {
+		if records[part.name] == nil {
+			continue
+		}
+		if err := json.Unmarshal(records[part.name], part.v); err != nil {
+			return nil, fmt.Errorf("parsing the %s: %w", part.name, err)
+		}
+	}
+	for id, account := range s.Accounts {
+		queue := queues[id]
+		account.WeeklyQueue = queue.WeeklyQueue
+		account.DeferredDigest = queue.DeferredDigest
+		account.Outbox = queue.Outbox
+		account.Remainders = queue.Remainders
+		account.Checkpoints = queue.Checkpoints
+		account.Approvals = queue.Approvals
+		account.SummaryCache = caches[id]
+	}
+	return s, nil
+}
+
+func (st *splitStore) Load() (*State, error) {
+	records := make(map[string][]byte)
+	saved, stored := make(map[string][32]byte), make(map[string][32]byte)
+	for _, part := range []string{statePart, queuePart, digestsPart, cachePart} {
+		data, err := st.parts.get(part)
+		if err != nil {
+			return nil, fmt.Errorf("reading the %s: %w", part, err)
+		}
+		if data == nil {
+			continue
+		}
+		stored[part] = sha256.Sum256(data)
+		if data, err = openState(st.name+" "+part, data); err != nil {
+			return nil, err
+		}
+		records[part] = data
+		saved[part] = sha256.Sum256(data)
+	}
+	state, err := joinState(records)
+	if err != nil {
+		return nil, err
+	}
+	st.saved, st.stored = saved, stored
+	return state, nil
+}
+
+func (st *splitStore) Save(s *State) error {
+	records, err := splitState(s)
+	if err != nil {
+		return err
+	}
+	changed := make(map[string][]byte)
+	hashes := make(map[string][32]byte)
+	for part, data := range records {
+		hash := sha256.Sum256(data)
+		if saved, ok := st.saved[part]; ok && saved == hash {
+			continue
+		}
+		if changed[part], err = sealState(data); err != nil {
+			return err
+		}
+		hashes[part] = hash
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := st.parts.put(changed, st.stored); err != nil {
+		return fmt.Errorf("writing the %s: %w", strings.Join(sortedKeys(changed), ", "), err)
+	}
+	for part, hash := range hashes {
+		st.saved[part] = hash
+		st.stored[part] = sha256.Sum256(changed[part])
+	}
+	return nil
+}
+
+func (st *splitStore) Close() error {
+	return st.parts.close()
+}
+
+func (st *splitStore) String() string {
+	return st.name
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// stateBucket is the bucket the state's parts are kept in
+var stateBucket = []byte("state")
+
+// boltStore keeps the state's parts in a bbolt file, one key each
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(config *StorageConfig, dir, _ string) (partStore, error) {
+	// bbolt locks its file, a second process waits a moment and then gives up rather than hanging
+	db, err := bolt.Open(storeFile(config, dir), 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (st *boltStore) get(part string) (data []byte, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		// the value is only valid during the transaction
+		if value := tx.Bucket(stateBucket).Get([]byte(part)); value != nil {
+			data = append([]byte{}, value...)
+		}
+		return nil
+	})
+	return data, err
+}
+
+func (st *boltStore) put(records map[string][]byte, expected map[string][32]byte) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucket)
+		for part, data := range records {
+			if err := checkUnchanged(part, bucket.Get([]byte(part)), expected); err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(part), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (st *boltStore) close() error {
+	return st.db.Close()
+}
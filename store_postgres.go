@@ -0,0 +1,4 @@
+package main
+
+// the postgres storage backend's driver, pgx through database/sql
+import _ "github.com/jackc/pgx/v5/stdlib"
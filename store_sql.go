@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// sqliteOptions are how the state database is opened: a write ahead log synced on every commit, so a crash loses
+// no saved state and never leaves a half written one, transactions that take the write lock up front, and a wait for
+// the lock rather than an error when another process holds it
+const sqliteOptions = "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_txlock=immediate"
+
+// sqliteMigrations bring the schema of a sqlite state database up to date, sqliteMigrations[i] taking it from version
+// i to i+1. they're only ever appended to
+var sqliteMigrations = []func(tx *sql.Tx) error{
+	// the table from before migrations, the state in the same four parts as the other databases
+	sqliteSchema(`CREATE TABLE IF NOT EXISTS reu_state (part TEXT PRIMARY KEY, data BLOB NOT NULL)`),
+	// a table per kind of record, so a new fetch cursor or a queued email writes a row rather than a part. the rows of
+	// the ordered tables keep their order by seq, which grows as they're added
+	sqliteSchema(
+		`CREATE TABLE reu_meta (name TEXT PRIMARY KEY, data BLOB NOT NULL)`,
+		`CREATE TABLE reu_accounts (id TEXT PRIMARY KEY, data BLOB NOT NULL)`,
+		`CREATE TABLE reu_tokens (account TEXT PRIMARY KEY, data BLOB NOT NULL)`,
+		`CREATE TABLE reu_fetch_cursors (account TEXT PRIMARY KEY, last_fetch TEXT NOT NULL)`,
+		`CREATE TABLE reu_queued_messages (seq INTEGER PRIMARY KEY, account TEXT NOT NULL, queue TEXT NOT NULL, message_id TEXT NOT NULL, n INTEGER NOT NULL, data BLOB NOT NULL, UNIQUE (account, queue, message_id, n))`,
+		`CREATE TABLE reu_digests (seq INTEGER PRIMARY KEY, id TEXT NOT NULL UNIQUE, kind TEXT NOT NULL, generated_at TEXT NOT NULL, data BLOB NOT NULL)`,
+		`CREATE TABLE reu_feedback (seq INTEGER PRIMARY KEY, digest_id TEXT NOT NULL, message_id TEXT NOT NULL, time TEXT NOT NULL, data BLOB NOT NULL, UNIQUE (digest_id, message_id, time))`,
+		`CREATE TABLE reu_summary_cache (account TEXT NOT NULL, key TEXT NOT NULL, data BLOB NOT NULL, PRIMARY KEY (account, key))`,
+	),
+	// the parts move into the tables
+	moveSQLiteParts,
+}
+
+// sqliteSchema is a migration that runs statements
+func sqliteSchema(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// sqliteTable is a kind of record the state database keeps
+type sqliteTable struct {
+	name string
+	// keys tell the rows apart, columns are the rest. a data column is the record's JSON, encrypted when a passphrase
+	// is configured
+	keys, columns []string
+	// ordered tables give their rows back in the order they were added, within groups told apart by their first
+	// group keys
+	ordered bool
+	group   int
+}
+
+var (
+	sqliteMetaTable     = &sqliteTable{name: "reu_meta", keys: []string{"name"}, columns: []string{"data"}}
+	sqliteAccountsTable = &sqliteTable{name: "reu_accounts", keys: []string{"id"}, columns: []string{"data"}}
+	sqliteTokensTable   = &sqliteTable{name: "reu_tokens", keys: []string{"account"}, columns: []string{"data"}}
+	sqliteCursorsTable  = &sqliteTable{name: "reu_fetch_cursors", keys: []string{"account"}, columns: []string{"last_fetch"}}
+	sqliteQueueTable    = &sqliteTable{name: "reu_queued_messages", keys: []string{"account", "queue", "message_id", "n"}, columns: []string{"data"}, ordered: true, group: 2}
+	sqliteDigestsTable  = &sqliteTable{name: "reu_digests", keys: []string{"id"}, columns: []string{"kind", "generated_at", "data"}, ordered: true}
+	sqliteFeedbackTable = &sqliteTable{name: "reu_feedback", keys: []string{"digest_id", "message_id", "time"}, columns: []string{"data"}, ordered: true}
+	sqliteCacheTable    = &sqliteTable{name: "reu_summary_cache", keys: []string{"account", "key"}, columns: []string{"data"}}
+)
+
+// sqliteTables are read in this order, the accounts before what belongs to them
+var sqliteTables = []*sqliteTable{
+	sqliteMetaTable, sqliteAccountsTable, sqliteTokensTable, sqliteCursorsTable, sqliteQueueTable, sqliteDigestsTable,
+	sqliteFeedbackTable, sqliteCacheTable,
+}
+
+// the queues of reu_queued_messages
+const (
+	weeklyQueue   = "weekly"
+	deferredQueue = "deferred"
+)
+
+// sqliteRow is a row of a table, with its data unencrypted
+type sqliteRow struct {
+	table         *sqliteTable
+	keys, columns []any
+}
+
+// id tells the row apart from every other row of the database
+func (r sqliteRow) id() string {
+	keys, _ := json.Marshal(r.keys)
+	return r.table.name + " " + string(keys)
+}
+
+// orderGroup is the group the row is ordered within
+func (r sqliteRow) orderGroup() string {
+	keys, _ := json.Marshal(r.keys[:r.table.group])
+	return r.table.name + " " + string(keys)
+}
+
+// hash changes when the row does
+func (r sqliteRow) hash() [32]byte {
+	data, _ := json.Marshal(r.columns)
+	return sha256.Sum256(data)
+}
+
+// write inserts the row, or updates it in place, so an ordered row keeps its place. its data is sealed by sealer
+func (r sqliteRow) write(tx *sql.Tx, sealer *stateSealer) error {
+	values := slices.Clone(r.keys)
+	updates := make([]string, len(r.table.columns))
+	for i, column := range r.table.columns {
+		value := r.columns[i]
+		if column == "data" {
+			sealed, err := sealer.seal(value.([]byte))
+			if err != nil {
+				return err
+			}
+			value = sealed
+		}
+		values = append(values, value)
+		updates[i] = column + " = excluded." + column
+	}
+	columns := append(slices.Clone(r.table.keys), r.table.columns...)
+	_, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s`,
+		r.table.name, strings.Join(columns, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "),
+		strings.Join(r.table.keys, ", "), strings.Join(updates, ", ")), values...)
+	return err
+}
+
+// remove deletes the row
+func (r sqliteRow) remove(tx *sql.Tx) error {
+	conditions := make([]string, len(r.table.keys))
+	for i, key := range r.table.keys {
+		conditions[i] = key + " = ?"
+	}
+	_, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s`, r.table.name, strings.Join(conditions, " AND ")), r.keys...)
+	return err
+}
+
+// sqliteToken is a row of reu_tokens, the account's oauth token and what's known about it
+type sqliteToken struct {
+	Token        *oauth2.Token `json:"token"`
+	IssuedAt     time.Time     `json:"issued_at"`
+	ExpiryWarned bool          `json:"expiry_warned"`
+	Scopes       []string      `json:"scopes"`
+}
+
+// sqliteRows are the rows s is kept in, the ordered ones in their order
+func sqliteRows(s *State) ([]sqliteRow, error) {
+	var rows []sqliteRow
+	add := func(table *sqliteTable, keys []any, columns []any, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("encoding a row of %s: %w", table.name, err)
+		}
+		rows = append(rows, sqliteRow{table: table, keys: keys, columns: append(columns, data)})
+		return nil
+	}
+
+	rest := *s
+	rest.Accounts, rest.Digests, rest.Feedback = nil, nil, nil
+	if err := add(sqliteMetaTable, []any{statePart}, nil, &rest); err != nil {
+		return nil, err
+	}
+	for _, id := range sortedKeys(s.Accounts) {
+		account := s.Accounts[id]
+		token := sqliteToken{Token: account.Token, IssuedAt: account.TokenIssuedAt, ExpiryWarned: account.TokenExpiryWarned, Scopes: account.Scopes}
+		if err := add(sqliteTokensTable, []any{id}, nil, token); err != nil {
+			return nil, err
+		}
+		rows = append(rows, sqliteRow{table: sqliteCursorsTable, keys: []any{id}, columns: []any{account.LastFetch.UTC().Format(time.RFC3339Nano)}})
+		for _, queue := range []struct {
+			name     string
+			messages []*gmail.Message
+		}{{weeklyQueue, account.WeeklyQueue}, {deferredQueue, account.DeferredDigest}} {
+			// an email queued twice is told apart by how many times it came before
+			seen := make(map[string]int)
+			for _, message := range queue.messages {
+				if err := add(sqliteQueueTable, []any{id, queue.name, message.Id, seen[message.Id]}, nil, message); err != nil {
+					return nil, err
+				}
+				seen[message.Id]++
+			}
+		}
+		for _, key := range sortedKeys(account.SummaryCache) {
+			if err := add(sqliteCacheTable, []any{id, key}, nil, account.SummaryCache[key]); err != nil {
+				return nil, err
+			}
+		}
+		rest := *account
+		rest.Token, rest.TokenIssuedAt, rest.TokenExpiryWarned, rest.Scopes = nil, time.Time{}, false, nil
+		rest.LastFetch, rest.WeeklyQueue, rest.DeferredDigest, rest.SummaryCache = time.Time{}, nil, nil, nil
+		if err := add(sqliteAccountsTable, []any{id}, nil, &rest); err != nil {
+			return nil, err
+		}
+	}
+	for _, digest := range s.Digests {
+		if err := add(sqliteDigestsTable, []any{digest.ID}, []any{digest.Kind, digest.GeneratedAt.UTC().Format(time.RFC3339Nano)}, digest); err != nil {
+			return nil, err
+		}
+	}
+	for _, feedback := range s.Feedback {
+		if err := add(sqliteFeedbackTable, []any{feedback.DigestID, feedback.MessageID, feedback.Time.UTC().Format(time.RFC3339Nano)}, nil, feedback); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// sqliteState puts a State back together from its rows. a State without its meta row was never saved
+func sqliteState(rows []sqliteRow) (*State, error) {
+	s := &State{Accounts: make(map[string]*AccountState)}
+	saved := false
+	for _, row := range rows {
+		data, _ := row.columns[len(row.columns)-1].([]byte)
+		var err error
+		switch row.table {
+		case sqliteMetaTable:
+			saved = true
+			err = json.Unmarshal(data, s)
+			if s.Accounts == nil {
+				s.Accounts = make(map[string]*AccountState)
+			}
+		case sqliteAccountsTable:
+			account := &AccountState{}
+			err = json.Unmarshal(data, account)
+			s.Accounts[row.keys[0].(string)] = account
+		case sqliteDigestsTable:
+			digest := &Digest{}
+			err = json.Unmarshal(data, digest)
+			s.Digests = append(s.Digests, digest)
+		case sqliteFeedbackTable:
+			var feedback Feedback
+			err = json.Unmarshal(data, &feedback)
+			s.Feedback = append(s.Feedback, feedback)
+		default:
+			// the rest belongs to an account, and goes with it when the account is gone
+			account := s.Accounts[row.keys[0].(string)]
+			if account == nil {
+				continue
+			}
+			switch row.table {
+			case sqliteTokensTable:
+				var token sqliteToken
+				err = json.Unmarshal(data, &token)
+				account.Token, account.TokenIssuedAt, account.TokenExpiryWarned, account.Scopes = token.Token, token.IssuedAt, token.ExpiryWarned, token.Scopes
+			case sqliteCursorsTable:
+				account.LastFetch, err = time.Parse(time.RFC3339Nano, row.columns[0].(string))
+			case sqliteQueueTable:
+				message := &gmail.Message{}
+				err = json.Unmarshal(data, message)
+				if row.keys[1] == deferredQueue {
+					account.DeferredDigest = append(account.DeferredDigest, message)
+				} else {
+					account.WeeklyQueue = append(account.WeeklyQueue, message)
+				}
+			case sqliteCacheTable:
+				var cached CachedSummary
+				err = json.Unmarshal(data, &cached)
+				if account.SummaryCache == nil {
+					account.SummaryCache = make(map[string]CachedSummary)
+				}
+				account.SummaryCache[row.keys[1].(string)] = cached
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing a row of %s: %w", row.table.name, err)
+		}
+	}
+	if !saved {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// sqliteStore keeps the State in a sqlite database, a table per kind of record: the accounts, their tokens, fetch
+// cursors and queued emails, the digests, the feedback and the summary cache. a save writes the rows that changed and
+// deletes the ones that are gone, all in one transaction
+type sqliteStore struct {
+	db     *sql.DB
+	sealer *stateSealer
+	// saved are the rows as they were last read or written, by id
+	saved map[string]sqliteSaved
+}
+
+// sqliteSaved is a row as it was last read or written, and where it was in its group
+type sqliteSaved struct {
+	row      sqliteRow
+	hash     [32]byte
+	position int
+}
+
+func openSQLiteStore(config *StorageConfig, dir string) (Store, error) {
+	db, err := sql.Open("sqlite", storeFile(config, dir)+"?"+sqliteOptions)
+	if err != nil {
+		return nil, err
+	}
+	// the profile's saves take turns on one connection, rather than some of them failing on the database's lock
+	db.SetMaxOpenConns(1)
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	sealer, err := sqliteSealer(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, sealer: sealer, saved: make(map[string]sqliteSaved)}, nil
+}
+
+// sqliteSaltRow is the row of reu_meta with the salt the database's rows are encrypted with
+const sqliteSaltRow = "salt"
+
+// sqliteQuerier is a database or a transaction
+type sqliteQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// sqliteSealer seals the rows of a database with its salt, which is made the first time the database is opened with a
+// passphrase. the key is derived once for all of them
+func sqliteSealer(db sqliteQuerier) (*stateSealer, error) {
+	if len(encryptionPassphrase) == 0 {
+		return newStateSealer(nil)
+	}
+	fresh := make([]byte, saltSize)
+	if _, err := rand.Read(fresh); err != nil {
+		return nil, fmt.Errorf("generating salt: %w", err)
+	}
+	// another replica may be making it at the same time, and whichever is first is the salt
+	if _, err := db.Exec(`INSERT INTO reu_meta (name, data) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`, sqliteSaltRow, fresh); err != nil {
+		return nil, fmt.Errorf("saving the encryption salt: %w", err)
+	}
+	var salt []byte
+	if err := db.QueryRow(`SELECT data FROM reu_meta WHERE name = ?`, sqliteSaltRow).Scan(&salt); err != nil {
+		return nil, fmt.Errorf("reading the encryption salt: %w", err)
+	}
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("the encryption salt is %d bytes, want %d", len(salt), saltSize)
+	}
+	return newStateSealer(salt)
+}
+
+// migrateSQLite runs the migrations the database hasn't had yet, in one transaction
+func migrateSQLite(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("opening the database: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS reu_schema (version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("creating the schema table: %w", err)
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT coalesce(max(version), 0) FROM reu_schema`).Scan(&version); err != nil {
+		return fmt.Errorf("reading the schema version: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("the database schema is version %d, but this build only understands up to %d", version, len(sqliteMigrations))
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		log.Info("Migrating the sqlite schema", "from", version, "to", version+1)
+		if err := sqliteMigrations[version](tx); err != nil {
+			return fmt.Errorf("migrating the schema to version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO reu_schema (version) VALUES (?)`, version+1); err != nil {
+			return fmt.Errorf("migrating the schema to version %d: %w", version+1, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// moveSQLiteParts writes the state the database kept in parts to the tables, and drops the parts
+func moveSQLiteParts(tx *sql.Tx) error {
+	parts, err := tx.Query(`SELECT part, data FROM reu_state`)
+	if err != nil {
+		return err
+	}
+	defer parts.Close()
+	records := make(map[string][]byte)
+	for parts.Next() {
+		var part string
+		var data []byte
+		if err := parts.Scan(&part, &data); err != nil {
+			return err
+		}
+		if records[part], err = openState("sqlite "+part, data); err != nil {
+			return err
+		}
+	}
+	if err := parts.Err(); err != nil {
+		return err
+	}
+	s, err := joinState(records)
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		rows, err := sqliteRows(s)
+		if err != nil {
+			return err
+		}
+		sealer, err := sqliteSealer(tx)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := row.write(tx, sealer); err != nil {
+				return fmt.Errorf("writing a row of %s: %w", row.table.name, err)
+			}
+		}
+	}
+	_, err = tx.Exec(`DROP TABLE reu_state`)
+	return err
+}
+
+func (st *sqliteStore) Load() (*State, error) {
+	var rows []sqliteRow
+	saved := make(map[string]sqliteSaved)
+	positions := make(map[string]int)
+	for _, table := range sqliteTables {
+		query := fmt.Sprintf(`SELECT %s, %s FROM %s`, strings.Join(table.keys, ", "), strings.Join(table.columns, ", "), table.name)
+		if table.ordered {
+			query += ` ORDER BY seq`
+		}
+		result, err := st.db.Query(query)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", table.name, err)
+		}
+		for result.Next() {
+			values := make([]any, len(table.keys)+len(table.columns))
+			targets := make([]any, len(values))
+			for i := range values {
+				targets[i] = &values[i]
+			}
+			if err := result.Scan(targets...); err != nil {
+				result.Close()
+				return nil, fmt.Errorf("reading %s: %w", table.name, err)
+			}
+			row := sqliteRow{table: table, keys: values[:len(table.keys)], columns: values[len(table.keys):]}
+			if table == sqliteMetaTable && row.keys[0] != statePart {
+				// the salt isn't part of the state
+				continue
+			}
+			if last := len(row.columns) - 1; table.columns[last] == "data" {
+				data, _ := row.columns[last].([]byte)
+				if row.columns[last], err = openState(table.name, data); err != nil {
+					result.Close()
+					return nil, err
+				}
+			}
+			rows = append(rows, row)
+			saved[row.id()] = sqliteSaved{row: row, hash: row.hash(), position: positions[row.orderGroup()]}
+			positions[row.orderGroup()]++
+		}
+		err = result.Err()
+		result.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", table.name, err)
+		}
+	}
+	s, err := sqliteState(rows)
+	if err != nil {
+		return nil, err
+	}
+	st.saved = saved
+	return s, nil
+}
+
+func (st *sqliteStore) Save(s *State) error {
+	rows, err := sqliteRows(s)
+	if err != nil {
+		return err
+	}
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	saved := make(map[string]sqliteSaved, len(rows))
+	positions, last, moving := make(map[string]int), make(map[string]int), make(map[string]bool)
+	for _, row := range rows {
+		id, hash, group := row.id(), row.hash(), row.orderGroup()
+		saved[id] = sqliteSaved{row: row, hash: hash, position: positions[group]}
+		positions[group]++
+		previous, ok := st.saved[id]
+		if row.table.ordered {
+			// a row added before one that was already there, or rows that swapped places, put the rest of the group
+			// out of order. they're added again, after it
+			if !ok || previous.position < last[group] {
+				moving[group] = true
+			}
+			last[group] = previous.position
+			if ok && moving[group] {
+				if err := row.remove(tx); err != nil {
+					return fmt.Errorf("moving a row of %s: %w", row.table.name, err)
+				}
+				ok = false
+			}
+		}
+		if ok && previous.hash == hash {
+			continue
+		}
+		if err := row.write(tx, st.sealer); err != nil {
+			return fmt.Errorf("writing a row of %s: %w", row.table.name, err)
+		}
+	}
+	for id, previous := range st.saved {
+		if _, ok := saved[id]; ok {
+			continue
+		}
+		if err := previous.row.remove(tx); err != nil {
+			return fmt.Errorf("deleting a row of %s: %w", previous.row.table.name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	st.saved = saved
+	return nil
+}
+
+func (st *sqliteStore) Close() error {
+	return st.db.Close()
+}
+
+func (st *sqliteStore) String() string {
+	return "sqlite"
+}
@@ -0,0 +1,4 @@
+package main
+
+// the sqlite storage backend, the default. modernc.org/sqlite is pure Go, so the build stays cgo free
+import _ "modernc.org/sqlite"
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// testStorages are the storage backends the store tests run against. postgres needs a database to run on, given by
+// REU_TEST_POSTGRES_DSN, and is skipped without one
+func testStorages(t *testing.T) map[string]*StorageConfig {
+	storages := map[string]*StorageConfig{
+		"file":   {Backend: "file"},
+		"sqlite": {Backend: "sqlite"},
+		"bbolt":  {Backend: "bbolt"},
+	}
+	if dsn := os.Getenv("REU_TEST_POSTGRES_DSN"); dsn != "" {
+		// a tenant of its own, so runs don't see each other's rows
+		storages["postgres"] = &StorageConfig{Backend: "postgres", DSN: dsn, Tenant: "test-" + newRunID()}
+	} else {
+		t.Log("REU_TEST_POSTGRES_DSN isn't set, skipping postgres")
+	}
+	return storages
+}
+
+// openTestStore opens the backend of config in a directory of its own
+func openTestStore(t *testing.T, config *StorageConfig) Store {
+	t.Helper()
+	dir := t.TempDir()
+	if config.Backend == "file" {
+		return &fileStore{path: dir + "/" + stateFile}
+	}
+	if config.Backend == "sqlite" {
+		store, err := openSQLiteStore(config, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}
+	parts, err := storeBackends[config.Backend](config, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { parts.close() })
+	return &splitStore{parts: parts, name: config.Backend, saved: make(map[string][32]byte), stored: make(map[string][32]byte)}
+}
+
+// testState has a record of every kind a store keeps apart
+func testState() *State {
+	at := time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)
+	return &State{
+		Version: len(stateMigrations),
+		Accounts: map[string]*AccountState{
+			defaultAccount: {
+				Token:          &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: at.Add(time.Hour)},
+				TokenIssuedAt:  at,
+				Scopes:         []string{"https://www.googleapis.com/auth/gmail.readonly"},
+				LastFetch:      at,
+				WeeklyQueue:    []*gmail.Message{{Id: "m1", Snippet: "first"}, {Id: "m2", Snippet: "second"}},
+				DeferredDigest: []*gmail.Message{{Id: "m3"}},
+				SummaryCache:   map[string]CachedSummary{"m1:abc": {Output: "notes", CachedAt: at}},
+				SMSDay:         "2026-10-16",
+				SMSSent:        2,
+			},
+		},
+		Digests:  []*Digest{{ID: "daily-2026-10-15", Kind: "daily", GeneratedAt: at.Add(-24 * time.Hour), Summary: "yesterday"}, {ID: "daily-2026-10-16", Kind: "daily", GeneratedAt: at, Summary: "today"}},
+		Feedback: []Feedback{{DigestID: "daily-2026-10-16", MessageID: "m1", Sender: "a@example.com", Rating: 1, Time: at}},
+		Channels: map[string]string{"daily": "123"},
+	}
+}
+
+// sameState compares states by their JSON, which is what the stores keep
+func sameState(t *testing.T, got, want *State) {
+	t.Helper()
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("state = %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+// TestStoreRoundTrip saves a state, changes some of it and saves again, and reads each back from every backend
+func TestStoreRoundTrip(t *testing.T) {
+	for name, config := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			store := openTestStore(t, config)
+			s, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s != nil {
+				t.Fatalf("a new store has state %+v, want none", s)
+			}
+
+			want := testState()
+			if err := store.Save(want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sameState(t, got, want)
+
+			// a row added, one dropped and one moved, which the backends that write rows by what changed have to notice
+			account := want.Accounts[defaultAccount]
+			account.WeeklyQueue = []*gmail.Message{{Id: "m4"}, account.WeeklyQueue[0]}
+			want.Digests = want.Digests[1:]
+			account.SMSSent++
+			if err := store.Save(want); err != nil {
+				t.Fatal(err)
+			}
+			if got, err = store.Load(); err != nil {
+				t.Fatal(err)
+			}
+			sameState(t, got, want)
+		})
+	}
+}
+
+// TestStoreUpdateConflict has two replicas update the same state. the one whose save is refused because the other
+// saved first reads the state again and makes its change on top
+func TestStoreUpdateConflict(t *testing.T) {
+	for name, config := range testStorages(t) {
+		if config.Backend == "file" || config.Backend == "sqlite" {
+			// a state file and a sqlite database belong to one process, there's no replica to conflict with
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			first := openTestStore(t, config).(*splitStore)
+			// the second replica's store sees the same records through its own view of them
+			second := &splitStore{parts: first.parts, name: first.name, saved: make(map[string][32]byte), stored: make(map[string][32]byte)}
+
+			if err := first.Save(testState()); err != nil {
+				t.Fatal(err)
+			}
+			replicas := make([]*stateStore, 2)
+			for i, store := range []Store{first, second} {
+				s, err := store.Load()
+				if err != nil {
+					t.Fatal(err)
+				}
+				replicas[i] = &stateStore{state: s, store: store}
+			}
+
+			if err := replicas[1].update(func(s *State) { s.Channels["weekly"] = "456" }); err != nil {
+				t.Fatal(err)
+			}
+			calls := 0
+			if err := replicas[0].update(func(s *State) {
+				calls++
+				s.account().SMSSent++
+			}); err != nil {
+				t.Fatalf("update = %v, want it to retry past the conflict", err)
+			}
+			if calls != 2 {
+				t.Errorf("the update ran %d times, want 2, once before the conflict and once after", calls)
+			}
+
+			got, err := second.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Channels["weekly"] != "456" {
+				t.Errorf("channels = %v, want the other replica's change kept", got.Channels)
+			}
+			if sent := got.account().SMSSent; sent != 3 {
+				t.Errorf("sms sent = %d, want 3", sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// summaryCacheTTL is how long the model's notes on an email are kept, long enough for the weekly summary and for
+// regenerating the week's digests
+const summaryCacheTTL = 14 * 24 * time.Hour
+
+// CachedSummary is the model's notes on one email, read with one exact prompt
+type CachedSummary struct {
+	Output   string    `json:"output"`
+	CachedAt time.Time `json:"cached_at"`
+}
+
+// summaryCacheKey is the message id plus a hash of the request for the email's notes: the notes template and the
+// email's own prompt, nothing from the digest it's read for. so the daily, the weekly and /regenerate all hit the same
+// entry, and a changed template or rule misses
+func summaryCacheKey(messageID string, req openai.ChatCompletionRequest) string {
+	h := sha256.New()
+	_ = json.NewEncoder(h).Encode(req.Model)
+	_ = json.NewEncoder(h).Encode(req.Messages)
+	return messageID + ":" + hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// cachedSummary is the output cached for key, from Redis when the replicas share the cache
+func (s *openAISummarizer) cachedSummary(ctx context.Context, key string) (string, bool) {
+	if s.redis == nil {
+		return s.state.cachedSummary(key)
+	}
+	data, err := s.redis.get(ctx, s.redis.key("summary", key))
+	if err == nil && data != nil {
+		data, err = openState("the redis summary cache", data)
+	}
+	if err != nil {
+		log.FromContext(ctx).Warn("Unable to read the summary cache in Redis", "error", err)
+		return "", false
+	}
+	return string(data), data != nil
+}
+
+// cacheSummaries caches the notes written by a digest, by key, all at once. in Redis when the replicas share the
+// cache, where they expire by themselves. the cache only saves money, so failing to write it doesn't fail the digest
+func (s *openAISummarizer) cacheSummaries(ctx context.Context, outputs map[string]string) {
+	if len(outputs) == 0 {
+		return
+	}
+	logger := log.FromContext(ctx)
+	if s.redis == nil {
+		if err := s.state.cacheSummaries(outputs, s.clock.Now()); err != nil {
+			logger.Error("Unable to cache the emails' notes", "count", len(outputs), "error", err)
+		}
+		return
+	}
+	for key, output := range outputs {
+		data, err := sealState([]byte(output))
+		if err == nil {
+			_, err = s.redis.set(ctx, s.redis.key("summary", key), data, summaryCacheTTL, false)
+		}
+		if err != nil {
+			logger.Error("Unable to cache the email's notes in Redis", "key", key, "error", err)
+		}
+	}
+}
+
+func (st *stateStore) cachedSummary(key string) (string, bool) {
+	var cached CachedSummary
+	var ok bool
+	st.read(func(s *State) {
+		cached, ok = s.account().SummaryCache[key]
+	})
+	return cached.Output, ok
+}
+
+// cacheSummaries remembers the outputs by key in a single update, and drops the entries that have expired
+func (st *stateStore) cacheSummaries(outputs map[string]string, now time.Time) error {
+	return st.update(func(s *State) {
+		account := s.account()
+		if account.SummaryCache == nil {
+			account.SummaryCache = make(map[string]CachedSummary)
+		}
+		for k, cached := range account.SummaryCache {
+			if now.Sub(cached.CachedAt) > summaryCacheTTL {
+				delete(account.SummaryCache, k)
+			}
+		}
+		for key, output := range outputs {
+			account.SummaryCache[key] = CachedSummary{Output: output, CachedAt: now}
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxDailyPosts bounds how many daily digests a weekly one links back to, in case weekly digests stop for a while
+const maxDailyPosts = 14
+
+// recordDailyPost remembers where a daily digest went, for the weekly digest to link back to
+func (a *App) recordDailyPost(posted *discordgo.Message) error {
+	if posted == nil {
+		return nil
+	}
+	post := DigestPost{
+		ChannelID: posted.ChannelID,
+		MessageID: posted.ID,
+		URL:       a.discordMessageURL(posted.ChannelID, posted.ID),
+		SentAt:    a.Clock.Now(),
+	}
+	return a.state.update(func(s *State) {
+		account := s.account()
+		account.DailyDigestPosts = append(account.DailyDigestPosts, post)
+		if len(account.DailyDigestPosts) > maxDailyPosts {
+			account.DailyDigestPosts = account.DailyDigestPosts[len(account.DailyDigestPosts)-maxDailyPosts:]
+		}
+	})
+}
+
+// weeklyReference makes the weekly digest a reply to the latest daily one, when both go to the same channel.
+// Discord only threads replies within a channel, elsewhere the links from dailyPostsSection have to do
+func weeklyReference(channelID string, posts []DigestPost) *discordgo.MessageReference {
+	for i := len(posts) - 1; i >= 0; i-- {
+		if posts[i].ChannelID == channelID {
+			failIfNotExists := false
+			return &discordgo.MessageReference{
+				MessageID:       posts[i].MessageID,
+				ChannelID:       channelID,
+				FailIfNotExists: &failIfNotExists,
+			}
+		}
+	}
+	return nil
+}
+
+// dailyPostsSection links the week's daily digests, e.g. "Daily digests: Mon 3 · Tue 4"
+func dailyPostsSection(posts []DigestPost, location *time.Location) *DigestSection {
+	section := &DigestSection{Key: "daily_digests", Title: "Daily digests", Inline: true}
+	for _, post := range posts {
+		if post.URL == "" {
+			continue
+		}
+		section.Lines = append(section.Lines, fmt.Sprintf("[%s](<%s>)", post.SentAt.In(location).Format("Mon 2"), post.URL))
+	}
+	return section
+}
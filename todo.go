@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const todoistTasksURL = "https://api.todoist.com/rest/v2/tasks"
+
+// Todo is an action item ready to be handed to a task manager
+type Todo struct {
+	Content     string
+	Description string
+	Due         string // Due is an optional YYYY-MM-DD date
+	Link        string // Link points back at the email the action item came from
+}
+
+// TodoProvider creates tasks in an external task manager
+type TodoProvider interface {
+	Name() string
+	CreateTodo(todo Todo) error
+}
+
+// todoNotifier turns the action items of a digest into todos
+type todoNotifier struct {
+	provider TodoProvider
+}
+
+func (t *todoNotifier) Name() string {
+	return "todo " + t.provider.Name()
+}
+
+func (t *todoNotifier) Notify(digest *Digest) error {
+	var failed int
+	for _, entry := range digest.Entries {
+		for _, item := range entry.ActionItems {
+			todo := Todo{
+				Content:     item.Description,
+				Description: fmt.Sprintf("From: %s\nSubject: %s\n\n%s", entry.From, entry.Subject, entry.Summary),
+				Due:         item.Due,
+				Link:        entry.URL,
+			}
+
+			if err := t.provider.CreateTodo(todo); err != nil {
+				log.Error("Failed to create todo", "provider", t.provider.Name(), "content", todo.Content, "error", err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d todos could not be created", failed)
+	}
+	return nil
+}
+
+type TodoistConfig struct {
+	APIToken  string   `json:"api_token"`
+	ProjectID string   `json:"project_id"`
+	Labels    []string `json:"labels"`
+}
+
+type todoistProvider struct {
+	config TodoistConfig
+	client *http.Client
+}
+
+func newTodoistProvider(config TodoistConfig) *todoistProvider {
+	return &todoistProvider{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (t *todoistProvider) Name() string {
+	return "todoist"
+}
+
+func (t *todoistProvider) CreateTodo(todo Todo) error {
+	description := todo.Description
+	if todo.Link != "" {
+		description = fmt.Sprintf("[Open in Gmail](%s)\n\n%s", todo.Link, description)
+	}
+
+	body, err := json.Marshal(struct {
+		Content     string   `json:"content"`
+		Description string   `json:"description,omitempty"`
+		ProjectID   string   `json:"project_id,omitempty"`
+		DueDate     string   `json:"due_date,omitempty"`
+		Labels      []string `json:"labels,omitempty"`
+	}{
+		Content:     todo.Content,
+		Description: description,
+		ProjectID:   t.config.ProjectID,
+		DueDate:     todo.Due,
+		Labels:      t.config.Labels,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding todoist task: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, todoistTasksURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating todoist request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.config.APIToken)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending todoist request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("todoist returned status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// defaultTripGapDays is how many days can pass between two bookings of the same trip when the config doesn't say
+	defaultTripGapDays = 2
+	// travelDateTime and travelDate are how the model writes the local times of a booking
+	travelDateTime = "2006-01-02T15:04"
+	travelDate     = time.DateOnly
+)
+
+// travelPattern picks out the emails worth asking the model about, lowercased
+var travelPattern = regexp.MustCompile(`flight|boarding|itinerary|e-ticket|eticket|booking|reservation|check-in|hotel|airbnb|train|rail|bahn|sncf|ferry|rental car|car hire|your trip|travel|confirmation`)
+
+// travelIcons start the line of each kind of booking
+var travelIcons = map[string]string{
+	"flight": "✈️",
+	"train":  "🚆",
+	"bus":    "🚌",
+	"ferry":  "⛴️",
+	"stay":   "🏨",
+	"car":    "🚗",
+}
+
+type TravelConfig struct {
+	// TripGapDays is how many days can pass between two bookings for them to still be the same trip
+	TripGapDays int `json:"trip_gap_days"`
+}
+
+// TravelSegment is one booking: a leg of the journey, a stay or a rental car. times are local to where they happen,
+// as the booking gives them
+type TravelSegment struct {
+	MessageID    string `json:"message_id"`
+	ThreadID     string `json:"thread_id"`
+	Kind         string `json:"kind"`
+	Title        string `json:"title"`
+	From         string `json:"from"`
+	To           string `json:"to"`
+	Start        string `json:"start"`
+	End          string `json:"end"`
+	Confirmation string `json:"confirmation"`
+	Details      string `json:"details"`
+	Cancelled    bool   `json:"cancelled,omitempty"`
+	// Updated is when the booking was last seen in an email
+	Updated time.Time `json:"updated"`
+}
+
+// key tells bookings apart, so a reminder or a change of the same booking replaces it rather than adding another
+func (s *TravelSegment) key() string {
+	if s.Confirmation != "" {
+		return strings.ToLower(s.Kind + "|" + s.Confirmation + "|" + s.Start[:min(len(s.Start), len(travelDate))])
+	}
+	return strings.ToLower(s.Kind + "|" + s.Title + "|" + s.Start)
+}
+
+// startTime and endTime read the booking's local times, as if they were in location. a booking without an end ends
+// when it starts
+func (s *TravelSegment) startTime(location *time.Location) time.Time {
+	return parseTravelTime(s.Start, location)
+}
+
+func (s *TravelSegment) endTime(location *time.Location) time.Time {
+	if end := parseTravelTime(s.End, location); !end.IsZero() {
+		return end
+	}
+	return s.startTime(location)
+}
+
+// allDay is whether the booking has dates but no times
+func (s *TravelSegment) allDay() bool {
+	return len(s.Start) == len(travelDate)
+}
+
+func parseTravelTime(value string, location *time.Location) time.Time {
+	for _, layout := range []string{travelDateTime, travelDate} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Trip is the bookings that go together, the ones with no more than trip_gap_days between them
+type Trip struct {
+	Name     string
+	Segments []TravelSegment
+}
+
+// ExtractTravel asks the model for the travel bookings in the emails
+func (s *openAISummarizer) ExtractTravel(ctx context.Context, messages []*gmail.Message) ([]TravelSegment, error) {
+	location := s.clock.Now().Location()
+
+	var emails strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&emails, "## id: %s\n- **From:** %s\n- **Subject:** %s\n- **Date:** %s\n\n%s\n\n",
+			message.Id,
+			extractHeader(message, "From"),
+			extractHeader(message, "Subject"),
+			localDate(extractHeader(message, "Date"), location),
+			truncateTokens(1500, stripQuotes(extractBody(message))),
+		)
+	}
+
+	prompt, err := s.renderPrompt(s.templates.Load().Travel, map[string]any{
+		"emails": emails.String(),
+		"today":  s.clock.Now().Format("Monday 2 January 2006"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.callOpenAIJSON(ctx, []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: prompt,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Segments []TravelSegment `json:"segments"`
+	}
+	if err := json.Unmarshal([]byte(resp), &parsed); err != nil {
+		return nil, fmt.Errorf("unable to parse travel bookings: %v", err)
+	}
+	return parsed.Segments, nil
+}
+
+// trackTravel files the travel bookings in the emails into their trips, and returns the ids of the emails that were
+// bookings. those are shown as the trip's itinerary rather than summarized one by one
+func (a *App) trackTravel(ctx context.Context, messages []*gmail.Message) map[string]bool {
+	if a.Config.Travel == nil || len(messages) == 0 {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+
+	var candidates []*gmail.Message
+	for _, message := range messages {
+		if travelPattern.MatchString(strings.ToLower(extractHeader(message, "From") + " " + extractHeader(message, "Subject") + " " + message.Snippet)) {
+			candidates = append(candidates, message)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	found, err := a.Summarizer.ExtractTravel(ctx, candidates)
+	if err != nil {
+		logger.Error("Unable to look for travel bookings", "error", err)
+		return nil
+	}
+	byID := make(map[string]*gmail.Message, len(candidates))
+	for _, message := range candidates {
+		byID[message.Id] = message
+	}
+
+	now := a.Clock.Now()
+	bookings := make(map[string]bool)
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		for _, segment := range found {
+			message, ok := byID[segment.MessageID]
+			if _, known := travelIcons[segment.Kind]; !ok || !known || segment.startTime(a.Location).IsZero() {
+				continue
+			}
+			segment.ThreadID = message.ThreadId
+			segment.Updated = now
+			// a cancellation leaves nothing in the itinerary, so its email stays in the digest
+			if !segment.Cancelled {
+				bookings[message.Id] = true
+			}
+
+			i := slices.IndexFunc(account.Travel, func(t TravelSegment) bool { return t.key() == segment.key() })
+			switch {
+			case segment.Cancelled && i >= 0:
+				account.Travel = slices.Delete(account.Travel, i, i+1)
+			case segment.Cancelled:
+			case i >= 0:
+				account.Travel[i] = segment
+			default:
+				account.Travel = append(account.Travel, segment)
+			}
+		}
+		// a trip is forgotten once it's over
+		account.Travel = slices.DeleteFunc(account.Travel, func(t TravelSegment) bool {
+			return t.endTime(a.Location).Before(now.AddDate(0, 0, -1))
+		})
+	}); err != nil {
+		logger.Error("Unable to save the travel bookings", "error", err)
+		return nil
+	}
+	logger.Info("Travel bookings updated", "emails", len(bookings))
+	return bookings
+}
+
+// trips groups the upcoming bookings into trips, soonest first
+func (a *App) trips() []Trip {
+	ended := a.Clock.Now().AddDate(0, 0, -1)
+	var segments []TravelSegment
+	a.state.read(func(s *State) {
+		for _, segment := range s.account().Travel {
+			if !segment.endTime(a.Location).Before(ended) {
+				segments = append(segments, segment)
+			}
+		}
+	})
+	slices.SortFunc(segments, func(x, y TravelSegment) int {
+		return x.startTime(a.Location).Compare(y.startTime(a.Location))
+	})
+
+	gapDays := defaultTripGapDays
+	if config := a.Config.Travel; config != nil && config.TripGapDays > 0 {
+		gapDays = config.TripGapDays
+	}
+
+	var trips []Trip
+	var tripEnd time.Time
+	for _, segment := range segments {
+		start := segment.startTime(a.Location)
+		if len(trips) == 0 || start.Sub(tripEnd) > time.Duration(gapDays)*24*time.Hour {
+			trips = append(trips, Trip{})
+		}
+		trip := &trips[len(trips)-1]
+		trip.Segments = append(trip.Segments, segment)
+		if end := segment.endTime(a.Location); end.After(tripEnd) {
+			tripEnd = end
+		}
+	}
+	for i := range trips {
+		trips[i].Name = tripName(trips[i].Segments)
+	}
+	return trips
+}
+
+// tripName is where a trip goes, e.g. "Trip to New York", from its first stay or else where its first leg arrives
+func tripName(segments []TravelSegment) string {
+	for _, segment := range segments {
+		if segment.Kind == "stay" && segment.To != "" {
+			return "Trip to " + segment.To
+		}
+	}
+	for _, segment := range segments {
+		if segment.Kind != "car" && segment.To != "" {
+			return "Trip to " + segment.To
+		}
+	}
+	return "Trip"
+}
+
+// itineraryLine is one booking in a trip's itinerary, e.g. "✈️ Thu 12 Mar 09:30 → 11:45 · LH 400 Frankfurt → New York · ref ABC123"
+func (a *App) itineraryLine(segment TravelSegment) string {
+	start := segment.startTime(a.Location)
+	l := a.locale()
+	when := l.shortDate(start) + " " + start.Format("15:04")
+	if segment.allDay() {
+		when = l.shortDate(start)
+	}
+	if end := parseTravelTime(segment.End, a.Location); !end.IsZero() {
+		switch {
+		case segment.Kind == "stay" || segment.Kind == "car":
+			when += " – " + l.shortDate(end)
+		case end.YearDay() == start.YearDay() && len(segment.End) == len(travelDateTime):
+			when += " → " + end.Format("15:04")
+		case len(segment.End) == len(travelDateTime):
+			when += " → " + l.shortDate(end) + " " + end.Format("15:04")
+		}
+	}
+	parts := []string{travelIcons[segment.Kind] + " " + when, "**" + segment.Title + "**"}
+	if segment.Confirmation != "" {
+		parts = append(parts, "ref `"+segment.Confirmation+"`")
+	}
+	if segment.Details != "" {
+		parts = append(parts, segment.Details)
+	}
+	return strings.Join(parts, " · ")
+}
+
+// travelSection is the itinerary of the trips a digest should mention: every upcoming one for the weekly summary, and
+// for the daily one those with a booking that came in since the last digest or that start in the next two days
+func (a *App) travelSection(kind string, since time.Time) *DigestSection {
+	if a.Config.Travel == nil {
+		return nil
+	}
+	now := a.Clock.Now()
+	section := &DigestSection{Key: "travel", Title: "🧳 Upcoming trips"}
+	for _, trip := range a.trips() {
+		if kind != "weekly" && !tripIsNews(trip, since, now, a.Location) {
+			continue
+		}
+		section.Lines = append(section.Lines, "**"+trip.Name+"**")
+		for _, segment := range trip.Segments {
+			section.Lines = append(section.Lines, a.itineraryLine(segment))
+		}
+	}
+	if len(section.Lines) > 0 {
+		section.Intro = "Gathered from the booking emails, which aren't summarized on their own."
+	}
+	return section
+}
+
+// tripIsNews is whether a daily digest should show the trip: it has a booking from an email since the last digest, or
+// it's about to start
+func tripIsNews(trip Trip, since, now time.Time, location *time.Location) bool {
+	soon := now.Add(48 * time.Hour)
+	for _, segment := range trip.Segments {
+		if segment.Updated.After(since) {
+			return true
+		}
+		if start := segment.startTime(location); start.After(now) && start.Before(soon) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTravelICS writes the upcoming bookings as an iCalendar file. the times are floating, without a timezone, since
+// they're the local times at each place and a calendar app shows them as they are
+func (a *App) writeTravelICS(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//reads_ur_emails//travel//EN\r\nCALSCALE:GREGORIAN\r\n")
+	stamp := a.Clock.Now().UTC().Format("20060102T150405Z")
+	for _, trip := range a.trips() {
+		for _, segment := range trip.Segments {
+			start, end := segment.startTime(a.Location), segment.endTime(a.Location)
+			sb.WriteString("BEGIN:VEVENT\r\n")
+			fmt.Fprintf(&sb, "UID:%s@reads_ur_emails\r\n", icsUID(segment.key()))
+			fmt.Fprintf(&sb, "DTSTAMP:%s\r\n", stamp)
+			if segment.allDay() || segment.Kind == "stay" {
+				if !end.After(start) {
+					end = start.AddDate(0, 0, 1)
+				}
+				fmt.Fprintf(&sb, "DTSTART;VALUE=DATE:%s\r\nDTEND;VALUE=DATE:%s\r\n", start.Format("20060102"), end.Format("20060102"))
+			} else {
+				fmt.Fprintf(&sb, "DTSTART:%s\r\nDTEND:%s\r\n", start.Format("20060102T150405"), end.Format("20060102T150405"))
+			}
+			fmt.Fprintf(&sb, "SUMMARY:%s\r\n", icsEscape(travelIcons[segment.Kind]+" "+segment.Title))
+			if segment.From != "" {
+				fmt.Fprintf(&sb, "LOCATION:%s\r\n", icsEscape(segment.From))
+			}
+			var description []string
+			if segment.Confirmation != "" {
+				description = append(description, "Confirmation: "+segment.Confirmation)
+			}
+			if segment.Details != "" {
+				description = append(description, segment.Details)
+			}
+			description = append(description, trip.Name)
+			fmt.Fprintf(&sb, "DESCRIPTION:%s\r\n", icsEscape(strings.Join(description, "\n")))
+			if segment.ThreadID != "" {
+				fmt.Fprintf(&sb, "URL:%s\r\n", gmailThreadURL(a.Config.GmailAccount, segment.ThreadID))
+			}
+			sb.WriteString("END:VEVENT\r\n")
+		}
+	}
+	sb.WriteString("END:VCALENDAR\r\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// icsEscape escapes the characters iCalendar text values give a meaning to
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// icsUID turns a booking's key into a stable event id, so importing the file again updates the events
+func icsUID(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(key))
+}
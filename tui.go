@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/log"
+	"scheduler"
+)
+
+const (
+	tuiLogLines      = 12
+	tuiProgressLines = 5
+	tuiDigestLines   = 6
+	tuiRefresh       = time.Second
+)
+
+var (
+	tuiHeading = lipgloss.NewStyle().Bold(true)
+	// tuiCurrent is the tab of the profile on screen
+	tuiCurrent = lipgloss.NewStyle().Reverse(true)
+)
+
+// logTail keeps the last few log lines so they can be drawn inside the TUI instead of scrolling over it
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+}
+
+func (l *logTail) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.lines = append(l.lines, line)
+	}
+	if len(l.lines) > l.max {
+		l.lines = l.lines[len(l.lines)-l.max:]
+	}
+	return len(p), nil
+}
+
+func (l *logTail) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func tuiCommand(a *App, args []string) error {
+	fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tail := &logTail{max: tuiLogLines}
+	log.SetOutput(tail)
+	defer log.SetOutput(os.Stderr)
+
+	s, err := startDaemon(a.profiles)
+	if err != nil {
+		return err
+	}
+
+	events := subscribeProgress()
+	defer unsubscribeProgress(events)
+
+	profiles := a.profiles
+	if len(profiles) == 0 {
+		profiles = []*App{a}
+	}
+	model := &tuiModel{scheduler: s, profiles: profiles, tail: tail, events: events, progress: make(map[string][]string)}
+	_, err = tea.NewProgram(model, tea.WithAltScreen()).Run()
+	return err
+}
+
+// tuiModel is the TUI: one profile's tasks, progress and last digest at a time, and the log of all of them
+type tuiModel struct {
+	scheduler *scheduler.Scheduler
+	profiles  []*App
+	// current is the profile on screen, whose summaries the keys ask for
+	current  int
+	tail     *logTail
+	events   chan ProgressEvent
+	progress map[string][]string
+	status   string
+	// width is the terminal's, so no line wraps and pushes the ones under it down. 0 until the first resize
+	width int
+}
+
+// tuiTickMsg redraws the screen, for the countdowns to the next runs
+type tuiTickMsg time.Time
+
+// tuiProgressMsg is a digest's progress, from any profile
+type tuiProgressMsg ProgressEvent
+
+func tuiTick() tea.Cmd {
+	return tea.Tick(tuiRefresh, func(t time.Time) tea.Msg { return tuiTickMsg(t) })
+}
+
+// nextProgress waits for the next progress event
+func (m *tuiModel) nextProgress() tea.Cmd {
+	return func() tea.Msg { return tuiProgressMsg(<-m.events) }
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return tea.Batch(tuiTick(), m.nextProgress())
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+	case tuiTickMsg:
+		return m, tuiTick()
+	case tuiProgressMsg:
+		m.addProgress(ProgressEvent(msg))
+		return m, m.nextProgress()
+	case tea.KeyMsg:
+		return m, m.key(msg)
+	}
+	return m, nil
+}
+
+// addProgress keeps the last few progress lines of the event's profile
+func (m *tuiModel) addProgress(event ProgressEvent) {
+	for _, p := range m.profiles {
+		if p.Profile != event.Profile {
+			continue
+		}
+		line := fmt.Sprintf("%s  %s %s %d/%d %s", p.Clock.Now().In(p.Location).Format(time.TimeOnly), event.Kind, event.Stage, event.Done, event.Total, event.Error)
+		lines := append(m.progress[p.Profile], line)
+		if len(lines) > tuiProgressLines {
+			lines = lines[len(lines)-tuiProgressLines:]
+		}
+		m.progress[p.Profile] = lines
+	}
+}
+
+// key does what a key press asks for
+func (m *tuiModel) key(msg tea.KeyMsg) tea.Cmd {
+	p := m.profiles[m.current]
+	switch key := msg.String(); key {
+	case "s":
+		m.status = "queued a daily summary"
+		if _, err := m.scheduler.Add(createTask(p.taskName("Daily summary (TUI)"), p.summarizeNow("daily")).Once().GlobalBlocking()); err != nil {
+			m.status = "unable to queue a daily summary: " + err.Error()
+		}
+	case "w":
+		m.status = "queued a weekly summary"
+		if _, err := m.scheduler.Add(createTask(p.taskName("Weekly summary (TUI)"), p.summarizeNow("weekly")).Once().GlobalBlocking()); err != nil {
+			m.status = "unable to queue a weekly summary: " + err.Error()
+		}
+	case "tab":
+		m.current = (m.current + 1) % len(m.profiles)
+		m.status = ""
+	case "shift+tab":
+		m.current = (m.current + len(m.profiles) - 1) % len(m.profiles)
+		m.status = ""
+	case "q", "ctrl+c":
+		return tea.Quit
+	default:
+		if len(key) == 1 && key[0] >= '1' && key[0] <= '9' && int(key[0]-'1') < len(m.profiles) {
+			m.current = int(key[0] - '1')
+			m.status = ""
+		}
+	}
+	return nil
+}
+
+func (m *tuiModel) View() string {
+	lines := m.screen()
+	if m.width > 0 {
+		clip := lipgloss.NewStyle().MaxWidth(m.width)
+		for i, line := range lines {
+			lines[i] = clip.Render(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// screen is everything on screen for the current profile. every section is as high each time, so the sections stay
+// put
+func (m *tuiModel) screen() []string {
+	a := m.profiles[m.current]
+	now := a.Clock.Now()
+	lines := []string{tuiHeading.Render("*reads_ur_emails*") + "  " + now.In(a.Location).Format("Mon 2 Jan 15:04:05"), ""}
+
+	if len(m.profiles) > 1 {
+		tabs := make([]string, len(m.profiles))
+		for i, profile := range m.profiles {
+			tabs[i] = fmt.Sprintf(" %d %s ", i+1, profile.Profile)
+			if i == m.current {
+				tabs[i] = tuiCurrent.Render(tabs[i])
+			}
+		}
+		lines = append(lines, tuiHeading.Render("profiles")+" "+strings.Join(tabs, " "), "")
+	}
+
+	lines = append(lines, tuiHeading.Render("tasks"))
+	for _, task := range a.tasks() {
+		next := "not scheduled"
+		if at, ok := m.scheduler.NextRun(task.ID); ok {
+			next = "next " + at.In(a.Location).Format("Mon 2 Jan 15:04") + " (in " + formatUntil(at.Sub(now)) + ")"
+		}
+		last := "not run yet"
+		if at, ok := m.scheduler.LastRun(task.ID); ok {
+			last = "last " + at.In(a.Location).Format("Mon 2 Jan 15:04")
+			if result := lastTaskStatus(task.Name); result != "" {
+				last += " " + result
+			}
+		}
+		lines = append(lines, fmt.Sprintf("  %-4d %-32s %-40s %s", task.ID, task.Name, next, last))
+	}
+
+	lines = append(lines, "", tuiHeading.Render("progress"))
+	lines = append(lines, padLines(indent(m.progress[a.Profile]), tuiProgressLines)...)
+
+	lines = append(lines, "", tuiHeading.Render("last digest"))
+	var digest []string
+	if digests := a.state.recentDigests("", 1); len(digests) > 0 {
+		d := digests[0]
+		digest = append(digest, fmt.Sprintf("  %s, %s, %d emails, $%.3f", d.Kind, d.GeneratedAt.In(a.Location).Format("Mon 2 Jan 15:04"), d.EmailCount, d.Usage.CostUSD))
+		for _, line := range firstLines(d.Summary, tuiDigestLines) {
+			digest = append(digest, "  │ "+line)
+		}
+	} else {
+		digest = append(digest, "  none yet")
+	}
+	// the summary's lines, the "…" after them and the line above
+	lines = append(lines, padLines(digest, tuiDigestLines+2)...)
+
+	lines = append(lines, "", tuiHeading.Render("log"))
+	lines = append(lines, padLines(indent(m.tail.Lines()), tuiLogLines)...)
+
+	help := "[s] summarize now  [w] weekly summary now  [q] quit"
+	if len(m.profiles) > 1 {
+		help = "[s] summarize now  [w] weekly summary now  [tab] next profile  [1-9] profile  [q] quit"
+	}
+	if m.status != "" {
+		help += "   " + m.status
+	}
+	return append(lines, "", help)
+}
+
+// indent puts lines under their heading
+func indent(lines []string) []string {
+	indented := make([]string, len(lines))
+	for i, line := range lines {
+		indented[i] = "  " + line
+	}
+	return indented
+}
+
+// padLines is lines cut or padded with empty ones to n
+func padLines(lines []string, n int) []string {
+	if len(lines) > n {
+		return lines[:n]
+	}
+	return append(lines, make([]string, n-len(lines))...)
+}
+
+func firstLines(text string, n int) []string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) > n {
+		lines = append(lines[:n], "…")
+	}
+	return lines
+}
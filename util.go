@@ -2,59 +2,146 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/charmbracelet/log"
-	"github.com/sashabaranov/go-openai"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
 )
 
+// Config is loaded from config.json. every field can be overridden by the environment variable in its env tag,
+// and by the matching command-line flag (see config.go)
 type Config struct {
-	DailySummaryTime       string `json:"daily_summary_time"`
-	WeeklySummaryDay       string `json:"weekly_summary_day"`
-	WeeklySummaryTime      string `json:"weekly_summary_time"`
-	OpenAIKey              string `json:"open_ai_key"`
-	DiscordToken           string `json:"discord_token"`
-	DailySummaryChannelID  string `json:"daily_summary_channel_id"`
-	WeeklySummaryChannelID string `json:"weekly_summary_channel_id"`
-	OAuthDebugChannelID    string `json:"oauth_debug_channel_id"`
+	DailySummaryTime       string `json:"daily_summary_time" env:"REU_DAILY_TIME"`
+	WeeklySummaryDay       string `json:"weekly_summary_day" env:"REU_WEEKLY_DAY"`
+	WeeklySummaryTime      string `json:"weekly_summary_time" env:"REU_WEEKLY_TIME"`
+	OpenAIKey              string `json:"open_ai_key" env:"REU_OPENAI_KEY"`
+	OpenAIBaseURL          string `json:"open_ai_base_url" env:"REU_OPENAI_BASE_URL"`
+	OpenAIOrgID            string `json:"open_ai_org_id" env:"REU_OPENAI_ORG_ID"`
+	HTTPProxy              string `json:"http_proxy" env:"REU_HTTP_PROXY"`
+	RequestTimeout         string `json:"request_timeout" env:"REU_REQUEST_TIMEOUT"`
+	DiscordToken           string `json:"discord_token" env:"REU_DISCORD_TOKEN"`
+	DailySummaryChannelID  string `json:"daily_summary_channel_id" env:"REU_DAILY_CHANNEL_ID"`
+	WeeklySummaryChannelID string `json:"weekly_summary_channel_id" env:"REU_WEEKLY_CHANNEL_ID"`
+	OAuthDebugChannelID    string `json:"oauth_debug_channel_id" env:"REU_OAUTH_DEBUG_CHANNEL_ID"`
+	Timezone               string `json:"timezone" env:"REU_TIMEZONE"`
+	Locale                 string `json:"locale" env:"REU_LOCALE"`
+	LogFormat              string `json:"log_format" env:"REU_LOG_FORMAT"`
+	OAuthFlow              string `json:"oauth_flow" env:"REU_OAUTH_FLOW"`
+	OAuthTestingMode       bool   `json:"oauth_testing_mode" env:"REU_OAUTH_TESTING_MODE"`
+	OAuthExpiryWarningDays int    `json:"oauth_expiry_warning_days" env:"REU_OAUTH_EXPIRY_WARNING_DAYS"`
+	GmailAccount           int    `json:"gmail_account" env:"REU_GMAIL_ACCOUNT"`
+	FetchQuery             string `json:"fetch_query" env:"REU_FETCH_QUERY"`
+	DiscordFormat          string `json:"discord_format" env:"REU_DISCORD_FORMAT"`
+
+	GmailAccess *GmailAccessConfig `json:"gmail_access" env:"REU_GMAIL_ACCESS"`
+
+	// Profiles are named overrides of this config, run side by side in one process, see profile.go
+	Profiles map[string]json.RawMessage `json:"profiles" env:"REU_PROFILES"`
+
+	Webhooks      []WebhookConfig      `json:"webhooks" env:"REU_WEBHOOKS"`
+	Todoist       *TodoistConfig       `json:"todoist" env:"REU_TODOIST"`
+	TTS           *TTSConfig           `json:"tts" env:"REU_TTS"`
+	Mattermost    *MattermostConfig    `json:"mattermost" env:"REU_MATTERMOST"`
+	Teams         *TeamsConfig         `json:"teams" env:"REU_TEAMS"`
+	Twilio        *TwilioConfig        `json:"twilio" env:"REU_TWILIO"`
+	ContentFilter *ContentFilterConfig `json:"content_filter" env:"REU_CONTENT_FILTER"`
+
+	ArchiveSigning *ArchiveSigningConfig `json:"archive_signing" env:"REU_ARCHIVE_SIGNING"`
+	Retention      *RetentionConfig      `json:"retention" env:"REU_RETENTION"`
+	ReadReceipts   *ReadReceiptsConfig   `json:"read_receipts" env:"REU_READ_RECEIPTS"`
+
+	Rollups   *RollupsConfig   `json:"rollups" env:"REU_ROLLUPS"`
+	FollowUps *FollowUpsConfig `json:"follow_ups" env:"REU_FOLLOW_UPS"`
+	OCR       *OCRConfig       `json:"ocr" env:"REU_OCR"`
+	Vision    *VisionConfig    `json:"vision" env:"REU_VISION"`
+	Budget    *BudgetConfig    `json:"budget" env:"REU_BUDGET"`
+	Race      *RaceConfig      `json:"race" env:"REU_RACE"`
+	LowVolume *LowVolumeConfig `json:"low_volume" env:"REU_LOW_VOLUME"`
+	DaysOff   *DaysOffConfig   `json:"days_off" env:"REU_DAYS_OFF"`
+
+	WhatChanged *WhatChangedConfig `json:"what_changed" env:"REU_WHAT_CHANGED"`
+
+	MiniDigests    *MiniDigestsConfig    `json:"mini_digests" env:"REU_MINI_DIGESTS"`
+	SecurityAlerts *SecurityAlertsConfig `json:"security_alerts" env:"REU_SECURITY_ALERTS"`
+	VolumeAlerts   *VolumeAlertsConfig   `json:"volume_alerts" env:"REU_VOLUME_ALERTS"`
+	Recruiting     *RecruitingConfig     `json:"recruiting" env:"REU_RECRUITING"`
+	Bills          *BillsConfig          `json:"bills" env:"REU_BILLS"`
+	Travel         *TravelConfig         `json:"travel" env:"REU_TRAVEL"`
+	MailingLists   *MailingListsConfig   `json:"mailing_lists" env:"REU_MAILING_LISTS"`
+	Newsletters    *NewslettersConfig    `json:"newsletters" env:"REU_NEWSLETTERS"`
+	InboxZero      *InboxZeroConfig      `json:"inbox_zero" env:"REU_INBOX_ZERO"`
+	Approval       *ApprovalConfig       `json:"approval" env:"REU_APPROVAL"`
+
+	Embeddings *EmbeddingConfig `json:"embeddings" env:"REU_EMBEDDINGS"`
+	Ask        *AskConfig       `json:"ask" env:"REU_ASK"`
+
+	LLMRateLimit *RateLimitConfig `json:"llm_rate_limit" env:"REU_LLM_RATE_LIMIT"`
+	LLMQueue     *LLMQueueConfig  `json:"llm_queue" env:"REU_LLM_QUEUE"`
+
+	Rules          []RuleConfig     `json:"rules" env:"REU_RULES"`
+	Categories     []CategoryConfig `json:"categories" env:"REU_CATEGORIES"`
+	SenderFeedback bool             `json:"sender_feedback" env:"REU_SENDER_FEEDBACK"`
+
+	API     *APIConfig     `json:"api" env:"REU_API"`
+	GRPC    *GRPCConfig    `json:"grpc" env:"REU_GRPC"`
+	Metrics *MetricsConfig `json:"metrics" env:"REU_METRICS"`
+
+	Fixtures *FixturesConfig `json:"fixtures" env:"REU_FIXTURES"`
+
+	Storage *StorageConfig `json:"storage" env:"REU_STORAGE"`
+	Redis   *RedisConfig   `json:"redis" env:"REU_REDIS"`
+
+	EncryptionPassphrase        string `json:"encryption_passphrase" env:"REU_ENCRYPTION_PASSPHRASE"`
+	EncryptionPassphraseCommand string `json:"encryption_passphrase_command" env:"REU_ENCRYPTION_PASSPHRASE_COMMAND"`
 }
 
-func parseWeekday(day string) time.Weekday {
+func parseWeekday(day string) (time.Weekday, error) {
 	weekdays := map[string]time.Weekday{
-		"Sunday":    time.Sunday,
-		"Monday":    time.Monday,
-		"Tuesday":   time.Tuesday,
-		"Wednesday": time.Wednesday,
-		"Thursday":  time.Thursday,
-		"Friday":    time.Friday,
-		"Saturday":  time.Saturday,
+		"sunday":    time.Sunday,
+		"monday":    time.Monday,
+		"tuesday":   time.Tuesday,
+		"wednesday": time.Wednesday,
+		"thursday":  time.Thursday,
+		"friday":    time.Friday,
+		"saturday":  time.Saturday,
 	}
-	if weekday, ok := weekdays[day]; ok {
-		return weekday
+	if weekday, ok := weekdays[strings.ToLower(day)]; ok {
+		return weekday, nil
 	}
-	log.Error("Invalid weekday", "day", day)
-	return time.Sunday
+	// the weekday in another language, like "Montag" or "mercredi"
+	if weekday, ok := localizedWeekday(day); ok {
+		return weekday, nil
+	}
+	return time.Sunday, fmt.Errorf("invalid weekday %q", day)
 }
 
-func loadConfig() (*Config, error) {
-	log.Info("Loading configuration", "file", configFile)
-	f, err := os.Open(configFile)
+func loadConfig(path string) (*Config, error) {
+	log.Info("Loading configuration", "file", path)
+	config := &Config{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// everything can come from the environment or flags instead, e.g. when running in a container
+		log.Warn("Config file not found, relying on environment and flags", "file", path)
+		return config, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to open config file: %v", err)
 	}
 	defer closeFile(f, "config file")
 
-	config := &Config{}
 	if err := json.NewDecoder(f).Decode(config); err != nil {
 		return nil, fmt.Errorf("unable to parse config file: %v", err)
 	}
@@ -63,67 +150,106 @@ func loadConfig() (*Config, error) {
 	return config, nil
 }
 
-func getLastFetchTime() time.Time {
-	log.Info("Retrieving last fetch time", "file", lastFetchFile)
-	f, err := os.Open(lastFetchFile)
-	if err != nil {
-		log.Warn("Last fetch file not found, defaulting to 1 day ago")
-		return time.Now().AddDate(0, 0, -1)
-	}
-	defer closeFile(f, "last fetch file")
-
+func (a *App) getLastFetchTime() time.Time {
+	log.Info("Retrieving last fetch time")
 	var lastFetchTime time.Time
-	if err := json.NewDecoder(f).Decode(&lastFetchTime); err != nil {
-		log.Fatal("Unable to parse last fetch time", "error", err)
+	a.state.read(func(s *State) {
+		lastFetchTime = s.account().LastFetch
+	})
+
+	if lastFetchTime.IsZero() {
+		now := a.Clock.Now()
+		yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location())
+		log.Warn("No last fetch time recorded, defaulting to the start of yesterday", "time", yesterday)
+		return yesterday
 	}
 
 	log.Info("Last fetch time retrieved", "time", lastFetchTime)
 	return lastFetchTime
 }
 
-func updateLastFetchTime(fetchTime time.Time) {
-	log.Info("Updating last fetch time", "time", fetchTime)
-	f, err := os.Create(lastFetchFile)
-	if err != nil {
-		log.Fatal("Unable to save last fetch time", "error", err)
+func (a *App) getClient(oauthConfig *oauth2.Config) (*http.Client, error) {
+	tok, err := a.state.loadToken()
+	var missing []string
+	if err == nil {
+		var granted []string
+		a.state.read(func(s *State) {
+			granted = grantedOrDefault(s.account().Scopes)
+		})
+		missing = scopeDifference(oauthConfig.Scopes, granted)
+		if extra := scopeDifference(granted, oauthConfig.Scopes); len(extra) > 0 {
+			log.Warn("The Gmail token has access no enabled feature needs, run `reads_ur_emails auth --force` to drop it", "scopes", scopeNames(extra))
+		}
 	}
-	defer closeFile(f, "last fetch file")
-
-	if err := json.NewEncoder(f).Encode(fetchTime); err != nil {
-		log.Error("Failed to encode last fetch time", "error", err)
+	if len(missing) > 0 {
+		log.Warn("Enabled features need more Gmail access, asking for consent again", "scopes", scopeNames(missing), "flow", a.oauthFlow())
+	}
+	if err != nil || !tok.Valid() || len(missing) > 0 {
+		if a.reauthorizing.Load() {
+			// the flow is already waiting on the user in the background
+			return nil, errReauthorizing
+		}
+		log.Warn("Token not found or invalid, obtaining a new one", "flow", a.oauthFlow())
+		if tok, err = a.obtainToken(a.oauthContext(context.Background()), oauthConfig); err != nil {
+			return nil, err
+		}
 	} else {
-		log.Info("Last fetch time updated successfully")
+		log.Info("Using existing valid token")
 	}
+	return oauthConfig.Client(a.oauthContext(context.Background()), tok), nil
 }
 
-func getClient(config *oauth2.Config) *http.Client {
-	tok, err := tokenFromFile(tokenFile)
-	if err != nil || !tok.Valid() {
-		log.Warn("Token not found or invalid, obtaining a new one")
-		tok = getTokenFromWeb(config)
-		saveToken(tokenFile, tok)
-	} else {
-		log.Info("Using existing valid token")
+// obtainToken runs the configured OAuth flow and saves the token it gets, with the scopes the user granted
+func (a *App) obtainToken(ctx context.Context, oauthConfig *oauth2.Config) (*oauth2.Token, error) {
+	var tok *oauth2.Token
+	var err error
+	switch a.oauthFlow() {
+	case "discord":
+		tok, err = a.getTokenFromWeb(ctx, oauthConfig)
+	case "loopback":
+		tok, err = getTokenFromLoopback(ctx, oauthConfig)
+	case "paste":
+		tok, err = getTokenFromTerminal(ctx, oauthConfig)
+	default:
+		err = fmt.Errorf("unknown oauth_flow %q, must be discord, loopback or paste", a.oauthFlow())
 	}
-	return config.Client(context.Background(), tok)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.state.saveToken(tok); err != nil {
+		return nil, err
+	}
+	granted := grantedScopes(tok, oauthConfig.Scopes)
+	if err := a.state.update(func(s *State) {
+		s.account().Scopes = granted
+	}); err != nil {
+		return nil, fmt.Errorf("saving granted scopes: %w", err)
+	}
+	if missing := scopeDifference(oauthConfig.Scopes, granted); len(missing) > 0 {
+		log.Warn("Some Gmail access was not granted, the features needing it stay off", "scopes", scopeNames(missing))
+	}
+	return tok, nil
 }
 
-func getTokenFromWeb(oauthConfig *oauth2.Config) *oauth2.Token {
-	authURL := oauthConfig.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+// getTokenFromWeb asks for the authorization code on the OAuth debug channel, and waits for it until ctx is done
+func (a *App) getTokenFromWeb(ctx context.Context, oauthConfig *oauth2.Config) (*oauth2.Token, error) {
+	authURL := oauthConfig.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
 
 	// Send the auth URL to the debug channel on Discord
-	err := sendToDiscord(config.OAuthDebugChannelID, fmt.Sprintf("OAuth token has expired. Please authorize this app by visiting the following URL and provide the authorization code here: %s", authURL))
+	err := a.sendToDiscord(a.oauthChannel(), fmt.Sprintf("OAuth token has expired. Please authorize this app by visiting the following URL and provide the authorization code here: %s", authURL))
 	if err != nil {
-		log.Fatal("Unable to send OAuth request to Discord", "error", err)
+		return nil, fmt.Errorf("sending OAuth request to Discord: %w", err)
 	}
+	a.sendSMSAlert("reads_ur_emails: Gmail authorization has expired. Check Discord to re-authorize.")
 
 	log.Info("Waiting for user to provide authorization code in Discord...")
 
-	// Set up a channel to receive the authorization code from Discord
-	authCodeChan := make(chan string)
+	// Set up a channel to receive the authorization code from Discord. the handler never blocks, once a code is in it
+	// drops the rest
+	authCodeChan := make(chan string, 1)
 
 	// Inside your message handler
-	discordSession.AddHandlerOnce(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	removeHandler := a.Discord.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
 		// Check if the message starts with a mention of the bot
 		if strings.HasPrefix(m.Content, "<@"+s.State.User.ID+">") {
 			// Remove the mention part
@@ -132,110 +258,211 @@ func getTokenFromWeb(oauthConfig *oauth2.Config) *oauth2.Token {
 			log.Info("Message received", "original content", m.Content, "stripped content", messageContent)
 
 			// Process the stripped message content
-			if m.ChannelID == config.OAuthDebugChannelID && m.Author != nil && !m.Author.Bot {
-				authCodeChan <- messageContent
+			if m.ChannelID == a.oauthChannel() && m.Author != nil && !m.Author.Bot {
+				select {
+				case authCodeChan <- messageContent:
+				default:
+				}
 			}
 		}
 	})
+	defer removeHandler()
 
 	// Wait for the authorization code
-	authCode := <-authCodeChan
+	var authCode string
+	select {
+	case authCode = <-authCodeChan:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for the authorization code: %w", ctx.Err())
+	}
 
 	// Exchange the authorization code for a token
-	tok, err := oauthConfig.Exchange(context.Background(), authCode)
+	tok, err := oauthConfig.Exchange(ctx, authCode)
 	if err != nil {
-		log.Fatal("Unable to retrieve token from web", "error", err)
+		return nil, fmt.Errorf("exchanging authorization code: %w", err)
 	}
 
-	// Notify the user of success
-	err = sendToDiscord(config.OAuthDebugChannelID, "OAuth token successfully retrieved and saved.")
+	// Notify the user of success. the token is still good if this fails, so it isn't worth failing over
+	err = a.sendToDiscord(a.oauthChannel(), "OAuth token successfully retrieved and saved.")
 	if err != nil {
-		log.Fatal("Unable to send OAuth success message to Discord", "error", err)
+		log.Warn("Unable to send OAuth success message to Discord", "error", err)
 	}
 
-	return tok
+	return tok, nil
 }
 
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	log.Info("Loading token from file", "file", file)
-	f, err := os.Open(file)
+// getTokenFromTerminal is the Discord-less version of getTokenFromWeb, for headless machines where the loopback flow
+// can't open a browser
+func getTokenFromTerminal(ctx context.Context, oauthConfig *oauth2.Config) (*oauth2.Token, error) {
+	authURL := oauthConfig.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	fmt.Printf("Authorize this app by visiting the following URL, then paste the authorization code here:\n%s\n> ", authURL)
+
+	var authCode string
+	if _, err := fmt.Scanln(&authCode); err != nil {
+		return nil, fmt.Errorf("reading authorization code: %w", err)
+	}
+
+	tok, err := oauthConfig.Exchange(ctx, authCode)
 	if err != nil {
-		log.Error("Failed to open token file", "file", file, "error", err)
-		return nil, err
+		return nil, fmt.Errorf("exchanging authorization code: %w", err)
 	}
-	defer closeFile(f, "token file")
+	return tok, nil
+}
 
-	tok := &oauth2.Token{}
-	if err := json.NewDecoder(f).Decode(tok); err != nil {
-		log.Error("Failed to decode token", "error", err)
-		return nil, err
+func (st *stateStore) loadToken() (*oauth2.Token, error) {
+	log.Info("Loading token from state")
+	var tok *oauth2.Token
+	st.read(func(s *State) {
+		tok = s.account().Token
+	})
+
+	if tok == nil {
+		log.Error("No token saved")
+		return nil, errors.New("no OAuth token saved")
 	}
 	log.Info("Token loaded successfully")
 	return tok, nil
 }
 
-func saveToken(path string, token *oauth2.Token) {
-	log.Info("Saving OAuth token", "path", path)
-	f, err := os.Create(path)
+func (st *stateStore) saveToken(token *oauth2.Token) error {
+	log.Info("Saving OAuth token")
+	if err := st.update(func(s *State) {
+		a := s.account()
+		// refreshes keep the old refresh token, so a different one means the user went through the consent screen again
+		if a.Token == nil || a.Token.RefreshToken != token.RefreshToken {
+			a.TokenIssuedAt = time.Now()
+			a.TokenExpiryWarned = false
+		}
+		a.Token = token
+	}); err != nil {
+		return fmt.Errorf("saving OAuth token: %w", err)
+	}
+	log.Info("Token saved successfully")
+	return nil
+}
+
+// loadOAuthConfig reads the Google client credentials from credentialsFile, asking for the given scopes
+func loadOAuthConfig(scopes ...string) (*oauth2.Config, error) {
+	b, err := os.ReadFile(credentialsFile)
 	if err != nil {
-		log.Fatal("Unable to save OAuth token", "error", err)
+		return nil, fmt.Errorf("unable to read client secret file: %w", err)
 	}
-	defer closeFile(f, "token file")
 
-	if err := json.NewEncoder(f).Encode(token); err != nil {
-		log.Error("Failed to encode token", "error", err)
-	} else {
-		log.Info("Token saved successfully")
+	config, err := google.ConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %w", err)
 	}
+	return config, nil
 }
 
-func createOAuthClient() *http.Client {
+func (a *App) createOAuthClient() (*http.Client, error) {
+	if replayingFixtures() {
+		return withFixtures(&http.Client{}), nil
+	}
+
 	log.Info("Creating OAuth client")
-	b, err := os.ReadFile(credentialsFile)
+	config, err := loadOAuthConfig(a.gmailScopes()...)
 	if err != nil {
-		log.Fatal("Unable to read client secret file", "error", err)
+		return nil, err
 	}
-
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	client, err := a.getClient(config)
 	if err != nil {
-		log.Fatal("Unable to parse client secret file to config", "error", err)
+		return nil, err
 	}
-
-	return getClient(config)
+	return withFixtures(client), nil
 }
 
-func fetchEmails(client *http.Client, after time.Time) ([]*gmail.Message, error) {
-	log.Info("Fetching emails", "after", after)
-	srv, err := gmail.NewService(context.Background(), option.WithHTTPClient(client))
+// fetchEmails returns the messages matching a Gmail search query
+func fetchEmails(ctx context.Context, client *http.Client, query string) ([]*gmail.Message, error) {
+	logger := log.FromContext(ctx)
+	logger.Info("Fetching emails", "query", query)
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve Gmail client: %v", err)
 	}
 
-	query := fmt.Sprintf("after:%d", after.Unix())
-	r, err := srv.Users.Messages.List("me").Q(query).Do()
+	r, err := srv.Users.Messages.List("me").Q(query).Context(ctx).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve messages: %v", err)
+		return nil, fmt.Errorf("unable to retrieve messages: %w", err)
 	}
 
 	if len(r.Messages) == 0 {
-		log.Info("No new messages found")
+		logger.Info("No new messages found")
 		return nil, nil
 	}
 
 	var messages []*gmail.Message
 	for _, m := range r.Messages {
-		msg, err := srv.Users.Messages.Get("me", m.Id).Do()
+		msg, err := srv.Users.Messages.Get("me", m.Id).Context(ctx).Do()
 		if err != nil {
-			return nil, fmt.Errorf("unable to retrieve message: %v", err)
+			return nil, fmt.Errorf("unable to retrieve message: %w", err)
 		}
 		messages = append(messages, msg)
-		log.Info("Fetched message", "id", msg.Id, "snippet", msg.Snippet)
+		logger.Info("Fetched message", "message_id", msg.Id, "snippet", msg.Snippet)
 	}
 
-	log.Info("Total messages fetched", "count", len(messages))
+	logger.Info("Total messages fetched", "count", len(messages))
+	recordEmailsFetched(len(messages))
 	return messages, nil
 }
 
+func fetchMessage(ctx context.Context, client *http.Client, id string) (*gmail.Message, error) {
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Gmail client: %v", err)
+	}
+
+	message, err := srv.Users.Messages.Get("me", id).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve message: %w", err)
+	}
+	return message, nil
+}
+
+func fetchLabels(ctx context.Context, client *http.Client) (map[string]string, error) {
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Gmail client: %v", err)
+	}
+
+	r, err := srv.Users.Labels.List("me").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve labels: %w", err)
+	}
+
+	labels := make(map[string]string, len(r.Labels))
+	for _, label := range r.Labels {
+		labels[label.Id] = label.Name
+	}
+	return labels, nil
+}
+
+func fetchAttachment(ctx context.Context, client *http.Client, messageID, attachmentID string) ([]byte, error) {
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Gmail client: %v", err)
+	}
+
+	attachment, err := srv.Users.Messages.Attachments.Get("me", messageID, attachmentID).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve attachment: %w", err)
+	}
+	return base64.URLEncoding.DecodeString(attachment.Data)
+}
+
+func sendEmail(ctx context.Context, client *http.Client, raw []byte, threadID string) error {
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return fmt.Errorf("unable to retrieve Gmail client: %v", err)
+	}
+
+	message := &gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw), ThreadId: threadID}
+	if _, err := srv.Users.Messages.Send("me", message).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to send email: %w", err)
+	}
+	return nil
+}
+
 func loadFile(path string) (string, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -244,26 +471,64 @@ func loadFile(path string) (string, error) {
 	return string(data), nil
 }
 
-func loadUserContext() (string, error) {
-	return loadFile("user_context.md")
+func loadUserContext(dir string) (string, error) {
+	return loadFile(profileFile(dir, "user_context.md"))
 }
 
-func loadTemplate(templateName string) (string, error) {
-	return loadFile("templates/" + templateName)
+func loadTemplate(dir, templateName string) (string, error) {
+	return loadFile(profileFile(dir, filepath.Join("templates", templateName)))
 }
 
-func callOpenAI(messages []openai.ChatCompletionMessage) (string, error) {
-	resp, err := openAIClient.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:    openai.GPT4o,
-			Messages: messages,
-		},
-	)
+// writeFileAtomic replaces path with data without ever leaving a truncated or half-written file behind: the data is
+// written and fsynced to a temp file in the same directory, which is then renamed over path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
 	if err != nil {
-		return "", fmt.Errorf("ChatCompletion error: %v", err)
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	tmp := f.Name()
+
+	// Clean up the temp file if anything goes wrong before the rename
+	success := false
+	defer func() {
+		if !success {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("writing temp file: %w", err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		return fmt.Errorf("setting permissions: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing temp file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("renaming temp file: %w", err)
+	}
+	success = true
+
+	// Sync the directory so the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		if err := d.Sync(); err != nil {
+			log.Warn("Failed to sync directory", "dir", dir, "error", err)
+		}
+		closeFile(d, "state directory")
 	}
-	return resp.Choices[0].Message.Content, nil
+
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
 
 func closeFile(f *os.File, description string) {
@@ -272,17 +537,114 @@ func closeFile(f *os.File, description string) {
 	}
 }
 
-func sendToDiscord(channelID string, message string) error {
-	const maxMessageLength = 2000
+// maxDiscordMessageLength is the most characters Discord accepts in one message
+const maxDiscordMessageLength = 2000
+
+func (a *App) sendToDiscord(channelID string, message string) error {
+	_, err := a.postToDiscord(channelID, message, nil)
+	return err
+}
+
+// postToDiscord sends message in as many chunks as it takes, the first one as a reply to reference if that isn't nil,
+// and returns the first chunk
+func (a *App) postToDiscord(channelID, message string, reference *discordgo.MessageReference) (*discordgo.Message, error) {
+	var first *discordgo.Message
+	for _, chunk := range splitMessage(discordTables(message), maxDiscordMessageLength) {
+		sent, err := a.Discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: chunk, Reference: reference})
+		if err != nil {
+			return first, fmt.Errorf("sending message chunk to Discord: %w", err)
+		}
+		if first == nil {
+			first = sent
+		}
+		reference = nil
+	}
+	return first, nil
+}
+
+// digestMessages are the messages a digest is posted as in channelID, the way discord_format says: its Markdown in as
+// many chunks as it takes, or its embeds in groups
+func (a *App) digestMessages(channelID string, digest *Digest) []*discordgo.MessageSend {
+	digest = a.filterForChannel(channelID, digest)
+	var messages []*discordgo.MessageSend
+	if a.Config.DiscordFormat != "embeds" {
+		for _, chunk := range splitMessage(discordTables(renderDiscord(digest)), maxDiscordMessageLength) {
+			messages = append(messages, &discordgo.MessageSend{Content: chunk})
+		}
+		return messages
+	}
+	for _, embeds := range groupEmbeds(renderEmbeds(digest)) {
+		messages = append(messages, &discordgo.MessageSend{Embeds: embeds})
+	}
+	return messages
+}
+
+// postDigest posts a digest and returns its first message. when Discord refuses one of its messages, the ones already
+// posted are deleted, so posting it again doesn't repeat them
+func (a *App) postDigest(channelID string, digest *Digest, reference *discordgo.MessageReference) (*discordgo.Message, error) {
+	sent, err := a.resumeDigest(channelID, digest, reference, nil)
+	if err != nil {
+		a.deleteMessages(channelID, sent)
+		return nil, err
+	}
+	return firstMessage(channelID, sent), nil
+}
 
-	// Helper function to send a chunk of the message
-	sendChunk := func(chunk string) error {
-		_, err := discordSession.ChannelMessageSend(channelID, chunk)
+// resumeDigest posts the messages of a digest after the ones in sent, the ids of those an earlier try posted, and
+// returns the ids of all that are posted, the ones before the failure when Discord refuses one. the first message
+// replies to reference
+func (a *App) resumeDigest(channelID string, digest *Digest, reference *discordgo.MessageReference, sent []string) ([]string, error) {
+	sent = append([]string(nil), sent...)
+	messages := a.digestMessages(channelID, digest)
+	for i := len(sent); i < len(messages); i++ {
+		if i == 0 {
+			messages[i].Reference = reference
+		}
+		posted, err := a.Discord.ChannelMessageSendComplex(channelID, messages[i])
 		if err != nil {
-			return fmt.Errorf("sending message chunk to Discord: %w", err)
+			return sent, fmt.Errorf("sending digest message %d of %d to Discord: %w", i+1, len(messages), err)
 		}
+		sent = append(sent, posted.ID)
+	}
+	return sent, nil
+}
+
+// firstMessage is the first of the messages with these ids, nil when there are none
+func firstMessage(channelID string, ids []string) *discordgo.Message {
+	if len(ids) == 0 {
 		return nil
 	}
+	return &discordgo.Message{ID: ids[0], ChannelID: channelID}
+}
+
+// deleteMessages deletes what's left of a digest that didn't get posted whole
+func (a *App) deleteMessages(channelID string, ids []string) {
+	for _, id := range ids {
+		if err := a.Discord.ChannelMessageDelete(channelID, id); err != nil {
+			log.Error("Unable to delete part of a digest that didn't get posted", "channel_id", channelID, "message_id", id, "error", err)
+		}
+	}
+}
+
+// discordMessageURL links to a message, or returns "" when the channel can't be looked up
+func (a *App) discordMessageURL(channelID, messageID string) string {
+	guildID := "@me"
+	channel, err := a.Discord.State.Channel(channelID)
+	if err != nil {
+		if channel, err = a.Discord.Channel(channelID); err != nil {
+			log.Error("Unable to look up Discord channel", "channel_id", channelID, "error", err)
+			return ""
+		}
+	}
+	if channel.GuildID != "" {
+		guildID = channel.GuildID
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, channelID, messageID)
+}
+
+// splitMessage breaks message into chunks of at most maxLength, splitting on newlines where it can
+func splitMessage(message string, maxLength int) []string {
+	var chunks []string
 
 	// Split the message by newlines first
 	lines := splitByNewlines(message)
@@ -291,34 +653,26 @@ func sendToDiscord(channelID string, message string) error {
 
 	for _, line := range lines {
 		// If the line itself is too long, we need to split it further
-		if len(line) > maxMessageLength {
-			// Split the long line into chunks of maxMessageLength
-			for len(line) > 0 {
-				if len(line) > maxMessageLength {
-					// Take a chunk of the max length
-					chunk := line[:maxMessageLength]
-					// Send the chunk
-					if err := sendChunk(chunk); err != nil {
-						return err
-					}
-					// Reduce the line by the chunk we just sent
-					line = line[maxMessageLength:]
-				} else {
-					// If the remaining line is within the limit, send it and break
-					if err := sendChunk(line); err != nil {
-						return err
-					}
-					line = ""
-				}
+		if len(line) > maxLength {
+			// Flush what we have so far to keep the order of lines
+			if currentChunk != "" {
+				chunks = append(chunks, currentChunk)
+				currentChunk = ""
+			}
+			// Split the long line into chunks of maxLength
+			for len(line) > maxLength {
+				chunks = append(chunks, line[:maxLength])
+				line = line[maxLength:]
+			}
+			if line != "" {
+				chunks = append(chunks, line)
 			}
 			continue
 		}
 
-		// If adding this line would exceed the max length, send the current chunk and start a new one
-		if len(currentChunk)+len(line)+1 > maxMessageLength {
-			if err := sendChunk(currentChunk); err != nil {
-				return err
-			}
+		// If adding this line would exceed the max length, start a new chunk
+		if currentChunk != "" && len(currentChunk)+len(line)+1 > maxLength {
+			chunks = append(chunks, currentChunk)
 			currentChunk = line
 		} else {
 			// Otherwise, add the line to the current chunk
@@ -329,14 +683,12 @@ func sendToDiscord(channelID string, message string) error {
 		}
 	}
 
-	// Send any remaining chunk
+	// Keep any remaining chunk
 	if currentChunk != "" {
-		if err := sendChunk(currentChunk); err != nil {
-			return err
-		}
+		chunks = append(chunks, currentChunk)
 	}
 
-	return nil
+	return chunks
 }
 
 // Helper function to split a string by newlines and return a slice of strings
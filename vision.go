@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// defaultVisionMaxImages is the image budget of one digest, each image costs as much as a short email
+	defaultVisionMaxImages = 5
+	// defaultVisionMinTextLength is how short a body has to be for its images to be worth looking at
+	defaultVisionMinTextLength = 200
+	// maxVisionImagesPerEmail keeps one email from spending the whole budget
+	maxVisionImagesPerEmail = 2
+	// maxVisionImageSize is the largest image OpenAI accepts
+	maxVisionImageSize = 20 << 20
+)
+
+type VisionConfig struct {
+	MaxImages     int    `json:"max_images"`
+	MinTextLength int    `json:"min_text_length"`
+	Detail        string `json:"detail"`
+}
+
+// emailImage is an image from an email, for the model to look at alongside the text
+type emailImage struct {
+	mimeType string
+	data     []byte
+}
+
+type emailImagesKey struct{}
+
+// withEmailImages attaches the images, by message id, that the summarizer sends along with each email
+func withEmailImages(ctx context.Context, images map[string][]emailImage) context.Context {
+	return context.WithValue(ctx, emailImagesKey{}, images)
+}
+
+func emailImagesFromContext(ctx context.Context) map[string][]emailImage {
+	images, _ := ctx.Value(emailImagesKey{}).(map[string][]emailImage)
+	return images
+}
+
+// withVisionImages picks the images of the emails whose text says too little, biggest first since those are the
+// screenshots and scans rather than logos, until the digest's image budget is spent
+func (a *App) withVisionImages(ctx context.Context, messages []*gmail.Message) context.Context {
+	if a.Config.Vision == nil {
+		return ctx
+	}
+	logger := log.FromContext(ctx)
+
+	budget, minTextLength := defaultVisionMaxImages, defaultVisionMinTextLength
+	if a.Config.Vision.MaxImages > 0 {
+		budget = a.Config.Vision.MaxImages
+	}
+	if a.Config.Vision.MinTextLength > 0 {
+		minTextLength = a.Config.Vision.MinTextLength
+	}
+
+	images := make(map[string][]emailImage)
+	used := 0
+	for _, message := range messages {
+		if used == budget {
+			logger.Info("Image budget spent, the remaining emails are summarized from their text", "budget", budget)
+			break
+		}
+		if message.Payload == nil || len(strings.TrimSpace(extractBody(message))) >= minTextLength {
+			continue
+		}
+
+		parts := imageParts(message.Payload)
+		sort.SliceStable(parts, func(i, j int) bool {
+			return parts[i].Body.Size > parts[j].Body.Size
+		})
+		for _, part := range parts {
+			if len(images[message.Id]) == maxVisionImagesPerEmail || used == budget {
+				break
+			}
+			if part.Body.Size > maxVisionImageSize {
+				continue
+			}
+			data, err := a.partData(ctx, message.Id, part)
+			if err != nil {
+				logger.Error("Failed to read image", "message_id", message.Id, "filename", part.Filename, "error", err)
+				continue
+			}
+			images[message.Id] = append(images[message.Id], emailImage{mimeType: part.MimeType, data: data})
+			used++
+		}
+	}
+	if used == 0 {
+		return ctx
+	}
+
+	logger.Info("Sending images to the vision model", "emails", len(images), "images", used)
+	return withEmailImages(ctx, images)
+}
+
+// imageMessage is a user message with images after the text, for a vision model
+func imageMessage(text string, images []emailImage, detail openai.ImageURLDetail) openai.ChatCompletionMessage {
+	parts := []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: text}}
+	for _, image := range images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				URL:    imageDataURL(image.mimeType, image.data),
+				Detail: detail,
+			},
+		})
+	}
+	return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, MultiContent: parts}
+}
+
+// imageDataURL inlines an image, so the model doesn't need access to Gmail to see it
+func imageDataURL(mimeType string, data []byte) string {
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/charmbracelet/log"
+	"github.com/wcharczuk/go-chart/v2"
+	"github.com/wcharczuk/go-chart/v2/drawing"
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxVolumeDays is how much volume history is kept
+const maxVolumeDays = 120
+
+// VolumeDay counts the emails fetched on one day, by sender and by category. categories are only known when digest
+// entries are extracted
+type VolumeDay struct {
+	Date       string         `json:"date"` // Date is YYYY-MM-DD in the configured timezone
+	Emails     int            `json:"emails"`
+	Senders    map[string]int `json:"senders"`
+	Categories map[string]int `json:"categories"`
+}
+
+// recordVolume adds a daily digest's emails to the volume history
+func (st *stateStore) recordVolume(now time.Time, messages []*gmail.Message, categories map[string]int) error {
+	date := now.Format(time.DateOnly)
+
+	return st.update(func(s *State) {
+		account := s.account()
+		if n := len(account.Volume); n == 0 || account.Volume[n-1].Date != date {
+			account.Volume = append(account.Volume, VolumeDay{
+				Date:       date,
+				Senders:    make(map[string]int),
+				Categories: make(map[string]int),
+			})
+		}
+		day := &account.Volume[len(account.Volume)-1]
+
+		day.Emails += len(messages)
+		for _, message := range messages {
+			day.Senders[senderName(extractHeader(message, "From"))]++
+		}
+		for category, n := range categories {
+			day.Categories[category] += n
+		}
+
+		if len(account.Volume) > maxVolumeDays {
+			account.Volume = account.Volume[len(account.Volume)-maxVolumeDays:]
+		}
+	})
+}
+
+// senderName is the display name of a From header, or the address when there isn't one
+func senderName(from string) string {
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return strings.TrimSpace(from)
+	}
+	if address.Name != "" {
+		return address.Name
+	}
+	return address.Address
+}
+
+// VolumeStats compares the last 7 days with the 7 before
+type VolumeStats struct {
+	Emails         int
+	PreviousEmails int
+	TopSender      string
+	TopSenderCount int
+	TopCategory    string
+
+	// Categories are this week's email counts by category
+	Categories map[string]int
+
+	// Daily is the email count of each of the last 14 days, oldest first, from Start
+	Daily [14]int
+	Start time.Time
+}
+
+func (st *stateStore) weeklyVolumeStats(now time.Time) VolumeStats {
+	var stats VolumeStats
+	senders := make(map[string]int)
+	categories := make(map[string]int)
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	st.read(func(s *State) {
+		for _, day := range s.account().Volume {
+			date, err := time.ParseInLocation(time.DateOnly, day.Date, now.Location())
+			if err != nil {
+				continue
+			}
+			// days back from today, 0 is today. rounded, since a day across a DST change is 23 or 25 hours
+			age := int(math.Round(today.Sub(date).Hours() / 24))
+			if age < 0 || age >= len(stats.Daily) {
+				continue
+			}
+
+			stats.Daily[len(stats.Daily)-1-age] = day.Emails
+			if age >= 7 {
+				stats.PreviousEmails += day.Emails
+				continue
+			}
+			stats.Emails += day.Emails
+			for sender, n := range day.Senders {
+				senders[sender] += n
+			}
+			for category, n := range day.Categories {
+				categories[category] += n
+			}
+		}
+	})
+
+	stats.Start = today.AddDate(0, 0, 1-len(stats.Daily))
+	stats.TopSender, stats.TopSenderCount = mostFrequent(senders)
+	stats.TopCategory, _ = mostFrequent(categories)
+	stats.Categories = categories
+	return stats
+}
+
+// mostFrequent returns the key with the highest count, breaking ties alphabetically
+func mostFrequent(counts map[string]int) (string, int) {
+	var top string
+	var topCount int
+	for _, key := range sortedKeys(counts) {
+		if counts[key] > topCount {
+			top, topCount = key, counts[key]
+		}
+	}
+	return top, topCount
+}
+
+// String is the one-line stats section, e.g. "42 emails, +20% vs last week, top sender: Jira (12)"
+func (v VolumeStats) String() string {
+	parts := []string{fmt.Sprintf("%d emails", v.Emails)}
+	if v.PreviousEmails > 0 {
+		change := float64(v.Emails-v.PreviousEmails) / float64(v.PreviousEmails) * 100
+		parts = append(parts, fmt.Sprintf("%+.0f%% vs last week", change))
+	}
+	if v.TopSender != "" {
+		parts = append(parts, fmt.Sprintf("top sender: %s (%d)", v.TopSender, v.TopSenderCount))
+	}
+	if v.TopCategory != "" {
+		parts = append(parts, "top category: "+v.TopCategory)
+	}
+	return strings.Join(parts, ", ")
+}
+
+var (
+	chartBackground = drawing.Color{R: 0x2b, G: 0x2d, B: 0x31, A: 0xff}
+	chartText       = drawing.Color{R: 0xdb, G: 0xde, B: 0xe1, A: 0xff}
+	chartAxis       = drawing.Color{R: 0xb5, G: 0xba, B: 0xc1, A: 0xff}
+	chartPrevious   = drawing.Color{R: 0x80, G: 0x84, B: 0x8e, A: 0xff}
+	chartCurrent    = drawing.Color{R: 0x58, G: 0x65, B: 0xf2, A: 0xff}
+)
+
+// categoryColors are the colors of the category breakdown's bars, in order
+var categoryColors = []drawing.Color{
+	{R: 0x55, G: 0xac, B: 0xee, A: 0xff},
+	{R: 0x78, G: 0xb1, B: 0x59, A: 0xff},
+	{R: 0xfd, G: 0xcb, B: 0x58, A: 0xff},
+	{R: 0xf4, G: 0x90, B: 0x0c, A: 0xff},
+	{R: 0xdd, G: 0x2e, B: 0x44, A: 0xff},
+	{R: 0xaa, G: 0x8e, B: 0xd6, A: 0xff},
+	{R: 0xc1, G: 0x69, B: 0x4f, A: 0xff},
+}
+
+// categoryShare is one category's slice of the breakdown
+type categoryShare struct {
+	name  string
+	count int
+	fill  drawing.Color
+}
+
+// categoryBreakdown sorts the categories by count, folding those past the palette into "other"
+func categoryBreakdown(categories map[string]int) []categoryShare {
+	var names []string
+	for _, name := range sortedKeys(categories) {
+		if categories[name] > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool { return categories[names[i]] > categories[names[j]] })
+
+	var shares []categoryShare
+	for i, name := range names {
+		share := categoryShare{name: name, count: categories[name]}
+		last := i == len(categoryColors)-1
+		if last && len(names) > len(categoryColors) {
+			share.name = "other"
+			for _, rest := range names[i+1:] {
+				share.count += categories[rest]
+			}
+		}
+		share.fill = categoryColors[i]
+		shares = append(shares, share)
+		if last {
+			break
+		}
+	}
+	return shares
+}
+
+// the sizes of the volume chart's two parts, side by side
+const (
+	dailyChartWidth    = 640
+	categoryChartWidth = 400
+	volumeChartHeight  = 320
+)
+
+// renderVolumeChart draws the daily counts as a bar chart, the previous week in grey and the last 7 days in blue, each
+// bar labelled with its day and count, and next to it this week's categories as bars of their own. both have their
+// counts up the side
+func renderVolumeChart(stats VolumeStats) ([]byte, error) {
+	bars := make([]chart.Value, len(stats.Daily))
+	for i, n := range stats.Daily {
+		fill := chartCurrent
+		if i < len(stats.Daily)-7 {
+			fill = chartPrevious
+		}
+		day := stats.Start.AddDate(0, 0, i)
+		bars[i] = chart.Value{Value: float64(n), Label: fmt.Sprintf("%s\n%d", day.Format("Mon 2"), n), Style: chart.Style{FillColor: fill, StrokeColor: fill}}
+	}
+	daily, err := renderBarChart("Emails per day", dailyChartWidth, bars)
+	if err != nil {
+		return nil, fmt.Errorf("rendering the daily chart: %w", err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, dailyChartWidth, volumeChartHeight))
+	shares := categoryBreakdown(stats.Categories)
+	if len(shares) > 0 {
+		bars := make([]chart.Value, len(shares))
+		for i, share := range shares {
+			bars[i] = chart.Value{Value: float64(share.count), Label: fmt.Sprintf("%s\n%d", share.name, share.count), Style: chart.Style{FillColor: share.fill, StrokeColor: share.fill}}
+		}
+		categories, err := renderBarChart("Categories this week", categoryChartWidth, bars)
+		if err != nil {
+			return nil, fmt.Errorf("rendering the category chart: %w", err)
+		}
+		img = image.NewRGBA(image.Rect(0, 0, dailyChartWidth+categoryChartWidth, volumeChartHeight))
+		draw.Draw(img, categories.Bounds().Add(image.Pt(dailyChartWidth, 0)), categories, image.Point{}, draw.Src)
+	}
+	draw.Draw(img, daily.Bounds(), daily, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encoding chart: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderBarChart draws bars in the chart's colors, with whole numbers up the side from 0, so a week without emails
+// still has an axis
+func renderBarChart(title string, width int, bars []chart.Value) (image.Image, error) {
+	peak := 1.0
+	for _, bar := range bars {
+		peak = math.Max(peak, bar.Value)
+	}
+	step := math.Ceil(peak / 5)
+	var ticks []chart.Tick
+	for v := 0.0; v < peak+step; v += step {
+		ticks = append(ticks, chart.Tick{Value: v, Label: fmt.Sprintf("%.0f", v)})
+	}
+
+	// each bar's share of the width inside the padding, which its label has too
+	slot := (width - 56) / len(bars)
+	c := chart.BarChart{
+		Title:      title,
+		TitleStyle: chart.Style{FontColor: chartText, FontSize: 11},
+		Width:      width,
+		Height:     volumeChartHeight,
+		// the labels under the bars are drawn in the bottom padding, the day or category and the count below it
+		Background: chart.Style{FillColor: chartBackground, Padding: chart.Box{Top: 36, Left: 40, Right: 16, Bottom: 44}},
+		Canvas:     chart.Style{FillColor: chartBackground},
+		XAxis: chart.Style{
+			FontColor: chartText, FontSize: 8, StrokeColor: chartAxis,
+			TextWrap: chart.TextWrapWord, TextHorizontalAlign: chart.TextHorizontalAlignCenter,
+		},
+		YAxis: chart.YAxis{
+			AxisType: chart.YAxisSecondary,
+			Style:    chart.Style{FontColor: chartText, FontSize: 9, StrokeColor: chartAxis},
+			Range:    &chart.ContinuousRange{Min: 0, Max: ticks[len(ticks)-1].Value},
+			Ticks:    ticks,
+		},
+		BarSpacing: slot / 5,
+		BarWidth:   slot * 4 / 5,
+		Bars:       bars,
+	}
+	var buf bytes.Buffer
+	if err := c.Render(chart.PNG, &buf); err != nil {
+		return nil, err
+	}
+	return png.Decode(&buf)
+}
+
+// sendVolumeChart posts the weekly chart in an embed. it's a nice-to-have, so failures are only logged
+func (a *App) sendVolumeChart(ctx context.Context, channelID string, stats VolumeStats) {
+	logger := log.FromContext(ctx)
+
+	chart, err := renderVolumeChart(stats)
+	if err != nil {
+		logger.Error("Unable to render volume chart", "error", err)
+		return
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       "Emails per day",
+		Description: "Last 14 days, this week in blue.",
+		Color:       0x5865f2,
+		Image:       &discordgo.MessageEmbedImage{URL: "attachment://volume.png"},
+	}
+
+	if _, err := a.Discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{embed},
+		Files:  []*discordgo.File{{Name: "volume.png", ContentType: "image/png", Reader: bytes.NewReader(chart)}},
+	}); err != nil {
+		logger.Error("Unable to send volume chart", "error", err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// TestRenderVolumeChart renders a chart of no emails and of one day's, and reads each back as a PNG
+func TestRenderVolumeChart(t *testing.T) {
+	single := VolumeStats{Start: time.Date(2026, 10, 3, 0, 0, 0, 0, time.UTC), Categories: map[string]int{"work": 3}}
+	single.Daily[13] = 3
+	for name, stats := range map[string]VolumeStats{"empty": {}, "single day": single} {
+		t.Run(name, func(t *testing.T) {
+			chart, err := renderVolumeChart(stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bytes.NewReader(chart))
+			if err != nil {
+				t.Fatalf("the chart isn't a PNG: %v", err)
+			}
+			if img.Bounds().Dx() < dailyChartWidth || img.Bounds().Dy() != volumeChartHeight {
+				t.Errorf("chart is %v, want at least %dx%d", img.Bounds(), dailyChartWidth, volumeChartHeight)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	webhookTimestampHeader = "X-Reads-Ur-Emails-Timestamp"
+	webhookSignatureHeader = "X-Reads-Ur-Emails-Signature"
+)
+
+type WebhookConfig struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Label names the webhook in the logs and content_filter's notifiers, the url's scheme and host when empty
+	Label string `json:"label"`
+}
+
+// webhookNotifier POSTs the digest as JSON to an arbitrary URL
+type webhookNotifier struct {
+	config WebhookConfig
+	client *http.Client
+	clock  Clock
+}
+
+func newWebhookNotifier(config WebhookConfig, clock Clock) *webhookNotifier {
+	return &webhookNotifier{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		clock:  clock,
+	}
+}
+
+// Name is the webhook's label, or its url without the path and query, where tokens tend to be
+func (w *webhookNotifier) Name() string {
+	if w.config.Label != "" {
+		return "webhook " + w.config.Label
+	}
+	u, err := url.Parse(w.config.URL)
+	if err != nil || u.Host == "" {
+		return "webhook"
+	}
+	return "webhook " + u.Scheme + "://" + u.Host
+}
+
+func (w *webhookNotifier) Notify(digest *Digest) error {
+	body, err := json.Marshal(digest)
+	if err != nil {
+		return fmt.Errorf("encoding digest: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(w.clock.Now().Unix(), 10)
+	headers := map[string]string{webhookTimestampHeader: timestamp}
+	if w.config.Secret != "" {
+		headers[webhookSignatureHeader] = "sha256=" + signWebhookPayload(w.config.Secret, timestamp, body)
+	}
+
+	return postJSON(w.client, w.config.URL, body, headers)
+}
+
+// postJSON POSTs an encoded JSON body and treats any non-2xx response as an error. webhook urls often carry a token,
+// so the errors leave the url out
+func postJSON(client *http.Client, endpoint string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("creating webhook request: invalid url")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("sending webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// signWebhookPayload signs "<timestamp>.<body>" so receivers can reject replayed requests
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
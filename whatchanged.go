@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"google.golang.org/api/gmail/v1"
+)
+
+// defaultThreadMemoryDays is how long a thread is remembered after the last digest it was in, when the config doesn't
+// say
+const defaultThreadMemoryDays = 14
+
+// threadStateTokens bounds what's remembered of a thread, a few sentences
+const threadStateTokens = 120
+
+// whatChangedKinds are the digests that compare threads with the day before. weekly and topic digests are a look back
+// over everything, which is the context the daily ones leave out
+var whatChangedKinds = []string{"daily", "mini"}
+
+// whatChangedInstructions are given to the model for the summary of a digest with ongoing threads in it
+const whatChangedInstructions = "Some emails continue threads from earlier digests, the scratchpad marks them as updates. " +
+	"Lead with what changed in those threads, a line or two each, and don't restate the background the user already knows."
+
+type WhatChangedConfig struct {
+	// MemoryDays is how long a thread is remembered after the last digest it was in, 14 when unset
+	MemoryDays int `json:"memory_days"`
+}
+
+// ThreadMemory is what the digests last told the user about a thread
+type ThreadMemory struct {
+	Subject string `json:"subject"`
+	State   string `json:"state"`
+	// MessageIDs are the emails State was written from
+	MessageIDs []string  `json:"message_ids"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type knownThreadsKey struct{}
+
+// withKnownThreads attaches what the earlier digests said about the threads of the emails, by thread id, for the
+// summarizer to leave out. a thread remembered from these very emails isn't known yet, so regenerating a digest reads
+// them as it did the first time
+func (a *App) withKnownThreads(ctx context.Context, kind string, messages []*gmail.Message) context.Context {
+	if a.Config.WhatChanged == nil || !slices.Contains(whatChangedKinds, kind) {
+		return ctx
+	}
+	known := make(map[string]ThreadMemory)
+	a.state.read(func(s *State) {
+		for _, message := range messages {
+			memory, ok := s.account().Threads[message.ThreadId]
+			if ok && !slices.Contains(memory.MessageIDs, message.Id) {
+				known[message.ThreadId] = memory
+			}
+		}
+	})
+	if len(known) == 0 {
+		return ctx
+	}
+	log.FromContext(ctx).Debug("Ongoing threads in the digest", "threads", len(known))
+	return context.WithValue(ctx, knownThreadsKey{}, known)
+}
+
+func knownThreadsFromContext(ctx context.Context) map[string]ThreadMemory {
+	known, _ := ctx.Value(knownThreadsKey{}).(map[string]ThreadMemory)
+	return known
+}
+
+// knownThreadPrompt tells the model what the user already knows about an email's thread
+func knownThreadPrompt(memory ThreadMemory, location *time.Location) string {
+	return fmt.Sprintf("# Already Known\nThis email continues a thread the user was told about on %s: %s\n"+
+		"Only note what this email changes, like new decisions, answers, dates or requests, as an update to the thread. "+
+		"Don't repeat what the user already knows, and if nothing changed, respond with just `[NOTHING]`.",
+		memory.UpdatedAt.In(location).Format("Monday 2 January"), memory.State)
+}
+
+// rememberThreads keeps what the digest said about each thread it covered, for tomorrow's digest to compare with. the
+// digest's entries say it best; without them, the latest email's opening lines stand in
+func (a *App) rememberThreads(ctx context.Context, kind string, digest *Digest, messages []*gmail.Message) {
+	config := a.Config.WhatChanged
+	if config == nil || !slices.Contains(whatChangedKinds, kind) || len(messages) == 0 {
+		return
+	}
+	summaries := make(map[string]string, len(digest.Entries))
+	for _, entry := range digest.Entries {
+		summaries[entry.MessageID] = strings.TrimSpace(entry.Summary)
+	}
+
+	now := a.Clock.Now()
+	threads := make(map[string]ThreadMemory)
+	for _, message := range messages {
+		if message.ThreadId == "" {
+			continue
+		}
+		memory := threads[message.ThreadId]
+		memory.Subject = extractHeader(message, "Subject")
+		memory.MessageIDs = append(memory.MessageIDs, message.Id)
+		memory.UpdatedAt = now
+		if summary := summaries[message.Id]; summary != "" {
+			memory.State = strings.TrimSpace(memory.State + " " + summary)
+		} else if len(digest.Entries) == 0 {
+			memory.State = strings.TrimSpace(message.Snippet)
+		}
+		threads[message.ThreadId] = memory
+	}
+
+	days := config.MemoryDays
+	if days <= 0 {
+		days = defaultThreadMemoryDays
+	}
+	cutoff := now.AddDate(0, 0, -days)
+	if err := a.state.update(func(s *State) {
+		account := s.account()
+		remembered := maps.Clone(account.Threads)
+		if remembered == nil {
+			remembered = make(map[string]ThreadMemory)
+		}
+		maps.DeleteFunc(remembered, func(_ string, memory ThreadMemory) bool { return memory.UpdatedAt.Before(cutoff) })
+		for id, memory := range threads {
+			if memory.State == "" {
+				// the model left the thread out of the entries, what was known about it still stands
+				continue
+			}
+			memory.State = truncateTokens(threadStateTokens, memory.State)
+			remembered[id] = memory
+		}
+		account.Threads = remembered
+	}); err != nil {
+		log.FromContext(ctx).Error("Unable to remember the digest's threads", "error", err)
+	}
+}